@@ -0,0 +1,83 @@
+package loom
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrBudgetExceeded is the cause of the error returned by an evaluation that
+// exhausts its step budget. Use errors.Is to test for it.
+var ErrBudgetExceeded = errors.New("evaluation budget exceeded")
+
+// contextCheckInterval is the number of steps between checks of an
+// evaluation's context.
+const contextCheckInterval = 1024
+
+// A budget limits the resources consumed by an evaluation. A step is a single
+// VM instruction or a single procedure application in the tree-walking
+// evaluator.
+type budget struct {
+	ctx   context.Context
+	steps int64 // the number of steps remaining, or -1 if unlimited
+	check int   // the number of steps until the next context check
+}
+
+// newBudget returns a budget for an evaluation that is limited by ctx and, if
+// steps is positive, to the given number of steps. If neither limit applies,
+// newBudget returns nil.
+func newBudget(ctx context.Context, steps int64) *budget {
+	if steps <= 0 {
+		if ctx.Done() == nil {
+			return nil
+		}
+		steps = -1
+	}
+	return &budget{ctx: ctx, steps: steps}
+}
+
+// step consumes a single step of the budget. If the budget is exhausted or its
+// context is done, step interrupts the evaluation. step may be called on a nil
+// budget, in which case it does nothing.
+func (b *budget) step() {
+	if b == nil {
+		return
+	}
+
+	if b.steps >= 0 {
+		if b.steps == 0 {
+			panic(interrupt(ErrBudgetExceeded))
+		}
+		b.steps--
+	}
+
+	if b.check--; b.check <= 0 {
+		b.check = contextCheckInterval
+		if err := b.ctx.Err(); err != nil {
+			panic(interrupt(err))
+		}
+	}
+}
+
+// interrupt returns an error that interrupts an evaluation with the given
+// cause. Interruptions cannot be caught by exception handlers.
+func interrupt(cause error) *Error {
+	return &Error{Message: cause.Error(), cause: cause, kind: interruptError}
+}
+
+// currentBudget returns the budget of the evaluation that is in progress in the
+// dynamic environment, if any.
+func (d *dynamicEnv) currentBudget() *budget {
+	if d == nil {
+		return nil
+	}
+	return d.budget
+}
+
+// withBudget calls f with b installed as the budget for evaluations in the
+// dynamic environment.
+func (d *dynamicEnv) withBudget(b *budget, f func() Value) Value {
+	outer := d.budget
+	d.budget = b
+	defer func() { d.budget = outer }()
+	return f()
+}
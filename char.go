@@ -0,0 +1,169 @@
+package loom
+
+import (
+	"fmt"
+	"unicode"
+)
+
+func CharPred(args Vector) Value {
+	if len(args) != 1 {
+		panic("char? expects 1 argument")
+	}
+	_, ok := args[0].(Character)
+	return Boolean(ok)
+}
+
+// charCompare returns true if each pair of adjacent characters in args
+// satisfies cmp. If fold is true, the characters are case-folded prior to
+// comparison. Every argument must be a character, even if an earlier pair
+// fails the comparison.
+func charCompare(name string, args Vector, fold bool, cmp func(a, b rune) bool) Value {
+	for _, v := range args {
+		if _, ok := v.(Character); !ok {
+			panic(newNamedError(fmt.Sprintf("the arguments to %v must be characters", name), v))
+		}
+	}
+
+	for i := 1; i < len(args); i++ {
+		a, b := rune(args[i-1].(Character)), rune(args[i].(Character))
+		if fold {
+			a, b = foldcase(a), foldcase(b)
+		}
+		if !cmp(a, b) {
+			return Boolean(false)
+		}
+	}
+	return Boolean(true)
+}
+
+func CharEq(args Vector) Value {
+	return charCompare("char=?", args, false, func(a, b rune) bool { return a == b })
+}
+
+func CharLt(args Vector) Value {
+	return charCompare("char<?", args, false, func(a, b rune) bool { return a < b })
+}
+
+func CharGt(args Vector) Value {
+	return charCompare("char>?", args, false, func(a, b rune) bool { return a > b })
+}
+
+func CharLte(args Vector) Value {
+	return charCompare("char<=?", args, false, func(a, b rune) bool { return a <= b })
+}
+
+func CharGte(args Vector) Value {
+	return charCompare("char>=?", args, false, func(a, b rune) bool { return a >= b })
+}
+
+func CharEqCI(args Vector) Value {
+	return charCompare("char-ci=?", args, true, func(a, b rune) bool { return a == b })
+}
+
+func CharLtCI(args Vector) Value {
+	return charCompare("char-ci<?", args, true, func(a, b rune) bool { return a < b })
+}
+
+func CharGtCI(args Vector) Value {
+	return charCompare("char-ci>?", args, true, func(a, b rune) bool { return a > b })
+}
+
+func CharLteCI(args Vector) Value {
+	return charCompare("char-ci<=?", args, true, func(a, b rune) bool { return a <= b })
+}
+
+func CharGteCI(args Vector) Value {
+	return charCompare("char-ci>=?", args, true, func(a, b rune) bool { return a >= b })
+}
+
+// charArg returns the single character argument to the named procedure.
+func charArg(name string, args Vector) rune {
+	if len(args) != 1 {
+		panic(name + " expects 1 argument")
+	}
+	c, ok := args[0].(Character)
+	if !ok {
+		panic(newNamedError("the argument to "+name+" must be a character", args[0]))
+	}
+	return rune(c)
+}
+
+func CharAlphabeticPred(args Vector) Value {
+	return Boolean(unicode.IsLetter(charArg("char-alphabetic?", args)))
+}
+
+func CharNumericPred(args Vector) Value {
+	return Boolean(unicode.IsDigit(charArg("char-numeric?", args)))
+}
+
+func CharWhitespacePred(args Vector) Value {
+	return Boolean(unicode.IsSpace(charArg("char-whitespace?", args)))
+}
+
+func CharUpperCasePred(args Vector) Value {
+	return Boolean(unicode.IsUpper(charArg("char-upper-case?", args)))
+}
+
+func CharLowerCasePred(args Vector) Value {
+	return Boolean(unicode.IsLower(charArg("char-lower-case?", args)))
+}
+
+// DigitValue returns the numeric value (0 to 9) of its argument if it is a
+// numeric digit (that is, if char-numeric? returns #t), or #f on any other
+// character.
+func DigitValue(args Vector) Value {
+	c := charArg("digit-value", args)
+	if !unicode.IsDigit(c) {
+		return Boolean(false)
+	}
+
+	// Each run of decimal digits in the Unicode database begins with a zero,
+	// so the value of a digit is its offset from the start of its range.
+	for _, r := range unicode.Digit.R16 {
+		if c >= rune(r.Lo) && c <= rune(r.Hi) {
+			return NewInt(int64(c-rune(r.Lo)) % 10)
+		}
+	}
+	for _, r := range unicode.Digit.R32 {
+		if c >= rune(r.Lo) && c <= rune(r.Hi) {
+			return NewInt(int64(c-rune(r.Lo)) % 10)
+		}
+	}
+	return Boolean(false)
+}
+
+func CharToInteger(args Vector) Value {
+	return NewInt(int64(charArg("char->integer", args)))
+}
+
+func IntegerToChar(args Vector) Value {
+	if len(args) != 1 {
+		panic("integer->char expects 1 argument")
+	}
+	n, ok := args[0].(Number)
+	if !ok {
+		panic(newNamedError("the argument to integer->char must be a Unicode scalar value", args[0]))
+	}
+	i, ok := n.Int()
+	if !ok || i < 0 || i > unicode.MaxRune || i >= 0xd800 && i <= 0xdfff {
+		panic(newNamedError("the argument to integer->char must be a Unicode scalar value", args[0]))
+	}
+	return Character(rune(i))
+}
+
+func CharUpcase(args Vector) Value {
+	return Character(unicode.ToUpper(charArg("char-upcase", args)))
+}
+
+func CharDowncase(args Vector) Value {
+	return Character(unicode.ToLower(charArg("char-downcase", args)))
+}
+
+func CharFoldcase(args Vector) Value {
+	return Character(foldcase(charArg("char-foldcase", args)))
+}
+
+// foldcase applies the Unicode simple case folding algorithm to c.
+func foldcase(c rune) rune {
+	return unicode.ToLower(unicode.ToUpper(c))
+}
@@ -1,38 +1,116 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"strings"
 
 	"github.com/pgavlin/loom"
 )
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: %s [-e expression] [script [arguments...]]
+
+With no arguments, loom starts an interactive session if standard input is a
+terminal and otherwise runs the program read from standard input.
+
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
-	var r io.Reader
+	expression := flag.String("e", "", "evaluate `expression` and print its value")
+	flag.Usage = usage
+	flag.Parse()
+
+	os.Exit(run(*expression, flag.Args()))
+}
 
-	switch len(os.Args) {
-	case 1:
-		r = os.Stdin
-	case 2:
-		f, err := os.Open(os.Args[1])
+// run runs loom and returns the exit status of the process.
+func run(expression string, args []string) int {
+	env := loom.NewEnv()
+
+	switch {
+	case expression != "":
+		env.SetCommandLine(append([]string{os.Args[0]}, args...))
+		v, err := env.EvalAll(strings.NewReader(expression))
 		if err != nil {
-			log.Fatal(err)
+			return fail(err)
+		}
+		printValue(v)
+	case len(args) != 0:
+		// the script name is the command name
+		env.SetCommandLine(args)
+		if _, err := env.Load(args[0]); err != nil {
+			return fail(err)
+		}
+	case isTerminal(os.Stdin):
+		env.SetCommandLine(os.Args[:1])
+		if err := runREPL(env); err != nil {
+			return fail(err)
 		}
-		defer f.Close()
+	default:
+		env.SetCommandLine(os.Args[:1])
+		if _, err := env.EvalAll(os.Stdin); err != nil {
+			return fail(err)
+		}
+	}
+	return 0
+}
 
-		r = f
-	case 3:
-		fmt.Fprintf(os.Stderr, "usage: %s [path to file]\n", os.Args[0])
-		os.Exit(-1)
+// fail reports an uncaught error and returns the corresponding exit status.
+// Errors caused by exit or emergency-exit are not reported.
+func fail(err error) int {
+	var exit *loom.ExitError
+	if errors.As(err, &exit) {
+		return exit.Code
 	}
 
-	x, err := loom.Parse(r)
-	if err != nil {
-		log.Fatalf("error parsing input: %v", err)
+	printError(err)
+	return 1
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// maxStackFrames is the maximum number of stack frames that are printed for an
+// error.
+const maxStackFrames = 20
+
+// printError prints an error and the stack trace of the failure, if any.
+func printError(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+
+	var serr *loom.Error
+	if !errors.As(err, &serr) {
+		return
 	}
+	for i, frame := range serr.Stack {
+		if i == maxStackFrames {
+			fmt.Fprintf(os.Stderr, "    ... %d more\n", len(serr.Stack)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "    at %v\n", frame)
+	}
+}
 
-	loom.Encode(os.Stdout, loom.NewEnv().Eval(x))
-	fmt.Printf("\n")
+// printValue prints a value on its own line. Each of multiple values is
+// printed on its own line. Unspecified values are not printed.
+func printValue(v loom.Value) {
+	if v == loom.Unspecified {
+		return
+	}
+	if values, ok := v.(loom.Values); ok {
+		for _, v := range values {
+			printValue(v)
+		}
+		return
+	}
+	loom.Write(os.Stdout, v)
+	fmt.Println()
 }
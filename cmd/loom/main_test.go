@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// capture runs loom with the given expression and arguments and returns its
+// exit status and the text written to standard output and standard error.
+func capture(t *testing.T, expression string, args ...string) (int, string, string) {
+	stdout, err := ioutil.TempFile(t.TempDir(), "stdout")
+	require.NoError(t, err)
+	defer stdout.Close()
+	stderr, err := ioutil.TempFile(t.TempDir(), "stderr")
+	require.NoError(t, err)
+	defer stderr.Close()
+
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	status := run(expression, args)
+	os.Stdout, os.Stderr = oldStdout, oldStderr
+
+	out, err := ioutil.ReadFile(stdout.Name())
+	require.NoError(t, err)
+	errOut, err := ioutil.ReadFile(stderr.Name())
+	require.NoError(t, err)
+	return status, string(out), string(errOut)
+}
+
+func TestExpression(t *testing.T) {
+	cases := []struct{ expr, output string }{
+		{`(+ 1 2)`, "3\n"},
+		{`'()`, "()\n"},
+		{`(values 1 '())`, "1\n()\n"},
+		{`(define x 1)`, ""},
+		{`(if #f #f)`, ""},
+		{`(values)`, ""},
+		{`(display "hi")`, "hi"},
+	}
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			status, out, errOut := capture(t, c.expr)
+			assert.Equal(t, 0, status)
+			assert.Equal(t, c.output, out)
+			assert.Empty(t, errOut)
+		})
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	cases := []struct {
+		expr   string
+		status int
+		output string
+	}{
+		{`(exit)`, 0, ""},
+		{`(exit #t)`, 0, ""},
+		{`(exit 3)`, 3, ""},
+		{`(exit #f)`, 1, ""},
+		{`(exit 'oops)`, 1, ""},
+		{`(dynamic-wind (lambda () #f) (lambda () (exit 4)) (lambda () (display "after")))`, 4, "after"},
+		{`(dynamic-wind (lambda () #f) (lambda () (emergency-exit 5)) (lambda () (display "after")))`, 5, ""},
+		{`(car 1)`, 1, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			status, out, _ := capture(t, c.expr)
+			assert.Equal(t, c.status, status)
+			assert.Equal(t, c.output, out)
+		})
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.scm")
+	script := "(define (f x)\n  (car x))\n(define (g x)\n  (f x)\n  1)\n(g 1)\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0600))
+
+	status, out, errOut := capture(t, "", path)
+	assert.Equal(t, 1, status)
+	assert.Empty(t, out)
+	assert.Equal(t, fmt.Sprintf(`error: %[1]v:2:3: car expects a list
+    at f (%[1]v:4:3)
+    at g (%[1]v:6:1)
+`, path), errOut)
+}
+
+func TestStackTraceLimit(t *testing.T) {
+	status, _, errOut := capture(t, `(define (f n) (if (= n 0) (car n) (+ 1 (f (- n 1))))) (f 30)`)
+	assert.Equal(t, 1, status)
+
+	lines := strings.Split(strings.TrimSuffix(errOut, "\n"), "\n")
+	require.Len(t, lines, maxStackFrames+2)
+	assert.Equal(t, "error: 1:27: car expects a list", lines[0])
+	assert.Equal(t, "    at f (1:40)", lines[1])
+	assert.Equal(t, "    ... 11 more", lines[len(lines)-1])
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterh/liner"
+	"github.com/pgavlin/loom"
+)
+
+// A repl is an interactive read-eval-print loop. Each expression is evaluated
+// in the same environment, and each result is printed using the write printer.
+type repl struct {
+	env  *loom.Env
+	line *liner.State
+}
+
+const help = `,disasm <procedure>   print the bytecode of a procedure
+,expand <form>        expand a form to core syntax
+,help                 print this message
+,load <path>          load a source file
+,time <expression>    evaluate an expression and print the elapsed time
+`
+
+// runREPL runs a read-eval-print loop on the terminal until the end of the
+// input. The line history is saved in ~/.loom_history.
+func runREPL(env *loom.Env) error {
+	r := &repl{env: env, line: liner.NewLiner()}
+	defer r.line.Close()
+
+	r.line.SetCtrlCAborts(true)
+	r.line.SetMultiLineMode(true)
+
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".loom_history")
+		if f, err := os.Open(historyPath); err == nil {
+			r.line.ReadHistory(f)
+			f.Close()
+		}
+	}
+
+	err := r.loop()
+
+	if historyPath != "" {
+		if f, err := os.Create(historyPath); err == nil {
+			r.line.WriteHistory(f)
+			f.Close()
+		}
+	}
+	return err
+}
+
+func (r *repl) loop() error {
+	var input strings.Builder
+	for {
+		prompt := "> "
+		if input.Len() != 0 {
+			prompt = "... "
+		}
+
+		text, err := r.line.Prompt(prompt)
+		switch {
+		case err == liner.ErrPromptAborted:
+			input.Reset()
+			continue
+		case err == io.EOF:
+			fmt.Println()
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(text), ",") {
+			r.line.AppendHistory(text)
+			if err := r.command(strings.TrimSpace(text)[1:]); err != nil {
+				if isExit(err) {
+					return err
+				}
+				printError(err)
+			}
+			continue
+		}
+
+		input.WriteString(text)
+		input.WriteString("\n")
+
+		// wait for more input if the last datum is incomplete
+		datums, err := readAll(input.String())
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			continue
+		}
+
+		if entry := strings.TrimSpace(input.String()); entry != "" {
+			r.line.AppendHistory(strings.Join(strings.Fields(entry), " "))
+		}
+		input.Reset()
+
+		if err != nil {
+			printError(err)
+			continue
+		}
+		for _, datum := range datums {
+			v, err := r.eval(datum)
+			if err != nil {
+				if isExit(err) {
+					return err
+				}
+				printError(err)
+				break
+			}
+			printValue(v)
+		}
+	}
+}
+
+// eval evaluates a datum. The evaluation is interrupted if the process
+// receives an interrupt signal.
+func (r *repl) eval(datum loom.Value) (loom.Value, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	return r.env.EvalContext(ctx, datum)
+}
+
+// command runs a meta-command. A meta-command is a line that begins with a
+// comma, e.g. ",load file.scm".
+func (r *repl) command(text string) error {
+	name, arg := text, ""
+	if i := strings.IndexAny(text, " \t"); i != -1 {
+		name, arg = text[:i], strings.TrimSpace(text[i:])
+	}
+
+	switch name {
+	case "disasm":
+		return r.disasm(arg)
+	case "expand":
+		return r.expand(arg)
+	case "help":
+		fmt.Print(help)
+		return nil
+	case "load":
+		return r.load(arg)
+	case "time":
+		return r.time(arg)
+	default:
+		return fmt.Errorf("unknown command ,%v; try ,help", name)
+	}
+}
+
+func (r *repl) load(path string) error {
+	if datum, err := loom.ParseString(path); err == nil {
+		if s, ok := datum.(loom.String); ok {
+			path = string(s)
+		}
+	}
+
+	v, err := r.env.Load(path)
+	if err != nil {
+		return err
+	}
+	printValue(v)
+	return nil
+}
+
+func (r *repl) expand(arg string) error {
+	datum, err := loom.ParseString(arg)
+	if err != nil {
+		return err
+	}
+	v, err := loom.Expand(r.env, datum)
+	if err != nil {
+		return err
+	}
+	printValue(v)
+	return nil
+}
+
+func (r *repl) disasm(arg string) error {
+	datum, err := loom.ParseString(arg)
+	if err != nil {
+		return err
+	}
+	v, err := r.eval(datum)
+	if err != nil {
+		return err
+	}
+	return loom.Disassemble(os.Stdout, v)
+}
+
+func (r *repl) time(arg string) error {
+	datum, err := loom.ParseString(arg)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	v, err := r.eval(datum)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	printValue(v)
+	fmt.Printf("; elapsed time: %v\n", elapsed)
+	return nil
+}
+
+// readAll reads each datum in text.
+func readAll(text string) ([]loom.Value, error) {
+	var datums []loom.Value
+	r := loom.NewReader(strings.NewReader(text))
+	for {
+		datum, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return datums, nil
+			}
+			return nil, err
+		}
+		datums = append(datums, datum)
+	}
+}
+
+// isExit returns true if err was caused by exit or emergency-exit.
+func isExit(err error) bool {
+	var exit *loom.ExitError
+	return errors.As(err, &exit)
+}
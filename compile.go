@@ -5,34 +5,292 @@ import (
 	"fmt"
 )
 
-type compiler struct {
-	body []instruction
+// A compileContext holds the state that is shared by the compilation of a
+// top-level form and each of the procedures nested within it.
+type compileContext struct {
+	// scope is the scope in which the compiled code will run, if known.
+	scope *scope
+	// keywords is the set of keywords defined by define-syntax forms within the
+	// code being compiled.
+	keywords map[Symbol]bool
 }
 
-func compile(expr Value) []instruction {
-	var c compiler
-	c.compile(expr, true)
-	return c.body
+// newCompileContext returns a new context for compiling exprs in the given
+// scope. The scope may be nil if it is not known at compile time.
+func newCompileContext(scope *scope, exprs []Value) *compileContext {
+	ctx := &compileContext{scope: scope, keywords: map[Symbol]bool{}}
+	for _, e := range exprs {
+		ctx.scanKeywords(e)
+	}
+	return ctx
 }
 
-func compileBody(exprs []Value) []instruction {
-	if len(exprs) == 0 {
-		return nil
+// scanKeywords records the keywords defined by each define-syntax, let-syntax,
+// and letrec-syntax form within e.
+// Quoted data is not scanned, as it may be cyclic.
+func (ctx *compileContext) scanKeywords(e Value) {
+	switch e := e.(type) {
+	case *Pair:
+		switch sym, _ := symbolName(e.car); sym {
+		case "quote":
+			return
+		case "define-syntax":
+			if args, ok := e.cdr.(*Pair); ok {
+				if keyword, ok := variableName(args.car); ok {
+					ctx.keywords[keyword] = true
+				}
+			}
+		case "let-syntax", "letrec-syntax":
+			if args, ok := e.cdr.(*Pair); ok {
+				for bindings, _ := args.car.(*Pair); bindings != nil; bindings, _ = bindings.cdr.(*Pair) {
+					if binding, ok := bindings.car.(*Pair); ok {
+						if keyword, ok := variableName(binding.car); ok {
+							ctx.keywords[keyword] = true
+						}
+					}
+				}
+			}
+		}
+		for p, ok := e, true; ok; p, ok = p.cdr.(*Pair) {
+			ctx.scanKeywords(p.car)
+		}
+	case Vector:
+		for _, v := range e {
+			ctx.scanKeywords(v)
+		}
 	}
+}
 
-	var c compiler
-	for _, expr := range exprs[:len(exprs)-1] {
-		c.compile(expr, false)
+// isKeyword returns true if the symbol or identifier v may name a keyword when
+// the code being compiled runs. Uses of such keywords are expanded at runtime.
+func (ctx *compileContext) isKeyword(v Value) bool {
+	if name, ok := variableName(v); ok && ctx.keywords[name] {
+		return true
 	}
-	c.compile(exprs[len(exprs)-1], true)
-	if len(c.body) > 0 && c.body[len(c.body)-1].code != opTail {
-		c.append(instruction{opReturn, nil})
+	_, ok := lookupSyntax(ctx.scope, v)
+	return ok
+}
+
+// A lexicalScope describes the variables that are stored in the slots of a
+// runtime scope. Each procedure that allocates a scope when it is called has a
+// lexical scope whose names are its formals followed by the variables defined
+// at the top level of its body.
+type lexicalScope struct {
+	names   []Symbol
+	formals int // the number of names that are formals
+	outer   *lexicalScope
+}
+
+// A local is the lexical address of a variable: the number of scopes between
+// the scope of the reference and the scope of the variable, and the index of
+// the variable's slot.
+type local struct {
+	depth int
+	index int
+}
+
+func (l local) MarshalSExp() SExpression {
+	return Cons(Symbol("local"), Cons(NewInt(int64(l.depth)), Cons(NewInt(int64(l.index)), nil)))
+}
+
+// isDefinition returns true if the variable at the lexical address l is defined
+// by the body of its procedure rather than being one of its formals.
+func (l *lexicalScope) isDefinition(addr local) bool {
+	for i := 0; i < addr.depth; i++ {
+		l = l.outer
+	}
+	return addr.index >= l.formals
+}
+
+// resolve returns the lexical address of the variable name. The second result
+// is false if name does not refer to a variable that is stored in a slot.
+func (l *lexicalScope) resolve(name Symbol) (local, bool) {
+	for depth := 0; l != nil; l, depth = l.outer, depth+1 {
+		for i, n := range l.names {
+			if n == name {
+				return local{depth: depth, index: i}, true
+			}
+		}
+	}
+	return local{}, false
+}
+
+// scanDefinitions appends the variables defined by the definitions at the top
+// level of body to names. Definitions nested inside begin forms are included.
+func scanDefinitions(body []Value, names []Symbol) []Symbol {
+	for _, e := range body {
+		p, ok := e.(*Pair)
+		if !ok {
+			continue
+		}
+
+		switch sym, _ := symbolName(p.car); sym {
+		case "define":
+			args, ok := p.cdr.(*Pair)
+			if !ok {
+				continue
+			}
+			variable := args.car
+			if signature, ok := variable.(*Pair); ok {
+				variable = signature.car
+			}
+			if sym, ok := variableName(variable); ok && !containsSymbol(names, sym) {
+				names = append(names, sym)
+			}
+		case "begin":
+			rest, _ := p.cdr.(*Pair)
+			names = scanDefinitions(rest.ToVector(), names)
+		}
+	}
+	return names
+}
+
+// definesSyntax returns true if body contains a syntax definition at its top
+// level, including within begin forms.
+func definesSyntax(body []Value) bool {
+	for _, e := range body {
+		switch e := e.(type) {
+		case *syntaxDefinition:
+			return true
+		case *Pair:
+			switch sym, _ := symbolName(e.car); sym {
+			case "define-syntax":
+				return true
+			case "begin":
+				rest, _ := e.cdr.(*Pair)
+				if definesSyntax(rest.ToVector()) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func containsSymbol(symbols []Symbol, sym Symbol) bool {
+	for _, s := range symbols {
+		if s == sym {
+			return true
+		}
+	}
+	return false
+}
+
+type compiler struct {
+	ctx       *compileContext
+	lexical   *lexicalScope // the lexical scope of the code being compiled
+	body      []instruction
+	positions []*Position
+	names     map[int]Symbol // the operator names of call instructions and the variables of local references, by pc
+
+	// pos is the source position of the innermost form being compiled.
+	pos *Position
+}
+
+func compileBody(exprs []Value) []instruction {
+	return compileProcedure("", nil, false, exprs).body
+}
+
+func compileProcedure(name Symbol, formals []Symbol, isVariadic bool, exprs []Value) *compiledProcedure {
+	c := compiler{ctx: newCompileContext(nil, exprs)}
+	return c.procedure(name, formals, isVariadic, exprs, false)
+}
+
+// procedure compiles a procedure that is nested within the code being
+// compiled. The procedure's formals and the variables defined at the top level
+// of its body are allocated slots in the scope that is created when the
+// procedure is called. Internal procedures that do not need any slots share
+// the scope of their caller unless their bodies define keywords.
+func (c *compiler) procedure(name Symbol, formals []Symbol, isVariadic bool, exprs []Value, internal bool) *compiledProcedure {
+	names := scanDefinitions(exprs, append([]Symbol(nil), formals...))
+	scoped := definesSyntax(exprs)
+
+	lexical := c.lexical
+	if len(names) != 0 || !internal || scoped {
+		lexical = &lexicalScope{names: names, formals: len(formals), outer: c.lexical}
+	}
+
+	inner := compiler{ctx: c.ctx, lexical: lexical}
+	inner.compileSequence(exprs, true)
+
+	proc := inner.finish(name, formals, isVariadic)
+	proc.slots, proc.internal, proc.scoped = len(names), internal, scoped
+	return proc
+}
+
+// finish finishes the compiled body and returns it as a procedure.
+//
+// The body always ends with a return instruction. Normally a body that ends
+// with a tail call never reaches it, but resuming a continuation that was
+// captured by the tail call does.
+func (c *compiler) finish(name Symbol, formals []Symbol, isVariadic bool) *compiledProcedure {
+	c.append(instruction{opReturn, nil})
+
+	return &compiledProcedure{
+		name:       name,
+		formals:    formals,
+		isVariadic: isVariadic,
+		body:       c.body,
+		positions:  c.positions,
+		names:      c.names,
 	}
-	return c.body
 }
 
 func (c *compiler) append(instructions ...instruction) {
 	c.body = append(c.body, instructions...)
+	for range instructions {
+		c.positions = append(c.positions, c.pos)
+	}
+}
+
+// call appends a call instruction with the given number of arguments.
+func (c *compiler) call(nargs int, tail bool) {
+	if tail {
+		c.append(instruction{opTail, integer(nargs)})
+	} else {
+		c.append(instruction{opCall, integer(nargs)})
+	}
+}
+
+// name records the operator of the call instruction, or the variable of the
+// local reference, that is appended next, if it is a symbol or identifier.
+func (c *compiler) name(operator Value) {
+	if sym, ok := symbolName(operator); ok {
+		if c.names == nil {
+			c.names = map[int]Symbol{}
+		}
+		c.names[len(c.body)] = sym
+	}
+}
+
+// jump appends a jump instruction with the given opcode and returns its
+// address. The jump's target must be set using patch.
+func (c *compiler) jump(code opcode) int {
+	c.append(instruction{code, nil})
+	return len(c.body) - 1
+}
+
+// patch sets the targets of the jumps at the given addresses to the address of
+// the next instruction.
+func (c *compiler) patch(jumps ...int) {
+	for _, pc := range jumps {
+		c.body[pc].immediate = integer(len(c.body))
+	}
+}
+
+// compileSequence compiles a sequence of expressions. The value of the
+// sequence is the value of its last expression.
+func (c *compiler) compileSequence(exprs []Value, tail bool) {
+	if len(exprs) == 0 {
+		c.append(instruction{opQuote, Unspecified})
+		return
+	}
+
+	for _, expr := range exprs[:len(exprs)-1] {
+		c.compile(expr, false)
+		c.append(instruction{opPop, nil})
+	}
+	c.compile(exprs[len(exprs)-1], tail)
 }
 
 // ⟨variable⟩
@@ -40,8 +298,61 @@ func (c *compiler) append(instructions ...instruction) {
 // An expression consisting of a variable (section 3.1) is a variable reference.
 // The value of the variable reference is the value stored in the location to
 // which the variable is bound. It is an error to reference an unbound variable.
+//
+// References to variables that are stored in slots are compiled to lexical
+// addresses. All other references are looked up by name. The names of
+// variables that are defined by a body are recorded so that references to
+// them before their definitions can be reported.
 func (c *compiler) compileVariable(e Symbol) {
-	c.append(instruction{opGet, e})
+	if l, ok := c.lexical.resolve(e); ok {
+		if c.lexical.isDefinition(l) {
+			c.name(e)
+		}
+		c.append(instruction{opLocal, l})
+	} else {
+		c.append(instruction{opGlobal, e})
+	}
+}
+
+// compileIdentifier compiles a reference to an identifier that was inserted by
+// a macro expansion. Identifiers that resolve to slots are compiled as local
+// references; all others are resolved when the reference is executed.
+func (c *compiler) compileIdentifier(id *identifier) {
+	if l, ok := c.resolveIdentifier(id); ok {
+		c.append(instruction{opLocal, l})
+	} else {
+		c.append(instruction{opIdentifier, id})
+	}
+}
+
+// resolveIdentifier returns the lexical address of the variable to which the
+// identifier refers. The second result is false if the identifier does not
+// refer to a variable that is stored in a slot.
+func (c *compiler) resolveIdentifier(id *identifier) (local, bool) {
+	lexical, depth := c.lexical, 0
+	for {
+		if l, ok := lexical.resolve(id.alias); ok {
+			return local{depth: depth + l.depth, index: l.index}, true
+		}
+
+		// continue in the lexical scope of the macro definition, which must
+		// enclose the reference
+		if id.lexical == nil {
+			return local{}, false
+		}
+		for lexical != id.lexical {
+			if lexical == nil {
+				return local{}, false
+			}
+			lexical, depth = lexical.outer, depth+1
+		}
+
+		if id.outer == nil {
+			l, ok := lexical.resolve(id.name)
+			return local{depth: depth + l.depth, index: l.index}, ok
+		}
+		id = id.outer
+	}
 }
 
 // (quote ⟨datum⟩)
@@ -55,90 +366,63 @@ func (c *compiler) compileQuote(e *Pair) {
 	c.append(instruction{opQuote, e.cdr.(*Pair).car})
 }
 
-//func (c *compiler) compileQuasiquote(v Value, vector, list bool) {
-//	if v == nil {
-//		c.append(instruction{opQuote, nil})
-//		return
-//	}
-//
-//	switch v := v.(type) {
-//	case Number, Boolean, Character, String, Symbol:
-//		c.append(instruction{opQuote, nil})
-//	case Vector:
-//		c.append(instruction{opQuote, Vector(nil)})
-//		for _, v := range v {
-//			c.compileQuasiquote(v, true, false)
-//			c.append(instruction{opAppend, nil})
-//		}
-//	case *Pair:
-//		switch sym, _ := v.car.(Symbol); sym {
-//		case "unquote":
-//			c.compile(v.cdr.(*Pair).car, false)
-//		case "unquote-splicing":
-//			//
-//
-//
-//
+// (quasiquote ⟨qq template⟩)
+// `⟨qq template⟩
 //
-//			// TODO: splicing
-//		case "quasiquote":
-//			c.compileQuasiquote(v.cdr.(*Pair).car, false, false)
-//
-//		// all else
-//		default:
-//
-//			for {
-//				switch sym, _ := v.car.(Symbol); sym {
-//				case "unquote":
-//					p, ok := v.cdr.(*Pair)
-//					if ok && p.cdr == nil {
-//						c.
-//							tail.cdr = eval(p.car, scope, false)
-//						return head
-//					}
-//				case "unquote-splicing":
-//					p, ok := v.cdr.(*Pair)
-//					if ok && p.cdr == nil {
-//						l, ok := eval(p.car, scope, false).(*Pair)
-//						if !ok {
-//							panic("the argument to unquote-splicing must be a list")
-//						}
-//						tail.cdr = l
-//						return head
-//					}
-//				}
-//
-//				elem := evalQuasiquote(v.car, scope)
-//				var p, q *Pair
-//				if splice, ok := elem.(splice); ok {
-//					p, q = splice.p, splice.p
-//					for q.cdr != nil {
-//						q = q.cdr.(*Pair)
-//					}
-//				} else {
-//					p = &Pair{car: elem}
-//					q = p
-//				}
-//
-//				if head == nil {
-//					head, tail = p, q
-//				} else {
-//					tail.cdr, tail = p, q
-//				}
-//
-//				if p, ok := v.cdr.(*Pair); ok {
-//					v = p
-//					continue
-//				}
-//
-//				tail.cdr = evalQuasiquote(v.cdr, scope)
-//				return head
-//			}
-//		}
-//	default:
-//		panic(fmt.Sprintf("unknown quasiquote type %T", v))
-//	}
-//}
+// The quasiquote form is compiled by rewriting its template as an expression
+// that constructs the quasiquoted value.
+func (c *compiler) compileQuasiquote(e *Pair, tail bool) {
+	c.compile(expandQuasiquote(e.cdr.(*Pair).car), tail)
+}
+
+// expandQuasiquote rewrites a quasiquote template as an expression that
+// constructs its value. Unquoted expressions are inserted as-is, lists are
+// constructed with cons, spliced lists are inserted with append, and vectors
+// are constructed as lists and then converted with list->vector.
+func expandQuasiquote(v Value) Value {
+	switch v := v.(type) {
+	case Vector:
+		elements := quoted(nil)
+		for i := len(v) - 1; i >= 0; i-- {
+			elements = expandQuasiquoteElement(v[i], elements)
+		}
+		return list(builtin("list->vector"), elements)
+	case *Pair:
+		if sym, _ := symbolName(v.car); sym == "quasiquote" {
+			return expandQuasiquote(v.cdr.(*Pair).car)
+		}
+		return expandQuasiquoteList(v)
+	default:
+		return quoted(unwrapIdentifier(v))
+	}
+}
+
+// expandQuasiquoteList rewrites the elements of a quasiquoted list.
+func expandQuasiquoteList(v Value) Value {
+	p, ok := v.(*Pair)
+	if !ok {
+		return expandQuasiquote(v)
+	}
+
+	switch sym, _ := symbolName(p.car); sym {
+	case "unquote", "unquote-splicing":
+		if arg, ok := p.cdr.(*Pair); ok && arg.cdr == nil {
+			return arg.car
+		}
+	}
+	return expandQuasiquoteElement(p.car, expandQuasiquoteList(p.cdr))
+}
+
+// expandQuasiquoteElement rewrites an element of a quasiquoted list or vector
+// that precedes the elements constructed by rest.
+func expandQuasiquoteElement(v, rest Value) Value {
+	if p, ok := v.(*Pair); ok {
+		if sym, _ := symbolName(p.car); sym == "unquote-splicing" {
+			return list(builtin("append"), p.cdr.(*Pair).car, rest)
+		}
+	}
+	return list(builtin("cons"), expandQuasiquote(v), rest)
+}
 
 // (lambda ⟨formals⟩ ⟨body⟩)
 //
@@ -184,12 +468,7 @@ func (c *compiler) compileLambda(e *Pair) {
 	}
 
 	formals, isVariadic := makeFormals(args[1])
-	proc := &compiledProcedure{
-		name:       "<lambda>",
-		formals:    formals,
-		isVariadic: isVariadic,
-		body:       compileBody(args[2:]),
-	}
+	proc := c.procedure("<lambda>", formals, isVariadic, args[2:], false)
 	c.append(instruction{opLambda, proc})
 }
 
@@ -203,40 +482,27 @@ func (c *compiler) compileLambda(e *Pair) {
 // is evaluated and its values are returned. Otherwise ⟨alternate⟩ is
 // evaluated and its values are returned. If ⟨test⟩ yields a false value and no
 // ⟨alternate⟩ is specified, then the result of the expression is unspecified.
+//
+// The test is compiled as a conditional jump over the consequent.
 func (c *compiler) compileIf(e *Pair, tail bool) {
 	args := e.ToVector()
 	if len(args) < 3 || len(args) > 4 {
 		panic("if must be of the form (if ⟨test⟩ ⟨consequent⟩) or (if ⟨test⟩ ⟨consequent⟩ ⟨alternate⟩)")
 	}
 
-	if_ := &compiledProcedure{
-		name: "<if-true>",
-		body: compileBody(args[2:3]),
-	}
-
-	else_ := &compiledProcedure{
-		name: "<if-false>",
-		body: []instruction{
-			{opQuote, nil},
-			{opReturn, nil},
-		},
-	}
-
+	test := e.cdr.(*Pair)
+	consequent := test.cdr.(*Pair)
+	c.compileElement(test, false)
+	alternate := c.jump(opJumpIfFalse)
+	c.compileElement(consequent, tail)
+	end := c.jump(opJump)
+	c.patch(alternate)
 	if len(args) == 4 {
-		else_.body = compileBody(args[3:4])
-	}
-
-	c.compile(args[1], false)
-
-	c.append(instruction{opLambda, if_},
-		instruction{opLambda, else_},
-		instruction{opIf, nil})
-
-	if tail {
-		c.append(instruction{opTail, integer(0)})
+		c.compileElement(consequent.cdr.(*Pair), tail)
 	} else {
-		c.append(instruction{opCall, integer(0)})
+		c.compileSequence(nil, tail)
 	}
+	c.patch(end)
 }
 
 // (set! ⟨variable⟩ ⟨expression⟩)
@@ -250,225 +516,298 @@ func (c *compiler) compileSet(e *Pair) {
 	if len(args) != 3 {
 		panic("set! must be of the form (set! ⟨variable⟩ ⟨expression⟩)")
 	}
-	sym, ok := args[1].(Symbol)
-	if !ok {
+	switch v := args[1].(type) {
+	case Symbol:
+		c.compileElement(e.cdr.(*Pair).cdr.(*Pair), false)
+		if l, ok := c.lexical.resolve(v); ok {
+			c.append(instruction{opSetLocal, l})
+		} else {
+			c.append(instruction{opSet, v})
+		}
+	case *identifier:
+		c.compileElement(e.cdr.(*Pair).cdr.(*Pair), false)
+		if l, ok := c.resolveIdentifier(v); ok {
+			c.append(instruction{opSetLocal, l})
+		} else {
+			c.append(instruction{opSetIdentifier, v})
+		}
+	default:
 		panic("set! must be of the form (set! ⟨variable⟩ ⟨expression⟩)")
 	}
-	c.compile(args[2], false)
-	c.append(instruction{opSet, sym})
+	c.append(instruction{opQuote, Unspecified})
 }
 
-//func isElse(clause *Pair) bool {
-//	sym, ok := clause.car.(Symbol)
-//	return ok && sym == "else"
-//}
-//
-//func evalClause(arg Value, clause *Pair, scope *scope, tail bool) Value {
-//	expr, _ := clause.cdr.(*Pair)
-//	if expr == nil {
-//		return arg
-//	}
-//
-//	if sym, ok := expr.car.(Symbol); ok && sym == "=>" {
-//		if proc, ok := expr.cdr.(*Pair); ok {
-//			call := &Pair{car: proc, cdr: &Pair{car: arg}}
-//			return eval(call, scope, tail)
-//		}
-//	}
-//
-//	return evalBegin(clause, scope, tail)
-//}
-//
-//func evalCond(e *Pair, scope *scope, tail bool) Value {
-//	for e, _ = e.cdr.(*Pair); e != nil; e, _ = e.cdr.(*Pair) {
-//		clause, ok := e.car.(*Pair)
-//		if !ok {
-//			panic("cond clause must be of the form (⟨test⟩ ⟨expression1⟩ ...), (⟨test⟩ => ⟨expression⟩), or (else ⟨expression1⟩ ⟨expression2⟩ ...)")
-//		}
-//
-//		if e.cdr == nil && isElse(clause) {
-//			return evalBegin(clause, scope, tail)
-//		}
-//
-//		v := eval(clause.car, scope, false)
-//		if Truthy(v) {
-//			return evalClause(v, clause, scope, tail)
-//		}
-//	}
-//	return nil
-//}
-//
-//func evalCase(e *Pair, scope *scope, tail bool) Value {
-//	keyp, _ := e.cdr.(*Pair)
-//	if keyp == nil {
-//		panic("case must be of the form (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)")
-//	}
+// (include ⟨string1⟩ ⟨string2⟩ ...)
+// (include-ci ⟨string1⟩ ⟨string2⟩ ...)
 //
-//	key := eval(keyp.car, scope, false)
-//
-//	for clauses, _ := keyp.cdr.(*Pair); clauses != nil; clauses, _ = clauses.cdr.(*Pair) {
-//		clause, ok := clauses.car.(*Pair)
-//		if !ok {
-//			panic("case clause must be of the form ((⟨datum1⟩ ...) ⟨expression1⟩ ⟨expression2⟩ ...), ((⟨datum1⟩ ...) => ⟨expression⟩), (else ⟨expression1⟩ ⟨expression2⟩ ...), or (else => ⟨expression⟩).")
-//		}
-//
-//		if clauses.cdr == nil && isElse(clause) {
-//			return evalClause(key, clause, scope, tail)
-//		}
-//
-//		for accepts, _ := clause.car.(*Pair); accepts != nil; accepts, _ = accepts.cdr.(*Pair) {
-//			if eqv(key, accepts.car) {
-//				return evalClause(key, clause, scope, tail)
-//			}
-//		}
-//	}
-//	return nil
-//}
-//
-//func evalAnd(e *Pair, scope *scope, tail bool) Value {
-//	if e.cdr == nil {
-//		return Boolean(true)
-//	}
-//
-//	e, _ = e.cdr.(*Pair)
-//	if e.cdr == nil {
-//		return eval(e.car, scope, tail)
-//	}
-//
-//	for ; e != nil; e, _ = e.cdr.(*Pair) {
-//		if !Truthy(eval(e.car, scope, false)) {
-//			return Boolean(false)
-//		}
-//	}
-//	return Boolean(true)
-//}
-//
-//func evalOr(e *Pair, scope *scope, tail bool) Value {
-//	if e.cdr == nil {
-//		return Boolean(true)
-//	}
-//
-//	e, _ = e.cdr.(*Pair)
-//	if e.cdr == nil {
-//		return eval(e.car, scope, tail)
-//	}
-//
-//	for ; e != nil; e, _ = e.cdr.(*Pair) {
-//		v := eval(e.car, scope, false)
-//		if Truthy(v) {
-//			return v
-//		}
-//	}
-//	return Boolean(false)
-//}
-//
-//func evalBinding(e Value, scope *scope) (Symbol, Value, bool) {
-//	binding, ok := e.(*Pair)
-//	if !ok {
-//		return "", nil, false
-//	}
-//	sym, ok := binding.car.(Symbol)
-//	if !ok {
-//		return "", nil, false
-//	}
-//	init, ok := binding.cdr.(*Pair)
-//	if !ok {
-//		return "", nil, false
-//	}
-//	if init.cdr != nil {
-//		return "", nil, false
-//	}
-//	return sym, eval(init.car, scope, false), true
-//}
-//
-//func evalBindings(e Value, scope *scope, seq bool) ([]Symbol, Vector, bool) {
-//	if e == nil {
-//		return nil, nil, true
-//	}
-//	bindings, ok := e.(*Pair)
-//	if !ok {
-//		return nil, nil, false
-//	}
-//
-//	var names []Symbol
-//	var values Vector
-//	for {
-//		sym, value, ok := evalBinding(bindings.car, scope)
-//		if !ok {
-//			return nil, nil, false
-//		}
-//		if seq {
-//			scope.set(sym, value)
-//		}
-//
-//		names = append(names, sym)
-//		values = append(values, value)
-//
-//		if bindings.cdr == nil {
-//			return names, values, true
-//		}
-//		if bindings, ok = bindings.cdr.(*Pair); !ok {
-//			return nil, nil, false
-//		}
-//	}
-//}
-//
-//func evalLet(e *Pair, scope *scope, tail bool) Value {
-//	const invalidLet = "let must be of the form (let ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
-//
-//	args := e.ToVector()
-//	if len(args) == 1 {
-//		panic(invalidLet)
-//	}
-//	args = args[1:]
-//
-//	sym, isNamedLet := args[0].(Symbol)
-//	if isNamedLet {
-//		args = args[1:]
-//		if len(args) == 0 {
-//			panic(invalidLet)
-//		}
-//	}
+// The contents of the included files are read at compile time and compiled in
+// place of the include form as if they were the body of a begin form.
+func (c *compiler) compileInclude(e *Pair, foldCase bool, tail bool) {
+	exprs := readIncludes(e, foldCase)
+	for _, expr := range exprs {
+		c.ctx.scanKeywords(expr)
+	}
+	c.compileSequence(exprs, tail)
+}
+
+// (cond ⟨clause1⟩ ⟨clause2⟩ ...)
 //
-//	formals, actuals, ok := evalBindings(args[0], scope, false)
-//	if !ok {
-//		panic(invalidLet)
-//	}
+// The cond form is compiled as a sequence of tests, each of which jumps to the
+// next clause if it yields a false value.
+func (c *compiler) compileCond(e *Pair, tail bool) {
+	clauses, _ := e.cdr.(*Pair)
+	c.compileCondClauses(clauses, nil, tail)
+}
+
+// condClauses is a list of cond clauses whose value is the value of otherwise
+// if no clause is selected. It is introduced by the compiler's rewrites.
+type condClauses struct {
+	clauses   *Pair
+	otherwise Value
+}
+
+func (cc *condClauses) MarshalSExp() SExpression {
+	return Cons(Symbol("cond"), cc.clauses)
+}
+
+// compileCondClauses compiles a list of cond clauses. If no clause is selected,
+// the value of the clauses is the value of otherwise.
+func (c *compiler) compileCondClauses(clauses *Pair, otherwise Value, tail bool) {
+	var ends []int
+	for ; clauses != nil; clauses, _ = clauses.cdr.(*Pair) {
+		clause, ok := clauses.car.(*Pair)
+		if !ok {
+			panic("cond clause must be of the form (⟨test⟩ ⟨expression1⟩ ...), (⟨test⟩ => ⟨expression⟩), or (else ⟨expression1⟩ ⟨expression2⟩ ...)")
+		}
+
+		if clauses.cdr == nil && isElse(clause) {
+			body, _ := clause.cdr.(*Pair)
+			c.compileSequence(body.ToVector(), tail)
+			c.patch(ends...)
+			return
+		}
+
+		c.compile(clause.car, false)
+		c.append(instruction{opDup, nil})
+		next := c.jump(opJumpIfFalse)
+		c.compileClause(clause, tail)
+		ends = append(ends, c.jump(opJump))
+		c.patch(next)
+		c.append(instruction{opPop, nil})
+	}
+	c.compile(otherwise, tail)
+	c.patch(ends...)
+}
+
+// compileClause compiles the body of a selected cond or case clause. The value
+// that selected the clause is on top of the stack.
 //
-//	scope = scope.push()
-//	proc := &procedure{
-//		name:    sym,
-//		closure: scope,
-//		formals: formals,
-//		body:    args[1:],
-//	}
+//	(⟨test⟩)                  => ⟨test⟩
+//	(⟨test⟩ => ⟨expression⟩)  => (⟨expression⟩ ⟨test⟩)
+//	(⟨test⟩ ⟨expression⟩ ...) => (begin ⟨expression⟩ ...)
+func (c *compiler) compileClause(clause *Pair, tail bool) {
+	exprs, _ := clause.cdr.(*Pair)
+	switch {
+	case exprs == nil:
+		// the selecting value is the value of the clause
+	case isArrow(exprs.car):
+		proc, ok := exprs.cdr.(*Pair)
+		if !ok {
+			panic("clause must be of the form (⟨test⟩ => ⟨expression⟩)")
+		}
+		c.compile(proc.car, false)
+		c.append(instruction{opSwap, nil})
+		c.name(proc.car)
+		c.call(1, tail)
+	default:
+		c.append(instruction{opPop, nil})
+		c.compileSequence(exprs.ToVector(), tail)
+	}
+}
+
+// (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)
 //
-//	if isNamedLet {
-//		scope.set(sym, proc)
-//	}
+// The case form is compiled by leaving the value of ⟨key⟩ on the stack and
+// testing it for membership in each clause's data in turn. The key is consumed
+// by the selected clause.
+func (c *compiler) compileCase(e *Pair, tail bool) {
+	keyp, _ := e.cdr.(*Pair)
+	if keyp == nil {
+		panic("case must be of the form (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)")
+	}
+
+	c.compile(keyp.car, false)
+
+	var ends []int
+	for clauses, _ := keyp.cdr.(*Pair); clauses != nil; clauses, _ = clauses.cdr.(*Pair) {
+		clause, ok := clauses.car.(*Pair)
+		if !ok {
+			panic("case clause must be of the form ((⟨datum1⟩ ...) ⟨expression1⟩ ⟨expression2⟩ ...), ((⟨datum1⟩ ...) => ⟨expression⟩), (else ⟨expression1⟩ ⟨expression2⟩ ...), or (else => ⟨expression⟩).")
+		}
+
+		if clauses.cdr == nil && isElse(clause) {
+			c.compileClause(clause, tail)
+			c.patch(ends...)
+			return
+		}
+
+		c.append(instruction{opMemv, unwrapSyntax(clause.car)})
+		next := c.jump(opJumpIfFalse)
+		c.compileClause(clause, tail)
+		ends = append(ends, c.jump(opJump))
+		c.patch(next)
+	}
+	c.append(instruction{opPop, nil}, instruction{opQuote, Unspecified})
+	c.patch(ends...)
+}
+
+// (and ⟨test1⟩ ...)
 //
-//	return proc.apply(actuals)
-//}
+// The and form is compiled as a sequence of tests, each of which jumps to the
+// end of the form if it yields a false value.
+func (c *compiler) compileAnd(tests *Pair, tail bool) {
+	c.compileShortCircuit(tests, Boolean(true), opJumpIfFalse, tail)
+}
+
+// (or ⟨test1⟩ ...)
 //
-//func evalSeq(e *Pair, scope *scope, tail bool) Value {
-//	if e == nil {
-//		return nil
-//	}
+// The or form is compiled as a sequence of tests, each of which jumps to the
+// end of the form if it yields a true value.
+func (c *compiler) compileOr(tests *Pair, tail bool) {
+	c.compileShortCircuit(tests, Boolean(false), opJumpIfTrue, tail)
+}
+
+// compileShortCircuit compiles a sequence of tests. The value of the first test
+// for which jump jumps is the value of the sequence. If there is no such test,
+// the value of the sequence is the value of the last test, or empty if there
+// are no tests.
+func (c *compiler) compileShortCircuit(tests *Pair, empty Value, jump opcode, tail bool) {
+	if tests == nil {
+		c.append(instruction{opQuote, empty})
+		return
+	}
+
+	var ends []int
+	for ; tests.cdr != nil; tests = tests.cdr.(*Pair) {
+		c.compile(tests.car, false)
+		c.append(instruction{opDup, nil})
+		ends = append(ends, c.jump(jump))
+		c.append(instruction{opPop, nil})
+	}
+	c.compile(tests.car, tail)
+	c.patch(ends...)
+}
+
+// (let ⟨bindings⟩ ⟨body⟩)
+// (let ⟨variable⟩ ⟨bindings⟩ ⟨body⟩)
 //
-//	for {
-//		next, _ := e.cdr.(*Pair)
-//		if next == nil {
-//			return eval(e.car, scope, tail)
-//		}
-//		eval(e.car, scope, false)
-//		e = next
-//	}
-//}
+// An ordinary let is compiled as the application of a procedure whose formals
+// are the bound variables. A named let is compiled as the application of a
+// procedure that is bound to ⟨variable⟩ within its own body.
+func (c *compiler) compileLet(e *Pair, tail bool) {
+	const invalidLet = "let must be of the form (let ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()
+	if len(args) == 1 {
+		panic(invalidLet)
+	}
+	args = args[1:]
+
+	variable := args[0]
+	sym, isNamedLet := variableName(variable)
+	if isNamedLet {
+		args = args[1:]
+		if len(args) == 0 {
+			panic(invalidLet)
+		}
+	}
+
+	formals, inits, ok := letBindings(args[0])
+	if !ok {
+		panic(invalidLet)
+	}
+
+	if isNamedLet {
+		signature := Cons(variable, symbolList(formals))
+		define := Cons(Symbol("define"), Cons(signature, Vector(args[1:]).ToList()))
+		c.append(instruction{opLambda, c.procedure("<let>", nil, false, []Value{define, variable}, true)})
+		c.call(0, false)
+	} else {
+		c.append(instruction{opLambda, c.procedure(sym, formals, false, args[1:], true)})
+	}
+
+	for _, init := range inits {
+		c.compile(init, false)
+	}
+	c.call(len(inits), tail)
+}
+
+// letBindings returns the variables and initializers of a let form's bindings.
+func letBindings(e Value) ([]Symbol, []Value, bool) {
+	var names []Symbol
+	var inits []Value
+	for e != nil {
+		bindings, ok := e.(*Pair)
+		if !ok {
+			return nil, nil, false
+		}
+		binding, ok := bindings.car.(*Pair)
+		if !ok {
+			return nil, nil, false
+		}
+		sym, ok := variableName(binding.car)
+		if !ok {
+			return nil, nil, false
+		}
+		init, ok := binding.cdr.(*Pair)
+		if !ok || init.cdr != nil {
+			return nil, nil, false
+		}
+
+		names, inits = append(names, sym), append(inits, init.car)
+		e = bindings.cdr
+	}
+	return names, inits, true
+}
+
+// symbolList returns a new list containing the given symbols.
+func symbolList(symbols []Symbol) Value {
+	values := make([]Value, len(symbols))
+	for i, sym := range symbols {
+		values[i] = sym
+	}
+	return list(values...)
+}
+
+// (guard (⟨variable⟩
+//         ⟨cond clause1⟩ ⟨cond clause2⟩ ...)
+//   ⟨body⟩)
 //
-//func evalBegin(e *Pair, scope *scope, tail bool) Value {
-//	e, _ = e.cdr.(*Pair)
-//	return evalSeq(e, scope, tail)
-//}
+// The guard form is compiled as a call to guardProc. The body is compiled as a
+// thunk, and the clauses are compiled as a procedure of ⟨variable⟩ that returns
+// guardNoMatch if no clause is selected.
+func (c *compiler) compileGuard(e *Pair, tail bool) {
+	variable, clauses, body := guardForm(e)
+
+	handler := c.procedure("<guard-clauses>", []Symbol{variable}, false, []Value{
+		&condClauses{clauses: clauses, otherwise: quoted(guardNoMatch)},
+	}, true)
+
+	c.append(instruction{opQuote, guardProc},
+		instruction{opLambda, c.procedure("<guard-body>", nil, false, body.ToVector(), true)},
+		instruction{opLambda, handler})
+	c.call(2, tail)
+}
+
+// list returns a new list containing the given values.
+func list(values ...Value) Value {
+	return Vector(values).ToList()
+}
+
+// quoted returns the expression (quote v).
+func quoted(v Value) Value {
+	return list(Symbol("quote"), v)
+}
 
 // A variable definition binds one or more identifiers and specifies an initial
 // value for each of them. The simplest kind of variable definition takes one
@@ -499,28 +838,220 @@ func (c *compiler) compileDefine(e *Pair) {
 		panic(invalidDefine)
 	}
 
+	var sym Symbol
 	switch v := args[1].(type) {
-	case Symbol:
-		c.compile(args[2], false)
-		c.append(instruction{opDefine, v})
+	case Symbol, *identifier:
+		sym, _ = variableName(v)
+		c.compileElement(e.cdr.(*Pair).cdr.(*Pair), false)
 	case *Pair:
-		sym, ok := v.car.(Symbol)
+		s, ok := variableName(v.car)
 		if !ok {
 			panic(invalidDefine)
 		}
+		sym = s
+		name, _ := symbolName(v.car)
 
 		formals, isVariadic := makeFormals(v.cdr)
-		proc := &compiledProcedure{
-			name:       sym,
-			formals:    formals,
-			isVariadic: isVariadic,
-			body:       compileBody(args[2:]),
-		}
+		proc := c.procedure(name, formals, isVariadic, args[2:], false)
 		c.append(instruction{opLambda, proc})
-		c.append(instruction{opDefine, sym})
 	default:
 		panic(invalidDefine)
 	}
+
+	// Definitions of variables that have been allocated slots in the current
+	// scope store into those slots. All other definitions bind the variable
+	// by name.
+	if l, ok := c.lexical.resolve(sym); ok && l.depth == 0 {
+		c.append(instruction{opSetLocal, l})
+	} else {
+		c.append(instruction{opDefine, sym})
+	}
+	c.append(instruction{opQuote, Unspecified})
+}
+
+// (define-syntax ⟨keyword⟩ ⟨transformer spec⟩)
+//
+// Syntax definitions are evaluated when they are executed so that the
+// transformer closes over the scope in which it is defined.
+func (c *compiler) compileDefineSyntax(e *Pair) {
+	keyword, spec := syntaxDefinitionForm(e)
+	c.compileSyntaxDefinition(&syntaxDefinition{keyword: keyword, spec: spec})
+}
+
+// A syntaxDefinition binds a keyword to a transformer when it is executed.
+// Syntax definitions are introduced by define-syntax forms and by the
+// compiler's rewrites of let-syntax forms.
+type syntaxDefinition struct {
+	keyword Symbol
+	spec    Value
+
+	// outer is true if the transformer closes over the scope that encloses
+	// the scope in which the keyword is defined, as for let-syntax.
+	outer bool
+
+	// lexical is the lexical scope of the scope that the transformer closes
+	// over. Identifiers inserted by the keyword's expansions resolve the
+	// variables of this scope at compile time.
+	lexical *lexicalScope
+}
+
+func (d *syntaxDefinition) MarshalSExp() SExpression {
+	return Cons(Symbol("define-syntax"), Cons(d.keyword, Cons(d.spec, nil)))
+}
+
+// compileSyntaxDefinition compiles a syntax definition in the current scope.
+func (c *compiler) compileSyntaxDefinition(d *syntaxDefinition) {
+	lexical := c.lexical
+	if d.outer {
+		lexical = lexical.outer
+	}
+	c.append(instruction{opDefineSyntax, &syntaxDefinition{keyword: d.keyword, spec: d.spec, outer: d.outer, lexical: lexical}},
+		instruction{opQuote, Unspecified})
+}
+
+// (let-syntax ⟨bindings⟩ ⟨body⟩)
+// (letrec-syntax ⟨bindings⟩ ⟨body⟩)
+//
+// The let-syntax and letrec-syntax forms are compiled as the application of an
+// internal procedure whose body defines the keywords and then evaluates
+// ⟨body⟩. The transformers of a let-syntax form close over the scope that
+// encloses the procedure's scope.
+func (c *compiler) compileLetSyntax(e *Pair, recursive, tail bool) {
+	keywords, specs, body := syntaxBindings(e)
+
+	exprs := make([]Value, len(keywords), len(keywords)+body.len())
+	for i, keyword := range keywords {
+		exprs[i] = &syntaxDefinition{keyword: keyword, spec: specs[i], outer: !recursive}
+	}
+	exprs = append(exprs, body.ToVector()...)
+
+	c.append(instruction{opLambda, c.procedure("<let-syntax>", nil, false, exprs, true)})
+	c.call(0, tail)
+}
+
+// A macroUse is a form whose operator may name a keyword. Macro uses are
+// expanded when they are executed so that keywords defined by internal
+// syntax definitions are visible to them.
+type macroUse struct {
+	form    *Pair
+	tail    bool
+	lexical *lexicalScope // the lexical scope of the use
+}
+
+func (*macroUse) MarshalSExp() SExpression {
+	return Symbol("<macro use>")
+}
+
+// expand expands the macro use in scope and compiles the result as the body of
+// an internal procedure. If the use's operator is not bound to a keyword in
+// scope, the use is compiled as a procedure call. It is an error if no rule
+// matches the use.
+func (u *macroUse) expand(scope *scope) *compiledProcedure {
+	c := compiler{ctx: newCompileContext(scope, nil), lexical: u.lexical, pos: u.form.pos}
+	if syntax, ok := lookupSyntax(scope, u.form.car); ok {
+		v := syntax.expand(u.form, scope)
+		c.ctx.scanKeywords(v)
+		c.compile(v, true)
+	} else {
+		c.compileApplication(u.form, true)
+	}
+
+	proc := c.finish("<expansion>", nil, false)
+	proc.internal = true
+	return proc
+}
+
+// compileApplication compiles a procedure call. A call whose operator is a
+// lambda expression that accepts its arguments, such as the expansion of a let
+// form, is compiled as a call to an internal procedure.
+func (c *compiler) compileApplication(e *Pair, tail bool) {
+	if init, formals, isVariadic, body, ok := immediateReceive(e); ok {
+		// the values of init are passed directly to the consumer
+		c.append(instruction{opLambda, c.procedure("", formals, isVariadic, body, true)})
+		c.compile(init, false)
+		if tail {
+			c.append(instruction{opTailValues, nil})
+		} else {
+			c.append(instruction{opCallValues, nil})
+		}
+		return
+	}
+
+	args := e.ToVector()[1:]
+	if formals, body, ok := immediateLambda(e.car, len(args)); ok {
+		c.append(instruction{opLambda, c.procedure("", formals, false, body, true)})
+	} else {
+		c.compileElement(e, false)
+	}
+	for rest := e.cdr; rest != nil; {
+		arg, ok := rest.(*Pair)
+		if !ok {
+			c.compile(rest, false)
+			break
+		}
+		c.compileElement(arg, false)
+		rest = arg.cdr
+	}
+
+	c.name(e.car)
+	c.call(len(args), tail)
+}
+
+// immediateLambda returns the formals and body of operator if it is a lambda
+// expression with fixed formals that accepts nargs arguments.
+func immediateLambda(operator Value, nargs int) ([]Symbol, []Value, bool) {
+	lambda, ok := operator.(*Pair)
+	if !ok {
+		return nil, nil, false
+	}
+	if sym, ok := lambda.car.(Symbol); !ok || sym != "lambda" {
+		return nil, nil, false
+	}
+	args := lambda.ToVector()
+	if len(args) < 3 {
+		return nil, nil, false
+	}
+	formals, isVariadic := makeFormals(args[1])
+	if isVariadic || len(formals) != nargs {
+		return nil, nil, false
+	}
+	return formals, args[2:], true
+}
+
+// immediateReceive returns the parts of a call to call-with-values whose
+// producer is a thunk with a single expression and whose consumer is a lambda
+// expression, such as the expansion of a receive form.
+func immediateReceive(e *Pair) (init Value, formals []Symbol, isVariadic bool, body []Value, ok bool) {
+	if !isBuiltin(e.car, "call-with-values") {
+		return nil, nil, false, nil, false
+	}
+	args := e.ToVector()[1:]
+	if len(args) != 2 {
+		return nil, nil, false, nil, false
+	}
+	producer, ok := args[0].(*Pair)
+	if !ok || producer.car != Symbol("lambda") || producer.len() != 3 || producer.cdr.(*Pair).car != nil {
+		return nil, nil, false, nil, false
+	}
+	consumer, ok := args[1].(*Pair)
+	if !ok || consumer.car != Symbol("lambda") || consumer.len() < 3 {
+		return nil, nil, false, nil, false
+	}
+	lambda := consumer.ToVector()
+	formals, isVariadic = makeFormals(lambda[1])
+	return producer.ToVector()[2], formals, isVariadic, lambda[2:], true
+}
+
+// compileElement compiles the expression that is the car of p, an element of a
+// form. References to variables are attributed to their own source positions
+// rather than to the form.
+func (c *compiler) compileElement(p *Pair, tail bool) {
+	if pos := p.carPosition(); pos != nil && isVariable(p.car) {
+		outer := c.pos
+		c.pos = pos
+		defer func() { c.pos = outer }()
+	}
+	c.compile(p.car, tail)
 }
 
 func (c *compiler) compile(expression Value, tail bool) {
@@ -534,19 +1065,32 @@ func (c *compiler) compile(expression Value, tail bool) {
 		c.append(instruction{opQuote, e})
 	case Symbol:
 		c.compileVariable(e)
+	case *identifier:
+		c.compileIdentifier(e)
+	case *condClauses:
+		c.compileCondClauses(e.clauses, e.otherwise, tail)
+	case *syntaxDefinition:
+		c.compileSyntaxDefinition(e)
 	case Vector:
-		c.append(instruction{opQuote, Vector(nil)})
 		for _, v := range e {
 			c.compile(v, false)
 		}
 		c.append(instruction{opVector, integer(len(e))})
 	case *Pair:
-		switch sym, _ := e.car.(Symbol); sym {
+		if e.pos != nil {
+			defer recoverAt(e.pos)
+
+			outer := c.pos
+			c.pos = e.pos
+			defer func() { c.pos = outer }()
+		}
+
+		switch sym, _ := symbolName(e.car); sym {
 		// primitive expressions
 		case "quote":
 			c.compileQuote(e)
-			//		case "quasiquote":
-			//			return evalQuasiquote(e.cdr.(*Pair).car, scope)
+		case "quasiquote":
+			c.compileQuasiquote(e, tail)
 		case "lambda":
 			c.compileLambda(e)
 		case "if":
@@ -554,40 +1098,50 @@ func (c *compiler) compile(expression Value, tail bool) {
 		case "set!":
 			c.compileSet(e)
 		case "include":
-			panic("NYI: include")
+			c.compileInclude(e, false, tail)
 		case "include-ci":
-			panic("NYI: include-ci")
+			c.compileInclude(e, true, tail)
 
 		// derived expressions
-		//		case "cond":
-		//			return evalCond(e, scope, tail)
-		//		case "case":
-		//			return evalCase(e, scope, tail)
-		//		case "and":
-		//			return evalAnd(e, scope, tail)
-		//		case "or":
-		//			return evalOr(e, scope, tail)
-		//		case "let":
-		//			return evalLet(e, scope, tail)
-		//		case "begin":
-		//			return evalBegin(e, scope, tail)
+		case "cond":
+			c.compileCond(e, tail)
+		case "case":
+			c.compileCase(e, tail)
+		case "and":
+			tests, _ := e.cdr.(*Pair)
+			c.compileAnd(tests, tail)
+		case "or":
+			tests, _ := e.cdr.(*Pair)
+			c.compileOr(tests, tail)
+		case "let":
+			c.compileLet(e, tail)
+		case "begin":
+			body, _ := e.cdr.(*Pair)
+			c.compileSequence(body.ToVector(), tail)
+		case "guard":
+			c.compileGuard(e, tail)
 
 		// variable definitions
 		case "define":
 			c.compileDefine(e)
 
+		// macros
+		case "let-syntax":
+			c.compileLetSyntax(e, false, tail)
+		case "letrec-syntax":
+			c.compileLetSyntax(e, true, tail)
+
+		// syntax definitions
+		case "define-syntax":
+			c.compileDefineSyntax(e)
+
 		// all else
 		default:
-			c.compile(e.car, false)
-			args := e.ToVector()[1:]
-			for _, arg := range args {
-				c.compile(arg, false)
-			}
-			if tail {
-				c.append(instruction{opTail, integer(len(args))})
-			} else {
-				c.append(instruction{opCall, integer(len(args))})
+			if c.ctx.isKeyword(e.car) {
+				c.append(instruction{opExpand, &macroUse{form: e, tail: tail, lexical: c.lexical}})
+				return
 			}
+			c.compileApplication(e, tail)
 		}
 	default:
 		panic(fmt.Sprintf("unknown expression type %T", e))
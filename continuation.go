@@ -0,0 +1,583 @@
+package loom
+
+// windStack is an immutable stack of the before and after thunks of the
+// dynamic-wind calls whose dynamic extents are active.
+type windStack struct {
+	before Procedure
+	after  Procedure
+	depth  int
+	outer  *windStack
+}
+
+// wind installs the thunks of a call to dynamic-wind.
+func (d *dynamicEnv) wind(before, after Procedure) {
+	depth := 1
+	if d.winders != nil {
+		depth = d.winders.depth + 1
+	}
+	d.winders = &windStack{before: bindDynamic(before, d), after: bindDynamic(after, d), depth: depth, outer: d.winders}
+}
+
+// rewind changes the active dynamic-wind calls to those in target. The after
+// thunks of the calls that are being left are called first, innermost first,
+// followed by the before thunks of the calls that are being entered, outermost
+// first. Each thunk is called with the dynamic-wind calls that were active
+// outside of its own call.
+func (d *dynamicEnv) rewind(target *windStack) {
+	common := target
+	for w := d.winders; w != common; {
+		switch {
+		case w == nil:
+			common = common.outer
+		case common == nil || w.depth > common.depth:
+			w = w.outer
+		case common.depth > w.depth:
+			common = common.outer
+		default:
+			w, common = w.outer, common.outer
+		}
+	}
+
+	for d.winders != common {
+		w := d.winders
+		d.winders = w.outer
+		w.after.Apply(nil)
+	}
+
+	var entered []*windStack
+	for w := target; w != common; w = w.outer {
+		entered = append(entered, w)
+	}
+	for i := len(entered) - 1; i >= 0; i-- {
+		entered[i].before.Apply(nil)
+		d.winders = entered[i]
+	}
+}
+
+// A continuation is a procedure that resumes the computation that was waiting
+// for the result of a call to call/cc or call/ec.
+//
+// A continuation captured by call/cc holds a copy of the VM's frames, and may
+// be resumed any number of times. A continuation captured by call/ec holds
+// the frame of the call instead, and may only be resumed while that frame is
+// active. In either case, a continuation that was captured by a VM that is
+// still running is resumed by that VM; if the continuation is invoked by any
+// other VM or by Go code, the Go stack is unwound to the capturing VM first.
+type continuation struct {
+	vm *vm // the VM that captured the continuation
+
+	// frame is a copy of the frame that called call/cc, or the frame of the
+	// call to call/ec. frame is nil if call/cc was called by the VM's
+	// outermost frame or by Go code, in which case resuming the continuation
+	// returns from the VM.
+	frame  *frame
+	escape bool
+
+	dynamic  *dynamicEnv
+	winders  *windStack
+	handlers *handlerStack
+}
+
+// capture returns a continuation that resumes the caller of the VM's current
+// frame.
+func (m *vm) capture(escape bool) *continuation {
+	k := &continuation{vm: m, escape: escape, dynamic: m.stack.scope.dynamic()}
+	if k.dynamic != nil {
+		k.winders, k.handlers = k.dynamic.winders, k.dynamic.handlers
+	}
+
+	switch {
+	case escape:
+		k.frame = m.stack
+	case m.stack.caller != nil:
+		k.frame = m.stack.caller.copyStack()
+	}
+	return k
+}
+
+func (k *continuation) MarshalSExp() SExpression {
+	if k.escape {
+		return Symbol("<escape continuation>")
+	}
+	return Symbol("<continuation>")
+}
+
+func (k *continuation) Apply(args Vector) Value {
+	v := makeValues(args)
+	k.jump(nil, v)
+
+	// resume a copy of the continuation's frames in a new VM
+	m := vm{dynamic: k.dynamic}
+	return m.run(&jump{k: k, v: v})
+}
+
+// jump transfers control from the VM m to k, which receives v. m is nil if k
+// is invoked by Go code. If k was captured by a different VM that is still
+// running, the Go stack is unwound to that VM by panicking. Otherwise, jump
+// returns, and m must resume k itself.
+func (k *continuation) jump(m *vm, v Value) {
+	if k.escape && !(k.vm.running && k.vm.active(k.frame)) {
+		panic(NewError("escape continuation invoked outside of its dynamic extent"))
+	}
+	if !k.vm.running {
+		// the rest of a top-level form may be resumed any number of times,
+		// but the Go code that called the VM cannot be
+		if k.frame == nil && !k.vm.toplevel {
+			panic(NewError("continuation invoked outside of its dynamic extent"))
+		}
+		return
+	}
+	if k.vm != m {
+		panic(&Error{Message: "continuation invoked outside of its VM", kind: jumpError, cause: &jump{k: k, v: v}})
+	}
+}
+
+// A jump is the transfer of control to a continuation. It is propagated as
+// the cause of a panicking *Error until it reaches the VM that must resume the
+// continuation.
+type jump struct {
+	k *continuation
+	v Value
+}
+
+func (j *jump) Error() string {
+	return "jump to continuation"
+}
+
+// resume resumes the continuation of j in m. The dynamic-wind calls and
+// exception handlers that were active when the continuation was captured are
+// reinstated. resume returns false if the continuation returns from the VM,
+// in which case the VM's result is j.v.
+func (m *vm) resume(j *jump) bool {
+	k := j.k
+	if d := k.dynamic; d != nil {
+		d.rewind(k.winders)
+		d.handlers = k.handlers
+	}
+
+	f := k.frame
+	switch {
+	case k.escape:
+		f = f.caller
+	case f != nil:
+		f = f.copyStack()
+	}
+	if f == nil {
+		return false
+	}
+
+	f.stack, f.pc = append(f.stack, j.v), f.pc+1
+	m.stack = f
+	return true
+}
+
+// (call-with-current-continuation proc)
+// (call/cc proc)
+//
+// The procedure call-with-current-continuation (or its equivalent
+// abbreviation call/cc) packages the current continuation as an "escape
+// procedure" and passes it as an argument to proc. The escape procedure is a
+// Scheme procedure that, if it is later called, will abandon whatever
+// continuation is in effect at that later time and will instead use the
+// continuation that was in effect when the escape procedure was created.
+// Calling the escape procedure will cause the invocation of before and after
+// thunks installed using dynamic-wind.
+var callCC = &dynamicProcedure{
+	name: "call-with-current-continuation",
+	compiled: &compiledProcedure{
+		name:    "call-with-current-continuation",
+		formals: []Symbol{"proc"},
+		slots:   1,
+		body: []instruction{
+			{opLocal, local{0, 0}},
+			{opContinuation, nil},
+			{opTail, integer(1)},
+			{opReturn, nil},
+		},
+	},
+}
+
+// (call-with-escape-continuation proc)
+// (call/ec proc)
+//
+// Like call/cc, but the continuation that is passed to proc may only be
+// invoked during the call to proc. Escape continuations do not copy the stack,
+// so they are the cheaper choice for early exits. Invoking an escape
+// continuation after the call has returned is an error.
+var callEC = &dynamicProcedure{
+	name: "call-with-escape-continuation",
+	compiled: &compiledProcedure{
+		name:    "call-with-escape-continuation",
+		formals: []Symbol{"proc"},
+		slots:   1,
+		body: []instruction{
+			{opLocal, local{0, 0}},
+			{opEscape, nil},
+			{opCall, integer(1)},
+			{opReturn, nil},
+		},
+	},
+}
+
+// (dynamic-wind before thunk after)
+//
+// Calls thunk without arguments, returning the result(s) of this call. Before
+// and after are called, also without arguments, as required by the following
+// rules. Note that, in the absence of calls to continuations captured using
+// call/cc, the three arguments are called once each, in order. Before is
+// called whenever execution enters the dynamic extent of the call to thunk and
+// after is called whenever it exits that dynamic extent.
+//
+// After is also called when the dynamic extent of the call to thunk is exited
+// by an exception or by exit, but not by emergency-exit.
+var dynamicWind = &dynamicProcedure{
+	name: "dynamic-wind",
+	compiled: &compiledProcedure{
+		name:    "dynamic-wind",
+		formals: []Symbol{"before", "thunk", "after"},
+		slots:   3,
+		body: []instruction{
+			{opLocal, local{0, 0}},
+			{opCall, integer(0)},
+			{opPop, nil},
+			{opLocal, local{0, 0}},
+			{opLocal, local{0, 2}},
+			{opWind, nil},
+			{opLocal, local{0, 1}},
+			{opCall, integer(0)},
+			{opUnwind, nil},
+			{opLocal, local{0, 2}},
+			{opCall, integer(0)},
+			{opPop, nil},
+			{opReturn, nil},
+		},
+	},
+}
+
+// A walker runs an evaluation by the tree-walking evaluator, which evaluates
+// expressions by recursive calls and so cannot copy its frames as the VM does
+// when a continuation is captured. Instead, a call to call/cc unwinds the Go
+// stack to the walker that runs the evaluation, and each frame of the
+// evaluator that is unwound saves the rest of its work as a walkerFrame. The
+// walker then resumes the saved frames in turn, innermost first, after
+// applying the receiver of call/cc to the continuation that they make up. The
+// frames are never modified, so the continuation may be resumed any number of
+// times.
+//
+// The tree-walking evaluator runs a walker for each top-level form and for
+// each call to a Scheme procedure by Go code.
+type walker struct {
+	// dynamic is the dynamic environment of the walker, if any. The active
+	// dynamic-wind calls and exception handlers of the environment at the
+	// start of the run are saved in winders and handlers.
+	dynamic  *dynamicEnv
+	winders  *windStack
+	handlers *handlerStack
+
+	running  bool // true while the walker is running
+	toplevel bool // true if the walker evaluates a top-level form
+}
+
+// run calls f and returns its value. If a continuation is captured during the
+// call, or if a continuation that must be resumed by the walker is invoked,
+// the continuation is resumed in place of the rest of the call. The
+// dynamic-wind calls and exception handlers that are active when run is
+// called are reinstated before it returns.
+func (w *walker) run(f func() Value) (v Value) {
+	if d := w.dynamic; d != nil {
+		w.winders, w.handlers = d.winders, d.handlers
+	}
+	w.running = true
+	defer func() { w.running = false }()
+
+	for f != nil {
+		v, f = w.exec(f)
+	}
+
+	if d := w.dynamic; d != nil && (d.winders != w.winders || d.handlers != w.handlers) {
+		d.rewind(w.winders)
+		d.handlers = w.handlers
+	}
+	return v
+}
+
+// exec calls f. If a continuation is captured during the call, or if a
+// continuation that must be resumed by the walker is invoked, the Go stack is
+// unwound to exec, which returns a function that resumes the continuation.
+// Failures that propagate out of the walker are signaled and reinstate the
+// dynamic-wind calls and exception handlers that were active at the start of
+// the run, as they do when they propagate out of a VM.
+func (w *walker) exec(f func() Value) (result Value, next func() Value) {
+	defer func() {
+		if x := recover(); x != nil {
+			err := toError(x)
+			switch c := err.cause.(type) {
+			case *walkerCapture:
+				k := c.continuation(w)
+				result, next = nil, func() Value { return k.resume(c.receive(k)) }
+				return
+			case *walkerJump:
+				if c.k.walker == w || !c.k.walker.running {
+					result, next = nil, func() Value {
+						c.k.reinstate()
+						return c.k.resume(func() Value { return c.v })
+					}
+					return
+				}
+			}
+
+			if d := w.dynamic; d != nil {
+				d.signal(err)
+				if err.unwinds() {
+					d.rewind(w.winders)
+				}
+				d.handlers = w.handlers
+			}
+			panic(err)
+		}
+	}()
+	return f(), nil
+}
+
+// A walkerFrame is the rest of the work of a frame of the tree-walking
+// evaluator that was unwound by the capture of a continuation. It is called
+// with the value for which the frame was waiting and returns the value that
+// the frame would have returned.
+type walkerFrame func(v Value) Value
+
+// saveFrames saves frames as the next frames of the continuation that is being
+// captured if x, a recovered panic, is the capture of a continuation. It
+// returns x, which the caller must propagate.
+func saveFrames(x interface{}, frames ...walkerFrame) interface{} {
+	if err, ok := x.(*Error); ok {
+		if c, ok := err.cause.(*walkerCapture); ok {
+			c.frames = append(c.frames, frames...)
+		}
+	}
+	return x
+}
+
+// A walkerCapture is the capture of a continuation by a call to call/cc by the
+// tree-walking evaluator. It is propagated as the cause of a panicking *Error
+// until it reaches the walker that runs the call, collecting the frames of the
+// continuation along the way.
+type walkerCapture struct {
+	receiver Procedure
+	frames   []walkerFrame // the frames of the continuation, innermost first
+
+	dynamic  *dynamicEnv
+	winders  *windStack
+	handlers *handlerStack
+}
+
+func (c *walkerCapture) Error() string {
+	return "capture of continuation"
+}
+
+// continuation returns the continuation captured by c, which is resumed by w.
+func (c *walkerCapture) continuation(w *walker) *walkerContinuation {
+	return &walkerContinuation{walker: w, frames: c.frames, dynamic: c.dynamic, winders: c.winders, handlers: c.handlers}
+}
+
+// receive returns a function that applies the receiver of call/cc to the
+// continuation k.
+func (c *walkerCapture) receive(k *walkerContinuation) func() Value {
+	return func() Value {
+		return forceTail(&tailCall{name: procedureName(nil, c.receiver), p: bindWalker(c.receiver, c.dynamic), args: Vector{k}, budget: c.dynamic.currentBudget()})
+	}
+}
+
+// walkerCallCC returns call/cc bound to d for a call by the tree-walking
+// evaluator. The call unwinds the Go stack to the walker that runs it, which
+// captures the continuation of the call and applies the receiver to it.
+func walkerCallCC(d *dynamicEnv) Procedure {
+	return ProcedureFunc(func(args Vector) Value {
+		if len(args) != 1 {
+			panic("call-with-current-continuation expects 1 argument")
+		}
+		receiver, ok := args[0].(Procedure)
+		if !ok {
+			panic(NewError("value is not a procedure", args[0]))
+		}
+
+		c := &walkerCapture{receiver: receiver, dynamic: d}
+		if d != nil {
+			c.winders, c.handlers = d.winders, d.handlers
+		}
+		panic(&Error{Message: "continuation captured outside of the tree-walking evaluator", kind: jumpError, cause: c})
+	})
+}
+
+// A walkerContinuation is a continuation captured by a call to call/cc by the
+// tree-walking evaluator.
+//
+// A continuation that was captured by a walker that is still running is
+// resumed by that walker. Otherwise, it is resumed by the innermost running
+// walker if it is invoked by the tree-walking evaluator, or by a new walker if
+// it is invoked by Go code.
+type walkerContinuation struct {
+	walker *walker // the walker that captured the continuation
+	frames []walkerFrame
+
+	dynamic  *dynamicEnv
+	winders  *windStack
+	handlers *handlerStack
+}
+
+func (k *walkerContinuation) MarshalSExp() SExpression {
+	return Symbol("<continuation>")
+}
+
+func (k *walkerContinuation) Apply(args Vector) Value {
+	v := makeValues(args)
+	if k.walker.running {
+		panic(k.jump(v))
+	}
+
+	w := walker{dynamic: k.dynamic}
+	return w.run(func() Value {
+		k.reinstate()
+		return k.resume(func() Value { return v })
+	})
+}
+
+// invoke transfers control from the tree-walking evaluator to k, which
+// receives args. The Go stack is unwound to the walker that resumes k.
+func (k *walkerContinuation) invoke(args Vector) Value {
+	panic(k.jump(makeValues(args)))
+}
+
+// jump returns the *Error that unwinds the Go stack to the walker that resumes
+// k with the value v.
+func (k *walkerContinuation) jump(v Value) *Error {
+	return &Error{Message: "continuation invoked outside of its walker", kind: jumpError, cause: &walkerJump{k: k, v: v}}
+}
+
+// reinstate reinstates the dynamic-wind calls and exception handlers that were
+// active when k was captured.
+func (k *walkerContinuation) reinstate() {
+	if d := k.dynamic; d != nil {
+		d.rewind(k.winders)
+		d.handlers = k.handlers
+	}
+}
+
+// resume passes the value of f to each of the frames of k in turn and returns
+// the value of the outermost frame. If a continuation is captured while k is
+// resumed, the frames of k that have yet to be resumed are saved as the rest of
+// the captured continuation.
+func (k *walkerContinuation) resume(f func() Value) Value {
+	v := k.call(0, f)
+	for i, frame := range k.frames {
+		frame, arg := frame, v
+		v = k.call(i+1, func() Value { return frame(arg) })
+	}
+	return v
+}
+
+// call calls f, which precedes the i'th frame of k.
+func (k *walkerContinuation) call(i int, f func() Value) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, k.frames[i:]...))
+		}
+	}()
+	return f()
+}
+
+// A walkerJump is the transfer of control to a continuation that was captured
+// by the tree-walking evaluator. It is propagated as the cause of a panicking
+// *Error until it reaches the walker that must resume the continuation.
+type walkerJump struct {
+	k *walkerContinuation
+	v Value
+}
+
+func (j *walkerJump) Error() string {
+	return "jump to continuation"
+}
+
+// walkerDynamicWind returns dynamic-wind bound to d for a call by the
+// tree-walking evaluator. The thunks are called by the evaluator rather than
+// by a VM, so that the continuations that are captured during the calls
+// include the rest of the call to dynamic-wind.
+func walkerDynamicWind(d *dynamicEnv) Procedure {
+	return ProcedureFunc(func(args Vector) Value {
+		if len(args) != 3 {
+			panic("dynamic-wind expects 3 arguments")
+		}
+		w := &windCall{dynamic: d, before: args[0], thunk: args[1], after: args[2]}
+		w.call(w.before, w.wind)
+		return w.wind(nil)
+	})
+}
+
+// A windCall is a call to dynamic-wind by the tree-walking evaluator. Each of
+// its methods that takes a value is the rest of the call after one of the
+// thunks returns.
+type windCall struct {
+	dynamic              *dynamicEnv
+	before, thunk, after Value
+}
+
+// wind installs the thunks and calls thunk once before has returned.
+func (w *windCall) wind(Value) Value {
+	before, ok := w.before.(Procedure)
+	if !ok {
+		panic(newNamedError("the first argument to dynamic-wind must be a procedure", w.before))
+	}
+	after, ok := w.after.(Procedure)
+	if !ok {
+		panic(newNamedError("the third argument to dynamic-wind must be a procedure", w.after))
+	}
+	w.dynamic.wind(before, after)
+	return w.unwind(w.call(w.thunk, w.unwind))
+}
+
+// unwind removes the thunks and calls after once thunk has returned v.
+func (w *windCall) unwind(v Value) Value {
+	w.dynamic.winders = w.dynamic.winders.outer
+	w.call(w.after, func(Value) Value { return v })
+	return v
+}
+
+// call calls the thunk p. If a continuation is captured during the call, rest
+// is saved as the rest of the call to dynamic-wind.
+func (w *windCall) call(p Value, rest walkerFrame) Value {
+	return callWalker(w.dynamic, p, nil, rest)
+}
+
+// walkerCallWithValues returns call-with-values bound to d for a call by the
+// tree-walking evaluator. The producer is called by the evaluator rather than
+// by a VM, so that the continuations that are captured during the call include
+// the call to the consumer.
+func walkerCallWithValues(d *dynamicEnv) Procedure {
+	return ProcedureFunc(func(args Vector) Value {
+		if len(args) != 2 {
+			panic("call-with-values expects 2 arguments")
+		}
+		consume := func(v Value) Value {
+			return callWalker(d, args[1], spreadValues(v), nil)
+		}
+		return consume(callWalker(d, args[0], nil, consume))
+	})
+}
+
+// callWalker applies p to args for a call by the tree-walking evaluator. If a
+// continuation is captured during the call, rest is saved as the rest of the
+// caller's work.
+func callWalker(d *dynamicEnv, p Value, args Vector, rest walkerFrame) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			if rest != nil {
+				x = saveFrames(x, rest)
+			}
+			panic(x)
+		}
+	}()
+	proc, ok := p.(Procedure)
+	if !ok {
+		panic(NewError("value is not a procedure", p))
+	}
+	return forceTail(&tailCall{name: procedureName(nil, proc), p: bindWalker(proc, d), args: args, budget: d.currentBudget()})
+}
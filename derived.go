@@ -0,0 +1,524 @@
+package loom
+
+// deriveOnce rewrites a use of the derived expression special in terms of
+// simpler expressions, as in section 7.3 of R7RS. Unlike the expander, which
+// expands a derived expression and its subforms to the core language in one
+// pass, deriveOnce performs a single step: the subforms of e are not expanded,
+// and the result may itself be a derived expression. The keywords and
+// procedures that the rewrite inserts are builtin identifiers, and the
+// variables that it introduces are temporaries. The second result is false if
+// special does not name a derived expression. The auxiliary syntax else and =>
+// is recognized by binding using aux.
+func deriveOnce(e *Pair, special Symbol, aux auxiliary) (Value, bool) {
+	defer recoverAt(e.pos)
+
+	switch special {
+	case "quasiquote":
+		arg, ok := e.cdr.(*Pair)
+		if !ok || arg.cdr != nil {
+			panic("quasiquote must be of the form (quasiquote ⟨qq template⟩)")
+		}
+		return expandQuasiquote(arg.car), true
+	case "cond":
+		return deriveCond(e, aux), true
+	case "case":
+		return deriveCase(e, aux), true
+	case "and":
+		return deriveAnd(e), true
+	case "or":
+		return deriveOr(e), true
+	case "let":
+		return deriveLet(e), true
+	case "let*":
+		return deriveLetStar(e), true
+	case "letrec", "letrec*":
+		return deriveLetrec(e), true
+	case "receive":
+		return deriveReceive(e), true
+	case "let-values":
+		return deriveLetValues(e), true
+	case "let*-values":
+		return deriveLetStarValues(e), true
+	case "define-values":
+		return deriveDefineValues(e), true
+	case "do":
+		return deriveDo(e), true
+	case "when", "unless":
+		return deriveWhen(e, special == "unless"), true
+	case "case-lambda":
+		return deriveCaseLambda(e), true
+	case "guard":
+		return deriveGuard(e, aux), true
+	}
+	return e, false
+}
+
+// An auxiliary returns true if the symbol or identifier v refers to the
+// auxiliary syntax name (else or =>) where it occurs, i.e. if v is not bound
+// to a variable or keyword that hides the auxiliary syntax.
+type auxiliary func(v Value, name Symbol) bool
+
+// derivedForm returns a list attributed to the source position of e whose
+// head is the builtin identifier name.
+func derivedForm(e *Pair, name Symbol, elements ...Value) Value {
+	return sourceList(e, append([]Value{builtin(name)}, elements...)...)
+}
+
+// derivedSequence returns an expression that evaluates exprs in order.
+func derivedSequence(e *Pair, exprs []Value) Value {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return derivedForm(e, "begin", exprs...)
+}
+
+// derivedLambda returns a lambda expression with the given formals and body.
+func derivedLambda(e *Pair, formals Value, body ...Value) Value {
+	return derivedForm(e, "lambda", append([]Value{formals}, body...)...)
+}
+
+// derivedUnspecified returns an expression whose value is unspecified.
+func derivedUnspecified(e *Pair) Value {
+	return derivedForm(e, "if", Boolean(false), Boolean(false))
+}
+
+// (cond ⟨clause1⟩ ⟨clause2⟩ ...)
+//
+//	(cond)                                => (if #f #f)
+//	(cond (else ⟨expression⟩ ...))        => (begin ⟨expression⟩ ...)
+//	(cond (⟨test⟩) ⟨clause⟩ ...)          => (or ⟨test⟩ (cond ⟨clause⟩ ...))
+//	(cond (⟨test⟩ => ⟨receiver⟩) ⟨clause⟩ ...)
+//	  => (let ((t ⟨test⟩)) (if t (⟨receiver⟩ t) (cond ⟨clause⟩ ...)))
+//	(cond (⟨test⟩ ⟨expression⟩ ...) ⟨clause⟩ ...)
+//	  => (if ⟨test⟩ (begin ⟨expression⟩ ...) (cond ⟨clause⟩ ...))
+//
+// The last clause has no alternative.
+func deriveCond(e *Pair, aux auxiliary) Value {
+	const invalidClause = "cond clause must be of the form (⟨test⟩ ⟨expression1⟩ ...), (⟨test⟩ => ⟨expression⟩), or (else ⟨expression1⟩ ⟨expression2⟩ ...)"
+
+	clauses := listElements(e.cdr, invalidClause)
+	if len(clauses) == 0 {
+		return derivedUnspecified(e)
+	}
+	clause, ok := clauses[0].(*Pair)
+	if !ok {
+		panic(invalidClause)
+	}
+	exprs := listElements(clause.cdr, invalidClause)
+
+	last := len(clauses) == 1
+	if last && aux(clause.car, "else") {
+		return derivedSequence(clause, exprs)
+	}
+
+	var rest []Value
+	if !last {
+		rest = []Value{derivedForm(e, "cond", clauses[1:]...)}
+	}
+	switch {
+	case len(exprs) == 0:
+		return derivedForm(clause, "or", append([]Value{clause.car}, rest...)...)
+	case aux(exprs[0], "=>"):
+		if len(exprs) != 2 {
+			panic("clause must be of the form (⟨test⟩ => ⟨expression⟩)")
+		}
+		t := temporary("t")
+		test := derivedForm(clause, "if", append([]Value{t, sourceList(clause, exprs[1], t)}, rest...)...)
+		return derivedForm(clause, "let", list(list(t, clause.car)), test)
+	default:
+		return derivedForm(clause, "if", append([]Value{clause.car, derivedSequence(clause, exprs)}, rest...)...)
+	}
+}
+
+// (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)
+//
+// The case form is rewritten to a cond form that tests the key for membership
+// in each clause's data with memv:
+//
+//	(let ((key ⟨key⟩))
+//	  (cond ((memv key '(⟨datum⟩ ...)) ⟨expression⟩ ...) ...))
+//
+// The body of a clause of the form (⟨data⟩ => ⟨receiver⟩) is (⟨receiver⟩ key).
+func deriveCase(e *Pair, aux auxiliary) Value {
+	const invalidClause = "case clause must be of the form ((⟨datum1⟩ ...) ⟨expression1⟩ ⟨expression2⟩ ...), ((⟨datum1⟩ ...) => ⟨expression⟩), (else ⟨expression1⟩ ⟨expression2⟩ ...), or (else => ⟨expression⟩)."
+
+	keyp, ok := e.cdr.(*Pair)
+	if !ok {
+		panic("case must be of the form (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)")
+	}
+
+	key := temporary("key")
+	clauses := listElements(keyp.cdr, invalidClause)
+	for i, c := range clauses {
+		clause, ok := c.(*Pair)
+		if !ok {
+			panic(invalidClause)
+		}
+
+		exprs := listElements(clause.cdr, invalidClause)
+		if len(exprs) != 0 && aux(exprs[0], "=>") {
+			if len(exprs) != 2 {
+				panic("clause must be of the form (⟨data⟩ => ⟨expression⟩)")
+			}
+			exprs = []Value{sourceList(clause, exprs[1], key)}
+		}
+
+		test := clause.car
+		if i != len(clauses)-1 || !aux(clause.car, "else") {
+			test = derivedForm(clause, "memv", key, derivedForm(clause, "quote", clause.car))
+		}
+		clauses[i] = sourceList(clause, append([]Value{test}, exprs...)...)
+	}
+
+	return derivedForm(e, "let", list(list(key, keyp.car)), derivedForm(e, "cond", clauses...))
+}
+
+// (and ⟨test1⟩ ...)
+//
+//	(and)                   => #t
+//	(and ⟨test⟩)            => ⟨test⟩
+//	(and ⟨test⟩ ⟨rest⟩ ...) => (if ⟨test⟩ (and ⟨rest⟩ ...) #f)
+func deriveAnd(e *Pair) Value {
+	tests := listElements(e.cdr, "and must be of the form (and ⟨test1⟩ ...)")
+	switch len(tests) {
+	case 0:
+		return Boolean(true)
+	case 1:
+		return tests[0]
+	default:
+		return derivedForm(e, "if", tests[0], derivedForm(e, "and", tests[1:]...), Boolean(false))
+	}
+}
+
+// (or ⟨test1⟩ ...)
+//
+//	(or)                   => #f
+//	(or ⟨test⟩)            => ⟨test⟩
+//	(or ⟨test⟩ ⟨rest⟩ ...) => (let ((t ⟨test⟩)) (if t t (or ⟨rest⟩ ...)))
+func deriveOr(e *Pair) Value {
+	tests := listElements(e.cdr, "or must be of the form (or ⟨test1⟩ ...)")
+	switch len(tests) {
+	case 0:
+		return Boolean(false)
+	case 1:
+		return tests[0]
+	default:
+		t := temporary("t")
+		return derivedForm(e, "let", list(list(t, tests[0])), derivedForm(e, "if", t, t, derivedForm(e, "or", tests[1:]...)))
+	}
+}
+
+// (let ⟨bindings⟩ ⟨body⟩)
+// (let ⟨variable⟩ ⟨bindings⟩ ⟨body⟩)
+//
+//	(let ((⟨variable⟩ ⟨init⟩) ...) ⟨body⟩) => ((lambda (⟨variable⟩ ...) ⟨body⟩) ⟨init⟩ ...)
+//	(let ⟨name⟩ ((⟨variable⟩ ⟨init⟩) ...) ⟨body⟩)
+//	  => ((letrec ((⟨name⟩ (lambda (⟨variable⟩ ...) ⟨body⟩))) ⟨name⟩) ⟨init⟩ ...)
+func deriveLet(e *Pair) Value {
+	const invalidLet = "let must be of the form (let ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) == 0 {
+		panic(invalidLet)
+	}
+
+	var name Value
+	if isVariable(args[0]) {
+		name, args = args[0], args[1:]
+	}
+	if len(args) < 2 {
+		panic(invalidLet)
+	}
+	variables, inits, ok := bindingForms(args[0])
+	if !ok {
+		panic(invalidLet)
+	}
+
+	proc := derivedLambda(e, list(variables...), args[1:]...)
+	if name != nil {
+		proc = derivedForm(e, "letrec", list(list(name, proc)), name)
+	}
+	return sourceList(e, append([]Value{proc}, inits...)...)
+}
+
+// (let* ⟨bindings⟩ ⟨body⟩)
+//
+//	(let* () ⟨body⟩)                     => (let () ⟨body⟩)
+//	(let* (⟨binding⟩ ⟨rest⟩ ...) ⟨body⟩) => (let (⟨binding⟩) (let* (⟨rest⟩ ...) ⟨body⟩))
+func deriveLetStar(e *Pair) Value {
+	const invalidLetStar = "let* must be of the form (let* ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetStar)
+	}
+	if _, _, ok := bindingForms(args[0]); !ok {
+		panic(invalidLetStar)
+	}
+
+	bindings, _ := args[0].(*Pair)
+	if bindings == nil {
+		return derivedForm(e, "let", append([]Value{nil}, args[1:]...)...)
+	}
+	rest := derivedForm(e, "let*", append([]Value{bindings.cdr}, args[1:]...)...)
+	return derivedForm(e, "let", list(bindings.car), rest)
+}
+
+// (letrec ⟨bindings⟩ ⟨body⟩)
+// (letrec* ⟨bindings⟩ ⟨body⟩)
+//
+// Both forms are rewritten to internal definitions, which have the semantics
+// of letrec*:
+//
+//	(let () (define ⟨variable⟩ ⟨init⟩) ... (let () ⟨body⟩))
+func deriveLetrec(e *Pair) Value {
+	keyword, _ := symbolName(e.car)
+	invalidLetrec := string(keyword) + " must be of the form (" + string(keyword) + " ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetrec)
+	}
+	variables, inits, ok := bindingForms(args[0])
+	if !ok {
+		panic(invalidLetrec)
+	}
+
+	forms := []Value{nil}
+	for i, v := range variables {
+		forms = append(forms, derivedForm(e, "define", v, inits[i]))
+	}
+	forms = append(forms, derivedForm(e, "let", append([]Value{nil}, args[1:]...)...))
+	return derivedForm(e, "let", forms...)
+}
+
+// (receive ⟨formals⟩ ⟨expression⟩ ⟨body⟩)
+//
+//	=> (call-with-values (lambda () ⟨expression⟩) (lambda ⟨formals⟩ ⟨body⟩))
+func deriveReceive(e *Pair) Value {
+	args := e.ToVector()[1:]
+	if len(args) < 3 {
+		panic("receive must be of the form (receive ⟨formals⟩ ⟨expression⟩ ⟨body⟩)")
+	}
+	return derivedForm(e, "call-with-values", derivedLambda(e, nil, args[1]), derivedLambda(e, args[0], args[2:]...))
+}
+
+// (let-values ⟨mv binding spec⟩ ⟨body⟩)
+//
+// The values of the first ⟨init⟩ are received by temporaries with the same
+// shape as its ⟨formals⟩, and the variables of the ⟨formals⟩ are bound to the
+// temporaries within the remaining bindings:
+//
+//	(let-values () ⟨body⟩) => (let () ⟨body⟩)
+//	(let-values ((⟨formals⟩ ⟨init⟩) ⟨binding⟩ ...) ⟨body⟩)
+//	  => (call-with-values (lambda () ⟨init⟩)
+//	       (lambda ⟨temporaries⟩
+//	         (let-values (⟨binding⟩ ...)
+//	           (let ((⟨variable⟩ ⟨temporary⟩) ...) ⟨body⟩))))
+//
+// A let-values form with a single binding is rewritten to a receive form.
+func deriveLetValues(e *Pair) Value {
+	const invalidLetValues = "let-values must be of the form (let-values ((⟨formals1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetValues)
+	}
+	formals, inits, ok := formalsBindingForms(args[0])
+	if !ok {
+		panic(invalidLetValues)
+	}
+	for _, f := range formals {
+		makeFormals(f)
+	}
+
+	switch len(formals) {
+	case 0:
+		return derivedForm(e, "let", append([]Value{nil}, args[1:]...)...)
+	case 1:
+		return derivedForm(e, "receive", append([]Value{formals[0], inits[0]}, args[1:]...)...)
+	}
+
+	receiver, temps := temporaries(formals[0])
+	variables := formalVariables(formals[0])
+	bindings := make([]Value, len(variables))
+	for i, v := range variables {
+		bindings[i] = list(v, temps[i])
+	}
+	body := derivedForm(e, "let", append([]Value{list(bindings...)}, args[1:]...)...)
+	rest := derivedForm(e, "let-values", args[0].(*Pair).cdr, body)
+	return derivedForm(e, "call-with-values", derivedLambda(e, nil, inits[0]), derivedLambda(e, receiver, rest))
+}
+
+// (let*-values ⟨mv binding spec⟩ ⟨body⟩)
+//
+//	(let*-values () ⟨body⟩) => (let () ⟨body⟩)
+//	(let*-values (⟨binding⟩ ⟨rest⟩ ...) ⟨body⟩)
+//	  => (let-values (⟨binding⟩) (let*-values (⟨rest⟩ ...) ⟨body⟩))
+func deriveLetStarValues(e *Pair) Value {
+	const invalidLetStarValues = "let*-values must be of the form (let*-values ((⟨formals1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetStarValues)
+	}
+	if _, _, ok := formalsBindingForms(args[0]); !ok {
+		panic(invalidLetStarValues)
+	}
+
+	bindings, _ := args[0].(*Pair)
+	if bindings == nil {
+		return derivedForm(e, "let", append([]Value{nil}, args[1:]...)...)
+	}
+	rest := derivedForm(e, "let*-values", append([]Value{bindings.cdr}, args[1:]...)...)
+	return derivedForm(e, "let-values", list(bindings.car), rest)
+}
+
+// (define-values ⟨formals⟩ ⟨expression⟩)
+//
+//	=> (begin
+//	     (define ⟨variable⟩ (if #f #f)) ...
+//	     (call-with-values (lambda () ⟨expression⟩)
+//	       (lambda ⟨temporaries⟩ (set! ⟨variable⟩ ⟨temporary⟩) ...)))
+func deriveDefineValues(e *Pair) Value {
+	args := e.ToVector()
+	if len(args) != 3 {
+		panic("define-values must be of the form (define-values ⟨formals⟩ ⟨expression⟩)")
+	}
+	makeFormals(args[1])
+
+	receiver, temps := temporaries(args[1])
+	forms := []Value{}
+	assignments := []Value{derivedUnspecified(e)}
+	if len(temps) != 0 {
+		assignments = make([]Value, len(temps))
+	}
+	for i, v := range formalVariables(args[1]) {
+		forms = append(forms, derivedForm(e, "define", v, derivedUnspecified(e)))
+		assignments[i] = derivedForm(e, "set!", v, temps[i])
+	}
+	forms = append(forms, derivedForm(e, "call-with-values", derivedLambda(e, nil, args[2]), derivedLambda(e, receiver, assignments...)))
+	return derivedForm(e, "begin", forms...)
+}
+
+// (do ((⟨variable1⟩ ⟨init1⟩ ⟨step1⟩) ...) (⟨test⟩ ⟨expression⟩ ...) ⟨command⟩ ...)
+//
+//	=> (letrec ((loop (lambda (⟨variable1⟩ ...)
+//	                    (if ⟨test⟩
+//	                        (begin ⟨expression⟩ ...)
+//	                        (begin ⟨command⟩ ... (loop ⟨step1⟩ ...))))))
+//	     (loop ⟨init1⟩ ...))
+//
+// A variable without a ⟨step⟩ is passed to the next iteration unchanged.
+func deriveDo(e *Pair) Value {
+	const invalidDo = "do must be of the form (do ((⟨variable1⟩ ⟨init1⟩ ⟨step1⟩) ...) (⟨test⟩ ⟨expression⟩ ...) ⟨command⟩ ...)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidDo)
+	}
+
+	var variables, inits, steps []Value
+	for _, spec := range listElements(args[0], invalidDo) {
+		parts := listElements(spec, invalidDo)
+		if len(parts) < 2 || len(parts) > 3 || !isVariable(parts[0]) {
+			panic(invalidDo)
+		}
+		step := parts[0]
+		if len(parts) == 3 {
+			step = parts[2]
+		}
+		variables, inits, steps = append(variables, parts[0]), append(inits, parts[1]), append(steps, step)
+	}
+	exit, ok := args[1].(*Pair)
+	if !ok {
+		panic(invalidDo)
+	}
+
+	loop := temporary("do")
+	result := derivedUnspecified(exit)
+	if exprs := listElements(exit.cdr, invalidDo); len(exprs) != 0 {
+		result = derivedSequence(exit, exprs)
+	}
+	next := sourceList(e, append([]Value{loop}, steps...)...)
+	body := derivedForm(e, "if", exit.car, result, derivedSequence(e, append(args[2:], next)))
+	proc := derivedLambda(e, list(variables...), body)
+	return derivedForm(e, "letrec", list(list(loop, proc)), sourceList(e, append([]Value{loop}, inits...)...))
+}
+
+// (when ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)
+// (unless ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)
+//
+//	(when ⟨test⟩ ⟨expression⟩ ...)   => (if ⟨test⟩ (begin ⟨expression⟩ ...))
+//	(unless ⟨test⟩ ⟨expression⟩ ...) => (if ⟨test⟩ (if #f #f) (begin ⟨expression⟩ ...))
+func deriveWhen(e *Pair, unless bool) Value {
+	keyword, _ := symbolName(e.car)
+	invalidWhen := string(keyword) + " must be of the form (" + string(keyword) + " ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)"
+
+	args := listElements(e.cdr, invalidWhen)
+	if len(args) < 2 {
+		panic(invalidWhen)
+	}
+
+	body := derivedSequence(e, args[1:])
+	if unless {
+		return derivedForm(e, "if", args[0], derivedUnspecified(e), body)
+	}
+	return derivedForm(e, "if", args[0], body)
+}
+
+// (case-lambda ⟨clause⟩ ...)
+//
+//	=> (make-case-lambda (lambda ⟨formals⟩ ⟨body⟩) ...)
+func deriveCaseLambda(e *Pair) Value {
+	const invalidCaseLambda = "case-lambda must be of the form (case-lambda (⟨formals⟩ ⟨body⟩) ...)"
+
+	clauses := listElements(e.cdr, invalidCaseLambda)
+	for i, c := range clauses {
+		clause, ok := c.(*Pair)
+		if !ok || clause.cdr == nil {
+			panic(invalidCaseLambda)
+		}
+		clauses[i] = derivedLambda(clause, clause.car, listElements(clause.cdr, invalidCaseLambda)...)
+	}
+	return derivedForm(e, "make-case-lambda", clauses...)
+}
+
+// (guard (⟨variable⟩ ⟨cond clause1⟩ ⟨cond clause2⟩ ...) ⟨body⟩)
+//
+//	=> (call-with-guard (lambda () ⟨body⟩)
+//	     (lambda (⟨variable⟩) (cond ⟨cond clause⟩ ... (else guard-no-match))))
+//
+// The else clause is added only if the last clause is not an else clause. The
+// clauses are in the scope of ⟨variable⟩, which hides any auxiliary syntax of
+// the same name.
+func deriveGuard(e *Pair, aux auxiliary) Value {
+	const invalidGuard = "guard must be of the form (guard (⟨variable⟩ ⟨cond clause1⟩ ⟨cond clause2⟩ ...) ⟨body⟩)"
+
+	args, ok := e.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+	spec, ok := args.car.(*Pair)
+	if !ok || !isVariable(spec.car) {
+		panic(invalidGuard)
+	}
+	body, ok := args.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+
+	variable, _ := symbolName(spec.car)
+	isElse := func(v Value) bool {
+		clause, ok := v.(*Pair)
+		return ok && variable != "else" && aux(clause.car, "else")
+	}
+
+	clauses := listElements(spec.cdr, invalidGuard)
+	if n := len(clauses); n == 0 || !isElse(clauses[n-1]) {
+		clauses = append(clauses, list(builtin("else"), builtin("guard-no-match")))
+	}
+	thunk := derivedLambda(e, nil, body.ToVector()...)
+	handler := derivedLambda(e, list(spec.car), derivedForm(e, "cond", clauses...))
+	return derivedForm(e, "call-with-guard", thunk, handler)
+}
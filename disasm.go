@@ -0,0 +1,129 @@
+package loom
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+var opcodeNames = [...]string{
+	opQuote:         "quote",
+	opGlobal:        "global",
+	opLocal:         "local",
+	opSetLocal:      "set-local",
+	opIdentifier:    "identifier",
+	opVector:        "vector",
+	opList:          "list",
+	opLambda:        "lambda",
+	opJump:          "jump",
+	opJumpIfFalse:   "jump-if-false",
+	opJumpIfTrue:    "jump-if-true",
+	opDup:           "dup",
+	opSwap:          "swap",
+	opMemv:          "memv",
+	opSet:           "set",
+	opSetIdentifier: "set-identifier",
+	opDefine:        "define",
+	opCall:          "call",
+	opTail:          "tail",
+	opCallValues:    "call-values",
+	opTailValues:    "tail-values",
+	opReturn:        "return",
+	opPop:           "pop",
+	opDefineSyntax:  "define-syntax",
+	opExpand:        "expand",
+	opContinuation:  "continuation",
+	opEscape:        "escape",
+	opWind:          "wind",
+	opUnwind:        "unwind",
+}
+
+func (op opcode) String() string {
+	if int(op) < len(opcodeNames) {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("opcode(%d)", int(op))
+}
+
+// Disassemble writes a listing of the bytecode of a procedure compiled by the
+// VM backend to w. The listing includes the bytecode of each lambda expression
+// within the procedure. Disassemble returns an error if v is not a compiled
+// procedure.
+func Disassemble(w io.Writer, v Value) error {
+	closure, ok := v.(*compiledClosure)
+	if !ok {
+		return NewError("only procedures compiled by the VM can be disassembled", v)
+	}
+
+	procs := []*compiledProcedure{closure.proc}
+	for i := 0; i < len(procs); i++ {
+		if i != 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+
+		text, nested := disassemble(procs[i])
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+		procs = append(procs, nested...)
+	}
+	return nil
+}
+
+// disassemble returns the listing of a single procedure and the procedures
+// created by its lambda instructions.
+func disassemble(proc *compiledProcedure) (string, []*compiledProcedure) {
+	var b strings.Builder
+
+	formals := make([]string, len(proc.formals))
+	for i, f := range proc.formals {
+		formals[i] = EncodeToString(f)
+	}
+	if proc.isVariadic {
+		formals[len(formals)-1] = ". " + formals[len(formals)-1]
+	}
+	name := string(proc.name)
+	if name == "" {
+		name = "<anonymous>"
+	}
+	fmt.Fprintf(&b, "%v (%v)\n", name, strings.Join(formals, " "))
+
+	var nested []*compiledProcedure
+	for pc, inst := range proc.body {
+		var operand string
+		switch imm := inst.immediate.(type) {
+		case integer:
+			operand = fmt.Sprint(int(imm))
+		case local:
+			operand = fmt.Sprintf("%d %d", imm.depth, imm.index)
+		case *compiledProcedure:
+			operand, nested = string(imm.name), append(nested, imm)
+		case *macroUse:
+			operand = EncodeToString(imm.form)
+		default:
+			switch inst.code {
+			case opDup, opSwap, opPop, opReturn, opTailValues, opCallValues, opContinuation, opEscape, opWind, opUnwind:
+			default:
+				operand = EncodeToString(imm)
+			}
+		}
+
+		var comments []string
+		if name, ok := proc.names[pc]; ok {
+			comments = append(comments, EncodeToString(name))
+		}
+		if pos := proc.position(pc); pos != nil && pos.IsValid() {
+			comments = append(comments, pos.String())
+		}
+
+		line := fmt.Sprintf("%5d  %-14v %v", pc, inst.code, operand)
+		if len(comments) != 0 {
+			line = fmt.Sprintf("%-40v ; %v", line, strings.Join(comments, " "))
+		}
+		b.WriteString(strings.TrimRight(line, " "))
+		b.WriteString("\n")
+	}
+	return b.String(), nested
+}
@@ -12,10 +12,15 @@ func Eqv(args Vector) Value {
 
 func eqv(obj1, obj2 Value) bool {
 	// The only type we need to treat specially is the Number type. All other
-	// types already obey the spec when compared for equality.
+	// types already obey the spec when compared for equality. Numbers are
+	// equivalent if they have the same exactness and are numerically equal.
 	if num1, ok := obj1.(Number); ok {
 		num2, ok := obj2.(Number)
-		return ok && num1.f.Cmp(num2.f) == 0
+		if !ok || num1.IsExact() != num2.IsExact() {
+			return false
+		}
+		c, ok := compare(num1, num2)
+		return ok && c == 0
 	}
 
 	return obj1 == obj2
@@ -47,6 +52,14 @@ func equal(obj1, obj2 Value, stack map[Value]struct{}) bool {
 
 	// TODO: handle self-referential data
 
+	// identifiers inserted by macro expansions are equal to their symbols
+	if id, ok := obj1.(*identifier); ok {
+		return equal(id.name, obj2, stack)
+	}
+	if id, ok := obj2.(*identifier); ok {
+		return equal(obj1, id.name, stack)
+	}
+
 	switch obj1 := obj1.(type) {
 	case *Pair:
 		obj2, ok := obj2.(*Pair)
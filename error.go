@@ -0,0 +1,276 @@
+package loom
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Error describes a failure that occurred during evaluation. An Error is also
+// the representation of Scheme error objects.
+type Error struct {
+	// Position is the source position at which the failure occurred, if known.
+	Position Position
+	// Procedure is the name of the procedure that failed, if known.
+	Procedure Symbol
+	// Message describes the failure.
+	Message string
+	// Irritants holds the values that caused the failure, if any.
+	Irritants Vector
+	// Stack describes the procedure calls that were active when the failure
+	// occurred, innermost first.
+	Stack []StackFrame
+
+	kind     errorKind
+	raised   bool  // true if the error carries a non-error object passed to raise
+	signaled bool  // true if the error has been passed to an exception handler
+	named    bool  // true if the message names the procedure that failed
+	cause    error // the Go error that caused the failure, if any
+}
+
+// A StackFrame describes a procedure call that was active when a failure
+// occurred.
+type StackFrame struct {
+	// Procedure is the name by which the procedure was called, if known.
+	Procedure Symbol
+	// Position is the source position of the call, if known.
+	Position Position
+}
+
+// String returns a string of the form "procedure (position)".
+func (f StackFrame) String() string {
+	name := string(f.Procedure)
+	if name == "" {
+		name = "<anonymous>"
+	}
+	if !f.Position.IsValid() {
+		return name
+	}
+	return fmt.Sprintf("%v (%v)", name, f.Position)
+}
+
+type errorKind byte
+
+const (
+	genericError   errorKind = iota
+	readError                // an error signaled by the reader
+	fileError                // an error signaled while opening a file
+	interruptError           // an error that interrupts evaluation, e.g. due to cancellation
+	exitError                // an error that terminates evaluation due to a call to exit
+	jumpError                // an error that unwinds the stack to the VM that resumes a continuation
+)
+
+// uncatchable returns true if the error cannot be handled by Scheme exception
+// handlers.
+func (e *Error) uncatchable() bool {
+	return e.kind == interruptError || e.kind == exitError || e.kind == jumpError
+}
+
+// unwinds returns true if the dynamic-wind after thunks that are active when
+// the error occurs are called as the error propagates. Interruptions and
+// emergency exits leave the active calls without calling their after thunks.
+func (e *Error) unwinds() bool {
+	if e.kind == interruptError {
+		return false
+	}
+	var exit *ExitError
+	return !errors.As(e, &exit) || !exit.Emergency
+}
+
+// NewError returns a new error with the given message and irritants. Host
+// procedures may panic with the result in order to report a failure.
+func NewError(message string, irritants ...Value) *Error {
+	return &Error{Message: message, Irritants: irritants}
+}
+
+// newNamedError returns a new error whose message names the procedure that
+// failed, e.g. "the argument to char-upcase must be a character". Error does
+// not repeat the name of the procedure.
+func newNamedError(message string, irritants ...Value) *Error {
+	return &Error{Message: message, Irritants: irritants, named: true}
+}
+
+// raisedError returns an error that carries an object passed to raise. If the
+// object is itself an error object, it is returned as-is.
+func raisedError(obj Value) *Error {
+	if err, ok := obj.(*Error); ok {
+		return err
+	}
+	return &Error{Message: "uncaught exception", Irritants: Vector{obj}, raised: true}
+}
+
+// payload returns the object that is passed to exception handlers for the
+// error: the object passed to raise, or the error itself.
+func (e *Error) payload() Value {
+	if e.raised {
+		return e.Irritants[0]
+	}
+	return e
+}
+
+func (e *Error) MarshalSExp() SExpression {
+	return Symbol("<error object>")
+}
+
+// Unwrap returns the Go error that caused the failure, if any.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Error returns a string of the form "position: procedure: message: irritants".
+// Each part is omitted if it is not known. The procedure is also omitted if
+// the message already names it, e.g. "the first argument to car must be a pair".
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Position.IsValid() {
+		b.WriteString(e.Position.String())
+		b.WriteString(": ")
+	}
+	if p := string(e.Procedure); p != "" && !e.named {
+		b.WriteString(p)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Message)
+	for i, v := range e.Irritants {
+		if i == 0 {
+			b.WriteString(":")
+		}
+		b.WriteString(" ")
+		Encode(&b, v)
+	}
+	return b.String()
+}
+
+// toError converts a recovered panic value into an *Error. Builtin procedures
+// panic with a string to report a failure whose message names the procedure,
+// e.g. "car expects 1 argument", and with an *Error or a Go error otherwise.
+func toError(x interface{}) *Error {
+	switch x := x.(type) {
+	case *Error:
+		return x
+	case string:
+		return &Error{Message: x, named: true}
+	case error:
+		var pathErr *os.PathError
+		if errors.As(x, &pathErr) {
+			return &Error{Message: x.Error(), kind: fileError, cause: x}
+		}
+		return &Error{Message: x.Error(), cause: x}
+	default:
+		return &Error{Message: fmt.Sprint(x)}
+	}
+}
+
+// recoverAt converts any panic that is propagating into an *Error and
+// attributes it to the given source position unless a more specific position
+// has already been identified. recoverAt must be invoked directly by a defer
+// statement.
+func recoverAt(pos *Position) {
+	if x := recover(); x != nil {
+		err := toError(x)
+		if !err.Position.IsValid() && pos != nil {
+			err.Position = *pos
+		}
+		panic(err)
+	}
+}
+
+// apply applies the call's procedure to its arguments. Any failure that occurs
+// during the application is converted to an *Error and attributed to the call's
+// procedure and source position unless more specific information has already
+// been identified. Calls to Scheme procedures are recorded in the error's
+// stack.
+//
+// Tail calls to Scheme procedures in the body of a Scheme procedure are
+// returned to the caller so that the Go stack does not grow. Tail calls to
+// other procedures are applied as part of the call, as they are by the VM.
+func (t *tailCall) apply() Value {
+	defer t.recover()
+	t.budget.step()
+	if cl, ok := t.p.(*caseLambda); ok {
+		t.p = cl.clause(t.args)
+	}
+	p, ok := t.p.(*procedure)
+	if !ok {
+		return t.p.Apply(t.args)
+	}
+	return t.forceHost(t.applyScheme(p))
+}
+
+// recover attributes a failure that occurs during the call to the call's
+// procedure and source position.
+func (t *tailCall) recover() {
+	if x := recover(); x != nil {
+		err := toError(x)
+		if err.Procedure == "" {
+			err.Procedure = t.name
+		}
+		if !err.Position.IsValid() && t.pos != nil {
+			err.Position = *t.pos
+		}
+		if _, ok := t.p.(*procedure); ok {
+			frame := StackFrame{Procedure: t.name}
+			if t.pos != nil {
+				frame.Position = *t.pos
+			}
+			err.Stack = append(err.Stack, frame)
+		}
+		panic(err)
+	}
+}
+
+// applyScheme applies p, the Scheme procedure of the call, to the call's
+// arguments. If a continuation is captured during the application, the rest
+// of the call is saved as the rest of the caller's work.
+func (t *tailCall) applyScheme(p *procedure) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, t.resume))
+		}
+	}()
+	return p.apply(t.args)
+}
+
+// forceHost applies the tail calls to procedures other than Scheme procedures
+// that are returned by the call's procedure.
+func (t *tailCall) forceHost(v Value) Value {
+	for {
+		tail, ok := v.(*tailCall)
+		if !ok || tail.isScheme() {
+			return v
+		}
+		v = t.applyHost(tail)
+	}
+}
+
+// applyHost applies tail, a tail call to a procedure other than a Scheme
+// procedure that is returned by the call's procedure. If a continuation is
+// captured during the application, the rest of the call is saved as the rest
+// of the caller's work.
+func (t *tailCall) applyHost(tail *tailCall) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, t.resume))
+		}
+	}()
+	return tail.apply()
+}
+
+// resume resumes the rest of the call once its procedure has returned v.
+func (t *tailCall) resume(v Value) Value {
+	defer t.recover()
+	return t.forceHost(v)
+}
+
+// procedureName returns the name by which p is referred to in the operator
+// position of an application.
+func procedureName(operator Value, p Procedure) Symbol {
+	if sym, ok := operator.(Symbol); ok {
+		return sym
+	}
+	if sym, ok := p.MarshalSExp().(Symbol); ok {
+		return sym
+	}
+	return ""
+}
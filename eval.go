@@ -1,7 +1,12 @@
 package loom
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 // scope
@@ -9,6 +14,12 @@ type scope struct {
 	env    map[Symbol]Value
 	syntax map[Symbol]*syntaxRules
 	outer  *scope
+
+	// slots holds the values of the variables that the compiler has resolved to
+	// lexical addresses in this scope.
+	slots []Value
+
+	dynamicEnv *dynamicEnv // the dynamic environment for evaluations in this scope, if any
 }
 
 func (s *scope) where(name Symbol) *scope {
@@ -26,16 +37,26 @@ func (s *scope) bound(name Symbol) bool {
 }
 
 func (s *scope) set(name Symbol, v Value) {
+	if s.env == nil {
+		s.env = map[Symbol]Value{}
+	}
 	s.env[name] = v
 }
 
+// setIfBound assigns v to the innermost binding of name, if any. The builtin
+// bindings are never modified: assigning to a builtin instead defines name in
+// the global scope that encloses s.
 func (s *scope) setIfBound(name Symbol, v Value) bool {
-	for s != nil {
+	var globals *scope
+	for ; s != nil; globals, s = s, s.outer {
 		if _, ok := s.env[name]; ok {
-			s.env[name] = v
+			if s == globalScope {
+				globals.set(name, v)
+			} else {
+				s.env[name] = v
+			}
 			return true
 		}
-		s = s.outer
 	}
 	return false
 }
@@ -61,9 +82,31 @@ func (s *scope) lookupKeyword(name Symbol) (*syntaxRules, bool) {
 }
 
 func (s *scope) setKeyword(name Symbol, v *syntaxRules) {
+	if s.syntax == nil {
+		s.syntax = map[Symbol]*syntaxRules{}
+	}
 	s.syntax[name] = v
 }
 
+// dynamic returns the dynamic environment for evaluations in the scope.
+func (s *scope) dynamic() *dynamicEnv {
+	for s != nil {
+		if s.dynamicEnv != nil {
+			return s.dynamicEnv
+		}
+		s = s.outer
+	}
+	return nil
+}
+
+// outerN returns the scope n levels out from s.
+func (s *scope) outerN(n int) *scope {
+	for ; n > 0; n-- {
+		s = s.outer
+	}
+	return s
+}
+
 func (s *scope) push() *scope {
 	return &scope{env: map[Symbol]Value{}, syntax: map[Symbol]*syntaxRules{}, outer: s}
 }
@@ -72,12 +115,54 @@ func (s *scope) pop() *scope {
 	return s.outer
 }
 
+// A Backend selects the engine that an Env uses to evaluate expressions.
+type Backend int
+
+const (
+	// VM compiles each expression to bytecode and executes it with the virtual
+	// machine. This is the default backend.
+	VM Backend = iota
+	// TreeWalker evaluates each expression by walking its syntax tree.
+	TreeWalker
+)
+
+// An Env is an environment in which expressions are evaluated.
+//
+// Each Env returned by NewEnv has its own global scope, which holds the
+// variables and keywords defined by evaluations in the Env. The global scope is
+// layered over the builtin procedures, which are shared by all environments and
+// never modified.
+//
+// An Env is not safe for concurrent use: an Env and the environments derived
+// from it by With, WithBackend, and WithBudget must be used by at most one
+// goroutine at a time. Distinct environments returned by NewEnv may be used
+// concurrently, provided that they do not share mutable values.
 type Env struct {
 	globals *scope
+	backend Backend
+	steps   int64
 }
 
+// NewEnv returns a new environment with its own global scope.
 func NewEnv() *Env {
-	return &Env{globals: globalScope}
+	return &Env{globals: newGlobalScope()}
+}
+
+// newGlobalScope returns a new global scope layered over the builtin bindings.
+// Each global scope has its own dynamic environment, which holds the current
+// output port and command line, and its own procedures for accessing them.
+func newGlobalScope() *scope {
+	d := &dynamicEnv{output: newStdoutPort(), commandLine: os.Args}
+
+	env := outputProcedures(d)
+	for name, proc := range processProcedures(d) {
+		env[name] = proc
+	}
+	s := &scope{env: env, dynamicEnv: d, outer: globalScope}
+	for name, proc := range expansionProcedures(s) {
+		env[name] = proc
+	}
+	return s
 }
 
 func (e *Env) With(bindings map[Symbol]Value) *Env {
@@ -85,7 +170,28 @@ func (e *Env) With(bindings map[Symbol]Value) *Env {
 		bindings = map[Symbol]Value{}
 	}
 
-	return &Env{globals: &scope{env: bindings, outer: e.globals}}
+	env := *e
+	env.globals = &scope{env: bindings, outer: e.globals}
+	return &env
+}
+
+// WithBackend returns an environment that shares e's bindings but evaluates
+// expressions using the given backend.
+func (e *Env) WithBackend(backend Backend) *Env {
+	env := *e
+	env.backend = backend
+	return &env
+}
+
+// WithBudget returns an environment that shares e's bindings but limits each
+// evaluation to the given number of steps. A step is a single VM instruction
+// or a single procedure application in the tree-walking evaluator. An
+// evaluation that exhausts its budget fails with an error that wraps
+// ErrBudgetExceeded. If steps is zero or negative, evaluations are not limited.
+func (e *Env) WithBudget(steps int64) *Env {
+	env := *e
+	env.steps = steps
+	return &env
 }
 
 func (e *Env) Bound(name Symbol) bool {
@@ -97,11 +203,108 @@ func (e *Env) Set(name Symbol, v Value) {
 }
 
 func (e *Env) Eval(expression Value) Value {
-	return eval(expression, e.globals, false)
+	return e.eval(context.Background(), expression)
+}
+
+// EvalContext evaluates expression in the environment. If ctx is canceled or
+// its deadline passes before the evaluation completes, the evaluation is
+// interrupted and fails with an error that wraps ctx.Err(). Interruptions
+// cannot be caught by Scheme exception handlers.
+func (e *Env) EvalContext(ctx context.Context, expression Value) (v Value, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			v, err = nil, toError(x)
+		}
+	}()
+	return e.eval(ctx, expression), nil
 }
 
+func (e *Env) eval(ctx context.Context, expression Value) Value {
+	expression = newExpander(e.globals).expandTopLevel(expression)
+
+	evaluate := func() Value {
+		if e.backend == TreeWalker {
+			w := walker{dynamic: e.globals.dynamic(), toplevel: true}
+			return w.run(func() Value { return eval(expression, e.globals, false) })
+		}
+		return evalCompiled(expression, e.globals)
+	}
+
+	d := e.globals.dynamic()
+	outer := d.globals
+	d.globals = e.globals
+	defer func() { d.globals = outer }()
+
+	b := newBudget(ctx, e.steps)
+	if b == nil {
+		return evaluate()
+	}
+	return d.withBudget(b, evaluate)
+}
+
+// EvalErr evaluates expression in the environment. Unlike Eval, any failure
+// that occurs during evaluation is returned as an *Error rather than propagated
+// as a panic.
+func (e *Env) EvalErr(expression Value) (v Value, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			v, err = nil, toError(x)
+		}
+	}()
+	return e.Eval(expression), nil
+}
+
+// EvalAll reads and evaluates each top-level form in r in order. It returns the
+// value of the last form. Evaluation stops at the first error.
+func (e *Env) EvalAll(r io.Reader) (Value, error) {
+	return e.evalReader(NewReader(r))
+}
+
+// Load reads and evaluates each top-level form in the file at path in order.
+// It returns the value of the last form. Evaluation stops at the first error.
+func (e *Env) Load(path string) (Value, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return e.evalReader(NewFileReader(path, f))
+}
+
+func (e *Env) evalReader(r *Reader) (Value, error) {
+	var result Value
+	for {
+		x, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, err
+		}
+
+		if result, err = e.EvalErr(x); err != nil {
+			// failures that are not attributed to a more specific position,
+			// e.g. references to unbound variables at the top level, are
+			// attributed to the datum
+			if serr, ok := err.(*Error); ok && !serr.Position.IsValid() {
+				serr.Position = r.start
+			}
+			return nil, err
+		}
+	}
+}
+
+// EvalTail evaluates expression in tail position. With the tree-walking
+// backend, the result may be a pending tail call; the VM backend always
+// completes the evaluation.
 func (e *Env) EvalTail(expression Value) Value {
-	return eval(expression, e.globals, true)
+	if e.backend == TreeWalker {
+		expression = newExpander(e.globals).expandTopLevel(expression)
+		w := walker{dynamic: e.globals.dynamic(), toplevel: true}
+		return w.run(func() Value { return eval(expression, e.globals, true) })
+	}
+	return e.Eval(expression)
 }
 
 // ⟨variable⟩
@@ -112,9 +315,41 @@ func (e *Env) EvalTail(expression Value) Value {
 func evalVariable(e Symbol, scope *scope) Value {
 	value, ok := scope.lookup(e)
 	if !ok {
-		panic(fmt.Sprintf("%v is not bound", string(e)))
+		panic(NewError("unbound variable", e))
+	}
+	return checkAssigned(e, value)
+}
+
+// evalIdentifier evaluates a reference to an identifier that was inserted by a
+// macro expansion.
+func evalIdentifier(id *identifier, scope *scope) Value {
+	s, name := id.resolve(scope)
+	value, ok := s.lookup(name)
+	if !ok {
+		panic(NewError("unbound variable", id.name))
 	}
-	return value
+	return checkAssigned(id.name, value)
+}
+
+// unassignedValue is the value of a variable that is defined within a body
+// before its definition has been evaluated. The region of such a variable is
+// the entire body, as for letrec*, but it is an error to reference the
+// variable before it has been assigned a value.
+type unassignedValue struct{}
+
+func (unassignedValue) MarshalSExp() SExpression {
+	return Symbol("<unassigned>")
+}
+
+var unassigned Value = unassignedValue{}
+
+// checkAssigned returns the value v of the variable name. It is an error if the
+// variable has not yet been assigned.
+func checkAssigned(name Symbol, v Value) Value {
+	if _, ok := v.(unassignedValue); ok {
+		panic(NewError("variable referenced before its definition", name))
+	}
+	return v
 }
 
 // (quote ⟨datum⟩)
@@ -136,6 +371,8 @@ func evalQuasiquote(v Value, scope *scope) Value {
 	switch v := v.(type) {
 	case Number, Boolean, Character, String, Symbol:
 		return v
+	case *identifier:
+		return v.name
 	case Vector:
 		result := make(Vector, 0, len(v))
 		for _, v := range v {
@@ -151,7 +388,7 @@ func evalQuasiquote(v Value, scope *scope) Value {
 		}
 		return result
 	case *Pair:
-		switch sym, _ := v.car.(Symbol); sym {
+		switch sym, _ := symbolName(v.car); sym {
 		case "unquote":
 			return eval(v.cdr.(*Pair).car, scope, false)
 		case "unquote-splicing":
@@ -167,7 +404,7 @@ func evalQuasiquote(v Value, scope *scope) Value {
 		default:
 			var head, tail *Pair
 			for {
-				switch sym, _ := v.car.(Symbol); sym {
+				switch sym, _ := symbolName(v.car); sym {
 				case "unquote":
 					p, ok := v.cdr.(*Pair)
 					if ok && p.cdr == nil {
@@ -262,11 +499,12 @@ func evalLambda(e *Pair, scope *scope) Value {
 	}
 	formals, isVariadic := makeFormals(args[1])
 	return &procedure{
-		name:       "<lambda>",
-		closure:    scope,
-		formals:    formals,
-		isVariadic: isVariadic,
-		body:       args[2:],
+		name:        "<lambda>",
+		closure:     scope,
+		formals:     formals,
+		isVariadic:  isVariadic,
+		body:        args[2:],
+		definitions: bodyDefinitions(formals, args[2:]),
 	}
 }
 
@@ -285,13 +523,34 @@ func evalIf(e *Pair, scope *scope, tail bool) Value {
 	if len(args) < 3 || len(args) > 4 {
 		panic("if must be of the form (if ⟨test⟩ ⟨consequent⟩) or (if ⟨test⟩ ⟨consequent⟩ ⟨alternate⟩)")
 	}
-	if Truthy(eval(args[1], scope, false)) {
-		return eval(args[2], scope, tail)
+	return evalBranch(e, evalTest(e, scope, tail), scope, tail)
+}
+
+// evalTest evaluates the test of the if expression e.
+func evalTest(e *Pair, scope *scope, tail bool) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(test Value) Value {
+				defer recoverAt(e.pos)
+				return evalBranch(e, test, scope, tail)
+			}))
+		}
+	}()
+	return evalElement(e.cdr.(*Pair), scope, false)
+}
+
+// evalBranch evaluates the consequent or alternate of the if expression e
+// according to the value of its test.
+func evalBranch(e *Pair, test Value, scope *scope, tail bool) Value {
+	consequent := e.cdr.(*Pair).cdr.(*Pair)
+	if Truthy(singleValue(test)) {
+		return evalElement(consequent, scope, tail)
 	}
-	if len(args) == 3 {
-		return nil
+	alternate, ok := consequent.cdr.(*Pair)
+	if !ok {
+		return Unspecified
 	}
-	return eval(args[3], scope, tail)
+	return evalElement(alternate, scope, tail)
 }
 
 // (set! ⟨variable⟩ ⟨expression⟩)
@@ -305,19 +564,51 @@ func evalSet(e *Pair, scope *scope) Value {
 	if len(args) != 3 {
 		panic("set! must be of the form (set! ⟨variable⟩ ⟨expression⟩)")
 	}
-	sym, ok := args[1].(Symbol)
-	if !ok {
+	target, name := scope, Symbol("")
+	switch v := args[1].(type) {
+	case Symbol:
+		name = v
+	case *identifier:
+		target, name = v.resolve(scope)
+	default:
 		panic("set! must be of the form (set! ⟨variable⟩ ⟨expression⟩)")
 	}
-	if !scope.setIfBound(sym, eval(args[2], scope, false)) {
-		panic(fmt.Sprintf("set!: %v is not bound", sym))
-	}
-	return nil
+	return evalAssignment(e, scope, func(v Value) Value {
+		if !target.setIfBound(name, v) {
+			sym, _ := symbolName(args[1])
+			panic(NewError(fmt.Sprintf("set!: %v is not bound", sym)))
+		}
+		return Unspecified
+	})
+}
+
+// evalAssignment evaluates the expression of the set! or define form e and
+// passes its value to store, which assigns the value to the form's variable.
+func evalAssignment(e *Pair, scope *scope, store func(v Value) Value) Value {
+	return store(singleValue(evalAssignedValue(e, scope, store)))
+}
+
+// evalAssignedValue evaluates the expression of the set! or define form e.
+func evalAssignedValue(e *Pair, scope *scope, store func(v Value) Value) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(v Value) Value {
+				defer recoverAt(e.pos)
+				return store(singleValue(v))
+			}))
+		}
+	}()
+	return evalElement(e.cdr.(*Pair).cdr.(*Pair), scope, false)
 }
 
 func isElse(clause *Pair) bool {
-	sym, ok := clause.car.(Symbol)
-	return ok && sym == "else"
+	sym, _ := symbolName(clause.car)
+	return sym == "else"
+}
+
+func isArrow(v Value) bool {
+	sym, _ := symbolName(v)
+	return sym == "=>"
 }
 
 func evalClause(arg Value, clause *Pair, scope *scope, tail bool) Value {
@@ -326,10 +617,19 @@ func evalClause(arg Value, clause *Pair, scope *scope, tail bool) Value {
 		return arg
 	}
 
-	if sym, ok := expr.car.(Symbol); ok && sym == "=>" {
+	if isArrow(expr.car) {
 		if proc, ok := expr.cdr.(*Pair); ok {
-			call := &Pair{car: proc, cdr: &Pair{car: arg}}
-			return eval(call, scope, tail)
+			operator := eval(proc.car, scope, false)
+			p, ok := operator.(Procedure)
+			if !ok {
+				panic(NewError("value is not a procedure", operator))
+			}
+			d := scope.dynamic()
+			call := &tailCall{name: procedureName(proc.car, p), pos: clause.pos, p: bindWalker(p, d), args: Vector{arg}, budget: d.currentBudget()}
+			if tail {
+				return call
+			}
+			return forceTail(call)
 		}
 	}
 
@@ -337,22 +637,30 @@ func evalClause(arg Value, clause *Pair, scope *scope, tail bool) Value {
 }
 
 func evalCond(e *Pair, scope *scope, tail bool) Value {
-	for e, _ = e.cdr.(*Pair); e != nil; e, _ = e.cdr.(*Pair) {
+	clauses, _ := e.cdr.(*Pair)
+	v, _ := evalCondClauses(clauses, scope, tail)
+	return v
+}
+
+// evalCondClauses evaluates a list of cond clauses. The second result is false
+// if no clause was selected.
+func evalCondClauses(e *Pair, scope *scope, tail bool) (Value, bool) {
+	for ; e != nil; e, _ = e.cdr.(*Pair) {
 		clause, ok := e.car.(*Pair)
 		if !ok {
 			panic("cond clause must be of the form (⟨test⟩ ⟨expression1⟩ ...), (⟨test⟩ => ⟨expression⟩), or (else ⟨expression1⟩ ⟨expression2⟩ ...)")
 		}
 
 		if e.cdr == nil && isElse(clause) {
-			return evalBegin(clause, scope, tail)
+			return evalBegin(clause, scope, tail), true
 		}
 
 		v := eval(clause.car, scope, false)
 		if Truthy(v) {
-			return evalClause(v, clause, scope, tail)
+			return evalClause(v, clause, scope, tail), true
 		}
 	}
-	return nil
+	return nil, false
 }
 
 func evalCase(e *Pair, scope *scope, tail bool) Value {
@@ -374,49 +682,114 @@ func evalCase(e *Pair, scope *scope, tail bool) Value {
 		}
 
 		for accepts, _ := clause.car.(*Pair); accepts != nil; accepts, _ = accepts.cdr.(*Pair) {
-			if eqv(key, accepts.car) {
+			if eqv(key, unwrapIdentifier(accepts.car)) {
 				return evalClause(key, clause, scope, tail)
 			}
 		}
 	}
-	return nil
+	return Unspecified
 }
 
+// (and ⟨test1⟩ ...)
+//
+// Semantics: The ⟨test⟩ expressions are evaluated from left to right, and if
+// any expression evaluates to #f (see section 6.3), then #f is returned. Any
+// remaining expressions are not evaluated. If all the expressions evaluate to
+// true values, the values of the last expression are returned. If there are no
+// expressions, then #t is returned.
 func evalAnd(e *Pair, scope *scope, tail bool) Value {
-	if e.cdr == nil {
+	e, _ = e.cdr.(*Pair)
+	if e == nil {
 		return Boolean(true)
 	}
 
+	for {
+		next, _ := e.cdr.(*Pair)
+		if next == nil {
+			return eval(e.car, scope, tail)
+		}
+		if v := eval(e.car, scope, false); !Truthy(v) {
+			return v
+		}
+		e = next
+	}
+}
+
+// (or ⟨test1⟩ ...)
+//
+// Semantics: The ⟨test⟩ expressions are evaluated from left to right, and the
+// value of the first expression that evaluates to a true value (see section
+// 6.3) is returned. Any remaining expressions are not evaluated. If all
+// expressions evaluate to #f or if there are no expressions, then #f is
+// returned.
+func evalOr(e *Pair, scope *scope, tail bool) Value {
 	e, _ = e.cdr.(*Pair)
-	if e.cdr == nil {
-		return eval(e.car, scope, tail)
+	if e == nil {
+		return Boolean(false)
 	}
 
-	for ; e != nil; e, _ = e.cdr.(*Pair) {
-		if !Truthy(eval(e.car, scope, false)) {
-			return Boolean(false)
+	for {
+		next, _ := e.cdr.(*Pair)
+		if next == nil {
+			return eval(e.car, scope, tail)
+		}
+		if v := eval(e.car, scope, false); Truthy(v) {
+			return v
 		}
+		e = next
 	}
-	return Boolean(true)
 }
 
-func evalOr(e *Pair, scope *scope, tail bool) Value {
-	if e.cdr == nil {
-		return Boolean(true)
+// guardForm returns the variable, clauses, and body of a guard form.
+func guardForm(e *Pair) (Symbol, *Pair, *Pair) {
+	const invalidGuard = "guard must be of the form (guard (⟨variable⟩ ⟨cond clause1⟩ ⟨cond clause2⟩ ...) ⟨body⟩)"
+
+	args, ok := e.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
 	}
+	spec, ok := args.car.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+	variable, ok := variableName(spec.car)
+	if !ok {
+		panic(invalidGuard)
+	}
+	clauses, _ := spec.cdr.(*Pair)
+	body, ok := args.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+	return variable, clauses, body
+}
 
-	e, _ = e.cdr.(*Pair)
-	if e.cdr == nil {
-		return eval(e.car, scope, tail)
+// (guard (⟨variable⟩
+//         ⟨cond clause1⟩ ⟨cond clause2⟩ ...)
+//   ⟨body⟩)
+//
+// Semantics: The ⟨body⟩ is evaluated with an exception handler that binds the
+// raised object to ⟨variable⟩ and, within the scope of that binding, evaluates
+// the clauses as if they were the clauses of a cond expression. That implicit
+// cond expression is evaluated with the continuation and dynamic environment
+// of the guard expression. If every ⟨cond clause⟩'s ⟨test⟩ evaluates to #f and
+// there is no else clause, then the raised object is re-raised.
+func evalGuard(e *Pair, scope *scope, tail bool) Value {
+	variable, clauses, body := guardForm(e)
+
+	v, err := scope.dynamic().guard(ProcedureFunc(func(Vector) Value {
+		return evalSeq(body, scope.push(), false)
+	}))
+	if err == nil {
+		return v
 	}
 
-	for ; e != nil; e, _ = e.cdr.(*Pair) {
-		v := eval(e.car, scope, false)
-		if Truthy(v) {
-			return v
-		}
+	scope = scope.push()
+	scope.set(variable, err.payload())
+	if v, ok := evalCondClauses(clauses, scope, tail); ok {
+		return v
 	}
-	return Boolean(false)
+	panic(err)
 }
 
 func evalBinding(e Value, scope *scope) (Symbol, Value, bool) {
@@ -424,7 +797,7 @@ func evalBinding(e Value, scope *scope) (Symbol, Value, bool) {
 	if !ok {
 		return "", nil, false
 	}
-	sym, ok := binding.car.(Symbol)
+	sym, ok := variableName(binding.car)
 	if !ok {
 		return "", nil, false
 	}
@@ -435,7 +808,7 @@ func evalBinding(e Value, scope *scope) (Symbol, Value, bool) {
 	if init.cdr != nil {
 		return "", nil, false
 	}
-	return sym, eval(init.car, scope, false), true
+	return sym, singleValue(eval(init.car, scope, false)), true
 }
 
 func evalBindings(e Value, scope *scope, seq bool) ([]Symbol, Vector, bool) {
@@ -479,7 +852,7 @@ func evalLet(e *Pair, scope *scope, tail bool) Value {
 	}
 	args = args[1:]
 
-	sym, isNamedLet := args[0].(Symbol)
+	sym, isNamedLet := variableName(args[0])
 	if isNamedLet {
 		args = args[1:]
 		if len(args) == 0 {
@@ -492,24 +865,32 @@ func evalLet(e *Pair, scope *scope, tail bool) Value {
 		panic(invalidLet)
 	}
 
+	name, _ := symbolName(args[0])
+
 	scope = scope.push()
 	proc := &procedure{
-		name:    sym,
-		closure: scope,
-		formals: formals,
-		body:    args[1:],
+		name:        name,
+		closure:     scope,
+		formals:     formals,
+		body:        args[1:],
+		definitions: bodyDefinitions(formals, args[1:]),
 	}
 
 	if isNamedLet {
 		scope.set(sym, proc)
 	}
 
-	return proc.apply(actuals)
+	scope.dynamic().currentBudget().step()
+	v := proc.apply(actuals)
+	if tail {
+		return v
+	}
+	return forceTail(v)
 }
 
 func evalSeq(e *Pair, scope *scope, tail bool) Value {
 	if e == nil {
-		return nil
+		return Unspecified
 	}
 
 	for {
@@ -517,16 +898,135 @@ func evalSeq(e *Pair, scope *scope, tail bool) Value {
 		if next == nil {
 			return eval(e.car, scope, tail)
 		}
-		eval(e.car, scope, false)
+		evalCommand(e.car, next, scope, tail)
 		e = next
 	}
 }
 
+// evalCommand evaluates expression, a command in the sequence that continues
+// with next.
+func evalCommand(expression Value, next *Pair, scope *scope, tail bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(Value) Value { return evalSeq(next, scope, tail) }))
+		}
+	}()
+	eval(expression, scope, false)
+}
+
+// evalBody evaluates the body of a procedure in scope. The last expression of
+// the body is evaluated in tail position.
+func evalBody(body []Value, scope *scope) Value {
+	for len(body) > 1 {
+		evalBodyCommand(body, scope)
+		body = body[1:]
+	}
+	return eval(body[0], scope, true)
+}
+
+// evalBodyCommand evaluates the first expression of body, which is followed by
+// the rest of the body.
+func evalBodyCommand(body []Value, scope *scope) {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(Value) Value { return evalBody(body[1:], scope) }))
+		}
+	}()
+	eval(body[0], scope, false)
+}
+
 func evalBegin(e *Pair, scope *scope, tail bool) Value {
 	e, _ = e.cdr.(*Pair)
 	return evalSeq(e, scope, tail)
 }
 
+// (include ⟨string1⟩ ⟨string2⟩ ...)
+// (include-ci ⟨string1⟩ ⟨string2⟩ ...)
+//
+// Semantics: Both include and include-ci take one or more filenames expressed
+// as string literals, apply an implementation-specific algorithm to find
+// corresponding files, read the contents of the files in the specified order
+// as if by repeated applications of read, and effectively replace the include
+// or include-ci expression with a begin expression containing what was read
+// from the files. The difference between the two is that include-ci reads each
+// file as if it began with the #!fold-case directive, while include does not.
+func evalInclude(e *Pair, scope *scope, foldCase, tail bool) Value {
+	body, _ := Vector(readIncludes(e, foldCase)).ToList().(*Pair)
+	return evalSeq(body, scope, tail)
+}
+
+// readIncludes reads the contents of the files named by an include or
+// include-ci form. Relative filenames are resolved against the directory of
+// the file that contains the form, if known.
+func readIncludes(e *Pair, foldCase bool) []Value {
+	names := e.ToVector()[1:]
+	if len(names) == 0 {
+		panic(fmt.Sprintf("%v must be of the form (%v ⟨string1⟩ ⟨string2⟩ ...)", e.car, e.car))
+	}
+
+	var exprs []Value
+	for _, name := range names {
+		path, ok := name.(String)
+		if !ok {
+			panic(fmt.Sprintf("%v must be of the form (%v ⟨string1⟩ ⟨string2⟩ ...)", e.car, e.car))
+		}
+		exprs = append(exprs, readInclude(e.Position(), string(path), foldCase)...)
+	}
+	return exprs
+}
+
+func readInclude(pos Position, path string, foldCase bool) []Value {
+	if !filepath.IsAbs(path) && pos.Filename != "" {
+		path = filepath.Join(filepath.Dir(pos.Filename), path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var exprs []Value
+	r := NewFileReader(path, f)
+	for {
+		x, err := r.Read()
+		if err != nil {
+			if err == io.EOF {
+				return exprs
+			}
+			panic(err)
+		}
+		var expr Value = x
+		if foldCase {
+			expr = foldSymbols(expr)
+		}
+		exprs = append(exprs, expr)
+	}
+}
+
+// foldSymbols case-folds each symbol in the datum v.
+func foldSymbols(v Value) Value {
+	switch v := v.(type) {
+	case Symbol:
+		return Symbol(strings.Map(foldcase, string(v)))
+	case *Pair:
+		for p, ok := v, true; ok; p, ok = p.cdr.(*Pair) {
+			p.car = foldSymbols(p.car)
+			if _, isPair := p.cdr.(*Pair); !isPair {
+				p.cdr = foldSymbols(p.cdr)
+			}
+		}
+		return v
+	case Vector:
+		for i := range v {
+			v[i] = foldSymbols(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
+
 // A variable definition binds one or more identifiers and specifies an initial
 // value for each of them. The simplest kind of variable definition takes one
 // of the following forms:
@@ -557,55 +1057,164 @@ func evalDefine(e *Pair, scope *scope) Value {
 	}
 
 	switch v := args[1].(type) {
-	case Symbol:
-		scope.set(v, eval(args[2], scope, false))
-		return nil
+	case Symbol, *identifier:
+		sym, _ := variableName(v)
+		return evalAssignment(e, scope, func(v Value) Value {
+			scope.set(sym, v)
+			return Unspecified
+		})
 	case *Pair:
-		sym, ok := v.car.(Symbol)
+		sym, ok := variableName(v.car)
 		if !ok {
 			panic(invalidDefine)
 		}
+		name, _ := symbolName(v.car)
 
 		formals, isVariadic := makeFormals(v.cdr)
 		scope.set(sym, &procedure{
-			name:       sym,
-			closure:    scope,
-			formals:    formals,
-			isVariadic: isVariadic,
-			body:       args[2:],
+			name:        name,
+			closure:     scope,
+			formals:     formals,
+			isVariadic:  isVariadic,
+			body:        args[2:],
+			definitions: bodyDefinitions(formals, args[2:]),
 		})
-		return nil
+		return Unspecified
 	default:
 		panic(invalidDefine)
 	}
 }
 
+// (define-syntax ⟨keyword⟩ ⟨transformer spec⟩)
+//
+// Syntax: ⟨Keyword⟩ is an identifier, and the ⟨transformer spec⟩ is an
+// instance of syntax-rules.
+//
+// Semantics: The keyword is bound to the specified transformer.
 func evalDefineSyntax(e *Pair, s *scope) Value {
+	keyword, spec := syntaxDefinitionForm(e)
+	s.setKeyword(keyword, newSyntaxRules(spec, s, nil))
+	return Unspecified
+}
+
+// syntaxDefinitionForm returns the keyword and transformer spec of a
+// define-syntax form.
+func syntaxDefinitionForm(e *Pair) (Symbol, Value) {
 	const invalidDefineSyntax = "define-syntax must be of the form (define-syntax ⟨keyword⟩ ⟨transformer spec⟩)"
-	const invalidSyntaxRules = "syntax-rules must be of the form (syntax-rules (⟨literal⟩ ...) ⟨syntaxrule⟩ ...)"
-	const invalidRule = "rules must be of the form ((⟨list pattern⟩) ⟨template⟩)"
 
 	args := e.ToVector()
 	if len(args) != 3 {
 		panic(invalidDefineSyntax)
 	}
 
-	keyword, ok := args[1].(Symbol)
+	keyword, ok := variableName(args[1])
 	if !ok {
 		panic(invalidDefineSyntax)
 	}
+	return keyword, args[2]
+}
+
+// (let-syntax ⟨bindings⟩ ⟨body⟩)
+// (letrec-syntax ⟨bindings⟩ ⟨body⟩)
+//
+// Syntax: ⟨Bindings⟩ has the form
+//
+//	((⟨keyword⟩ ⟨transformer spec⟩) ...)
+//
+// Each ⟨keyword⟩ is an identifier, and each ⟨transformer spec⟩ is an instance
+// of syntax-rules.
+//
+// Semantics: The ⟨body⟩ is expanded in the syntactic environment obtained by
+// extending the syntactic environment of the let-syntax expression with macros
+// whose keywords are the ⟨keyword⟩s, bound to the specified transformers. Each
+// binding of a ⟨keyword⟩ has ⟨body⟩ as its region. The bindings of a
+// letrec-syntax expression also have the transformer specs as their region, so
+// the transformers can transcribe expressions into uses of the macros
+// introduced by the letrec-syntax expression.
+func evalLetSyntax(e *Pair, scope *scope, recursive, tail bool) Value {
+	keywords, specs, body := syntaxBindings(e)
+
+	inner, env := scope.push(), scope
+	if recursive {
+		env = inner
+	}
+	for i, keyword := range keywords {
+		inner.setKeyword(keyword, newSyntaxRules(specs[i], env, nil))
+	}
+	return evalSeq(body, inner, tail)
+}
 
-	spec, ok := args[2].(*Pair)
+// syntaxBindings returns the keywords, transformer specs, and body of a
+// let-syntax or letrec-syntax form.
+func syntaxBindings(e *Pair) ([]Symbol, []Value, *Pair) {
+	name, _ := symbolName(e.car)
+	invalid := fmt.Sprintf("%v must be of the form (%v ((⟨keyword⟩ ⟨transformer spec⟩) ...) ⟨body⟩)", name, name)
+
+	args, ok := e.cdr.(*Pair)
 	if !ok {
-		panic(invalidDefineSyntax)
+		panic(invalid)
+	}
+	body, ok := args.cdr.(*Pair)
+	if !ok {
+		panic(invalid)
 	}
 
-	if spec, ok := spec.car.(Symbol); !ok || spec != "syntax-rules" {
-		panic(invalidDefineSyntax)
+	var keywords []Symbol
+	var specs []Value
+	for _, binding := range listElements(args.car, invalid) {
+		b, ok := binding.(*Pair)
+		if !ok {
+			panic(invalid)
+		}
+		parts := listElements(b, invalid)
+		if len(parts) != 2 {
+			panic(invalid)
+		}
+		keyword, ok := variableName(parts[0])
+		if !ok {
+			panic(invalid)
+		}
+		keywords, specs = append(keywords, keyword), append(specs, parts[1])
+	}
+	return keywords, specs, body
+}
+
+// listElements returns the elements of the proper list v. If v is not a proper
+// list, listElements panics with the given message.
+func listElements(v Value, invalid string) []Value {
+	var elements []Value
+	for v != nil {
+		p, ok := v.(*Pair)
+		if !ok {
+			panic(invalid)
+		}
+		elements, v = append(elements, p.car), p.cdr
+	}
+	return elements
+}
+
+// newSyntaxRules returns the transformer described by a transformer spec. The
+// transformer closes over the scope env. If the spec was compiled, lexical is
+// the lexical scope of env.
+func newSyntaxRules(spec Value, env *scope, lexical *lexicalScope) *syntaxRules {
+	const invalidSyntaxRules = "syntax-rules must be of the form (syntax-rules (⟨literal⟩ ...) ⟨syntax rule⟩ ...) or (syntax-rules ⟨ellipsis⟩ (⟨literal⟩ ...) ⟨syntax rule⟩ ...)"
+	const invalidRule = "rules must be of the form ((⟨list pattern⟩) ⟨template⟩)"
+
+	specPair, ok := spec.(*Pair)
+	if !ok {
+		panic(invalidSyntaxRules)
+	}
+	if name, _ := symbolName(specPair.car); name != "syntax-rules" {
+		panic(invalidSyntaxRules)
 	}
 
-	// TODO: special ellipsis
-	specArgs := spec.ToVector()
+	// (syntax-rules ⟨ellipsis⟩ (⟨literal⟩ ...) ⟨syntax rule⟩ ...)
+	specArgs, ellipsis := specPair.ToVector(), Symbol("...")
+	if len(specArgs) > 1 {
+		if sym, ok := symbolName(specArgs[1]); ok {
+			ellipsis, specArgs = sym, append(specArgs[:1:1], specArgs[2:]...)
+		}
+	}
 	if len(specArgs) < 3 {
 		panic(invalidSyntaxRules)
 	}
@@ -616,13 +1225,14 @@ func evalDefineSyntax(e *Pair, s *scope) Value {
 	}
 	literals := map[Symbol]*scope{}
 	for _, l := range literalSpec.ToVector() {
-		l, ok := l.(Symbol)
+		l, ok := symbolName(l)
 		if !ok {
 			panic(invalidSyntaxRules)
 		}
-		literals[l] = s.where(l)
+		literals[l] = env.where(l)
 	}
 
+	checker := syntaxMatcher{ellipsis: ellipsis, literals: literals}
 	rules := make([]syntaxRule, len(specArgs[2:]))
 	for i, ruleSpec := range specArgs[2:] {
 		specPair, ok := ruleSpec.(*Pair)
@@ -637,16 +1247,17 @@ func evalDefineSyntax(e *Pair, s *scope) Value {
 		if !ok {
 			panic(invalidRule)
 		}
+		checker.checkRule(pattern, ruleArgs[1])
 		rules[i] = syntaxRule{pattern: pattern, template: ruleArgs[1]}
 	}
 
-	s.setKeyword(keyword, &syntaxRules{
-		scope:    s,
+	return &syntaxRules{
+		scope:    env,
+		lexical:  lexical,
+		ellipsis: ellipsis,
 		literals: literals,
 		rules:    rules,
-	})
-
-	return nil
+	}
 }
 
 func eval(expression Value, scope *scope, tail bool) Value {
@@ -659,17 +1270,16 @@ func eval(expression Value, scope *scope, tail bool) Value {
 		return e
 	case Symbol:
 		return evalVariable(e, scope)
-	case *binding:
-		v, _ := e.where.lookup(e.name)
-		return v
+	case *identifier:
+		return evalIdentifier(e, scope)
 	case Vector:
-		result := make(Vector, len(e))
-		for i, v := range e {
-			result[i] = eval(v, scope, false)
-		}
-		return result
+		return evalVector(e, make(Vector, 0, len(e)), scope)
 	case *Pair:
-		switch sym, _ := e.car.(Symbol); sym {
+		if e.pos != nil {
+			defer recoverAt(e.pos)
+		}
+
+		switch sym, _ := symbolName(e.car); sym {
 		// primitive expressions
 		case "quote":
 			return evalQuote(e)
@@ -678,17 +1288,13 @@ func eval(expression Value, scope *scope, tail bool) Value {
 		case "lambda":
 			return evalLambda(e, scope)
 		case "if":
-			v := evalIf(e, scope, tail)
-			if tail {
-				return v
-			}
-			return forceTail(v)
+			return evalIf(e, scope, tail)
 		case "set!":
 			return evalSet(e, scope)
 		case "include":
-			panic("NYI: include")
+			return evalInclude(e, scope, false, tail)
 		case "include-ci":
-			panic("NYI: include-ci")
+			return evalInclude(e, scope, true, tail)
 
 		// derived expressions
 		case "cond":
@@ -703,55 +1309,248 @@ func eval(expression Value, scope *scope, tail bool) Value {
 			return evalLet(e, scope, tail)
 		case "begin":
 			return evalBegin(e, scope, tail)
+		case "guard":
+			return evalGuard(e, scope, tail)
 
 		// variable definitions
 		case "define":
 			return evalDefine(e, scope)
 
+		// macros
+		case "let-syntax":
+			return evalLetSyntax(e, scope, false, tail)
+		case "letrec-syntax":
+			return evalLetSyntax(e, scope, true, tail)
+
 		// syntax definitions
 		case "define-syntax":
 			return evalDefineSyntax(e, scope)
 
 		// all else
 		default:
-			if sym, ok := e.car.(Symbol); ok {
-				if syntax, ok := scope.lookupKeyword(sym); ok {
-					if v, ok := syntax.match(e, scope); ok {
-						return eval(v, scope, tail)
-					}
-				}
-			}
-
-			p, ok := eval(e.car, scope, false).(Procedure)
-			if !ok {
-				panic("value is not a procedure")
+			if syntax, ok := lookupSyntax(scope, e.car); ok {
+				return eval(syntax.expand(e, scope), scope, tail)
 			}
-			args := e.ToVector()
-			actuals := make(Vector, len(args)-1)
-			for i, arg := range args[1:] {
-				actuals[i] = eval(arg, scope, false)
+			if formals, body, ok := immediateLambda(e.car, e.len()-1); ok {
+				return evalImmediateLambda(e, formals, body, scope, tail)
 			}
-			if tail {
-				return &tailCall{p: p, args: actuals}
+			if init, formals, isVariadic, body, ok := immediateReceive(e); ok {
+				return evalImmediateReceive(init, formals, isVariadic, body, scope, tail)
 			}
-			return forceTail(p.Apply(actuals))
+
+			return evalOperands(e, evalOperator(e, scope, tail), scope, tail)
 		}
 	case *tailCall:
 		if tail {
 			return e
 		}
-		return forceTail(e.p.Apply(e.args))
+		return forceTail(e)
 	default:
 		panic(fmt.Sprintf("unknown expression type %T", e))
 	}
 }
 
+// evalElement evaluates the expression that is the car of p, an element of a
+// form. Failed references to variables are attributed to the source position of
+// the reference rather than to the form.
+func evalElement(p *Pair, scope *scope, tail bool) Value {
+	if pos := p.carPosition(); pos != nil && isVariable(p.car) {
+		defer recoverAt(pos)
+	}
+	return eval(p.car, scope, tail)
+}
+
+// evalVector evaluates the elements of the vector e that follow those whose
+// values are in result.
+func evalVector(e, result Vector, scope *scope) Value {
+	for len(result) < len(e) {
+		result = append(result, evalVectorElement(e, result, scope))
+	}
+	return result
+}
+
+// evalVectorElement evaluates the element of the vector e that follows those
+// whose values are in result.
+func evalVectorElement(e, result Vector, scope *scope) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(v Value) Value {
+				n := len(result)
+				return evalVector(e, append(result[:n:n], v), scope)
+			}))
+		}
+	}()
+	return eval(e[len(result)], scope, false)
+}
+
+// evalOperator evaluates the operator of the application e.
+func evalOperator(e *Pair, scope *scope, tail bool) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(operator Value) Value {
+				defer recoverAt(e.pos)
+				return evalOperands(e, operator, scope, tail)
+			}))
+		}
+	}()
+	return evalElement(e, scope, false)
+}
+
+// evalOperands evaluates the arguments of the application e and applies
+// operator to them.
+func evalOperands(e *Pair, operator Value, scope *scope, tail bool) Value {
+	p, ok := operator.(Procedure)
+	if !ok {
+		panic(NewError("value is not a procedure", operator))
+	}
+	return applyProcedure(e, p, evalActuals(e, p, scope, tail, applyProcedure), scope, tail)
+}
+
+// applyProcedure applies p, the operator of the application e, to actuals.
+func applyProcedure(e *Pair, p Procedure, actuals Vector, scope *scope, tail bool) Value {
+	d := scope.dynamic()
+	call := &tailCall{name: procedureName(e.car, p), pos: e.pos, p: bindWalker(p, d), args: actuals, budget: d.currentBudget()}
+	if tail {
+		return call
+	}
+	return forceTail(call)
+}
+
+// evalActuals evaluates the arguments of the application e, which are passed to
+// p by apply.
+func evalActuals(e *Pair, p Procedure, scope *scope, tail bool, apply func(e *Pair, p Procedure, actuals Vector, scope *scope, tail bool) Value) Vector {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(actuals Value) Value {
+				defer recoverAt(e.pos)
+				return apply(e, p, actuals.(Vector), scope, tail)
+			}))
+		}
+	}()
+	return evalArgs(e.cdr, make(Vector, 0, e.len()-1), scope)
+}
+
+// evalArgs evaluates args, the arguments of an application that follow those
+// whose values are in actuals, and appends their values to actuals.
+func evalArgs(args Value, actuals Vector, scope *scope) Vector {
+	for args != nil {
+		arg, ok := args.(*Pair)
+		if !ok {
+			return append(actuals, singleValue(evalArg(args, nil, actuals, scope)))
+		}
+		actuals, args = append(actuals, singleValue(evalArg(arg, arg.cdr, actuals, scope))), arg.cdr
+	}
+	return actuals
+}
+
+// evalArg evaluates arg, the argument of an application that follows those
+// whose values are in actuals and precedes the arguments in rest. If arg is a
+// pair, its car is evaluated.
+func evalArg(arg, rest Value, actuals Vector, scope *scope) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(v Value) Value {
+				n := len(actuals)
+				return evalArgs(rest, append(actuals[:n:n], singleValue(v)), scope)
+			}))
+		}
+	}()
+	if p, ok := arg.(*Pair); ok {
+		return evalElement(p, scope, false)
+	}
+	return eval(arg, scope, false)
+}
+
+// evalImmediateLambda evaluates a call whose operator is a lambda expression
+// that accepts its arguments, such as the expansion of a let form. The body is
+// applied directly, as for a let form, so that the call does not appear in
+// stack traces.
+func evalImmediateLambda(e *Pair, formals []Symbol, body []Value, scope *scope, tail bool) Value {
+	proc := &procedure{closure: scope, formals: formals, body: body, definitions: bodyDefinitions(formals, body)}
+	return applyImmediateLambda(e, proc, evalActuals(e, proc, scope, tail, applyImmediateLambda), scope, tail)
+}
+
+// applyImmediateLambda applies p, the procedure of the immediate lambda e, to
+// actuals.
+func applyImmediateLambda(e *Pair, p Procedure, actuals Vector, scope *scope, tail bool) Value {
+	scope.dynamic().currentBudget().step()
+	v := p.(*procedure).apply(actuals)
+	if tail {
+		return v
+	}
+	return forceTail(v)
+}
+
+// evalImmediateReceive evaluates a call to call-with-values whose producer and
+// consumer are lambda expressions, such as the expansion of a receive form. The
+// values of init are passed directly to the body of the consumer.
+func evalImmediateReceive(init Value, formals []Symbol, isVariadic bool, body []Value, scope *scope, tail bool) Value {
+	proc := &procedure{closure: scope, formals: formals, isVariadic: isVariadic, body: body, definitions: bodyDefinitions(formals, body)}
+	return applyConsumer(proc, evalProducer(init, proc, scope, tail), scope, tail)
+}
+
+// evalProducer evaluates init, the producer of an immediate receive whose
+// consumer is proc.
+func evalProducer(init Value, proc *procedure, scope *scope, tail bool) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, func(v Value) Value { return applyConsumer(proc, v, scope, tail) }))
+		}
+	}()
+	return eval(init, scope, false)
+}
+
+// applyConsumer passes the values vs to the consumer proc of an immediate receive.
+func applyConsumer(proc *procedure, vs Value, scope *scope, tail bool) Value {
+	actuals := spreadValues(vs)
+	checkValues(proc.formals, proc.isVariadic, actuals)
+
+	scope.dynamic().currentBudget().step()
+	v := proc.apply(actuals)
+	if tail {
+		return v
+	}
+	return forceTail(v)
+}
+
+// bindWalker binds p to d for a call by the tree-walking evaluator.
+func bindWalker(p Procedure, d *dynamicEnv) Procedure {
+	switch p := p.(type) {
+	case *dynamicProcedure:
+		switch p {
+		case callCC:
+			return walkerCallCC(d)
+		case dynamicWind:
+			return walkerDynamicWind(d)
+		}
+	case *compiledClosure:
+		if p == callWithValues {
+			return walkerCallWithValues(d)
+		}
+	case *walkerContinuation:
+		return ProcedureFunc(p.invoke)
+	}
+	return bindDynamic(p, d)
+}
+
 func forceTail(v Value) Value {
 	for {
 		tail, ok := v.(*tailCall)
 		if !ok {
 			return v
 		}
-		v = tail.p.Apply(tail.args)
+		v = applyTail(tail)
 	}
 }
+
+// applyTail applies the pending tail call t. If a continuation is captured
+// during the call, the rest of forceTail is saved as the rest of the caller's
+// work.
+func applyTail(t *tailCall) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			panic(saveFrames(x, forceTail))
+		}
+	}()
+	return t.apply()
+}
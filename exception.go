@@ -0,0 +1,312 @@
+package loom
+
+import "fmt"
+
+// dynamicEnv holds the dynamic environment of an evaluation.
+type dynamicEnv struct {
+	handlers *handlerStack // the current exception handlers
+	winders  *windStack    // the active dynamic-wind calls
+	budget   *budget       // the budget of the current evaluation, if any
+	output   *outputPort   // the current output port
+	globals  *scope        // the global scope of the current evaluation
+
+	commandLine []string // the command line returned by command-line
+}
+
+// handlerStack is an immutable stack of exception handlers.
+type handlerStack struct {
+	handler Procedure
+	outer   *handlerStack
+}
+
+// withHandler calls thunk with handler installed as the current exception
+// handler. Any exception that is raised during the call and has not yet been
+// signaled is signaled before the stack is unwound past the call.
+func (d *dynamicEnv) withHandler(handler, thunk Procedure) Value {
+	handlers := d.handlers
+	d.handlers = &handlerStack{handler: handler, outer: handlers}
+	defer func() {
+		if x := recover(); x != nil {
+			err := toError(x)
+			d.signal(err)
+			d.handlers = handlers
+			panic(err)
+		}
+		d.handlers = handlers
+	}()
+	return thunk.Apply(nil)
+}
+
+// signal calls the current exception handler on the object raised by err
+// unless err has already been signaled or cannot be handled. The handler is
+// called in the dynamic environment of the raise, except that the current
+// exception handler is the one that was installed when the handler being
+// called was installed. If the handler returns, a secondary exception is
+// signaled in the same dynamic environment as the handler and propagated by
+// panicking.
+//
+// Exceptions raised by raise and error are signaled at once. Other failures
+// are signaled as they propagate, before the stack is unwound past any
+// dynamic-wind call or exception handler.
+func (d *dynamicEnv) signal(err *Error) {
+	if d == nil || err.signaled || err.uncatchable() {
+		return
+	}
+	err.signaled = true
+
+	handlers := d.handlers
+	if handlers == nil {
+		return
+	}
+	d.handlers = handlers.outer
+	defer func() { d.handlers = handlers }()
+
+	handlers.handler.Apply(Vector{err.payload()})
+
+	secondary := NewError("exception handler returned from non-continuable exception", err.payload())
+	d.signal(secondary)
+	panic(secondary)
+}
+
+// signalRaise calls raise, which must panic, and signals the resulting
+// exception before the stack is unwound.
+func (d *dynamicEnv) signalRaise(raise func(Vector) Value, args Vector) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			err := toError(x)
+			d.signal(err)
+			panic(err)
+		}
+	}()
+	return raise(args)
+}
+
+// A dynamicProcedure is a builtin procedure that requires access to the dynamic
+// environment of its caller. Dynamic procedures are recognized and invoked
+// specially by the evaluator.
+//
+// A dynamic procedure is implemented either by a Go function or by bytecode.
+// Procedures that are implemented by bytecode run in the caller's VM when they
+// are called by compiled code.
+type dynamicProcedure struct {
+	name     Symbol
+	apply    func(d *dynamicEnv, args Vector) Value
+	compiled *compiledProcedure
+}
+
+func (p *dynamicProcedure) MarshalSExp() SExpression {
+	return p.name
+}
+
+func (p *dynamicProcedure) Apply(args Vector) Value {
+	panic(fmt.Sprintf("%v must be called from Scheme code", p.name))
+}
+
+// bind returns a procedure that invokes p in the given dynamic environment.
+func (p *dynamicProcedure) bind(d *dynamicEnv) Procedure {
+	if p.compiled != nil {
+		return &compiledClosure{proc: p.compiled, scope: &scope{dynamicEnv: d}}
+	}
+	return ProcedureFunc(func(args Vector) Value {
+		return p.apply(d, args)
+	})
+}
+
+// bindDynamic binds p to d if p is a dynamic procedure.
+func bindDynamic(p Procedure, d *dynamicEnv) Procedure {
+	if dp, ok := p.(*dynamicProcedure); ok {
+		return dp.bind(d)
+	}
+	return p
+}
+
+var applyProc = &dynamicProcedure{name: "apply", apply: func(d *dynamicEnv, args Vector) Value {
+	if len(args) > 0 {
+		if p, ok := args[0].(Procedure); ok {
+			args[0] = bindDynamic(p, d)
+		}
+	}
+	return ProcedureApply(args)
+}}
+
+// (raise obj)
+//
+// Raises an exception by invoking the current exception handler on obj. The
+// handler is called with the same dynamic environment as that of the call to
+// raise, except that the current exception handler is the one that was
+// installed when the handler being called was installed. If the handler
+// returns, a secondary exception is raised in the same dynamic environment as
+// the handler.
+func Raise(args Vector) Value {
+	if len(args) != 1 {
+		panic("raise expects 1 argument")
+	}
+	err := raisedError(args[0])
+	err.signaled = false
+	panic(err)
+}
+
+var raiseProc = &dynamicProcedure{name: "raise", apply: func(d *dynamicEnv, args Vector) Value {
+	return d.signalRaise(Raise, args)
+}}
+
+// (raise-continuable obj)
+//
+// Raises an exception by invoking the current exception handler on obj. The
+// handler is called with the same dynamic environment as the call to
+// raise-continuable, except that: (1) the current exception handler is the one
+// that was installed when the handler being called was installed, and (2) if
+// the handler being called returns, then it will again become the current
+// exception handler. If the handler returns, the values it returns become the
+// values returned by the call to raise-continuable.
+var raiseContinuableProc = &dynamicProcedure{name: "raise-continuable", apply: func(d *dynamicEnv, args Vector) Value {
+	if len(args) != 1 {
+		panic("raise-continuable expects 1 argument")
+	}
+
+	handlers := d.handlers
+	if handlers == nil {
+		panic(raisedError(args[0]))
+	}
+
+	d.handlers = handlers.outer
+	defer func() { d.handlers = handlers }()
+	return handlers.handler.Apply(args)
+}}
+
+// (with-exception-handler handler thunk)
+//
+// The handler argument should be a procedure that accepts one argument. The
+// thunk argument should be a procedure that accepts zero arguments. The
+// with-exception-handler procedure returns the results of invoking thunk.
+// Handler is installed as the current exception handler in the dynamic
+// environment in effect during the invocation of thunk.
+var withExceptionHandlerProc = &dynamicProcedure{name: "with-exception-handler", apply: func(d *dynamicEnv, args Vector) Value {
+	if len(args) != 2 {
+		panic("with-exception-handler expects 2 arguments")
+	}
+	handler, ok := args[0].(Procedure)
+	if !ok {
+		panic(newNamedError("the first argument to with-exception-handler must be a procedure", args[0]))
+	}
+	thunk, ok := args[1].(Procedure)
+	if !ok {
+		panic(newNamedError("the second argument to with-exception-handler must be a procedure", args[1]))
+	}
+
+	return d.withHandler(bindDynamic(handler, d), bindDynamic(thunk, d))
+}}
+
+// guardSentinel is the type of guardNoMatch.
+type guardSentinel struct {
+	name Symbol
+}
+
+func (s *guardSentinel) MarshalSExp() SExpression {
+	return s.name
+}
+
+// guardNoMatch is returned by a guard's clauses if no clause accepts the
+// raised object.
+var guardNoMatch = &guardSentinel{name: "<no match>"}
+
+// guardProc implements the guard form. It is called with a body thunk and a
+// procedure of one argument that evaluates the guard's clauses. If the body
+// raises an exception, the clauses are evaluated with the raised object. If no
+// clause accepts the object, it is re-raised.
+var guardProc = &dynamicProcedure{name: "guard", apply: func(d *dynamicEnv, args Vector) Value {
+	body, clauses := args[0].(Procedure), args[1].(Procedure)
+
+	v, err := d.guard(body)
+	if err == nil {
+		return v
+	}
+	if v = clauses.Apply(Vector{err.payload()}); v == guardNoMatch {
+		err.signaled = false
+		panic(err)
+	}
+	return v
+}}
+
+// guard calls body with an exception handler that unwinds to the caller. Any
+// exception raised by body is returned as an *Error. Interruptions and exits
+// are not handled.
+func (d *dynamicEnv) guard(body Procedure) (v Value, err *Error) {
+	defer func() {
+		if x := recover(); x != nil {
+			if err = toError(x); err.uncatchable() {
+				panic(err)
+			}
+			v = nil
+		}
+	}()
+	return d.withHandler(ProcedureFunc(func(args Vector) Value {
+		err := raisedError(args[0])
+		err.signaled = true
+		panic(err)
+	}), body), nil
+}
+
+// (error message obj ...)
+//
+// Raises an exception as if by calling raise on a newly allocated error object
+// which encapsulates the information provided by message, as well as any objs,
+// known as the irritants.
+func ErrorRaise(args Vector) Value {
+	if len(args) < 1 {
+		panic("error expects at least 1 argument")
+	}
+	message, ok := args[0].(String)
+	if !ok {
+		panic(newNamedError("the first argument to error must be a string", args[0]))
+	}
+	panic(&Error{Message: string(message), Irritants: append(Vector(nil), args[1:]...)})
+}
+
+var errorProc = &dynamicProcedure{name: "error", apply: func(d *dynamicEnv, args Vector) Value {
+	return d.signalRaise(ErrorRaise, args)
+}}
+
+// errorArg returns the single error object argument to the named procedure.
+func errorArg(name string, args Vector) *Error {
+	if len(args) != 1 {
+		panic(name + " expects 1 argument")
+	}
+	err, ok := args[0].(*Error)
+	if !ok {
+		panic(newNamedError("the argument to "+name+" must be an error object", args[0]))
+	}
+	return err
+}
+
+func ErrorObjectPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
+	_, ok := args[0].(*Error)
+	return Boolean(ok)
+}
+
+func ErrorObjectMessage(args Vector) Value {
+	return String(errorArg("error-object-message", args).Message)
+}
+
+func ErrorObjectIrritants(args Vector) Value {
+	return errorArg("error-object-irritants", args).Irritants.ToList()
+}
+
+func ReadErrorPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
+	err, ok := args[0].(*Error)
+	return Boolean(ok && err.kind == readError)
+}
+
+func FileErrorPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
+	err, ok := args[0].(*Error)
+	return Boolean(ok && err.kind == fileError)
+}
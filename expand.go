@@ -0,0 +1,1460 @@
+package loom
+
+// Expand expands each macro use and derived expression within the top-level
+// form datum and returns the equivalent form in the core language: constants,
+// variable references, procedure calls, and quote, lambda, if, set!, define,
+// and begin forms. Macro uses are expanded in the global scope of env.
+//
+// Syntax definitions at the top level of datum are added to env. Syntax
+// definitions within bodies and the keywords bound by let-syntax and
+// letrec-syntax forms are expanded away. The variables that are bound by
+// identifiers inserted by a macro are written using their aliases, which are
+// unique to the expansion.
+func Expand(env *Env, datum Value) (v Value, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			v, err = nil, toError(x)
+		}
+	}()
+	return newExpander(env.globals).expandTopLevel(datum), nil
+}
+
+// specialForms is the set of keywords that are implemented by the expander
+// rather than by macros. Variables named by these keywords are always renamed,
+// as the backends recognize special forms by name.
+var specialForms = map[Symbol]bool{
+	"quote":         true,
+	"quasiquote":    true,
+	"lambda":        true,
+	"if":            true,
+	"set!":          true,
+	"include":       true,
+	"include-ci":    true,
+	"cond":          true,
+	"case":          true,
+	"and":           true,
+	"or":            true,
+	"let":           true,
+	"let*":          true,
+	"letrec":        true,
+	"letrec*":       true,
+	"receive":       true,
+	"let-values":    true,
+	"let*-values":   true,
+	"begin":         true,
+	"do":            true,
+	"when":          true,
+	"unless":        true,
+	"case-lambda":   true,
+	"guard":         true,
+	"define":        true,
+	"define-values": true,
+	"let-syntax":    true,
+	"letrec-syntax": true,
+	"define-syntax": true,
+}
+
+// expansionScope holds the bindings to which the expansions of derived
+// expressions refer: the builtin bindings and the procedures that implement
+// case-lambda and guard. It is not visible to programs.
+var expansionScope = &scope{env: map[Symbol]Value{
+	"make-case-lambda": ProcedureFunc(makeCaseLambda),
+	"call-with-guard":  guardProc,
+	"guard-no-match":   guardNoMatch,
+}, outer: globalScope}
+
+// builtin returns an identifier that refers to the binding of name in
+// expansionScope. The reference is not affected by any binding of name in the
+// program.
+func builtin(name Symbol) *identifier {
+	return &identifier{name: name, alias: newAlias(name), scope: expansionScope}
+}
+
+// isBuiltin returns true if v is an identifier that was returned by
+// builtin(name).
+func isBuiltin(v Value, name Symbol) bool {
+	id, ok := v.(*identifier)
+	return ok && id.scope == expansionScope && id.outer == nil && id.name == name
+}
+
+// An expander expands top-level forms in a global scope.
+type expander struct {
+	globals *scope
+
+	// top is the syntactic environment of the top level. It binds the
+	// identifiers that are defined at the top level by macro expansions.
+	top *syntacticEnv
+}
+
+func newExpander(globals *scope) *expander {
+	return &expander{globals: globals, top: &syntacticEnv{}}
+}
+
+// A syntacticEnv maps the symbols and identifiers that are bound by the forms
+// enclosing an expression to their denotations. Symbols are bound under their
+// names and identifiers under their aliases.
+type syntacticEnv struct {
+	bindings map[Symbol]*denotation
+	outer    *syntacticEnv
+}
+
+func (env *syntacticEnv) lookup(name Symbol) *denotation {
+	for ; env != nil; env = env.outer {
+		if d, ok := env.bindings[name]; ok {
+			return d
+		}
+	}
+	return nil
+}
+
+func (env *syntacticEnv) bind(name Symbol, d *denotation) {
+	if env.bindings == nil {
+		env.bindings = map[Symbol]*denotation{}
+	}
+	env.bindings[name] = d
+}
+
+func (env *syntacticEnv) push() *syntacticEnv {
+	return &syntacticEnv{outer: env}
+}
+
+// A denotation is the meaning of a bound symbol or identifier: a variable or a
+// keyword.
+type denotation struct {
+	variable Value        // the symbol or identifier that names the variable in the expansion
+	syntax   *syntaxRules // the transformer bound to the keyword
+}
+
+// A reference is the meaning of a symbol or identifier where it occurs. Symbols
+// and identifiers that are not bound by an enclosing form refer to the global
+// binding of their name.
+type reference struct {
+	local *denotation // the binding of an enclosing form, if any
+	name  Symbol      // the name of the global binding otherwise
+	scope *scope      // the global scope in which name is bound
+
+	// inserted is true if the reference to the global binding was inserted
+	// by a macro.
+	inserted bool
+}
+
+// keyword returns the transformer of the keyword to which r refers.
+func (r reference) keyword() (*syntaxRules, bool) {
+	if r.local != nil {
+		return r.local.syntax, r.local.syntax != nil
+	}
+	return r.scope.lookupKeyword(r.name)
+}
+
+// special returns the name of the special form to which r refers, if any.
+func (r reference) special() Symbol {
+	if r.local != nil || !specialForms[r.name] {
+		return ""
+	}
+	if _, ok := r.scope.lookupKeyword(r.name); ok {
+		return ""
+	}
+	return r.name
+}
+
+// resolve returns the meaning of the symbol or identifier v in env. An
+// identifier that is bound by the expansion that inserted it refers to that
+// binding; otherwise it refers to the binding of its symbol in the syntactic
+// environment of the macro definition.
+func (x *expander) resolve(v Value, env *syntacticEnv) reference {
+	id, ok := v.(*identifier)
+	if !ok {
+		name := v.(Symbol)
+		if d := env.lookup(name); d != nil {
+			return reference{local: d}
+		}
+		return reference{name: name, scope: x.globals}
+	}
+
+	for {
+		if d := env.lookup(id.alias); d != nil {
+			return reference{local: d}
+		}
+		env = id.env
+		if id.outer == nil {
+			if d := env.lookup(id.name); d != nil {
+				return reference{local: d}
+			}
+			scope := id.scope
+			if scope == nil {
+				scope = x.globals
+			}
+			return reference{name: id.name, scope: scope, inserted: true}
+		}
+		id = id.outer
+	}
+}
+
+// sameBinding returns true if the symbol or identifier form, which occurs in
+// formEnv, refers to the same binding as the literal p of a macro defined in
+// literalEnv.
+func (x *expander) sameBinding(form Value, formEnv *syntacticEnv, p Symbol, literalEnv *syntacticEnv) bool {
+	if sym, ok := symbolName(form); !ok || sym != p {
+		return false
+	}
+	f, l := x.resolve(form, formEnv), x.resolve(p, literalEnv)
+	if f.local != nil || l.local != nil {
+		return f.local == l.local
+	}
+	return f.name == l.name
+}
+
+// isAuxiliary returns true if the symbol or identifier v, which occurs in env,
+// refers to the auxiliary syntax name (else or =>). Like a literal of a
+// syntax-rules macro, auxiliary syntax is matched by binding, so a variable
+// named else or => that is bound by an enclosing form is not auxiliary syntax.
+func (x *expander) isAuxiliary(v Value, env *syntacticEnv, name Symbol) bool {
+	return x.sameBinding(v, env, name, nil)
+}
+
+// operator returns the meaning of the operator of form. The second result is
+// false if the operator is neither a symbol nor an identifier.
+func (x *expander) operator(form *Pair, env *syntacticEnv) (reference, bool) {
+	switch form.car.(type) {
+	case Symbol, *identifier:
+		return x.resolve(form.car, env), true
+	default:
+		return reference{}, false
+	}
+}
+
+// transcribe expands a use of the macro whose transformer is syntax. It is an
+// error if no rule matches the use.
+func (x *expander) transcribe(syntax *syntaxRules, form *Pair, env *syntacticEnv) Value {
+	defer recoverAt(form.pos)
+
+	if v, ok := syntax.apply(syntaxMatcher{expander: x, formEnv: env}, form); ok {
+		return v
+	}
+	panic(NewError("no syntax rule matches the macro use", form))
+}
+
+// expandMacroUses expands form while it is a macro use. If the result is a
+// special form, expandMacroUses also returns the name of the form.
+func (x *expander) expandMacroUses(form Value, env *syntacticEnv) (Value, Symbol) {
+	for {
+		p, ok := form.(*Pair)
+		if !ok {
+			return form, ""
+		}
+		r, ok := x.operator(p, env)
+		if !ok {
+			return form, ""
+		}
+		syntax, ok := r.keyword()
+		if !ok {
+			return form, r.special()
+		}
+		form = x.transcribe(syntax, p, env)
+	}
+}
+
+// expandOnce expands form once if it is a macro use or a derived expression.
+// The second result is false if form is neither.
+func (x *expander) expandOnce(form Value) (Value, bool) {
+	p, ok := form.(*Pair)
+	if !ok {
+		return form, false
+	}
+	r, ok := x.operator(p, x.top)
+	if !ok {
+		return form, false
+	}
+	syntax, ok := r.keyword()
+	if !ok {
+		return deriveOnce(p, r.special(), func(v Value, name Symbol) bool { return x.isAuxiliary(v, x.top, name) })
+	}
+	return x.transcribe(syntax, p, x.top), true
+}
+
+// hides returns true if a variable named name that is bound in env would hide
+// a binding to which the expansion may refer: a special form, a global
+// keyword, or a variable bound by an enclosing form.
+func (x *expander) hides(name Symbol, env *syntacticEnv) bool {
+	if specialForms[name] || env.lookup(name) != nil {
+		return true
+	}
+	_, ok := x.globals.lookupKeyword(name)
+	return ok
+}
+
+// bindVariable binds the symbol or identifier v to a new variable in env and
+// returns the name of the variable in the expansion. Variables that were
+// inserted by a macro are renamed to their aliases, and other variables that
+// would hide bindings to which the expansion may refer are renamed but keep
+// their names.
+func (x *expander) bindVariable(v Value, env *syntacticEnv) Value {
+	key, _ := variableName(v)
+	name, _ := symbolName(v)
+
+	var variable Value = name
+	switch _, inserted := v.(*identifier); {
+	case inserted || specialForms[name]:
+		alias := newAlias(name)
+		variable = &identifier{name: alias, alias: alias}
+	case x.hides(name, env):
+		variable = &identifier{name: name, alias: newAlias(name)}
+	}
+	env.bind(key, &denotation{variable: variable})
+	return variable
+}
+
+// temporary returns a new variable that is introduced by the expander.
+func temporary(name Symbol) *identifier {
+	alias := newAlias(name)
+	return &identifier{name: alias, alias: alias}
+}
+
+// bindFormals binds the variables of the formals of a lambda expression in env
+// and returns the formals of the expansion.
+func (x *expander) bindFormals(formals Value, env *syntacticEnv) Value {
+	makeFormals(formals)
+	return x.bindFormalList(formals, env)
+}
+
+func (x *expander) bindFormalList(formals Value, env *syntacticEnv) Value {
+	switch f := formals.(type) {
+	case Symbol, *identifier:
+		return x.bindVariable(f, env)
+	case *Pair:
+		return &Pair{car: x.bindVariable(f.car, env), cdr: x.bindFormalList(f.cdr, env), pos: f.pos}
+	default:
+		return nil
+	}
+}
+
+// defineVariable binds the variable v of a definition in env and returns the
+// name of the variable in the expansion. Symbols that are defined at the top
+// level name global variables. A variable that is already bound by the same
+// body is redefined.
+func (x *expander) defineVariable(v Value, env *syntacticEnv) Value {
+	if _, inserted := v.(*identifier); env == x.top && !inserted {
+		x.defineGlobal(v.(Symbol))
+		return v
+	}
+	key, _ := variableName(v)
+	if binding, ok := env.bindings[key]; ok && binding.syntax == nil {
+		return binding.variable
+	}
+	return x.bindVariable(v, env)
+}
+
+// defineGlobal prepares the global scope for a top-level definition of the
+// variable name. The definition replaces a global keyword of the same name.
+// Special forms may not be redefined at the top level, as the backends
+// recognize them by name.
+func (x *expander) defineGlobal(name Symbol) {
+	if specialForms[name] {
+		panic(NewError("syntactic keyword may not be redefined as a variable", name))
+	}
+	delete(x.globals.syntax, name)
+}
+
+// defineSyntax binds the keyword of a define-syntax form in env. Keywords that
+// are defined at the top level are added to the global scope unless they were
+// inserted by a macro.
+func (x *expander) defineSyntax(e *Pair, env *syntacticEnv) {
+	keyword, spec := syntaxDefinitionForm(e)
+	syntax := x.transformer(spec, env)
+
+	_, inserted := e.cdr.(*Pair).car.(*identifier)
+	if env == x.top && !inserted {
+		x.globals.setKeyword(keyword, syntax)
+		return
+	}
+	env.bind(keyword, &denotation{syntax: syntax})
+}
+
+// transformer returns the transformer described by a transformer spec that
+// occurs in env.
+func (x *expander) transformer(spec Value, env *syntacticEnv) *syntaxRules {
+	syntax := newSyntaxRules(spec, x.globals, nil)
+	syntax.env = env
+	return syntax
+}
+
+// expandTopLevel expands a top-level form. The forms within a top-level begin
+// form are also top-level forms, and are expanded in order.
+func (x *expander) expandTopLevel(form Value) Value {
+	form, special := x.expandMacroUses(form, x.top)
+
+	e, ok := form.(*Pair)
+	if !ok {
+		return x.expandExpr(form, x.top)
+	}
+	defer recoverAt(e.pos)
+
+	switch special {
+	case "begin", "include", "include-ci":
+		forms := sequenceForms(e, special)
+		for i, form := range forms {
+			forms[i] = x.expandTopLevel(form)
+		}
+		return sourceList(e, append([]Value{Symbol("begin")}, forms...)...)
+	case "define":
+		d := parseDefinition(e)
+		return x.expandDefinition(d, x.defineVariable(d.variable, x.top), x.top)
+	case "define-values":
+		return x.defineValues(e, x.top)()
+	case "define-syntax":
+		x.defineSyntax(e, x.top)
+		return sourceList(e, Symbol("begin"))
+	}
+	return x.expandExpr(e, x.top)
+}
+
+// sequenceForms returns the forms of a begin, include, or include-ci form.
+func sequenceForms(e *Pair, special Symbol) []Value {
+	switch special {
+	case "include":
+		return readIncludes(e, false)
+	case "include-ci":
+		return readIncludes(e, true)
+	default:
+		return listElements(e.cdr, "begin must be of the form (begin ⟨form⟩ ...)")
+	}
+}
+
+// A definition is a define form.
+type definition struct {
+	form     *Pair
+	variable Value // the symbol or identifier being defined
+
+	// formals is the formals of a procedure definition, and body is its body.
+	// For other definitions, body holds the expression.
+	formals     Value
+	isProcedure bool
+	body        []Value
+}
+
+func parseDefinition(e *Pair) definition {
+	const invalidDefine = "define must be of the form (define ⟨variable⟩ ⟨expression⟩), (define (⟨variable⟩ ⟨formals⟩) ⟨body⟩), or (define (⟨variable⟩ . ⟨formal⟩) ⟨body⟩)"
+
+	args := e.ToVector()
+	if len(args) < 3 {
+		panic(invalidDefine)
+	}
+
+	switch v := args[1].(type) {
+	case Symbol, *identifier:
+		if len(args) != 3 {
+			panic(invalidDefine)
+		}
+		return definition{form: e, variable: v, body: args[2:]}
+	case *Pair:
+		if _, ok := variableName(v.car); !ok {
+			panic(invalidDefine)
+		}
+		return definition{form: e, variable: v.car, formals: v.cdr, isProcedure: true, body: args[2:]}
+	default:
+		panic(invalidDefine)
+	}
+}
+
+// expandDefinition expands a definition of variable, which is the name of the
+// defined variable in the expansion.
+func (x *expander) expandDefinition(d definition, variable Value, env *syntacticEnv) Value {
+	defer recoverAt(d.form.pos)
+
+	if !d.isProcedure {
+		return sourceElements(d.form, Symbol("define"), variable, x.expandExpr(d.body[0], env))
+	}
+
+	inner := env.push()
+	signature := &Pair{car: variable, cdr: x.bindFormals(d.formals, inner), pos: d.form.cdr.(*Pair).car.(*Pair).pos}
+	return sourceList(d.form, append([]Value{Symbol("define"), signature}, x.expandBody(d.body, inner)...)...)
+}
+
+// expandBody expands the forms of a body in env, which holds the bindings of
+// the body's region. The macro uses at the top level of the body are expanded
+// first in order to find the body's definitions, which are bound before any of
+// the body's expressions are expanded so that the definitions may refer to one
+// another.
+func (x *expander) expandBody(forms []Value, env *syntacticEnv) []Value {
+	var expansions []func() Value
+	for len(forms) != 0 {
+		spliced, expansion := x.scanBodyForm(forms[0], env)
+		forms = append(spliced, forms[1:]...)
+		if expansion != nil {
+			expansions = append(expansions, expansion)
+		}
+	}
+
+	body := make([]Value, len(expansions))
+	for i, expand := range expansions {
+		body[i] = expand()
+	}
+	return body
+}
+
+// scanBodyForm scans a form at the top level of a body. If the form is a begin
+// or include form, scanBodyForm returns the forms that it contains; otherwise,
+// it binds the form's definitions and returns a function that expands it.
+func (x *expander) scanBodyForm(form Value, env *syntacticEnv) ([]Value, func() Value) {
+	form, special := x.expandMacroUses(form, env)
+
+	e, ok := form.(*Pair)
+	if !ok {
+		return nil, func() Value { return x.expandExpr(form, env) }
+	}
+	defer recoverAt(e.pos)
+
+	switch special {
+	case "begin", "include", "include-ci":
+		return sequenceForms(e, special), nil
+	case "define":
+		d := parseDefinition(e)
+		variable := x.defineVariable(d.variable, env)
+		return nil, func() Value { return x.expandDefinition(d, variable, env) }
+	case "define-values":
+		return nil, x.defineValues(e, env)
+	case "define-syntax":
+		x.defineSyntax(e, env)
+		return nil, nil
+	}
+	return nil, func() Value { return x.expandExpr(e, env) }
+}
+
+// expandExpr expands an expression in env.
+func (x *expander) expandExpr(v Value, env *syntacticEnv) Value {
+	switch e := v.(type) {
+	case Symbol, *identifier:
+		return x.variable(e, env)
+	case Vector:
+		result := make(Vector, len(e))
+		for i, v := range e {
+			result[i] = x.expandExpr(v, env)
+		}
+		return result
+	case *Pair:
+		return x.expandForm(e, env)
+	default:
+		return v
+	}
+}
+
+// expandExprs expands each of a sequence of expressions in env.
+func (x *expander) expandExprs(exprs []Value, env *syntacticEnv) []Value {
+	result := make([]Value, len(exprs))
+	for i, e := range exprs {
+		result[i] = x.expandExpr(e, env)
+	}
+	return result
+}
+
+// variable returns the expansion of a reference to the variable named by the
+// symbol or identifier v. A reference to a global variable that was inserted by
+// a macro is replaced by an identifier that refers to the global binding if a
+// variable of the same name is bound where the reference occurs.
+func (x *expander) variable(v Value, env *syntacticEnv) Value {
+	r := x.resolve(v, env)
+	switch {
+	case r.local != nil && r.local.syntax != nil:
+		sym, _ := symbolName(v)
+		panic(NewError("syntactic keyword may not be used as a variable", sym))
+	case r.local != nil:
+		return r.local.variable
+	case !r.inserted || r.scope == x.globals && env.lookup(r.name) == nil:
+		return r.name
+	default:
+		return &identifier{name: r.name, alias: newAlias(r.name), scope: r.scope}
+	}
+}
+
+// expandForm expands a list expression in env.
+func (x *expander) expandForm(e *Pair, env *syntacticEnv) Value {
+	defer recoverAt(e.pos)
+
+	form, special := x.expandMacroUses(e, env)
+	p, ok := form.(*Pair)
+	if !ok {
+		return x.expandExpr(form, env)
+	}
+
+	switch special {
+	// primitive expressions
+	case "quote":
+		return x.expandQuote(p)
+	case "quasiquote":
+		arg, ok := p.cdr.(*Pair)
+		if !ok || arg.cdr != nil {
+			panic("quasiquote must be of the form (quasiquote ⟨qq template⟩)")
+		}
+		return x.expandExpr(expandQuasiquote(arg.car), env)
+	case "lambda":
+		return x.expandLambda(p, env)
+	case "if":
+		args := p.ToVector()
+		if len(args) < 3 || len(args) > 4 {
+			panic("if must be of the form (if ⟨test⟩ ⟨consequent⟩) or (if ⟨test⟩ ⟨consequent⟩ ⟨alternate⟩)")
+		}
+		return sourceElements(p, append([]Value{Symbol("if")}, x.expandExprs(args[1:], env)...)...)
+	case "set!":
+		args := p.ToVector()
+		if len(args) != 3 || !isVariable(args[1]) {
+			panic("set! must be of the form (set! ⟨variable⟩ ⟨expression⟩)")
+		}
+		return sourceElements(p, Symbol("set!"), x.variable(args[1], env), x.expandExpr(args[2], env))
+	case "begin", "include", "include-ci":
+		return sequenceExpr(p, x.expandExprs(sequenceForms(p, special), env))
+
+	// derived expressions
+	case "cond":
+		return x.expandCond(p, env)
+	case "case":
+		return x.expandCase(p, env)
+	case "and":
+		return x.expandAnd(p, env)
+	case "or":
+		return x.expandOr(p, env)
+	case "let":
+		return x.expandLet(p, env)
+	case "let*":
+		return x.expandLetStar(p, env)
+	case "letrec", "letrec*":
+		return x.expandLetrec(p, env)
+	case "receive":
+		return x.expandReceive(p, env)
+	case "let-values":
+		return x.expandLetValues(p, env)
+	case "let*-values":
+		return x.expandLetStarValues(p, env)
+	case "do":
+		return x.expandDo(p, env)
+	case "when", "unless":
+		return x.expandWhen(p, env, special == "unless")
+	case "case-lambda":
+		return x.expandCaseLambda(p, env)
+	case "guard":
+		return x.expandGuard(p, env)
+
+	// macros
+	case "let-syntax":
+		return x.expandLetSyntax(p, env, false)
+	case "letrec-syntax":
+		return x.expandLetSyntax(p, env, true)
+
+	// definitions
+	case "define", "define-values", "define-syntax":
+		if env != x.top {
+			panic("definitions are valid only at the outermost level of a program and at the beginning of a body")
+		}
+		return x.expandTopLevel(p)
+	}
+
+	return sourceElements(p, x.expandExprs(p.ToVector(), env)...)
+}
+
+// isVariable returns true if v is a symbol or an identifier.
+func isVariable(v Value) bool {
+	_, ok := variableName(v)
+	return ok
+}
+
+// sourceList returns a new list of the given elements that is attributed to
+// the source position of e.
+func sourceList(e *Pair, elements ...Value) Value {
+	l, _ := list(elements...).(*Pair)
+	if l != nil {
+		l.pos = e.pos
+	}
+	return l
+}
+
+// sourceElements is like sourceList, but each element of the new list is also
+// attributed to the source position of the corresponding element of e.
+func sourceElements(e *Pair, elements ...Value) Value {
+	l, _ := list(elements...).(*Pair)
+	if l == nil {
+		return nil
+	}
+	l.pos, l.carPos = e.pos, e.carPos
+	for p, q := l, e; ; {
+		next, ok := p.cdr.(*Pair)
+		if !ok {
+			return l
+		}
+		if q, ok = q.cdr.(*Pair); !ok {
+			return l
+		}
+		next.pos, p = q.pos, next
+	}
+}
+
+// sequenceExpr returns an expression that evaluates exprs in order.
+func sequenceExpr(e *Pair, exprs []Value) Value {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	return sourceList(e, append([]Value{Symbol("begin")}, exprs...)...)
+}
+
+// lambdaExpr returns a lambda expression with the given formals and body.
+func lambdaExpr(e *Pair, formals Value, body []Value) Value {
+	return sourceList(e, append([]Value{Symbol("lambda"), formals}, body...)...)
+}
+
+// unspecified returns an expression whose value is unspecified.
+func unspecified(e *Pair) Value {
+	return sourceList(e, Symbol("if"), Boolean(false), Boolean(false))
+}
+
+// bind returns an expression that evaluates body with variable bound to the
+// value of init.
+func bind(e *Pair, variable, init, body Value) Value {
+	return sourceList(e, sourceList(e, Symbol("lambda"), list(variable), body), init)
+}
+
+// receive returns an expression that evaluates body with formals bound to the
+// values of init as if by a call to a procedure with those formals. The
+// backends evaluate the expression without calling either lambda expression.
+func receive(e *Pair, formals, init Value, body []Value) Value {
+	return sourceList(e, builtin("call-with-values"), lambdaExpr(e, nil, []Value{init}), lambdaExpr(e, formals, body))
+}
+
+// isSimple returns true if evaluating the expansion v has no effects, so that
+// v may be evaluated more than once.
+func isSimple(v Value) bool {
+	switch v.(type) {
+	case Symbol, *identifier, Number, Boolean, Character, String:
+		return true
+	default:
+		return false
+	}
+}
+
+// (quote ⟨datum⟩)
+//
+// Identifiers within ⟨datum⟩ are replaced by their symbols.
+func (x *expander) expandQuote(e *Pair) Value {
+	arg, ok := e.cdr.(*Pair)
+	if !ok || arg.cdr != nil {
+		panic("quote must be of the form (quote ⟨datum⟩)")
+	}
+	return sourceList(e, Symbol("quote"), unwrapSyntax(arg.car))
+}
+
+// (lambda ⟨formals⟩ ⟨body⟩)
+func (x *expander) expandLambda(e *Pair, env *syntacticEnv) Value {
+	args := e.ToVector()
+	if len(args) < 3 {
+		panic("lambda must be of the form (lambda ⟨formals⟩ ⟨body⟩)")
+	}
+
+	inner := env.push()
+	formals := x.bindFormals(args[1], inner)
+	return lambdaExpr(e, formals, x.expandBody(args[2:], inner))
+}
+
+// (cond ⟨clause1⟩ ⟨clause2⟩ ...)
+//
+// The cond form is expanded to nested if expressions.
+func (x *expander) expandCond(e *Pair, env *syntacticEnv) Value {
+	return x.expandClauses(e.cdr, env, unspecified(e))
+}
+
+// expandClauses expands a list of cond clauses. If no clause is selected, the
+// value of the expansion is the value of otherwise.
+func (x *expander) expandClauses(clauses Value, env *syntacticEnv, otherwise Value) Value {
+	const invalidClause = "cond clause must be of the form (⟨test⟩ ⟨expression1⟩ ...), (⟨test⟩ => ⟨expression⟩), or (else ⟨expression1⟩ ⟨expression2⟩ ...)"
+
+	elements := listElements(clauses, invalidClause)
+	alternatives := make([]func(Value) Value, len(elements))
+	for i, c := range elements {
+		clause, ok := c.(*Pair)
+		if !ok {
+			panic(invalidClause)
+		}
+
+		if i == len(elements)-1 && x.isAuxiliary(clause.car, env, "else") {
+			body := sequenceExpr(clause, x.expandExprs(listElements(clause.cdr, invalidClause), env))
+			alternatives[i] = func(Value) Value { return body }
+			continue
+		}
+
+		test := x.expandExpr(clause.car, env)
+		alternatives[i] = x.expandClause(clause, test, env, invalidClause)
+	}
+
+	v := otherwise
+	for i := len(alternatives) - 1; i >= 0; i-- {
+		v = alternatives[i](v)
+	}
+	return v
+}
+
+// expandClause expands a cond clause whose test expands to test. It returns a
+// function that returns the expansion of the clause given the expression that
+// is evaluated if the clause is not selected.
+//
+//	(⟨test⟩)                  => (or ⟨test⟩ ⟨otherwise⟩)
+//	(⟨test⟩ => ⟨expression⟩)  => (let ((t ⟨test⟩)) (if t (⟨expression⟩ t) ⟨otherwise⟩))
+//	(⟨test⟩ ⟨expression⟩ ...) => (if ⟨test⟩ (begin ⟨expression⟩ ...) ⟨otherwise⟩)
+func (x *expander) expandClause(clause *Pair, test Value, env *syntacticEnv, invalid string) func(Value) Value {
+	exprs := listElements(clause.cdr, invalid)
+	switch {
+	case len(exprs) == 0:
+		return func(otherwise Value) Value { return either(clause, test, otherwise) }
+	case x.isAuxiliary(exprs[0], env, "=>"):
+		if len(exprs) != 2 {
+			panic("clause must be of the form (⟨test⟩ => ⟨expression⟩)")
+		}
+		receiver := x.expandExpr(exprs[1], env)
+		return func(otherwise Value) Value {
+			t := temporary("t")
+			return bind(clause, t, test, sourceList(clause, Symbol("if"), t, sourceList(clause, receiver, t), otherwise))
+		}
+	default:
+		body := sequenceExpr(clause, x.expandExprs(exprs, env))
+		return func(otherwise Value) Value { return sourceList(clause, Symbol("if"), test, body, otherwise) }
+	}
+}
+
+// either returns an expression whose value is the value of test if that value
+// is true and the value of otherwise if it is not.
+func either(e *Pair, test, otherwise Value) Value {
+	if isSimple(test) {
+		return sourceList(e, Symbol("if"), test, test, otherwise)
+	}
+	t := temporary("t")
+	return bind(e, t, test, sourceList(e, Symbol("if"), t, t, otherwise))
+}
+
+// (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)
+//
+// The case form is expanded to nested if expressions that test the value of
+// ⟨key⟩ for membership in each clause's data in turn with memv.
+func (x *expander) expandCase(e *Pair, env *syntacticEnv) Value {
+	const invalidClause = "case clause must be of the form ((⟨datum1⟩ ...) ⟨expression1⟩ ⟨expression2⟩ ...), ((⟨datum1⟩ ...) => ⟨expression⟩), (else ⟨expression1⟩ ⟨expression2⟩ ...), or (else => ⟨expression⟩)."
+
+	keyp, ok := e.cdr.(*Pair)
+	if !ok {
+		panic("case must be of the form (case ⟨key⟩ ⟨clause1⟩ ⟨clause2⟩ ...)")
+	}
+
+	key := x.expandExpr(keyp.car, env)
+	k, simple := key, isSimple(key)
+	if !simple {
+		k = temporary("key")
+	}
+
+	elements := listElements(keyp.cdr, invalidClause)
+	alternatives := make([]func(Value) Value, len(elements))
+	for i, c := range elements {
+		clause, ok := c.(*Pair)
+		if !ok {
+			panic(invalidClause)
+		}
+
+		body := x.expandCaseBody(clause, k, env, invalidClause)
+		if i == len(elements)-1 && x.isAuxiliary(clause.car, env, "else") {
+			alternatives[i] = func(Value) Value { return body }
+			continue
+		}
+
+		test := sourceList(clause, builtin("memv"), k, quoted(unwrapSyntax(clause.car)))
+		alternatives[i] = func(otherwise Value) Value {
+			return sourceList(clause, Symbol("if"), test, body, otherwise)
+		}
+	}
+
+	v := unspecified(e)
+	for i := len(alternatives) - 1; i >= 0; i-- {
+		v = alternatives[i](v)
+	}
+	if !simple {
+		v = bind(e, k, key, v)
+	}
+	return v
+}
+
+// expandCaseBody expands the body of a case clause. The body of a clause of the
+// form (⟨data⟩ => ⟨expression⟩) is a call to ⟨expression⟩ with the key k.
+func (x *expander) expandCaseBody(clause *Pair, k Value, env *syntacticEnv, invalid string) Value {
+	exprs := listElements(clause.cdr, invalid)
+	if len(exprs) != 0 && x.isAuxiliary(exprs[0], env, "=>") {
+		if len(exprs) != 2 {
+			panic("clause must be of the form (⟨data⟩ => ⟨expression⟩)")
+		}
+		return sourceList(clause, x.expandExpr(exprs[1], env), k)
+	}
+	return sequenceExpr(clause, x.expandExprs(exprs, env))
+}
+
+// (and ⟨test1⟩ ...)
+//
+//	(and)                => #t
+//	(and ⟨test⟩)         => ⟨test⟩
+//	(and ⟨test⟩ ⟨rest⟩ ...) => (if ⟨test⟩ (and ⟨rest⟩ ...) #f)
+func (x *expander) expandAnd(e *Pair, env *syntacticEnv) Value {
+	tests := x.expandExprs(listElements(e.cdr, "and must be of the form (and ⟨test1⟩ ...)"), env)
+	if len(tests) == 0 {
+		return Boolean(true)
+	}
+
+	v := tests[len(tests)-1]
+	for i := len(tests) - 2; i >= 0; i-- {
+		v = sourceList(e, Symbol("if"), tests[i], v, Boolean(false))
+	}
+	return v
+}
+
+// (or ⟨test1⟩ ...)
+//
+//	(or)                => #f
+//	(or ⟨test⟩)         => ⟨test⟩
+//	(or ⟨test⟩ ⟨rest⟩ ...) => (let ((t ⟨test⟩)) (if t t (or ⟨rest⟩ ...)))
+func (x *expander) expandOr(e *Pair, env *syntacticEnv) Value {
+	tests := x.expandExprs(listElements(e.cdr, "or must be of the form (or ⟨test1⟩ ...)"), env)
+	if len(tests) == 0 {
+		return Boolean(false)
+	}
+
+	v := tests[len(tests)-1]
+	for i := len(tests) - 2; i >= 0; i-- {
+		v = either(e, tests[i], v)
+	}
+	return v
+}
+
+// (let ⟨bindings⟩ ⟨body⟩)
+// (let ⟨variable⟩ ⟨bindings⟩ ⟨body⟩)
+//
+// An ordinary let is expanded to the application of a lambda expression whose
+// formals are the bound variables. A named let is expanded to the application
+// of a procedure that is defined with the name ⟨variable⟩ within its own
+// region:
+//
+//	(((lambda () (define (⟨variable⟩ ⟨formals⟩) ⟨body⟩) ⟨variable⟩)) ⟨init⟩ ...)
+func (x *expander) expandLet(e *Pair, env *syntacticEnv) Value {
+	const invalidLet = "let must be of the form (let ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) == 0 {
+		panic(invalidLet)
+	}
+
+	var name Value
+	if isVariable(args[0]) {
+		name, args = args[0], args[1:]
+		if len(args) == 0 {
+			panic(invalidLet)
+		}
+	}
+
+	variables, inits, ok := bindingForms(args[0])
+	if !ok {
+		panic(invalidLet)
+	}
+	inits = x.expandExprs(inits, env)
+
+	if name == nil {
+		inner := env.push()
+		formals := x.bindFormals(list(variables...), inner)
+		lambda := lambdaExpr(e, formals, x.expandBody(args[1:], inner))
+		return sourceList(e, append([]Value{lambda}, inits...)...)
+	}
+
+	outer := env.push()
+	proc := x.bindVariable(name, outer)
+	inner := outer.push()
+	signature := Cons(proc, x.bindFormals(list(variables...), inner))
+	define := sourceList(e, append([]Value{Symbol("define"), signature}, x.expandBody(args[1:], inner)...)...)
+	lambda := sourceList(e, Symbol("lambda"), nil, define, proc)
+	return sourceList(e, append([]Value{sourceList(e, lambda)}, inits...)...)
+}
+
+// bindingForms returns the variables and initializers of the bindings of a let
+// form. Unlike letBindings, it returns the variables as written.
+func bindingForms(e Value) ([]Value, []Value, bool) {
+	variables, inits, ok := formalsBindingForms(e)
+	if !ok {
+		return nil, nil, false
+	}
+	for _, v := range variables {
+		if !isVariable(v) {
+			return nil, nil, false
+		}
+	}
+	return variables, inits, true
+}
+
+// formalsBindingForms returns the formals and initializers of the bindings of a
+// let-values form. The formals are not checked.
+func formalsBindingForms(e Value) ([]Value, []Value, bool) {
+	var formals, inits []Value
+	for e != nil {
+		bindings, ok := e.(*Pair)
+		if !ok {
+			return nil, nil, false
+		}
+		binding, ok := bindings.car.(*Pair)
+		if !ok {
+			return nil, nil, false
+		}
+		init, ok := binding.cdr.(*Pair)
+		if !ok || init.cdr != nil {
+			return nil, nil, false
+		}
+
+		formals, inits = append(formals, binding.car), append(inits, init.car)
+		e = bindings.cdr
+	}
+	return formals, inits, true
+}
+
+// formalVariables returns the variables of formals in order.
+func formalVariables(formals Value) []Value {
+	switch f := formals.(type) {
+	case *Pair:
+		return append([]Value{f.car}, formalVariables(f.cdr)...)
+	case nil:
+		return nil
+	default:
+		return []Value{f}
+	}
+}
+
+// temporaries returns formals of the same shape as formals whose variables are
+// new temporaries. It also returns the temporaries in order.
+func temporaries(formals Value) (Value, []Value) {
+	switch f := formals.(type) {
+	case *Pair:
+		name, _ := symbolName(f.car)
+		t := temporary(name)
+		rest, ts := temporaries(f.cdr)
+		return &Pair{car: t, cdr: rest, pos: f.pos}, append([]Value{t}, ts...)
+	case nil:
+		return nil, nil
+	default:
+		name, _ := symbolName(f)
+		t := temporary(name)
+		return t, []Value{t}
+	}
+}
+
+// (let* ⟨bindings⟩ ⟨body⟩)
+//
+// The let* form is expanded to nested let expressions, each of which binds a
+// single variable:
+//
+//	(let* () ⟨body⟩)                     => (let () ⟨body⟩)
+//	(let* (⟨binding⟩ ⟨rest⟩ ...) ⟨body⟩) => (let (⟨binding⟩) (let* (⟨rest⟩ ...) ⟨body⟩))
+func (x *expander) expandLetStar(e *Pair, env *syntacticEnv) Value {
+	const invalidLetStar = "let* must be of the form (let* ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetStar)
+	}
+	variables, inits, ok := bindingForms(args[0])
+	if !ok {
+		panic(invalidLetStar)
+	}
+
+	inner := env.push()
+	formals := make([]Value, len(variables))
+	for i, v := range variables {
+		if i != 0 {
+			inner = inner.push()
+		}
+		inits[i] = x.expandExpr(inits[i], inner.outer)
+		formals[i] = x.bindVariable(v, inner)
+	}
+	body := x.expandBody(args[1:], inner)
+
+	if len(formals) == 0 {
+		return sourceList(e, lambdaExpr(e, nil, body))
+	}
+	last := len(formals) - 1
+	v := sourceList(e, lambdaExpr(e, list(formals[last]), body), inits[last])
+	for i := last - 1; i >= 0; i-- {
+		v = bind(e, formals[i], inits[i], v)
+	}
+	return v
+}
+
+// (letrec ⟨bindings⟩ ⟨body⟩)
+// (letrec* ⟨bindings⟩ ⟨body⟩)
+//
+// Both forms are expanded to the application of a procedure of no arguments
+// whose body defines the variables in order, which gives them the semantics of
+// letrec*:
+//
+//	((lambda () (define ⟨variable1⟩ ⟨init1⟩) ... (let () ⟨body⟩)))
+//
+// The body is wrapped in a let only if it contains definitions of its own.
+func (x *expander) expandLetrec(e *Pair, env *syntacticEnv) Value {
+	keyword, _ := symbolName(e.car)
+	invalidLetrec := string(keyword) + " must be of the form (" + string(keyword) + " ((⟨variable1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetrec)
+	}
+	variables, inits, ok := bindingForms(args[0])
+	if !ok {
+		panic(invalidLetrec)
+	}
+
+	inner := env.push()
+	formals := listElements(x.bindFormals(list(variables...), inner), invalidLetrec)
+	forms := make([]Value, len(formals))
+	for i, v := range formals {
+		forms[i] = sourceList(e, Symbol("define"), v, x.expandExpr(inits[i], inner))
+	}
+
+	bodyEnv := inner.push()
+	body := x.expandBody(args[1:], bodyEnv)
+	if len(bodyEnv.bindings) != 0 {
+		body = []Value{sourceList(e, lambdaExpr(e, nil, body))}
+	}
+	return sourceList(e, lambdaExpr(e, nil, append(forms, body...)))
+}
+
+// (receive ⟨formals⟩ ⟨expression⟩ ⟨body⟩)
+//
+// The ⟨expression⟩ is evaluated, and the values it returns are bound to the
+// variables of ⟨formals⟩ as if by a call to a procedure with those formals
+// (SRFI 8). The form is expanded to a call to call-with-values:
+//
+//	(call-with-values (lambda () ⟨expression⟩) (lambda ⟨formals⟩ ⟨body⟩))
+func (x *expander) expandReceive(e *Pair, env *syntacticEnv) Value {
+	args := e.ToVector()[1:]
+	if len(args) < 3 {
+		panic("receive must be of the form (receive ⟨formals⟩ ⟨expression⟩ ⟨body⟩)")
+	}
+	init := x.expandExpr(args[1], env)
+
+	inner := env.push()
+	formals := x.bindFormals(args[0], inner)
+	return receive(e, formals, init, x.expandBody(args[2:], inner))
+}
+
+// (let-values ⟨mv binding spec⟩ ⟨body⟩)
+//
+// Each ⟨init⟩ is evaluated in turn and its values are received by temporaries
+// with the same shape as its ⟨formals⟩. The body is then evaluated with the
+// variables of the ⟨formals⟩ bound to the temporaries:
+//
+//	(receive ⟨temporaries1⟩ ⟨init1⟩ ... ((lambda (⟨variable⟩ ...) ⟨body⟩) ⟨temporary⟩ ...))
+//
+// A let-values form with a single binding receives the values of its ⟨init⟩
+// directly.
+func (x *expander) expandLetValues(e *Pair, env *syntacticEnv) Value {
+	const invalidLetValues = "let-values must be of the form (let-values ((⟨formals1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetValues)
+	}
+	formals, inits, ok := formalsBindingForms(args[0])
+	if !ok {
+		panic(invalidLetValues)
+	}
+	inits = x.expandExprs(inits, env)
+
+	var variables []Value
+	for _, f := range formals {
+		makeFormals(f)
+		variables = append(variables, formalVariables(f)...)
+	}
+	makeFormals(list(variables...))
+
+	inner := env.push()
+	bound := make([]Value, len(formals))
+	for i, f := range formals {
+		bound[i] = x.bindFormalList(f, inner)
+	}
+	body := x.expandBody(args[1:], inner)
+
+	if len(formals) == 1 {
+		return receive(e, bound[0], inits[0], body)
+	}
+
+	var boundVariables, temps []Value
+	receivers := make([]Value, len(formals))
+	for i, f := range formals {
+		var ts []Value
+		receivers[i], ts = temporaries(f)
+		boundVariables, temps = append(boundVariables, formalVariables(bound[i])...), append(temps, ts...)
+	}
+
+	v := sourceList(e, append([]Value{lambdaExpr(e, list(boundVariables...), body)}, temps...)...)
+	for i := len(formals) - 1; i >= 0; i-- {
+		v = receive(e, receivers[i], inits[i], []Value{v})
+	}
+	return v
+}
+
+// (let*-values ⟨mv binding spec⟩ ⟨body⟩)
+//
+// The let*-values form is expanded to nested receptions of the values of each
+// ⟨init⟩, each of which is evaluated in the region of the preceding bindings:
+//
+//	(receive ⟨formals1⟩ ⟨init1⟩ (receive ⟨formals2⟩ ⟨init2⟩ ... ⟨body⟩))
+func (x *expander) expandLetStarValues(e *Pair, env *syntacticEnv) Value {
+	const invalidLetStarValues = "let*-values must be of the form (let*-values ((⟨formals1⟩ ⟨init1⟩) ...) ⟨body⟩)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidLetStarValues)
+	}
+	formals, inits, ok := formalsBindingForms(args[0])
+	if !ok {
+		panic(invalidLetStarValues)
+	}
+
+	inner := env.push()
+	bound := make([]Value, len(formals))
+	for i, f := range formals {
+		if i != 0 {
+			inner = inner.push()
+		}
+		inits[i] = x.expandExpr(inits[i], inner.outer)
+		bound[i] = x.bindFormals(f, inner)
+	}
+	body := x.expandBody(args[1:], inner)
+
+	if len(formals) == 0 {
+		return sourceList(e, lambdaExpr(e, nil, body))
+	}
+	last := len(formals) - 1
+	v := receive(e, bound[last], inits[last], body)
+	for i := last - 1; i >= 0; i-- {
+		v = receive(e, bound[i], inits[i], []Value{v})
+	}
+	return v
+}
+
+// (define-values ⟨formals⟩ ⟨expression⟩)
+//
+// defineValues binds the variables of a define-values form in env and returns a
+// function that expands the form. Each variable is defined and then assigned
+// the corresponding value of ⟨expression⟩:
+//
+//	(begin
+//	  (define ⟨variable⟩ (if #f #f)) ...
+//	  (receive ⟨temporaries⟩ ⟨expression⟩ (set! ⟨variable⟩ ⟨temporary⟩) ...))
+func (x *expander) defineValues(e *Pair, env *syntacticEnv) func() Value {
+	const invalidDefineValues = "define-values must be of the form (define-values ⟨formals⟩ ⟨expression⟩)"
+
+	args := e.ToVector()
+	if len(args) != 3 {
+		panic(invalidDefineValues)
+	}
+	makeFormals(args[1])
+
+	variables := formalVariables(args[1])
+	for i, v := range variables {
+		variables[i] = x.defineVariable(v, env)
+	}
+
+	return func() Value {
+		defer recoverAt(e.pos)
+
+		receiver, temps := temporaries(args[1])
+		forms := []Value{Symbol("begin")}
+		assignments := []Value{unspecified(e)}
+		if len(variables) != 0 {
+			assignments = make([]Value, len(variables))
+		}
+		for i, v := range variables {
+			forms = append(forms, sourceList(e, Symbol("define"), v, unspecified(e)))
+			assignments[i] = sourceList(e, Symbol("set!"), v, temps[i])
+		}
+		forms = append(forms, receive(e, receiver, x.expandExpr(args[2], env), assignments))
+		return sourceList(e, forms...)
+	}
+}
+
+// (do ((⟨variable1⟩ ⟨init1⟩ ⟨step1⟩) ...)
+//     (⟨test⟩ ⟨expression⟩ ...)
+//   ⟨command⟩ ...)
+//
+// The do form is expanded to a loop procedure, as for a named let:
+//
+//	(let ⟨loop⟩ ((⟨variable1⟩ ⟨init1⟩) ...)
+//	  (if ⟨test⟩
+//	      (begin ⟨expression⟩ ...)
+//	      (begin ⟨command⟩ ... (⟨loop⟩ ⟨step1⟩ ...))))
+//
+// A variable without a ⟨step⟩ is passed to the next iteration unchanged.
+func (x *expander) expandDo(e *Pair, env *syntacticEnv) Value {
+	const invalidDo = "do must be of the form (do ((⟨variable1⟩ ⟨init1⟩ ⟨step1⟩) ...) (⟨test⟩ ⟨expression⟩ ...) ⟨command⟩ ...)"
+
+	args := e.ToVector()[1:]
+	if len(args) < 2 {
+		panic(invalidDo)
+	}
+
+	var variables, inits, steps []Value
+	for _, spec := range listElements(args[0], invalidDo) {
+		parts := listElements(spec, invalidDo)
+		if len(parts) < 2 || len(parts) > 3 || !isVariable(parts[0]) {
+			panic(invalidDo)
+		}
+		step := parts[0]
+		if len(parts) == 3 {
+			step = parts[2]
+		}
+		variables, inits, steps = append(variables, parts[0]), append(inits, parts[1]), append(steps, step)
+	}
+	exit, ok := args[1].(*Pair)
+	if !ok {
+		panic(invalidDo)
+	}
+	inits = x.expandExprs(inits, env)
+
+	loop := temporary("do")
+	inner := env.push()
+	formals := x.bindFormals(list(variables...), inner)
+
+	test := x.expandExpr(exit.car, inner)
+	result := unspecified(exit)
+	if exprs := listElements(exit.cdr, invalidDo); len(exprs) != 0 {
+		result = sequenceExpr(exit, x.expandExprs(exprs, inner))
+	}
+	commands := x.expandExprs(args[2:], inner)
+	next := sourceList(e, append([]Value{loop}, x.expandExprs(steps, inner)...)...)
+
+	body := sourceList(e, Symbol("if"), test, result, sequenceExpr(e, append(commands, next)))
+	define := sourceList(e, Symbol("define"), Cons(loop, formals), body)
+	lambda := lambdaExpr(e, nil, []Value{define, loop})
+	return sourceList(e, append([]Value{sourceList(e, lambda)}, inits...)...)
+}
+
+// (when ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)
+// (unless ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)
+//
+//	(when ⟨test⟩ ⟨expression⟩ ...)   => (if ⟨test⟩ (begin ⟨expression⟩ ...))
+//	(unless ⟨test⟩ ⟨expression⟩ ...) => (if ⟨test⟩ (if #f #f) (begin ⟨expression⟩ ...))
+func (x *expander) expandWhen(e *Pair, env *syntacticEnv, unless bool) Value {
+	keyword, _ := symbolName(e.car)
+	invalidWhen := string(keyword) + " must be of the form (" + string(keyword) + " ⟨test⟩ ⟨expression1⟩ ⟨expression2⟩ ...)"
+
+	args := x.expandExprs(listElements(e.cdr, invalidWhen), env)
+	if len(args) < 2 {
+		panic(invalidWhen)
+	}
+
+	body := sequenceExpr(e, args[1:])
+	if unless {
+		return sourceList(e, Symbol("if"), args[0], unspecified(e), body)
+	}
+	return sourceList(e, Symbol("if"), args[0], body)
+}
+
+// (case-lambda ⟨clause⟩ ...)
+//
+// Each ⟨clause⟩ is of the form (⟨formals⟩ ⟨body⟩). The case-lambda form is
+// expanded to a call to make-case-lambda with a lambda expression for each
+// clause.
+func (x *expander) expandCaseLambda(e *Pair, env *syntacticEnv) Value {
+	const invalidCaseLambda = "case-lambda must be of the form (case-lambda (⟨formals⟩ ⟨body⟩) ...)"
+
+	call := []Value{builtin("make-case-lambda")}
+	for _, c := range listElements(e.cdr, invalidCaseLambda) {
+		clause, ok := c.(*Pair)
+		if !ok || clause.cdr == nil {
+			panic(invalidCaseLambda)
+		}
+		call = append(call, x.expandLambda(&Pair{car: Symbol("lambda"), cdr: clause, pos: clause.pos}, env))
+	}
+	return sourceList(e, call...)
+}
+
+// (guard (⟨variable⟩
+//         ⟨cond clause1⟩ ⟨cond clause2⟩ ...)
+//   ⟨body⟩)
+//
+// The guard form is expanded to a call to call-with-guard with a thunk whose
+// body is ⟨body⟩ and a procedure of ⟨variable⟩ that evaluates the clauses and
+// returns the value of guard-no-match if no clause is selected.
+func (x *expander) expandGuard(e *Pair, env *syntacticEnv) Value {
+	const invalidGuard = "guard must be of the form (guard (⟨variable⟩ ⟨cond clause1⟩ ⟨cond clause2⟩ ...) ⟨body⟩)"
+
+	args, ok := e.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+	spec, ok := args.car.(*Pair)
+	if !ok || !isVariable(spec.car) {
+		panic(invalidGuard)
+	}
+	body, ok := args.cdr.(*Pair)
+	if !ok {
+		panic(invalidGuard)
+	}
+
+	thunk := lambdaExpr(e, nil, x.expandBody(body.ToVector(), env.push()))
+
+	inner := env.push()
+	variable := x.bindVariable(spec.car, inner)
+	handler := sourceList(e, Symbol("lambda"), list(variable), x.expandClauses(spec.cdr, inner, builtin("guard-no-match")))
+
+	return sourceList(e, builtin("call-with-guard"), thunk, handler)
+}
+
+// (let-syntax ⟨bindings⟩ ⟨body⟩)
+// (letrec-syntax ⟨bindings⟩ ⟨body⟩)
+//
+// The body is expanded in a syntactic environment that binds the keywords, and
+// its expansion is evaluated as the body of a procedure of no arguments.
+func (x *expander) expandLetSyntax(e *Pair, env *syntacticEnv, recursive bool) Value {
+	keywords, specs, body := syntaxBindings(e)
+
+	inner := env.push()
+	definitions := env
+	if recursive {
+		definitions = inner
+	}
+	for i, keyword := range keywords {
+		inner.bind(keyword, &denotation{syntax: x.transformer(specs[i], definitions)})
+	}
+
+	return sourceList(e, lambdaExpr(e, nil, x.expandBody(body.ToVector(), inner)))
+}
+
+// expansionProcedures returns the procedures that expand macro uses. Macro
+// uses are expanded in the global scope of the current evaluation, or in the
+// global scope s if there is none.
+func expansionProcedures(s *scope) map[Symbol]Value {
+	d := s.dynamic()
+	globals := func() *scope {
+		if d.globals != nil {
+			return d.globals
+		}
+		return s
+	}
+
+	return map[Symbol]Value{
+		// (macroexpand datum)
+		//
+		// Returns the expansion of the top-level form datum in the core
+		// language. Syntax definitions within datum take effect.
+		"macroexpand": ProcedureFunc(func(args Vector) Value {
+			if len(args) != 1 {
+				panic("macroexpand expects 1 argument")
+			}
+			return newExpander(globals()).expandTopLevel(args[0])
+		}),
+
+		// (macroexpand-1 datum)
+		//
+		// If datum is a macro use or a derived expression, returns the result
+		// of expanding it once. Otherwise, returns datum.
+		"macroexpand-1": ProcedureFunc(func(args Vector) Value {
+			if len(args) != 1 {
+				panic("macroexpand-1 expects 1 argument")
+			}
+			v, _ := newExpander(globals()).expandOnce(args[0])
+			return v
+		}),
+	}
+}
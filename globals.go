@@ -1,5 +1,7 @@
 package loom
 
+// globalScope holds the builtin bindings. It is shared by every environment and
+// must not be modified.
 var globalScope = &scope{env: map[Symbol]Value{
 	// equality predicates
 	"eqv?":   ProcedureFunc(Eqv),
@@ -7,18 +9,67 @@ var globalScope = &scope{env: map[Symbol]Value{
 	"equal?": ProcedureFunc(Equal),
 
 	// numerics
-	"number?":           ProcedureFunc(NumberPred),
-	"=":                 ProcedureFunc(NumberEq),
-	"<":                 ProcedureFunc(NumberLt),
-	">":                 ProcedureFunc(NumberGt),
-	"<=":                ProcedureFunc(NumberLte),
-	">=":                ProcedureFunc(NumberGte),
-	"+":                 ProcedureFunc(NumberAdd),
-	"*":                 ProcedureFunc(NumberMul),
-	"-":                 ProcedureFunc(NumberSub),
-	"/":                 ProcedureFunc(NumberDiv),
-	"truncate-quotient": ProcedureFunc(NumberTruncateQuotient),
-	"quotient":          ProcedureFunc(NumberTruncateQuotient),
+	"number?":            ProcedureFunc(NumberPred),
+	"=":                  ProcedureFunc(NumberEq),
+	"<":                  ProcedureFunc(NumberLt),
+	">":                  ProcedureFunc(NumberGt),
+	"<=":                 ProcedureFunc(NumberLte),
+	">=":                 ProcedureFunc(NumberGte),
+	"+":                  ProcedureFunc(NumberAdd),
+	"*":                  ProcedureFunc(NumberMul),
+	"-":                  ProcedureFunc(NumberSub),
+	"/":                  ProcedureFunc(NumberDiv),
+	"floor/":             ProcedureFunc(NumberFloorDiv),
+	"floor-quotient":     ProcedureFunc(NumberFloorQuotient),
+	"floor-remainder":    ProcedureFunc(NumberFloorRemainder),
+	"modulo":             ProcedureFunc(NumberFloorRemainder),
+	"truncate/":          ProcedureFunc(NumberTruncateDiv),
+	"truncate-quotient":  ProcedureFunc(NumberTruncateQuotient),
+	"truncate-remainder": ProcedureFunc(NumberTruncateRemainder),
+	"quotient":           ProcedureFunc(NumberTruncateQuotient),
+	"remainder":          ProcedureFunc(NumberTruncateRemainder),
+	"exact?":             ProcedureFunc(NumberExactPred),
+	"inexact?":           ProcedureFunc(NumberInexactPred),
+	"exact":              ProcedureFunc(NumberExact),
+	"inexact":            ProcedureFunc(NumberInexact),
+	"numerator":          ProcedureFunc(NumberNumerator),
+	"denominator":        ProcedureFunc(NumberDenominator),
+	"complex?":           ProcedureFunc(NumberPred),
+	"real?":              ProcedureFunc(NumberPred),
+	"rational?":          ProcedureFunc(NumberRationalPred),
+	"integer?":           ProcedureFunc(NumberIntegerPred),
+	"exact-integer?":     ProcedureFunc(NumberExactIntegerPred),
+	"zero?":              ProcedureFunc(NumberZeroPred),
+	"positive?":          ProcedureFunc(NumberPositivePred),
+	"negative?":          ProcedureFunc(NumberNegativePred),
+	"odd?":               ProcedureFunc(NumberOddPred),
+	"even?":              ProcedureFunc(NumberEvenPred),
+	"nan?":               ProcedureFunc(NumberNaNPred),
+	"infinite?":          ProcedureFunc(NumberInfinitePred),
+	"finite?":            ProcedureFunc(NumberFinitePred),
+	"abs":                ProcedureFunc(NumberAbs),
+	"max":                ProcedureFunc(NumberMax),
+	"min":                ProcedureFunc(NumberMin),
+	"gcd":                ProcedureFunc(NumberGcd),
+	"lcm":                ProcedureFunc(NumberLcm),
+	"floor":              ProcedureFunc(NumberFloor),
+	"ceiling":            ProcedureFunc(NumberCeiling),
+	"truncate":           ProcedureFunc(NumberTruncate),
+	"round":              ProcedureFunc(NumberRound),
+	"exp":                ProcedureFunc(NumberExp),
+	"log":                ProcedureFunc(NumberLog),
+	"sin":                ProcedureFunc(NumberSin),
+	"cos":                ProcedureFunc(NumberCos),
+	"tan":                ProcedureFunc(NumberTan),
+	"asin":               ProcedureFunc(NumberAsin),
+	"acos":               ProcedureFunc(NumberAcos),
+	"atan":               ProcedureFunc(NumberAtan),
+	"sqrt":               ProcedureFunc(NumberSqrt),
+	"exact-integer-sqrt": ProcedureFunc(NumberExactIntegerSqrt),
+	"expt":               ProcedureFunc(NumberExpt),
+	"square":             ProcedureFunc(NumberSquare),
+	"number->string":     ProcedureFunc(NumberToString),
+	"string->number":     ProcedureFunc(StringToNumber),
 
 	// booleans
 	"boolean?": ProcedureFunc(BooleanPred),
@@ -36,6 +87,7 @@ var globalScope = &scope{env: map[Symbol]Value{
 	"length":    ProcedureFunc(ListLength),
 	"append":    ProcedureFunc(ListAppend),
 	"assq":      ProcedureFunc(ListAssq),
+	"memv":      ProcedureFunc(ListMemv),
 	"list-tail": ProcedureFunc(ListTail),
 	"list-ref":  ProcedureFunc(ListRef),
 
@@ -44,6 +96,30 @@ var globalScope = &scope{env: map[Symbol]Value{
 	"symbol->string": ProcedureFunc(SymbolToString),
 	"string->symbol": ProcedureFunc(StringToSymbol),
 
+	// characters
+	"char?":            ProcedureFunc(CharPred),
+	"char=?":           ProcedureFunc(CharEq),
+	"char<?":           ProcedureFunc(CharLt),
+	"char>?":           ProcedureFunc(CharGt),
+	"char<=?":          ProcedureFunc(CharLte),
+	"char>=?":          ProcedureFunc(CharGte),
+	"char-ci=?":        ProcedureFunc(CharEqCI),
+	"char-ci<?":        ProcedureFunc(CharLtCI),
+	"char-ci>?":        ProcedureFunc(CharGtCI),
+	"char-ci<=?":       ProcedureFunc(CharLteCI),
+	"char-ci>=?":       ProcedureFunc(CharGteCI),
+	"char-alphabetic?": ProcedureFunc(CharAlphabeticPred),
+	"char-numeric?":    ProcedureFunc(CharNumericPred),
+	"char-whitespace?": ProcedureFunc(CharWhitespacePred),
+	"char-upper-case?": ProcedureFunc(CharUpperCasePred),
+	"char-lower-case?": ProcedureFunc(CharLowerCasePred),
+	"digit-value":      ProcedureFunc(DigitValue),
+	"char->integer":    ProcedureFunc(CharToInteger),
+	"integer->char":    ProcedureFunc(IntegerToChar),
+	"char-upcase":      ProcedureFunc(CharUpcase),
+	"char-downcase":    ProcedureFunc(CharDowncase),
+	"char-foldcase":    ProcedureFunc(CharFoldcase),
+
 	// strings
 	"string?":       ProcedureFunc(StringPred),
 	"string-length": ProcedureFunc(StringLength),
@@ -60,10 +136,35 @@ var globalScope = &scope{env: map[Symbol]Value{
 	"vector-ref":     ProcedureFunc(VectorRef),
 	"vector-append":  ProcedureFunc(VectorAppend),
 	"vector->string": ProcedureFunc(VectorToString),
+	"list->vector":   ProcedureFunc(ListToVector),
 
 	// Control funcitons
-	"apply": ProcedureFunc(ProcedureApply),
-	"map":   ProcedureFunc(ProcedureMap),
+	"apply":                          applyProc,
+	"map":                            ProcedureFunc(ProcedureMap),
+	"values":                         ProcedureFunc(ProcedureValues),
+	"call-with-values":               callWithValues,
+	"call-with-current-continuation": callCC,
+	"call/cc":                        callCC,
+	"call-with-escape-continuation":  callEC,
+	"call/ec":                        callEC,
+	"dynamic-wind":                   dynamicWind,
+
+	// exceptions
+	"raise":                  raiseProc,
+	"raise-continuable":      raiseContinuableProc,
+	"with-exception-handler": withExceptionHandlerProc,
+	"error":                  errorProc,
+	"error-object?":          ProcedureFunc(ErrorObjectPred),
+	"error-object-message":   ProcedureFunc(ErrorObjectMessage),
+	"error-object-irritants": ProcedureFunc(ErrorObjectIrritants),
+	"read-error?":            ProcedureFunc(ReadErrorPred),
+	"file-error?":            ProcedureFunc(FileErrorPred),
+
+	// process context
+	"exit":                      ProcedureFunc(Exit),
+	"emergency-exit":            ProcedureFunc(EmergencyExit),
+	"get-environment-variable":  ProcedureFunc(GetEnvironmentVariable),
+	"get-environment-variables": ProcedureFunc(GetEnvironmentVariables),
 
 	// extras
 	"repr":               ProcedureFunc(Repr),
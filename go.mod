@@ -2,4 +2,7 @@ module github.com/pgavlin/loom
 
 go 1.16
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/peterh/liner v1.2.2
+	github.com/stretchr/testify v1.7.0
+)
@@ -6,12 +6,26 @@ import (
 	"io"
 	"math"
 	"math/big"
+	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type lexer struct {
 	r *bufio.Reader
+
+	pos   Position // the position of the next rune
+	last  Position // the position of the last rune read
+	start Position // the position of the current token
+}
+
+func newLexer(filename string, r io.Reader) *lexer {
+	return &lexer{
+		r:   bufio.NewReader(r),
+		pos: Position{Filename: filename, Line: 1, Column: 1},
+	}
 }
 
 var identifierInitial = []*unicode.RangeTable{
@@ -39,24 +53,44 @@ var indentifierSubsequent = append(identifierInitial,
 	unicode.Me,
 )
 
-func (l *lexer) read() (rune, error) {
+func (l *lexer) readRune() (rune, error) {
 	c, _, err := l.r.ReadRune()
 	if err != nil {
-		if err == io.EOF {
-			return 0, nil
-		}
+		return 0, err
+	}
+
+	l.last = l.pos
+	if c == '\n' {
+		l.pos.Line, l.pos.Column = l.pos.Line+1, 1
+	} else {
+		l.pos.Column++
 	}
 	return c, nil
 }
 
+func (l *lexer) read() (rune, error) {
+	c, err := l.readRune()
+	if err == io.EOF {
+		return 0, nil
+	}
+	return c, err
+}
+
+func (l *lexer) unread() {
+	if l.r.UnreadRune() == nil {
+		l.pos = l.last
+	}
+}
+
 func (l *lexer) peek() rune {
 	c, _ := l.read()
-	l.r.UnreadRune()
+	l.unread()
 	return c
 }
 
 func (l *lexer) next() (interface{}, error) {
 	for {
+		l.start = l.pos
 		c, err := l.read()
 		if err != nil {
 			return nil, err
@@ -69,6 +103,7 @@ func (l *lexer) next() (interface{}, error) {
 			return c, nil
 		case ',':
 			if l.peek() == '@' {
+				l.read()
 				return '@', nil
 			}
 			return ',', nil
@@ -79,23 +114,23 @@ func (l *lexer) next() (interface{}, error) {
 				return nil, err
 			}
 		case '#':
-			k, _, err := l.r.ReadRune()
+			k, err := l.readRune()
 			if err != nil {
 				return nil, err
 			}
 			switch k {
 			case 'b':
-				return l.numPrefix(2)
+				return l.numPrefix('b')
 			case 'o':
-				return l.numPrefix(8)
+				return l.numPrefix('o')
 			case 'd':
-				return l.numPrefix(10)
+				return l.numPrefix('d')
 			case 'x':
-				return l.numPrefix(16)
+				return l.numPrefix('x')
 			case 'i':
-				return l.numPrefix(0)
+				return l.numPrefix('i')
 			case 'e':
-				return l.numPrefix(0)
+				return l.numPrefix('e')
 			case 't':
 				// TODO: #true
 				return Boolean(true), nil
@@ -116,14 +151,16 @@ func (l *lexer) next() (interface{}, error) {
 				if err := l.blockComment(); err != nil {
 					return nil, err
 				}
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				return l.label(k)
 			default:
 				// TODO: #u8(
 				return string([]rune{c, k}), nil
 			}
 		case '-', '+', '.':
-			return l.num(c, 10, true)
+			return l.num(c, 10, 0, true)
 		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-			return l.num(c, 10, false)
+			return l.num(c, 10, 0, false)
 		case '!', '$', '%', '&', '*', '/', ':', '<', '=', '>', '?', '^', '_', '~':
 			return l.identifier(c)
 		case '|':
@@ -139,37 +176,34 @@ func (l *lexer) next() (interface{}, error) {
 	}
 }
 
-func (l *lexer) lineComment() (err error) {
-	for c := rune(0); c != '\n'; {
-		if c, err = l.read(); err != nil {
+func (l *lexer) lineComment() error {
+	for {
+		c, err := l.read()
+		if err != nil {
 			return err
 		}
+		if c == '\n' || c == 0 {
+			return nil
+		}
 	}
-	return nil
 }
 
 func (l *lexer) blockComment() error {
 	nest := 1
 	for nest > 0 {
-		c, err := l.read()
+		c, err := l.readRune()
 		if err != nil {
-			return err
+			return unexpectedEOF(err)
 		}
 		switch c {
 		case '#':
-			k, _, err := l.r.ReadRune()
-			if err != nil {
-				return err
-			}
-			if k == '|' {
+			if l.peek() == '|' {
+				l.read()
 				nest++
 			}
 		case '|':
-			k, _, err := l.r.ReadRune()
-			if err != nil {
-				return err
-			}
-			if k == '#' {
+			if l.peek() == '#' {
+				l.read()
 				nest--
 			}
 		}
@@ -177,51 +211,90 @@ func (l *lexer) blockComment() error {
 	return nil
 }
 
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF. It is used when the
+// input ends in the middle of a token.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// directive skips a directive such as #!fold-case. Directives are currently
+// ignored. A #! at the very beginning of the input begins an interpreter line,
+// e.g. "#!/usr/bin/env loom", which is skipped like a comment.
 func (l *lexer) directive() error {
+	if l.start.Line == 1 && l.start.Column == 1 {
+		if c := l.peek(); c == '/' || c == ' ' {
+			return l.lineComment()
+		}
+	}
+
+	for c := l.peek(); c != 0 && !isSpace(c) && c != '(' && c != ')'; c = l.peek() {
+		if _, err := l.read(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (l *lexer) numPrefix(radix int) (interface{}, error) {
-	c, err := l.read()
-	if err != nil {
-		return nil, err
-	}
+// A labelDefinition is a datum label of the form #n=, which labels the datum
+// that follows it.
+type labelDefinition int
 
-	// prefix
-	if c == '#' {
-		if c, err = l.read(); err != nil {
+// A labelReference is a datum label of the form #n#, which refers to the datum
+// labeled by #n=.
+type labelReference int
+
+// label lexes the remainder of a datum label that begins with the given digit.
+func (l *lexer) label(first rune) (interface{}, error) {
+	n := int(first - '0')
+	for {
+		c, err := l.read()
+		if err != nil {
 			return nil, err
 		}
-		if radix == 0 {
-			switch c {
-			case 'b':
-				radix = 2
-			case 'o':
-				radix = 8
-			case 'd':
-				radix = 10
-			case 'x':
-				radix = 16
-			default:
-				return nil, fmt.Errorf("invalid radix #%v", c)
-			}
-		} else {
-			switch c {
-			case 'i', 'e':
-				// OK (TODO: do not ignore exactness)
-			default:
-				return nil, fmt.Errorf("invalid exactness #%v", c)
+		switch {
+		case c >= '0' && c <= '9':
+			if n > (math.MaxInt32-int(c-'0'))/10 {
+				return nil, fmt.Errorf("datum label is too large")
 			}
+			n = n*10 + int(c-'0')
+		case c == '=':
+			return labelDefinition(n), nil
+		case c == '#':
+			return labelReference(n), nil
+		default:
+			return nil, fmt.Errorf("malformed datum label")
 		}
-		if c, err = l.read(); err != nil {
+	}
+}
+
+// numPrefix lexes a number literal that begins with the prefix #k.
+func (l *lexer) numPrefix(k rune) (interface{}, error) {
+	var text strings.Builder
+	text.WriteRune('#')
+	text.WriteRune(k)
+	for {
+		c, err := l.read()
+		if err != nil {
 			return nil, err
 		}
+		if c != '#' && !continuesIdentifier(c) {
+			l.unread()
+			break
+		}
+		text.WriteRune(c)
 	}
 
-	return l.num(c, radix, false)
+	s := text.String()
+	if n, ok := parsePrefixedNumber(s, 10); ok {
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid number literal '%s'", s)
 }
 
-func (l *lexer) num(c rune, radix int, maybeIdentifier bool) (v interface{}, err error) {
+func (l *lexer) num(c rune, radix int, exactness rune, maybeIdentifier bool) (v interface{}, err error) {
 	var text strings.Builder
 	for {
 		text.WriteRune(c)
@@ -231,71 +304,217 @@ func (l *lexer) num(c rune, radix int, maybeIdentifier bool) (v interface{}, err
 			return nil, err
 		}
 		if !continuesIdentifier(c) {
-			l.r.UnreadRune()
+			l.unread()
 			break
 		}
 	}
 
-	// TODO: number lexer
+	s := text.String()
+	if n, ok := parseNumber(s, radix, exactness); ok {
+		return n, nil
+	}
+
+	if !maybeIdentifier {
+		return nil, fmt.Errorf("invalid number literal '%s'", s)
+	}
+	if s == "." {
+		return '.', nil
+	}
 
-	var f big.Float
+	return Symbol(s), nil
+}
 
-	s := text.String()
+// decimalPattern matches decimal numbers with a fractional part or exponent.
+var decimalPattern = regexp.MustCompile(`^[+-]?([0-9]+\.?[0-9]*|\.[0-9]+)(e[+-]?[0-9]+)?$`)
+
+// radixPrefixes maps number prefix characters to their radix.
+var radixPrefixes = map[rune]int{'b': 2, 'o': 8, 'd': 10, 'x': 16}
+
+// parsePrefixedNumber parses the textual representation of a real number that
+// may begin with radix and exactness prefixes. If the text has no radix
+// prefix, it is parsed in the given radix.
+func parsePrefixedNumber(s string, radix int) (Number, bool) {
+	exactness, hasRadix := rune(0), false
+	for len(s) >= 2 && s[0] == '#' {
+		switch p := unicode.ToLower(rune(s[1])); p {
+		case 'b', 'o', 'd', 'x':
+			if hasRadix {
+				return Number{}, false
+			}
+			radix, hasRadix = radixPrefixes[p], true
+		case 'i', 'e':
+			if exactness != 0 {
+				return Number{}, false
+			}
+			exactness = p
+		default:
+			return Number{}, false
+		}
+		s = s[2:]
+	}
+	return parseNumber(s, radix, exactness)
+}
+
+// parseNumber parses the textual representation of a real number in the given
+// radix. If exactness is 'e' or 'i', the result is converted to an exact or an
+// inexact number, respectively.
+func parseNumber(s string, radix int, exactness rune) (Number, bool) {
 	switch s {
-	case "+inf.0":
-		f.SetInf(false)
-		return Number{&f}, nil
-	case "-inf.0":
-		f.SetInf(true)
-		return Number{&f}, nil
-	case "+nan.0", "-nan.0":
-		f.SetFloat64(math.NaN())
-		return Number{&f}, nil
-	}
-
-	// Rationals
+	case "+inf.0", "-inf.0", "+nan.0", "-nan.0":
+		if exactness == 'e' {
+			return Number{}, false
+		}
+		switch s {
+		case "+inf.0":
+			return NewFloat(math.Inf(1)), true
+		case "-inf.0":
+			return NewFloat(math.Inf(-1)), true
+		default:
+			return NewFloat(math.NaN()), true
+		}
+	}
+
+	var n Number
 	if i := strings.IndexByte(s, '/'); i != -1 {
-		var num, denom big.Int
-		_, numOk := num.SetString(s[:i], radix)
-		_, denomOk := denom.SetString(s[i+1:], radix)
-		if numOk && denomOk {
-			var rat big.Rat
-			rat.SetFrac(&num, &denom)
-			f.SetRat(&rat)
-			return Number{&f}, nil
+		// rationals
+		num, numOk := new(big.Int).SetString(s[:i], radix)
+		denom, denomOk := new(big.Int).SetString(s[i+1:], radix)
+		if !numOk || !denomOk || denom.Sign() <= 0 || s[i+1] == '+' {
+			return Number{}, false
+		}
+		n = normalizeRat(new(big.Rat).SetFrac(num, denom))
+	} else if b, ok := new(big.Int).SetString(s, radix); ok {
+		// integers
+		n = normalizeInt(b)
+	} else if radix == 10 && decimalPattern.MatchString(s) {
+		// decimals
+		if exactness == 'e' {
+			if !exactDecimalFits(s) {
+				return Number{}, false
+			}
+			r, ok := new(big.Rat).SetString(s)
+			if !ok {
+				return Number{}, false
+			}
+			return normalizeRat(r), true
 		}
-	} else if _, _, err = f.Parse(s, radix); err == nil {
-		return Number{&f}, nil
+		f, _ := strconv.ParseFloat(s, 64)
+		n = NewFloat(f)
+	} else {
+		return Number{}, false
 	}
 
-	if !maybeIdentifier {
-		return nil, fmt.Errorf("invalid number literal '%s'", s)
+	switch exactness {
+	case 'e':
+		return n.exact(), true
+	case 'i':
+		return n.inexact(), true
+	default:
+		return n, true
 	}
+}
 
-	return Symbol(s), nil
+// exactDecimalFits returns false if the exact value of the decimal s may be
+// larger than maxExactBits, i.e. if its exponent is too large in magnitude.
+func exactDecimalFits(s string) bool {
+	i := strings.IndexByte(s, 'e')
+	if i == -1 {
+		return true
+	}
+	e, err := strconv.Atoi(s[i+1:])
+	return err == nil && math.Abs(float64(e))*math.Log2(10) <= maxExactBits
+}
+
+// characterNames maps the names of named characters to their values.
+var characterNames = map[string]Character{
+	"alarm":     '\a',
+	"backspace": '\b',
+	"delete":    0x7f,
+	"escape":    0x1b,
+	"newline":   '\n',
+	"null":      0,
+	"return":    '\r',
+	"space":     ' ',
+	"tab":       '\t',
 }
 
 func (l *lexer) char() (interface{}, error) {
-	return nil, fmt.Errorf("NYI: chars")
+	c, err := l.readRune()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("unterminated character literal")
+		}
+		return nil, err
+	}
+
+	// a single character, a character name, or a hex scalar value
+	var name strings.Builder
+	name.WriteRune(c)
+	if unicode.IsLetter(c) {
+		for {
+			k, err := l.read()
+			if err != nil {
+				return nil, err
+			}
+			if !continuesIdentifier(k) {
+				l.unread()
+				break
+			}
+			name.WriteRune(k)
+		}
+	}
+
+	s := name.String()
+	if utf8.RuneCountInString(s) == 1 {
+		return Character(c), nil
+	}
+	if ch, ok := characterNames[s]; ok {
+		return ch, nil
+	}
+	if s[0] == 'x' {
+		var v rune
+		for _, k := range s[1:] {
+			d, ok := hexDigit(k)
+			if !ok || v > unicode.MaxRune {
+				return nil, fmt.Errorf("invalid character literal #\\%s", s)
+			}
+			v = v*16 + d
+		}
+		// surrogate code points are not scalar values
+		if utf8.ValidRune(v) {
+			return Character(v), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid character literal #\\%s", s)
 }
 
 func (l *lexer) string() (interface{}, error) {
+	s, err := l.delimited('"')
+	if err != nil {
+		return nil, err
+	}
+	return String(s), nil
+}
+
+// delimited reads the remainder of a string or symbol that is enclosed in the
+// given delimiter, interpreting any escape sequences.
+func (l *lexer) delimited(delimiter rune) (string, error) {
 	var s strings.Builder
 	for {
-		c, err := l.read()
+		c, err := l.readRune()
 		if err != nil {
-			return nil, err
+			return "", unexpectedEOF(err)
 		}
 		switch c {
-		case '"', 0:
-			return String(s.String()), nil
+		case delimiter:
+			return s.String(), nil
 		case '\\':
 			k, err := l.read()
 			if err != nil {
-				return nil, err
+				return "", err
 			}
 			switch k {
-			case '\\', '"':
+			case '\\', '"', '|':
 				c = k
 			case 'a':
 				c = '\a'
@@ -310,18 +529,18 @@ func (l *lexer) string() (interface{}, error) {
 			case ' ', '\t':
 				for {
 					if k, err = l.read(); err != nil {
-						return nil, err
+						return "", err
 					}
 					if k == '\n' {
 						break
 					}
 					if k != ' ' && k != '\t' {
-						return nil, fmt.Errorf("unterminated line continuation")
+						return "", fmt.Errorf("unterminated line continuation")
 					}
 				}
 				for k = l.peek(); k == ' ' || k == '\t'; k = l.peek() {
 					if _, err = l.read(); err != nil {
-						return nil, err
+						return "", err
 					}
 				}
 				continue
@@ -329,19 +548,24 @@ func (l *lexer) string() (interface{}, error) {
 				c = 0
 				for {
 					if k, err = l.read(); err != nil {
-						return nil, err
+						return "", err
 					}
 					if k == ';' {
 						break
 					}
 					d, ok := hexDigit(k)
 					if !ok {
-						return nil, fmt.Errorf("invalid hex digit '%v'", k)
+						return "", fmt.Errorf("invalid hex digit '%v'", k)
 					}
-					c = c*16 + d
+					if c = c*16 + d; c > unicode.MaxRune {
+						return "", fmt.Errorf("invalid hex escape")
+					}
+				}
+				if !utf8.ValidRune(c) {
+					return "", fmt.Errorf("invalid hex escape")
 				}
 			default:
-				return nil, fmt.Errorf("invalid escape sequence '\\%v'", k)
+				return "", fmt.Errorf("invalid escape sequence '\\%v'", k)
 			}
 		}
 		s.WriteRune(c)
@@ -358,7 +582,7 @@ func (l *lexer) identifier(first rune) (interface{}, error) {
 			return nil, err
 		}
 		if !continuesIdentifier(c) {
-			l.r.UnreadRune()
+			l.unread()
 			return Symbol(id.String()), nil
 		}
 		id.WriteRune(c)
@@ -366,7 +590,11 @@ func (l *lexer) identifier(first rune) (interface{}, error) {
 }
 
 func (l *lexer) symbol() (interface{}, error) {
-	return nil, fmt.Errorf("NYI: symbols")
+	s, err := l.delimited('|')
+	if err != nil {
+		return nil, err
+	}
+	return Symbol(s), nil
 }
 
 func beginsIdentifier(c rune) bool {
@@ -382,9 +610,9 @@ func hexDigit(c rune) (rune, bool) {
 	case c >= '0' && c <= '9':
 		return c - '0', true
 	case c >= 'A' && c <= 'F':
-		return c - 'A', true
+		return c - 'A' + 10, true
 	case c >= 'a' && c <= 'f':
-		return c - 'a', true
+		return c - 'a' + 10, true
 	default:
 		return 0, false
 	}
@@ -395,9 +623,9 @@ func radixDigit(c rune, radix int) (v int, ok bool) {
 	case c >= '0' && c <= '9':
 		v = int(c - '0')
 	case c >= 'A' && c <= 'Z':
-		v = int(c - 'A')
+		v = int(c-'A') + 10
 	case c >= 'a' && c <= 'z':
-		v = int(c - 'a')
+		v = int(c-'a') + 10
 	default:
 		return 0, false
 	}
@@ -48,7 +48,7 @@ func PairSetCar(args Vector) Value {
 		panic("set-car! expects a list")
 	}
 	p.car = args[1]
-	return nil
+	return Unspecified
 }
 
 func PairSetCdr(args Vector) Value {
@@ -60,7 +60,7 @@ func PairSetCdr(args Vector) Value {
 		panic("set-cdr! expects a list")
 	}
 	p.cdr = args[1]
-	return nil
+	return Unspecified
 }
 
 func NullPred(args Vector) Value {
@@ -150,6 +150,38 @@ func ListAssq(args Vector) Value {
 	return Boolean(false)
 }
 
+func ListMemv(args Vector) Value {
+	if len(args) != 2 {
+		panic("memv expects two arguments")
+	}
+
+	l, ok := args[1].(*Pair)
+	if !ok && args[1] != nil {
+		panic("the second argument to memv must be a list")
+	}
+
+	for l != nil {
+		if eqv(args[0], l.car) {
+			return l
+		}
+		next, ok := l.cdr.(*Pair)
+		if !ok && l.cdr != nil {
+			panic("the second argument to memv must be a list")
+		}
+		l = next
+	}
+
+	return Boolean(false)
+}
+
+func ListToVector(args Vector) Value {
+	if len(args) != 1 {
+		panic("list->vector expects 1 argument")
+	}
+
+	return append(Vector{}, listElements(args[0], "the argument to list->vector must be a list")...)
+}
+
 func ListTail(args Vector) Value {
 	if len(args) != 2 {
 		panic("list-tail expects two arguments")
@@ -172,7 +204,7 @@ func ListTail(args Vector) Value {
 	}
 
 	if p == nil {
-		panic(fmt.Sprintf("list does not contain %v elements", i))
+		panic(NewError(fmt.Sprintf("list does not contain %v elements", i)))
 	}
 	return p
 }
@@ -199,7 +231,7 @@ func ListRef(args Vector) Value {
 	}
 
 	if p == nil {
-		panic(fmt.Sprintf("list does not contain %v elements", i))
+		panic(NewError(fmt.Sprintf("list does not contain %v elements", i)))
 	}
 	return p.car
 }
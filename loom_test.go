@@ -1,21 +1,46 @@
 package loom
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// backends lists the evaluation backends. Each test is run against every
+// backend.
+var backends = []struct {
+	name    string
+	backend Backend
+}{
+	{"vm", VM},
+	{"tree-walker", TreeWalker},
+}
+
+// testExpr evaluates expr and expectedExpr with each backend and checks that
+// their values are equal.
 func testExpr(t *testing.T, expr, expectedExpr string, globalPairs ...interface{}) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			testBackend(t, NewEnv().WithBackend(b.backend), expr, expectedExpr, globalPairs...)
+		})
+	}
+}
+
+func testBackend(t *testing.T, e *Env, expr, expectedExpr string, globalPairs ...interface{}) {
 	defer func() {
 		if x := recover(); x != nil {
 			t.Fatalf("panic: %v", x)
 		}
 	}()
 
-	e := NewEnv()
-
 	globals := map[Symbol]Value{}
 	require.Zero(t, len(globalPairs)%2, "len(globalPairs) must be even")
 
@@ -249,3 +274,1285 @@ func TestSmoke(t *testing.T) {
 		})
 	}
 }
+
+func TestEvalErr(t *testing.T) {
+	cases := []struct {
+		name, expr      string
+		procedure       Symbol
+		message         string
+		irritants       Vector
+		expectedMessage string
+	}{
+		{
+			"car",
+			"(car 42)",
+			"car",
+			"car expects a list",
+			nil,
+			"1:1: car expects a list",
+		},
+		{
+			"unbound",
+			"(+ 1 x)",
+			"",
+			"unbound variable",
+			Vector{Symbol("x")},
+			"1:6: unbound variable: x",
+		},
+		{
+			"unbound-test",
+			"(if (car '(1)) x 0)",
+			"",
+			"unbound variable",
+			Vector{Symbol("x")},
+			"1:16: unbound variable: x",
+		},
+		{
+			"procedure",
+			"(/ 1 0)",
+			"/",
+			"division by zero",
+			Vector{NewInt(1)},
+			"1:1: /: division by zero: 1",
+		},
+		{
+			"not-a-procedure",
+			"(42 1)",
+			"",
+			"value is not a procedure",
+			Vector{NewInt(42)},
+			"1:1: value is not a procedure: 42",
+		},
+		{
+			"nested",
+			"((lambda () (define (f x) (car x)) (f 1)))",
+			"car",
+			"car expects a list",
+			nil,
+			"1:27: car expects a list",
+		},
+		{
+			"arity",
+			"((lambda () (define (f x) x) (f)))",
+			"f",
+			"f expects 1 arguments",
+			nil,
+			"1:30: f expects 1 arguments",
+		},
+		{
+			"name in message",
+			"((lambda () (define (a) (error \"expected a list\")) (a)))",
+			"error",
+			"expected a list",
+			nil,
+			"1:25: error: expected a list",
+		},
+		{
+			"named with colon",
+			"(truncate-quotient 1 0)",
+			"truncate-quotient",
+			"truncate-quotient: division by zero",
+			Vector{NewInt(1)},
+			"1:1: truncate-quotient: division by zero: 1",
+		},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					x, err := ParseString(c.expr)
+					require.NoError(t, err)
+
+					_, err = NewEnv().WithBackend(b.backend).EvalErr(x)
+					require.Error(t, err)
+
+					e, ok := err.(*Error)
+					require.True(t, ok)
+					assert.Equal(t, c.procedure, e.Procedure)
+					assert.Equal(t, c.message, e.Message)
+					assert.Equal(t, c.irritants, e.Irritants)
+					assert.Equal(t, c.expectedMessage, e.Error())
+				})
+			}
+
+			x, err := ParseString("(+ 1 2)")
+			require.NoError(t, err)
+
+			v, err := NewEnv().WithBackend(b.backend).EvalErr(x)
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(3), v))
+		})
+	}
+}
+
+func TestPositions(t *testing.T) {
+	x, err := ParseFile("config.scm", strings.NewReader("; config\n(define (f x)\n  (car x))\n"))
+	require.NoError(t, err)
+
+	define := x.(*Pair)
+	assert.Equal(t, Position{Filename: "config.scm", Line: 2, Column: 1}, define.Position())
+	signature := define.cdr.(*Pair)
+	assert.Equal(t, Position{Filename: "config.scm", Line: 2, Column: 9}, signature.Position())
+	body := signature.cdr.(*Pair).car.(*Pair)
+	assert.Equal(t, Position{Filename: "config.scm", Line: 3, Column: 3}, body.Position())
+	assert.Equal(t, Position{Filename: "config.scm", Line: 3, Column: 8}, body.cdr.(*Pair).Position())
+
+	_, err = ParseFile("config.scm", strings.NewReader("(a\n  . b c)"))
+	assert.EqualError(t, err, "config.scm:2:7: unexpected token c")
+
+	call, err := ParseFile("main.scm", strings.NewReader("(f 42)"))
+	require.NoError(t, err)
+
+	// errors in macro expansions are attributed to the macro use
+	use, err := ParseFile("main.scm", strings.NewReader(`((lambda ()
+  (define-syntax first (syntax-rules () ((_ x) (car x))))
+  (first 42)))`))
+	require.NoError(t, err)
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			_, err = env.EvalErr(x)
+			require.NoError(t, err)
+
+			_, err = env.EvalErr(call)
+			assert.EqualError(t, err, "config.scm:3:3: car expects a list")
+
+			_, err = env.EvalErr(use)
+			assert.EqualError(t, err, "main.scm:3:3: car expects a list")
+		})
+	}
+
+	// errors in compiled code are attributed to the instruction's source
+	root := &compiledClosure{
+		scope: newGlobalScope(),
+		proc:  compileProcedure("<main>", nil, false, []Value{x.(*Pair).cdr.(*Pair).cdr.(*Pair).car}),
+	}
+	assert.PanicsWithError(t, "config.scm:3:8: <main>: unbound variable: x", func() { root.Apply(nil) })
+}
+
+func TestEvalAll(t *testing.T) {
+	program := `
+		(define (square x) (* x x))
+		(define y (square 4))
+		(+ y 1)`
+
+	path := filepath.Join(t.TempDir(), "program.scm")
+	require.NoError(t, os.WriteFile(path, []byte(program+"\n(car y)"), 0600))
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			v, err := env.EvalAll(strings.NewReader(program))
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(17), v))
+
+			_, err = env.EvalAll(strings.NewReader("(define z 1) (car z) (define w 2)"))
+			assert.EqualError(t, err, "1:14: car expects a list")
+			assert.False(t, env.Bound("w"))
+
+			_, err = env.EvalAll(strings.NewReader("(define z 1)\n  foo"))
+			assert.EqualError(t, err, "2:3: unbound variable: foo")
+
+			_, err = env.Load(path)
+			assert.EqualError(t, err, path+":5:1: car expects a list")
+		})
+	}
+}
+
+func TestCharacters(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"char?", `(list (char? #\a) (char? "a") (char? 97))`, "'(#t #f #f)"},
+		{"char=?", `(list (char=? #\a #\a #\a) (char=? #\a #\b))`, "'(#t #f)"},
+		{"char<?", `(list (char<? #\a #\b #\c) (char<? #\a #\a))`, "'(#t #f)"},
+		{"char>?", `(list (char>? #\c #\b #\a) (char>? #\a #\b))`, "'(#t #f)"},
+		{"char<=?", `(list (char<=? #\a #\a #\b) (char<=? #\b #\a))`, "'(#t #f)"},
+		{"char>=?", `(list (char>=? #\b #\b #\a) (char>=? #\a #\b))`, "'(#t #f)"},
+		{"char-ci=?", `(list (char-ci=? #\a #\A) (char-ci=? #\a #\B))`, "'(#t #f)"},
+		{"char-ci<?", `(list (char-ci<? #\a #\B) (char-ci<? #\b #\A))`, "'(#t #f)"},
+		{"char-ci>?", `(list (char-ci>? #\b #\A) (char-ci>? #\a #\B))`, "'(#t #f)"},
+		{"char-ci<=?", `(list (char-ci<=? #\a #\A #\b) (char-ci<=? #\b #\A))`, "'(#t #f)"},
+		{"char-ci>=?", `(list (char-ci>=? #\B #\b #\a) (char-ci>=? #\a #\B))`, "'(#t #f)"},
+		{"char? arity", `(guard (e ((error-object? e) (error-object-message e))) (char? #\a #\b))`, `"char? expects 1 argument"`},
+		{"char<? non-character", `(guard (e ((error-object? e) (list (error-object-message e) (error-object-irritants e)))) (char<? 1 2))`, `'("the arguments to char<? must be characters" (1))`},
+		{"char-ci=? non-character", `(guard (e ((error-object? e) (error-object-irritants e))) (char-ci=? #\a #\b "c"))`, `'("c")`},
+		{"char-alphabetic?", `(list (char-alphabetic? #\a) (char-alphabetic? #\λ) (char-alphabetic? #\1))`, "'(#t #t #f)"},
+		{"char-numeric?", `(list (char-numeric? #\1) (char-numeric? #\x0664) (char-numeric? #\a))`, "'(#t #t #f)"},
+		{"char-whitespace?", `(list (char-whitespace? #\space) (char-whitespace? #\tab) (char-whitespace? #\a))`, "'(#t #t #f)"},
+		{"char-upper-case?", `(list (char-upper-case? #\A) (char-upper-case? #\a))`, "'(#t #f)"},
+		{"char-lower-case?", `(list (char-lower-case? #\a) (char-lower-case? #\A))`, "'(#t #f)"},
+		{"digit-value", `(list (digit-value #\3) (digit-value #\x0664) (digit-value #\x0AE6) (digit-value #\x0EA6))`, "'(3 4 0 #f)"},
+		{"char->integer", `(char->integer #\A)`, "65"},
+		{"integer->char", `(integer->char 955)`, `#\λ`},
+		{"char-upcase", `(list (char-upcase #\a) (char-upcase #\λ) (char-upcase #\1))`, `'(#\A #\Λ #\1)`},
+		{"char-downcase", `(list (char-downcase #\A) (char-downcase #\Λ) (char-downcase #\1))`, `'(#\a #\λ #\1)`},
+		{"char-foldcase", `(list (char-foldcase #\A) (char-foldcase #\a))`, `'(#\a #\a)`},
+		{"string-ref", `(string-ref "abc" 1)`, `#\b`},
+		{"vector->string", `(vector->string #(#\a #\b))`, `"ab"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"rational division", `(/ 1 3)`, "1/3"},
+		{"integral division", `(/ 6 3)`, "2"},
+		{"rational addition", `(+ 1/3 2/3)`, "1"},
+		{"inexact contagion", `(+ 1/2 0.5)`, "1.0"},
+		{"fixnum overflow", `(* 9223372036854775807 2)`, "18446744073709551614"},
+		{"negation", `(list (number->string (- 0.0)) (number->string (- 0)) (- 1.5) (- 1/2) (- -9223372036854775808))`, `'("-0.0" "0" -1.5 -1/2 9223372036854775808)`},
+		{"bignum demotion", `(- 9223372036854775808 1)`, "9223372036854775807"},
+		{"exact?", `(list (exact? 1) (exact? 1/2) (exact? 1.0))`, "'(#t #t #f)"},
+		{"inexact?", `(list (inexact? 1) (inexact? 1.0))`, "'(#f #t)"},
+		{"exact", `(exact 0.5)`, "1/2"},
+		{"inexact", `(inexact 1/4)`, "0.25"},
+		{"numerator", `(list (numerator 6/4) (numerator 0.75))`, "'(3 3.0)"},
+		{"denominator", `(list (denominator 6/4) (denominator 5))`, "'(2 1)"},
+		{"=", `(list (= 1 1.0) (= 1/2 0.5) (= 1 2))`, "'(#t #t #f)"},
+		{"<", `(list (< 1/3 0.34 1) (< 1 +nan.0))`, "'(#t #f)"},
+		{"eqv?", `(list (eqv? 1 1.0) (eqv? 1/2 2/4) (eqv? 100000000000000000000 100000000000000000000))`, "'(#f #t #t)"},
+		{"truncate-quotient", `(list (truncate-quotient 7 2) (truncate-quotient -7 2) (truncate-quotient 7.0 2))`, "'(3 -3 3.0)"},
+		{"truncate-remainder", `(list (truncate-remainder 7 2) (truncate-remainder -7 2) (remainder 7 -2))`, "'(1 -1 1)"},
+		{"truncate/", `(call-with-values (lambda () (truncate/ -7 2)) list)`, "'(-3 -1)"},
+		{"floor-quotient", `(list (floor-quotient 7 2) (floor-quotient -7 2) (floor-quotient 7 -2.0))`, "'(3 -4 -4.0)"},
+		{"floor-remainder", `(list (floor-remainder 7 2) (floor-remainder -7 2) (modulo 7 -2))`, "'(1 1 -1)"},
+		{"floor/", `(call-with-values (lambda () (floor/ -7 2)) list)`, "'(-4 1)"},
+		{"bignum division", `(call-with-values (lambda () (floor/ -100000000000000000000 3)) list)`, "'(-33333333333333333334 2)"},
+		{"predicates", `(list (zero? 0) (zero? 0.0) (zero? +nan.0) (positive? 1/2) (negative? -1.5) (odd? 3) (even? 3) (even? 0.0))`, "'(#t #t #f #t #t #t #f #t)"},
+		{"type predicates", `(list (integer? 2.0) (integer? 1/2) (rational? 1/2) (rational? +inf.0) (real? 1.5) (exact-integer? 2.0) (integer? "2"))`, "'(#t #f #t #f #t #f #f)"},
+		{"nan?", `(list (nan? +nan.0) (nan? 1.0) (infinite? -inf.0) (infinite? 1) (finite? 1/2) (finite? +inf.0))`, "'(#t #f #t #f #t #f)"},
+		{"abs", `(list (abs -7) (abs -1/2) (abs -7.5) (abs -9223372036854775808))`, "'(7 1/2 7.5 9223372036854775808)"},
+		{"max", `(list (max 3 4) (max 3.9 4) (max 1/2 1/3))`, "'(4 4.0 1/2)"},
+		{"min", `(list (min 3 4) (min 3.9 4))`, "'(3 3.9)"},
+		{"gcd", `(list (gcd 32 -36) (gcd) (gcd 32.0 36))`, "'(4 0 4.0)"},
+		{"lcm", `(list (lcm 32 -36) (lcm) (lcm 32.0 36))`, "'(288 1 288.0)"},
+		{"floor", `(list (floor -4.3) (floor 7/2) (floor -7/2) (floor 3))`, "'(-5.0 3 -4 3)"},
+		{"ceiling", `(list (ceiling -4.3) (ceiling 7/2) (ceiling -7/2))`, "'(-4.0 4 -3)"},
+		{"truncate", `(list (truncate -4.7) (truncate 7/2) (truncate -7/2))`, "'(-4.0 3 -3)"},
+		{"round", `(list (round 3.5) (round 2.5) (round -3.5) (round 7/2) (round 5/2) (round 8/3))`, "'(4.0 2.0 -4.0 4 2 3)"},
+		{"exp", `(list (exp 0) (log 1) (log 8 2))`, "'(1.0 0.0 3.0)"},
+		{"trig", `(list (sin 0) (cos 0) (tan 0) (asin 0) (acos 1) (atan 0) (atan 0 1))`, "'(0.0 1.0 0.0 0.0 0.0 0.0 0.0)"},
+		{"sqrt", `(list (sqrt 16) (sqrt 1/4) (sqrt 2.25) (sqrt 2))`, "'(4 1/2 1.5 1.4142135623730951)"},
+		{"exact-integer-sqrt", `(call-with-values (lambda () (exact-integer-sqrt 17)) list)`, "'(4 1)"},
+		{"expt", `(list (expt 2 10) (expt 2 -2) (expt 2/3 2) (expt 0 0) (expt 4 1/2) (expt 2.0 3) (expt 2 100))`, "'(1024 1/4 4/9 1 2.0 8.0 1267650600228229401496703205376)"},
+		{"expt trivial bases", `(list (expt 1 1000000000000) (expt -1 1000000000001) (expt 0 1000000000000) (expt -2/3 -3))`, "'(1 -1 0 -27/8)"},
+		{"product too large", `(guard (e ((error-object? e) (error-object-message e))) (let ((n (expt 2 10000000))) (* n n)))`, `"*: result is too large"`},
+		{"expt bignum exponent", `(list (expt 1 (expt 2 100)) (expt -1 (expt 2 100)) (expt -1 (+ (expt 2 100) 1)) (expt 0 (expt 2 100)) (expt 1 (- (expt 2 100))))`, "'(1 1 -1 0 1)"},
+		{"square", `(list (square 42) (square 1/2) (square 2.0))`, "'(1764 1/4 4.0)"},
+		{"number->string", `(list (number->string 255) (number->string 255 16) (number->string -5 2) (number->string 1/3 8) (number->string 1.5))`, `'("255" "ff" "-101" "1/3" "1.5")`},
+		{"string->number", `(list (string->number "100") (string->number "100" 16) (string->number "#x100" 10) (string->number "#e1.25") (string->number "1/3") (string->number "abc"))`, "'(100 256 256 5/4 1/3 #f)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	x, err := ParseString(`(/ 1 0)`)
+	require.NoError(t, err)
+	for _, b := range backends {
+		_, err = NewEnv().WithBackend(b.backend).EvalErr(x)
+		assert.EqualError(t, err, "1:1: /: division by zero: 1", b.name)
+	}
+
+	// exact results that would exhaust memory fail instead
+	for _, expr := range []string{`(expt 2 1000000000000)`, `(expt 2/3 -100000000)`, `(let ((n (expt 3 10000000))) (* n n))`, `(expt 2 (expt 2 100))`, `(expt 1/2 (expt 2 100))`} {
+		x, err := ParseString(expr)
+		require.NoError(t, err)
+		_, err = NewEnv().EvalErr(x)
+		require.Error(t, err, expr)
+		assert.Contains(t, err.Error(), "result is too large", expr)
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"guard", `(guard (e (#t (list 'caught e))) (raise 'boom))`, "'(caught boom)"},
+		{"guard =>", `(guard (e ((assq 'a e) => cdr) ((assq 'b e))) (raise (list (cons 'a 42))))`, "42"},
+		{"guard test", `(guard (e ((assq 'a e) => cdr) ((assq 'b e))) (raise (list (cons 'b 23))))`, "'(b . 23)"},
+		{"guard else", `(guard (e ((symbol? e) 'symbol) (else 'other)) (raise 42))`, "'other"},
+		{"guard no exception", `(guard (e (#t 'caught)) (+ 1 2))`, "3"},
+		{"guard re-raise", `(guard (outer (#t (list 'outer outer))) (guard (inner ((string? inner) 'inner)) (raise 'boom)))`, "'(outer boom)"},
+		{"error object", `(guard (e ((error-object? e) (list (error-object-message e) (error-object-irritants e)))) (error "bad thing" 1 2))`, `'("bad thing" (1 2))`},
+		{"builtin error", `(guard (e ((error-object? e) (error-object-message e))) (car 42))`, `"car expects a list"`},
+		{"unbound variable", `(guard (e ((error-object? e) (list (error-object-message e) (error-object-irritants e)))) undefined-variable)`, `'("unbound variable" (undefined-variable))`},
+		{"error-object?", `(list (error-object? 42) (guard (e (#t (error-object? e))) (raise 42)))`, "'(#f #f)"},
+		{"read-error?", `(guard (e (#t (list (read-error? e) (file-error? e)))) (error "oops"))`, "'(#f #f)"},
+		{"raise-continuable", `(with-exception-handler (lambda (c) 42) (lambda () (+ (raise-continuable 'oops) 2)))`, "44"},
+		{"nested handlers", `(with-exception-handler
+			(lambda (c) (* c 2))
+			(lambda ()
+				(with-exception-handler
+					(lambda (c) (raise-continuable (+ c 1)))
+					(lambda () (raise-continuable 20)))))`, "42"},
+		{"handler escape", `(guard (e (#t (list 'escaped e)))
+			(with-exception-handler
+				(lambda (c) (raise (list 'handled c)))
+				(lambda () (raise 'boom))))`, "'(escaped (handled boom))"},
+		{"handler returns", `(guard (e ((error-object? e) (error-object-message e)))
+			(with-exception-handler
+				(lambda (c) 'ignored)
+				(lambda () (raise 'boom))))`, `"exception handler returned from non-continuable exception"`},
+		{"guard in raise-continuable", `(with-exception-handler
+			(lambda (c) 'outer)
+			(lambda () (guard (e (#t (list 'guard e))) (raise-continuable 'boom))))`, "'(guard boom)"},
+		{"apply", `(with-exception-handler (lambda (c) 42) (lambda () (apply raise-continuable '(oops))))`, "42"},
+		{"handler before unwinding", `(let ((trace '()))
+			(define (note x) (set! trace (append trace (list x))))
+			(call/ec (lambda (k)
+				(with-exception-handler
+					(lambda (c) (note c) (k 'escaped))
+					(lambda () (dynamic-wind (lambda () (note 'before)) (lambda () (raise 'handler)) (lambda () (note 'after)))))))
+			trace)`, "'(before handler after)"},
+		{"builtin error before unwinding", `(let ((trace '()))
+			(define (note x) (set! trace (append trace (list x))))
+			(call/ec (lambda (k)
+				(with-exception-handler
+					(lambda (c) (note 'handler) (k 'escaped))
+					(lambda () (dynamic-wind (lambda () (note 'before)) (lambda () (car 1)) (lambda () (note 'after)))))))
+			trace)`, "'(before handler after)"},
+		{"handler returns before unwinding", `(let ((trace '()))
+			(define (note x) (set! trace (append trace (list x))))
+			(guard (e ((error-object? e) (note (error-object-message e))))
+				(with-exception-handler
+					(lambda (c) (note 'outer) (raise c))
+					(lambda ()
+						(with-exception-handler
+							(lambda (c) (note 'inner))
+							(lambda () (dynamic-wind (lambda () (note 'before)) (lambda () (error "boom")) (lambda () (note 'after))))))))
+			trace)`, `'(before inner outer after "exception handler returned from non-continuable exception")`},
+		{"guard after unwinding", `(let ((trace '()))
+			(define (note x) (set! trace (append trace (list x))))
+			(guard (e (#t (note e)))
+				(dynamic-wind (lambda () (note 'before)) (lambda () (raise 'guard)) (lambda () (note 'after))))
+			trace)`, "'(before after guard)"},
+		{"re-raise caught error", `(let ((e (guard (e (#t e)) (error "boom"))))
+			(with-exception-handler (lambda (c) 42) (lambda () (raise-continuable 1) (guard (e2 (#t (eq? e e2))) (raise e)))))`, "#t"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	for _, b := range backends {
+		x, err := ParseString(`(raise 'boom)`)
+		require.NoError(t, err)
+		_, err = NewEnv().WithBackend(b.backend).EvalErr(x)
+		assert.EqualError(t, err, "1:1: raise: uncaught exception: boom", b.name)
+
+		x, err = ParseString(`(error "bad thing" 42)`)
+		require.NoError(t, err)
+		_, err = NewEnv().WithBackend(b.backend).EvalErr(x)
+		assert.EqualError(t, err, "1:1: error: bad thing: 42", b.name)
+	}
+
+	_, err := ParseString(`(a b`)
+	require.Error(t, err)
+	assert.Equal(t, Boolean(true), ReadErrorPred(Vector{toError(err)}))
+
+	_, err = os.Open(filepath.Join(t.TempDir(), "missing.scm"))
+	require.Error(t, err)
+	assert.Equal(t, Boolean(true), FileErrorPred(Vector{toError(err)}))
+}
+
+func TestForms(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"and", `(list (and) (and 1 2) (and 1 #f 2))`, "'(#t 2 #f)"},
+		{"or", `(list (or) (or #f 2) (or #f #f))`, "'(#f 2 #f)"},
+		{"case", `(list (case 2 ((1) 'one) ((2 3) 'two)) (case 4 ((1) 'one) (else 'other)))`, "'(two other)"},
+		{"case =>", `(list (case 2 ((2) => -) (else 'other)) (case 3 ((2) 'two) (else => -)))`, "'(-2 -3)"},
+		{"cond =>", `(cond ((assq 'b '((a . 1) (b . 2))) => cdr) (else 'none))`, "2"},
+		{"cond test", `(cond (#f 1) ((+ 1 1)))`, "2"},
+		{"bound =>", `(let ((=> 1)) (list (cond (#t => 'x)) (case 1 ((1) => 'y))))`, "'(x y)"},
+		{"bound else", `(let ((else #f)) (cond (else 'x) (#t 'y)))`, "'y"},
+		{"inserted =>", `(let-syntax ((m (syntax-rules () ((_ x) (cond (x => list)))))) (let ((=> 1)) (m 5)))`, "'(5)"},
+		{"guard variable else", `(guard (else ((number? else) (list else))) (raise 3))`, "'(3)"},
+		{"cond no match", `(list (cond (#f 1)) (case 1 ((2) 'two)))`, "(list (if #f #f) (if #f #f))"},
+		{"if in argument", `(list (if #f 1) (if #t 1 2) (if #f 1 2) (+ 1 (if (< 1 2) 2 3)))`, "(list (if #f #f) 1 2 3)"},
+		{"loop with cond", `(let loop ((i 0) (acc 0))
+			(cond ((= i 10) acc)
+			      ((odd? i) (loop (+ i 1) (+ acc i)))
+			      (else (loop (+ i 1) acc))))`, "25"},
+		{"and or in loop", `(let loop ((i 0) (n 0))
+			(if (< i 10)
+				(loop (+ i 1) (if (or (= i 2) (and (> i 5) (even? i))) (+ n 1) n))
+				n))`, "3"},
+		{"let", `(let ((x 1) (y 2)) (+ x y))`, "3"},
+		{"named let", `(let loop ((i 0) (acc '())) (if (= i 3) acc (loop (+ i 1) (cons i acc))))`, "'(2 1 0)"},
+		{"let in argument", `(+ 1 (let loop ((i 0)) (if (= i 3) i (loop (+ i 1)))))`, "4"},
+		{"begin", `((lambda () (begin (define x 1) (define y 2)) (+ x y)))`, "3"},
+		{"quasiquote splicing", "`(1 ,@(list 2 3) 4 . ,(+ 2 3))", "'(1 2 3 4 . 5)"},
+		{"quasiquote vector", "(let ((v `#(1 ,(+ 1 1) ,@(list 3 4)))) (list (vector-ref v 1) (vector-ref v 3)))", "'(2 4)"},
+		{"quasiquote nested", "`(1 `(2 ,(+ 1 2)))", "'(1 (2 3))"},
+		{"define-syntax", `((lambda ()
+			(define-syntax swap!
+				(syntax-rules ()
+					((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))
+			(define x 1)
+			(define y 2)
+			(swap! x y)
+			(list x y)))`, "'(2 1)"},
+		{"recursive macro", `((lambda ()
+			(define-syntax my-or
+				(syntax-rules ()
+					((_) #f)
+					((_ e) e)
+					((_ e r ...) (let ((t e)) (if t t (my-or r ...))))))
+			(my-or #f #f 5)))`, "5"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+}
+
+func TestDerivedForms(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"let*", `(let ((x 2) (y 3))
+			(let* ((x 7)
+			       (z (+ x y)))
+				(* z x)))`, "70"},
+		{"let* empty", `(let* () (define x 1) (+ x 1))`, "2"},
+		{"let* shadowing", `(let* ((x 1) (x (+ x 1)) (x (* x 10))) x)`, "20"},
+		{"letrec", `(letrec ((even?
+		                      (lambda (n)
+		                        (if (zero? n)
+		                            #t
+		                            (odd? (- n 1)))))
+		                     (odd?
+		                      (lambda (n)
+		                        (if (zero? n)
+		                            #f
+		                            (even? (- n 1))))))
+			(even? 88))`, "#t"},
+		{"letrec*", `(letrec* ((p
+		                       (lambda (x)
+		                         (+ 1 (q (- x 1)))))
+		                      (q
+		                       (lambda (y)
+		                         (if (zero? y)
+		                             0
+		                             (+ 1 (p (- y 1))))))
+		                      (x (p 5))
+		                      (y x))
+			y)`, "5"},
+		{"letrec body definitions", `(letrec ((x 1)) (define x 2) x)`, "2"},
+		{"let-values", `(let ((a 'a) (b 'b) (x 'x) (y 'y))
+			(let-values (((a) b) ((x . y) a) (z a))
+				(list a x y z)))`, "'(b a () (a))"},
+		{"let*-values", `(let ((a 'a) (b 'b) (x 'x) (y 'y))
+			(let*-values (((a) b) ((x) a))
+				(list a x)))`, "'(b b)"},
+		{"let-values multiple values", `(let-values (((root rem) (exact-integer-sqrt 32)))
+			(* root rem))`, "35"},
+		{"let*-values multiple values", `(let ((a 'a) (b 'b) (x 'x) (y 'y))
+			(let*-values (((a b) (values x y))
+			              ((x y) (values a b)))
+				(list a b x y)))`, "'(x y x y)"},
+		{"define-values", `((lambda ()
+			(define-values (x . y) 1)
+			(define-values z 2)
+			(list x y z)))`, "'(1 () (2))"},
+		{"define-values multiple values", `((lambda ()
+			(define-values (x y) (exact-integer-sqrt 17))
+			(list x y)))`, "'(4 1)"},
+		{"do", `(let ((x '(1 3 5 7 9)))
+			(do ((x x (cdr x))
+			     (sum 0 (+ sum (car x))))
+			    ((null? x) sum)))`, "25"},
+		{"do commands", `(let ((acc '()))
+			(do ((i 0 (+ i 1)))
+			    ((= i 3))
+				(set! acc (cons i acc)))
+			acc)`, "'(2 1 0)"},
+		{"do tail", `(do ((i 0 (+ i 1))) ((= i 100000) i))`, "100000"},
+		{"when", `(list (when (= 1 1.0) 'a 'b) (when #f 'c))`, "(list 'b (if #f #f))"},
+		{"unless", `(list (unless (= 1 1.0) 'c) (unless #f 'a 'b))`, "(list (if #f #f) 'b)"},
+		{"case-lambda", `((lambda ()
+			(define range
+				(case-lambda
+					((e) (range 0 e))
+					((b e) (do ((r '() (cons e r))
+					            (e (- e 1) (- e 1)))
+					           ((< e b) r)))))
+			(list (range 3) (range 3 5))))`, "'((0 1 2) (3 4))"},
+		{"case-lambda rest", `((lambda ()
+			(define plus
+				(case-lambda
+					(() 0)
+					((x) x)
+					((x y) (+ x y))
+					((x y z) (+ (+ x y) z))
+					(args (apply + args))))
+			(list (plus) (plus 1) (plus 1 2 3) (plus 1 2 3 4))))`, "'(0 1 6 10)"},
+		{"case-lambda tail", `(letrec ((f (case-lambda
+				((n) (f n 0))
+				((n acc) (if (= n 0) acc (f (- n 1) (+ acc 1)))))))
+			(f 100000))`, "100000"},
+		{"internal definitions", `((lambda ()
+			(define (ev? n) (if (= n 0) #t (od? (- n 1))))
+			(define (od? n) (if (= n 0) #f (ev? (- n 1))))
+			(define x (ev? 10))
+			x))`, "#t"},
+		{"local keyword definition", `((lambda () (define (when x) (list 'when x)) (when 1)))`, "'(when 1)"},
+		{"top-level macro redefinition", `(begin
+			(define-syntax foo (syntax-rules () ((_ x) 'macro)))
+			(define (foo x) 'procedure)
+			(foo 1))`, "'procedure"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	errors := []struct{ name, expr, message string }{
+		{"case-lambda arity", `((case-lambda ((a) a) ((a b) b)) 1 2 3)`, "no case-lambda clause accepts the arguments"},
+		{"reference before definition", `((lambda () (define a b) (define b 1) a))`, "variable referenced before its definition: b"},
+		{"inner region", `(begin
+			(define x 'outer)
+			((lambda () (define y x) (define x 'inner) y)))`, "variable referenced before its definition: x"},
+		{"letrec", `(letrec ((a b) (b 1)) a)`, "variable referenced before its definition: b"},
+		{"top-level keyword definition", `(define (when x) x)`, "syntactic keyword may not be redefined as a variable: when"},
+		{"top-level keyword define-values", `(define-values (a if) (values 1 2))`, "syntactic keyword may not be redefined as a variable: if"},
+	}
+	for _, c := range errors {
+		for _, b := range backends {
+			t.Run(c.name+"/"+b.name, func(t *testing.T) {
+				_, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(c.expr))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), c.message)
+			})
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"call-with-values", `(call-with-values (lambda () (values 4 5))
+			(lambda (a b) b))`, "5"},
+		{"call-with-values procedures", `(call-with-values * -)`, "-1"},
+		{"no values", `(call-with-values (lambda () (values)) list)`, "'()"},
+		{"single value", `(+ 1 (values 2))`, "3"},
+		{"ignored values", `(begin (values 1 2) 3)`, "3"},
+		{"returned values", `(call-with-values (lambda () (if #t (values 1 2) 3)) list)`, "'(1 2)"},
+		{"dynamic-wind values", `(call-with-values (lambda () (dynamic-wind (lambda () #f) (lambda () (values 1 2)) (lambda () #f))) list)`, "'(1 2)"},
+		{"dynamic consumer", `(call-with-values (lambda () (values + 1 2)) apply)`, "3"},
+		{"receive", `(receive (q r) (floor/ -7 2) (list q r))`, "'(-4 1)"},
+		{"receive rest", `(receive (a . rest) (values 1 2 3) (list a rest))`, "'(1 (2 3))"},
+		{"receive list", `(receive all (values 1 2 3) all)`, "'(1 2 3)"},
+		{"receive body definitions", `(receive (a b) (values 1 2) (define c 3) (+ a b c))`, "6"},
+		{"receive tail", `((lambda ()
+			(define (loop n acc)
+				(receive (q r) (truncate/ n 2)
+					(if (= n 0) acc (loop (- n 1) (+ acc r)))))
+			(loop 100000 0)))`, "50000"},
+		{"call-with-values tail", `((lambda ()
+			(define (loop n)
+				(call-with-values (lambda () (values n 1))
+					(lambda (n d) (if (= n 0) 'done (loop (- n d))))))
+			(loop 100000)))`, "'done"},
+		{"redefined receive", `((lambda ()
+			(define-syntax receive
+				(syntax-rules ()
+					((_ formals expr body ...) (list 'receive 'formals expr))))
+			(receive (a b) 1 a)))`, "'(receive (a b) 1)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	errors := []struct{ name, expr, message string }{
+		{"too few values", `(receive (a b) (values 1) a)`, "expected 2 values: 1"},
+		{"too many values", `(let-values (((a) (values 1 2))) a)`, "expected 1 value: 1 2"},
+		{"too few rest values", `(receive (a b . c) 1 a)`, "expected at least 2 values: 1"},
+		{"define-values", `(define-values (a b) (values 1 2 3))`, "expected 2 values: 1 2 3"},
+		{"argument", `(list (values 1 2) 3)`, "expected 1 value: 1 2"},
+		{"no values argument", `(list (values))`, "expected 1 value"},
+		{"builtin argument", `(+ (values 1 2) 10)`, "expected 1 value: 1 2"},
+		{"if test", `(if (values #f 1) 'a 'b)`, "expected 1 value: #f 1"},
+		{"and test", `(and (values #f 1) 'a)`, "expected 1 value: #f 1"},
+		{"define", `(define x (values 1 2))`, "expected 1 value: 1 2"},
+		{"internal define", `((lambda () (define x (values 1 2)) x))`, "expected 1 value: 1 2"},
+		{"set!", `(let ((x 0)) (set! x (values 1 2)) x)`, "expected 1 value: 1 2"},
+		{"let", `(let ((x (values 1 2))) x)`, "expected 1 value: 1 2"},
+	}
+	for _, c := range errors {
+		for _, b := range backends {
+			t.Run(c.name+"/"+b.name, func(t *testing.T) {
+				_, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(c.expr))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), c.message)
+			})
+		}
+	}
+
+	for _, b := range backends {
+		t.Run("eval/"+b.name, func(t *testing.T) {
+			v, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(`(values 1 "two" 'three)`))
+			require.NoError(t, err)
+			assert.Equal(t, Values{NewInt(1), String("two"), Symbol("three")}, v)
+			assert.Equal(t, `1 "two" three`, EncodeToString(v))
+		})
+	}
+}
+
+func TestContinuations(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"call/cc", `(+ 1 (call/cc (lambda (k) (+ 2 (k 3)))))`, "4"},
+		{"call/cc return", `(+ 1 (call/cc (lambda (k) 2)))`, "3"},
+		{"call-with-current-continuation", `(call-with-current-continuation (lambda (k) (k 'done) 'not-done))`, "'done"},
+		{"call/ec", `(+ 1 (call/ec (lambda (k) (+ 2 (k 3)))))`, "4"},
+		{"call-with-escape-continuation", `(call-with-escape-continuation (lambda (k) (k 'done) 'not-done))`, "'done"},
+		{"escape from map", `(call/cc (lambda (return)
+			(map (lambda (x) (if (negative? x) (return x) x)) '(54 0 37 -3 245 19))
+			#t))`, "-3"},
+		{"escape from map/ec", `(call/ec (lambda (return)
+			(map (lambda (x) (if (negative? x) (return x) x)) '(54 0 37 -3 245 19))
+			#t))`, "-3"},
+		{"multiple values", `(call-with-values (lambda () (call/cc (lambda (k) (k 1 2)))) list)`, "'(1 2)"},
+		{"escape loop", `((lambda ()
+			(define (loop n acc)
+				(if (= n 0) acc (loop (- n 1) (+ acc (call/ec (lambda (k) (k 1)))))))
+			(loop 100000 0)))`, "100000"},
+		{"dynamic-wind", `((lambda ()
+			(define path '())
+			(define (add s) (set! path (cons s path)))
+			(define result (dynamic-wind (lambda () (add 'before)) (lambda () (add 'during) 'result) (lambda () (add 'after))))
+			(cons result path)))`, "'(result after during before)"},
+		{"dynamic-wind escape", `((lambda ()
+			(define path '())
+			(define (add s) (set! path (cons s path)))
+			(call/cc (lambda (k)
+				(dynamic-wind
+					(lambda () (add 'outer-before))
+					(lambda ()
+						(dynamic-wind
+							(lambda () (add 'inner-before))
+							(lambda () (k 'escaped))
+							(lambda () (add 'inner-after))))
+					(lambda () (add 'outer-after)))))
+			path))`, "'(outer-after inner-after inner-before outer-before)"},
+		{"dynamic-wind escape/ec", `((lambda ()
+			(define path '())
+			(define (add s) (set! path (cons s path)))
+			(define result (call/ec (lambda (k)
+				(dynamic-wind (lambda () (add 'before)) (lambda () (k 'escaped)) (lambda () (add 'after))))))
+			(cons result path)))`, "'(escaped after before)"},
+		{"dynamic-wind raise", `((lambda ()
+			(define path '())
+			(define (add s) (set! path (cons s path)))
+			(define result (guard (e (#t (add 'handler) e))
+				(dynamic-wind (lambda () (add 'before)) (lambda () (raise 'boom)) (lambda () (add 'after)))))
+			(cons result path)))`, "'(boom handler after before)"},
+		{"dynamic-wind values", `(call-with-values (lambda () (dynamic-wind (lambda () 1) (lambda () (values 2 3)) (lambda () 4))) list)`, "'(2 3)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	errors := []struct{ name, expr, message string }{
+		{"escape after return", `((call/ec (lambda (k) k)) 1)`, "escape continuation invoked outside of its dynamic extent"},
+		{"dynamic-wind before", `(dynamic-wind 1 (lambda () 2) (lambda () 3))`, "value is not a procedure: 1"},
+		{"call/cc", `(call/cc 1)`, "value is not a procedure: 1"},
+	}
+	for _, c := range errors {
+		for _, b := range backends {
+			t.Run(c.name+"/"+b.name, func(t *testing.T) {
+				_, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(c.expr))
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), c.message)
+			})
+		}
+	}
+
+	// re-entering a continuation runs the before thunks again
+	for _, b := range backends {
+		t.Run("re-entry/"+b.name, func(t *testing.T) {
+			v, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(`
+				(define path '())
+				(define (add s) (set! path (cons s path)))
+				(define k #f)
+				(define n 0)
+				(dynamic-wind
+					(lambda () (add 'connect))
+					(lambda () (add (call/cc (lambda (c) (set! k c) 'talk1))))
+					(lambda () (add 'disconnect)))
+				(if (< n 1)
+					(begin (set! n (+ n 1)) (k 'talk2)))
+				path`))
+			require.NoError(t, err)
+			assert.Equal(t, "(disconnect talk2 connect disconnect talk1 connect)", EncodeToString(v))
+		})
+	}
+
+	// continuations may be re-entered after call/cc has returned, any number
+	// of times
+	reentries := []struct{ name, expr, expected string }{
+		{"re-entry after return", `
+			(let ((k #f) (n 0))
+				(set! n (+ (call/cc (lambda (c) (set! k c) 1)) n))
+				(if (< n 3) (k 1))
+				n)`, "3"},
+		{"re-entry of top-level form", `
+			(define k #f)
+			(define (f) (call/cc (lambda (c) (set! k c) 1)))
+			(define x (+ 100 (f)))
+			(define first x)
+			(k 5)
+			(list first x)`, "(101 105)"},
+		{"re-entry of arguments", `
+			(let ((k #f) (vs '()))
+				(set! vs (cons (list 'a (list 'b (call/cc (lambda (c) (set! k c) 0)) 'c) 'd) vs))
+				(if (< (length vs) 3) (k (length vs)))
+				vs)`, "((a (b 2 c) d) (a (b 1 c) d) (a (b 0 c) d))"},
+		{"re-entry of body", `
+			(define (g)
+				(define path '())
+				(define k #f)
+				(set! path (cons (call/cc (lambda (c) (set! k c) 0)) path))
+				(if (< (length path) 3) (k (length path)))
+				(if #t path))
+			(g)`, "(2 1 0)"},
+		{"re-entry of if", `
+			(define k #f)
+			(define path '())
+			(set! path (cons (if (call/cc (lambda (c) (set! k c) #t)) 'yes 'no) path))
+			(if (null? (cdr path)) (k #f))
+			path`, "(no yes)"},
+		{"re-entry of let", `
+			(define k #f)
+			(define path '())
+			(let ((x (call/cc (lambda (c) (set! k c) 1))) (y 10))
+				(set! path (cons (+ x y) path)))
+			(if (< (length path) 2) (k 2))
+			path`, "(12 11)"},
+		{"re-entry of receive", `
+			(define k #f)
+			(define path '())
+			(call-with-values (lambda () (call/cc (lambda (c) (set! k c) (values 1 2)))) (lambda (a b) (set! path (cons (+ a b) path))))
+			(if (< (length path) 2) (k 3 4))
+			path`, "(7 3)"},
+		{"generator", `
+			(define (make-generator lst)
+				(define return #f)
+				(define (walk lst)
+					(if (null? lst)
+						(return 'done)
+						(begin
+							(call/cc (lambda (next) (set! resume next) (return (car lst))))
+							(walk (cdr lst)))))
+				(define resume (lambda (v) (walk lst)))
+				(lambda () (call/cc (lambda (r) (set! return r) (resume #f)))))
+			(define g (make-generator '(1 2 3)))
+			(define a (g))
+			(define b (g))
+			(define c (g))
+			(list a b c (g))`, "(1 2 3 done)"},
+		{"dynamic-wind in and out", `
+			(define path '())
+			(define (add s) (set! path (cons s path)))
+			(define k #f)
+			(define (jump-in)
+				(dynamic-wind
+					(lambda () (add 'in))
+					(lambda ()
+						(call/cc (lambda (c) (set! k c)))
+						(add 'body))
+					(lambda () (add 'out))))
+			(jump-in)
+			(define n 0)
+			(dynamic-wind
+				(lambda () (add 'outer-in))
+				(lambda () (if (< n 1) (begin (set! n 1) (k #f))))
+				(lambda () (add 'outer-out)))
+			path`, "(out body in outer-out outer-in out body in)"},
+	}
+	for _, c := range reentries {
+		for _, b := range backends {
+			t.Run(c.name+"/"+b.name, func(t *testing.T) {
+				v, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(c.expr))
+				require.NoError(t, err)
+				assert.Equal(t, c.expected, EncodeToString(v))
+			})
+		}
+	}
+
+	// exit runs the after thunks of the active dynamic-wind calls
+	for _, b := range backends {
+		t.Run("exit/"+b.name, func(t *testing.T) {
+			var out strings.Builder
+			env := NewEnv().WithBackend(b.backend)
+			env.SetOutput(&out)
+			_, err := env.EvalAll(strings.NewReader(`
+				(dynamic-wind (lambda () (display "before ")) (lambda () (exit 3)) (lambda () (display "after")))`))
+			var exit *ExitError
+			require.ErrorAs(t, err, &exit)
+			assert.Equal(t, 3, exit.Code)
+			assert.Equal(t, "before after", out.String())
+
+			out.Reset()
+			_, err = env.EvalAll(strings.NewReader(`
+				(dynamic-wind (lambda () (display "before")) (lambda () (emergency-exit)) (lambda () (display "after")))`))
+			require.ErrorAs(t, err, &exit)
+			assert.Equal(t, "before", out.String())
+		})
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.scm"), []byte("(define (Double x) (* x 2))\n(define Ten 10)"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.scm"), []byte(`(include "lib.scm") (include-ci "lib.scm") (list (Double Ten) (double ten))`), 0600))
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			v, err := NewEnv().With(nil).WithBackend(b.backend).Load(filepath.Join(dir, "main.scm"))
+			require.NoError(t, err)
+			assert.Equal(t, "(20 20)", EncodeToString(v))
+
+			x, err := ParseString(`(include "missing.scm")`)
+			require.NoError(t, err)
+			_, err = NewEnv().WithBackend(b.backend).EvalErr(x)
+			require.Error(t, err)
+			assert.Equal(t, Boolean(true), FileErrorPred(Vector{err.(*Error)}))
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"closure", `(let ((n 0)) (define (inc) (set! n (+ n 1)) n) (inc) (inc))`, "2"},
+		{"nested closures", `((((lambda (a) (lambda (b) (lambda (c) (list a b c)))) 1) 2) 3)`, "'(1 2 3)"},
+		{"variadic", `((lambda (a . rest) (list a rest)) 1 2 3)`, "'(1 (2 3))"},
+		{"shadow global", `(let ((car cdr)) (car '(1 2)))`, "'(2)"},
+		{"internal define", `((lambda (x) (define y (* x 2)) (define x 3) (list x y)) 1)`, "'(3 2)"},
+		{"define in begin", `((lambda () (begin (define a 1)) (set! a (+ a 1)) a))`, "2"},
+		{"set! global", `(begin (define g 1) ((lambda () (set! g 2))) g)`, "2"},
+		{"macro define", `((lambda ()
+			(define-syntax def (syntax-rules () ((_ n v) (define n v))))
+			(def x 42)
+			x))`, "42"},
+		{"mutual recursion", `((lambda ()
+			(define (even? n) (if (= n 0) #t (odd? (- n 1))))
+			(define (odd? n) (if (= n 0) #f (even? (- n 1))))
+			(list (even? 10) (odd? 7))))`, "'(#t #t)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	parse := func(t *testing.T, expr string) Value {
+		x, err := ParseString(expr)
+		require.NoError(t, err)
+		return x
+	}
+
+	loop := `(begin (define (f) (f)) (f))`
+	guarded := `(guard (e (#t 'caught)) (let loop () (loop)))`
+	handled := `(with-exception-handler (lambda (e) 'handled) (lambda () (let loop () (loop))))`
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().With(nil).WithBackend(b.backend)
+
+			v, err := env.WithBudget(1000).EvalContext(context.Background(), parse(t, `(+ 1 2)`))
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(3), v))
+
+			for _, expr := range []string{loop, guarded, handled} {
+				_, err = env.WithBudget(10000).EvalContext(context.Background(), parse(t, expr))
+				assert.True(t, errors.Is(err, ErrBudgetExceeded), "%v: %v", expr, err)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				_, err = env.EvalContext(ctx, parse(t, expr))
+				cancel()
+				assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v: %v", expr, err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err = env.EvalContext(ctx, parse(t, `(+ 1 2)`))
+			assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+
+			// the budget applies to each evaluation
+			limited := env.WithBudget(10000)
+			for i := 0; i < 3; i++ {
+				_, err = limited.EvalErr(parse(t, `(let loop ((i 0)) (if (< i 100) (loop (+ i 1)) i))`))
+				require.NoError(t, err)
+			}
+			_, err = limited.EvalErr(parse(t, loop))
+			assert.True(t, errors.Is(err, ErrBudgetExceeded), "%v", err)
+		})
+	}
+}
+
+func TestEvalDeadline(t *testing.T) {
+	const deadline = 100 * time.Millisecond
+
+	programs := []string{
+		`(let loop () (loop))`,
+		`(do ((i 0 (+ i 1))) (#f) (let ((j i)) j))`,
+		`(let loop () (apply (lambda (x) (let* ((y x) (z y)) z)) '(1)) (loop))`,
+		`(define (f n) (if (= n 0) 0 (+ 1 (f (- n 1))))) (let loop () (f 1000) (loop))`,
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, program := range programs {
+				x, err := ParseString("(begin " + program + ")")
+				require.NoError(t, err)
+
+				ctx, cancel := context.WithTimeout(context.Background(), deadline)
+				start := time.Now()
+				_, err = NewEnv().WithBackend(b.backend).EvalContext(ctx, x)
+				elapsed := time.Since(start)
+				cancel()
+
+				assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v: %v", program, err)
+				assert.Less(t, int64(elapsed), int64(2*deadline), program)
+			}
+		})
+	}
+}
+
+func TestEnvIsolation(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			e1, e2 := NewEnv().WithBackend(b.backend), NewEnv().WithBackend(b.backend)
+
+			_, err := e1.EvalAll(strings.NewReader(`(define x 1) (set! car cdr) (define-syntax k (syntax-rules () ((_) 'k)))`))
+			require.NoError(t, err)
+			assert.True(t, e1.Bound("x"))
+			assert.False(t, e2.Bound("x"))
+
+			v, err := e1.EvalAll(strings.NewReader(`(list (car '(1 2)) (k))`))
+			require.NoError(t, err)
+			assert.Equal(t, "((2) k)", EncodeToString(v))
+
+			v, err = e2.EvalAll(strings.NewReader(`(car '(1 2))`))
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(1), v))
+
+			_, err = e2.EvalAll(strings.NewReader(`(k)`))
+			assert.Error(t, err)
+
+			e2.Set("x", NewInt(2))
+			v, err = e1.EvalAll(strings.NewReader(`x`))
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(1), v))
+		})
+	}
+}
+
+// TestConcurrentEnvs evaluates programs in independent environments in
+// parallel. Run with -race to detect shared mutable state.
+func TestConcurrentEnvs(t *testing.T) {
+	program := `
+		(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+		(define counter 0)
+		(define-syntax incr! (syntax-rules () ((_ v) (set! v (+ v 1)))))
+		(let loop ((i 0))
+			(if (< i 100)
+				(begin
+					(incr! counter)
+					(loop (+ i 1)))))
+		(define f (fib 10))
+		(set! + -)
+		(list counter (+ 3 1) f (guard (e ((error-object? e) (string->symbol (error-object-message e)))) (error "boom")))`
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			for i := 0; i < 8; i++ {
+				t.Run(fmt.Sprint(i), func(t *testing.T) {
+					t.Parallel()
+
+					for j := 0; j < 4; j++ {
+						v, err := NewEnv().WithBackend(b.backend).EvalAll(strings.NewReader(program))
+						require.NoError(t, err)
+						assert.Equal(t, "(100 2 55 boom)", EncodeToString(v))
+					}
+				})
+			}
+		})
+	}
+}
+
+type point struct {
+	X, Y int
+	Tags []string
+}
+
+func TestDefineFunc(t *testing.T) {
+	env := NewEnv()
+	env.DefineFunc("add", func(a int, b float64) float64 { return float64(a) + b })
+	env.DefineFunc("join", strings.Join)
+	env.DefineFunc("sum", func(xs ...int64) int64 {
+		s := int64(0)
+		for _, x := range xs {
+			s += x
+		}
+		return s
+	})
+	env.DefineFunc("not-go", func(b bool) bool { return !b })
+	env.DefineFunc("byte", func(b uint8) uint8 { return b })
+	env.DefineFunc("rune", func(r rune) int { return int(r) })
+	env.DefineFunc("lengths", func(m map[string][]int) map[string]int {
+		r := map[string]int{}
+		for k, v := range m {
+			r[k] = len(v)
+		}
+		return r
+	})
+	env.DefineFunc("move", func(p point, dx int) *point {
+		p.X += dx
+		return &p
+	})
+	env.DefineFunc("nothing", func() *point { return nil })
+	env.DefineFunc("fail", func(s string) (string, error) {
+		if s == "" {
+			return "", os.ErrNotExist
+		}
+		return s, nil
+	})
+	env.DefineFunc("identity", func(v Value) Value { return v })
+	env.DefineFunc("call", func(f func(int, int) int, a, b int) int { return f(a, b) })
+	env.DefineFunc("adder", func(n int) func(int) int { return func(x int) int { return x + n } })
+	env.DefineFunc("quiet", func() {})
+	env.DefineFunc("divmod", func(a, b int) (int, int, error) {
+		if b == 0 {
+			return 0, 0, errors.New("division by zero")
+		}
+		return a / b, a % b, nil
+	})
+	env.DefineFunc("a", func() error { return errors.New("expected a list") })
+	env.DefineFunc("call-divmod", func(f func(int, int) (int, int), a, b int) []int {
+		q, r := f(a, b)
+		return []int{q, r}
+	})
+
+	cases := []struct{ expr, expected string }{
+		{`(add 1 2.5)`, "3.5"},
+		{`(join '("a" "b" "c") ", ")`, `"a, b, c"`},
+		{`(join #("a" "b") "")`, `"ab"`},
+		{`(list (sum) (sum 1 2 3))`, "'(0 6)"},
+		{`(not-go #f)`, "#t"},
+		{`(byte 255)`, "255"},
+		{`(rune #\a)`, "97"},
+		{`(lengths '(("a" 1 2) (b)))`, `'((a . 2) (b . 0))`},
+		{`(move '((X . 1) (Y . 2) (Tags "a")) 3)`, `'((X . 4) (Y . 2) (Tags . #("a")))`},
+		{`(nothing)`, "'()"},
+		{`(fail "ok")`, `"ok"`},
+		{`(identity 'sym)`, "'sym"},
+		{`(call - 5 3)`, "2"},
+		{`((adder 2) 40)`, "42"},
+		{`(quiet)`, "(if #f #f)"},
+		{`(call-with-values (lambda () (divmod 7 2)) list)`, "'(3 1)"},
+		{`(call-divmod floor/ -7 2)`, "#(-4 1)"},
+		{`(call-divmod divmod 7 2)`, "#(3 1)"},
+	}
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			x, err := ParseString(c.expr)
+			require.NoError(t, err)
+			v, err := env.EvalErr(x)
+			require.NoError(t, err)
+
+			expected, err := ParseString(c.expected)
+			require.NoError(t, err)
+			assert.Equal(t, EncodeToString(env.Eval(expected)), EncodeToString(v))
+		})
+	}
+
+	errs := []struct{ expr, message string }{
+		{`(add 'one 2)`, `1:1: the first argument to add must be an exact integer: one`},
+		{`(add 1.5 2)`, `1:1: the first argument to add must be an exact integer: 1.5`},
+		{`(add 1)`, `1:1: add expects 2 arguments`},
+		{`(sum 1 'x)`, `1:1: the second argument to sum must be an exact integer: x`},
+		{`(byte 256)`, `1:1: the first argument to byte must be an exact integer in the range of uint8: 256`},
+		{`(join '("a" 1) "")`, `1:1: element 1 of the first argument to join must be a string: 1`},
+		{`(move '((Z . 1)) 0)`, `1:1: the first argument to move has no field named: Z`},
+		{`(move '((Tags 1)) 0)`, `1:1: element 0 of field Tags of the first argument to move must be a string: 1`},
+		{`(fail "")`, `1:1: fail: file does not exist`},
+		{`(divmod 1 0)`, `1:1: divmod: division by zero`},
+		{`(a)`, `1:1: a: expected a list`},
+		{`(call-divmod + 1 2)`, `1:1: call-divmod: <builtin procedure> must return 2 values: 3`},
+		{`(call-divmod (lambda (a b) (values a 'b)) 1 2)`, `1:1: call-divmod: the second result of <lambda> must be an exact integer: b`},
+	}
+	for _, c := range errs {
+		t.Run(c.expr, func(t *testing.T) {
+			x, err := ParseString(c.expr)
+			require.NoError(t, err)
+			_, err = env.EvalErr(x)
+			assert.EqualError(t, err, c.message)
+		})
+	}
+
+	x, err := ParseString(`(fail "")`)
+	require.NoError(t, err)
+	_, err = env.EvalErr(x)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	assert.Panics(t, func() { env.DefineFunc("bad", 42) })
+	assert.PanicsWithValue(t, "bad: the second argument has unsupported type chan int", func() { env.DefineFunc("bad", func(int, chan int) {}) })
+	assert.PanicsWithValue(t, "bad: the first result has unsupported type map[string]complex128", func() { env.DefineFunc("bad", func() map[string]complex128 { return nil }) })
+	assert.PanicsWithValue(t, "bad: the first argument has unsupported type func(chan int)", func() { env.DefineFunc("bad", func(func(chan int)) {}) })
+	assert.False(t, env.Bound("bad"))
+
+	type list struct {
+		Next *list
+		Item int
+	}
+	assert.NotPanics(t, func() { env.DefineFunc("recursive", func(l *list) *list { return l }) })
+}
+
+func TestOutput(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			var out strings.Builder
+			env := NewEnv().WithBackend(b.backend)
+			env.SetOutput(&out)
+
+			_, err := env.EvalAll(strings.NewReader(`
+				(write "a\"b") (write-char #\space) (display "a\"b") (newline)
+				(map write (list #\a '|odd symbol| #(1 "2")))
+				(newline (current-output-port))
+				(map display (list #\a '|odd symbol| #(1 "2")))
+				(write-string "hello" (current-output-port) 1 3)
+				(write-string "!\n")`))
+			require.NoError(t, err)
+			assert.Equal(t, "\"a\\\"b\" a\"b\n#\\a|odd symbol|#(1 \"2\")\naodd symbol#(1 2)el!\n", out.String())
+
+			out.Reset()
+			_, err = env.EvalAll(strings.NewReader(`
+				(define x (list 'a 'b))
+				(set-cdr! (cdr x) x)
+				(write x) (newline)
+				(display x) (newline)
+				(define y (list 1 2))
+				(write (list y y)) (newline)
+				(write-shared (list y y)) (newline)
+				(write-simple (list y y)) (newline)
+				(write '#0=(c . #0#))`))
+			require.NoError(t, err)
+			assert.Equal(t, "#0=(a b . #0#)\n#0=(a b . #0#)\n((1 2) (1 2))\n(#0=(1 2) #0#)\n((1 2) (1 2))\n#0=(c . #0#)", out.String())
+
+			errs := []string{
+				`(write)`,
+				`(write 1 2)`,
+				`(write-char "a")`,
+				`(write-string "abc" (current-output-port) 2 1)`,
+				`(write-string "abc" (current-output-port) 0 4)`,
+			}
+			for _, e := range errs {
+				_, err := env.EvalAll(strings.NewReader(e))
+				assert.Error(t, err, e)
+			}
+		})
+	}
+
+	// each environment has its own output port
+	var out1, out2 strings.Builder
+	e1, e2 := NewEnv(), NewEnv()
+	e1.SetOutput(&out1)
+	e2.SetOutput(&out2)
+	_, err := e1.EvalAll(strings.NewReader(`(display "one")`))
+	require.NoError(t, err)
+	_, err = e2.EvalAll(strings.NewReader(`(display "two")`))
+	require.NoError(t, err)
+	assert.Equal(t, "one", out1.String())
+	assert.Equal(t, "two", out2.String())
+}
+
+func TestProcessContext(t *testing.T) {
+	os.Setenv("LOOM_TEST_VARIABLE", "value")
+	defer os.Unsetenv("LOOM_TEST_VARIABLE")
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+
+			v, err := env.EvalAll(strings.NewReader(`(length (command-line))`))
+			require.NoError(t, err)
+			assert.True(t, eqv(NewInt(int64(len(os.Args))), v))
+
+			env.SetCommandLine([]string{"script.scm", "a", "b"})
+			v, err = env.EvalAll(strings.NewReader(`(command-line)`))
+			require.NoError(t, err)
+			assert.Equal(t, `("script.scm" "a" "b")`, EncodeToString(v))
+
+			v, err = env.EvalAll(strings.NewReader(`
+				(list (get-environment-variable "LOOM_TEST_VARIABLE")
+				      (get-environment-variable "LOOM_TEST_UNDEFINED_VARIABLE"))`))
+			require.NoError(t, err)
+			assert.Equal(t, `("value" #f)`, EncodeToString(v))
+
+			v, err = env.EvalAll(strings.NewReader(`(get-environment-variables)`))
+			require.NoError(t, err)
+			var environ map[string]string
+			require.NoError(t, Unmarshal(v, &environ))
+			assert.Equal(t, "value", environ["LOOM_TEST_VARIABLE"])
+
+			exits := []struct {
+				expr string
+				code int
+			}{
+				{`(exit)`, 0},
+				{`(exit #t)`, 0},
+				{`(exit #f)`, 1},
+				{`(exit 3)`, 3},
+				{`(exit 'failure)`, 1},
+				{`(emergency-exit 4)`, 4},
+				{`(guard (e (#t 'caught)) (exit 5))`, 5},
+				{`(with-exception-handler (lambda (e) 'caught) (lambda () (exit 6)))`, 6},
+				{`(map (lambda (x) (exit x)) '(7))`, 7},
+			}
+			for _, e := range exits {
+				_, err := env.EvalAll(strings.NewReader(e.expr))
+				var exit *ExitError
+				if assert.True(t, errors.As(err, &exit), e.expr) {
+					assert.Equal(t, e.code, exit.Code, e.expr)
+				}
+			}
+		})
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			_, err := env.EvalAll(strings.NewReader(`
+				(define (g x) (car x))
+				(define (f x) (+ 1 (g x)))
+				(define (h x) (let ((y (f x))) y))
+				(define (k) (h 1) 'unreachable)
+				(k)`))
+			require.Error(t, err)
+
+			var serr *Error
+			require.True(t, errors.As(err, &serr))
+
+			var names []Symbol
+			for _, frame := range serr.Stack {
+				names = append(names, frame.Procedure)
+			}
+			assert.Equal(t, []Symbol{"g", "f", "h", "k"}, names)
+			assert.Equal(t, "g (3:24)", serr.Stack[0].String())
+			assert.Equal(t, "k (6:5)", serr.Stack[3].String())
+		})
+	}
+}
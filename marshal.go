@@ -0,0 +1,450 @@
+package loom
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// An Unmarshaler is a type that can unmarshal a Scheme value into itself. It is
+// the counterpart of the MarshalSExp method of Value.
+type Unmarshaler interface {
+	UnmarshalSExp(v Value) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// Marshal returns the Scheme representation of in. Go values are converted as
+// follows:
+//
+//	bool                  boolean
+//	integer types         exact integer
+//	floating-point types  inexact real
+//	string                string
+//	slices and arrays     vector
+//	maps                  association list of (key . value) pairs, sorted by
+//	                      key; string keys are converted to symbols
+//	structs               association list of (field . value) pairs
+//	pointers              the value pointed to, or () if the pointer is nil
+//	functions             procedure
+//
+// Values that implement Value are marshaled as themselves; their MarshalSExp
+// method determines their external representation.
+//
+// Each exported struct field is keyed by a symbol with the field's name unless
+// the field's tag specifies otherwise. The tag is formatted as
+// `loom:"name,omitempty"`. The name may be empty, in which case the field's
+// name is used. If the omitempty option is present, the field is omitted if it
+// has a zero value. A field with the tag `loom:"-"` is always omitted.
+//
+// Marshal returns an error if in refers to itself, e.g. by way of a pointer
+// field that points to the enclosing struct.
+func Marshal(in interface{}) (Value, error) {
+	v, err := toValue(reflect.ValueOf(in))
+	if err != nil {
+		return nil, err.toError("the value")
+	}
+	return v, nil
+}
+
+// Unmarshal converts the Scheme value v to a Go value and stores the result in
+// the value pointed to by out. Unmarshal is the inverse of Marshal. In
+// addition:
+//
+//   - slices and arrays may be unmarshaled from lists as well as vectors
+//   - strings, including map keys, may be unmarshaled from symbols as well as
+//     strings
+//   - integer types are unmarshaled from exact integers that are within the
+//     range of the type; floating-point types are unmarshaled from any number
+//   - the empty list is unmarshaled as the zero value of a pointer, slice, map,
+//     or interface
+//   - Scheme values are stored as-is in Go values of types that they implement,
+//     including interface{}
+//
+// If out's element type implements Unmarshaler, its UnmarshalSExp method is
+// called to unmarshal v. When unmarshaling into a struct, each key of the
+// association list must name a field of the struct.
+func Unmarshal(v Value, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("Unmarshal: expected a non-nil pointer, not %T", out)
+	}
+
+	elem, err := fromValue(v, rv.Type().Elem())
+	if err != nil {
+		return err.toError("the value")
+	}
+	rv.Elem().Set(elem)
+	return nil
+}
+
+// A conversionError describes a value that could not be converted between
+// Scheme and Go.
+type conversionError struct {
+	path      string // the location of the value within the value being converted, e.g. "element 1 of "
+	problem   string // the problem with the value, e.g. "must be a string"
+	irritants Vector // the value that could not be converted, if it is a Scheme value
+	cause     error  // the error that caused the failure, if any
+}
+
+func conversionErrorf(value Value, format string, args ...interface{}) *conversionError {
+	return &conversionError{problem: fmt.Sprintf(format, args...), irritants: Vector{value}}
+}
+
+// in records that the value that could not be converted is contained by an
+// enclosing value at the given location.
+func (e *conversionError) in(format string, args ...interface{}) *conversionError {
+	e.path += fmt.Sprintf(format, args...) + " of "
+	return e
+}
+
+// toError returns an *Error that describes the failure to convert the value
+// described by subject.
+func (e *conversionError) toError(subject string) *Error {
+	return &Error{Message: e.path + subject + " " + e.problem, Irritants: e.irritants, cause: e.cause}
+}
+
+// toNamedError is like toError, but subject names the procedure that failed,
+// e.g. "the first argument to f".
+func (e *conversionError) toNamedError(subject string) *Error {
+	err := e.toError(subject)
+	err.named = true
+	return err
+}
+
+// A structField describes a marshaled field of a struct.
+type structField struct {
+	name      Symbol
+	index     int
+	omitEmpty bool
+}
+
+// structFields returns the marshaled fields of the struct type t.
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := field.Tag.Get("loom")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.IndexByte(tag, ','); comma != -1 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		f := structField{name: Symbol(name), index: i}
+		for _, option := range strings.Split(options, ",") {
+			if option == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// fromValue converts the Scheme value v to a Go value of type t.
+func fromValue(v Value, t reflect.Type) (reflect.Value, *conversionError) {
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), nil
+		}
+	} else if vt := reflect.TypeOf(v); vt.AssignableTo(t) {
+		return reflect.ValueOf(v), nil
+	}
+
+	if t.Kind() != reflect.Ptr && reflect.PtrTo(t).Implements(unmarshalerType) {
+		rv := reflect.New(t)
+		if err := rv.Interface().(Unmarshaler).UnmarshalSExp(v); err != nil {
+			return reflect.Value{}, &conversionError{problem: "is invalid: " + err.Error(), cause: err}
+		}
+		return rv.Elem(), nil
+	}
+
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := v.(Boolean)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be a boolean")
+		}
+		rv.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if c, ok := v.(Character); ok && t.Kind() == reflect.Int32 {
+			rv.SetInt(int64(c))
+			break
+		}
+		n, ok := v.(Number)
+		if !ok || !n.IsExact() || !n.IsInteger() {
+			return reflect.Value{}, conversionErrorf(v, "must be an exact integer")
+		}
+		i, ok := n.Int()
+		if !ok || rv.OverflowInt(i) {
+			return reflect.Value{}, conversionErrorf(v, "must be an exact integer in the range of %v", t)
+		}
+		rv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := v.(Number)
+		if !ok || !n.IsExact() || !n.IsInteger() {
+			return reflect.Value{}, conversionErrorf(v, "must be an exact integer")
+		}
+		u, ok := n.Uint()
+		if !ok || rv.OverflowUint(u) {
+			return reflect.Value{}, conversionErrorf(v, "must be an exact integer in the range of %v", t)
+		}
+		rv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		n, ok := v.(Number)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be a number")
+		}
+		f, _ := n.Float64()
+		rv.SetFloat(f)
+	case reflect.String:
+		switch s := v.(type) {
+		case String:
+			rv.SetString(string(s))
+		case Symbol:
+			rv.SetString(string(s))
+		default:
+			return reflect.Value{}, conversionErrorf(v, "must be a string")
+		}
+	case reflect.Slice, reflect.Array:
+		elements, ok := sequenceElements(v)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be a list or vector")
+		}
+		if t.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(t, len(elements), len(elements)))
+		} else if len(elements) != t.Len() {
+			return reflect.Value{}, conversionErrorf(v, "must be a list or vector of length %d", t.Len())
+		}
+		for i, element := range elements {
+			ev, err := fromValue(element, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err.in("element %d", i)
+			}
+			rv.Index(i).Set(ev)
+		}
+	case reflect.Map:
+		entries, ok := associationList(v)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be an association list")
+		}
+		rv.Set(reflect.MakeMapWithSize(t, len(entries)))
+		for _, entry := range entries {
+			key, err := fromValue(entry.car, t.Key())
+			if err != nil {
+				return reflect.Value{}, err.in("a key")
+			}
+			value, err := fromValue(entry.cdr, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err.in("the value of key %v", EncodeToString(entry.car))
+			}
+			rv.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		entries, ok := associationList(v)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be an association list")
+		}
+		fields := map[Symbol]structField{}
+		for _, f := range structFields(t) {
+			fields[f.name] = f
+		}
+		for _, entry := range entries {
+			name, _ := entry.car.(Symbol)
+			field, ok := fields[name]
+			if !ok {
+				return reflect.Value{}, conversionErrorf(entry.car, "has no field named")
+			}
+			value, err := fromValue(entry.cdr, t.Field(field.index).Type)
+			if err != nil {
+				return reflect.Value{}, err.in("field %v", name)
+			}
+			rv.Field(field.index).Set(value)
+		}
+	case reflect.Ptr:
+		elem, err := fromValue(v, t.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		rv.Set(reflect.New(t.Elem()))
+		rv.Elem().Set(elem)
+	case reflect.Func:
+		p, ok := v.(Procedure)
+		if !ok {
+			return reflect.Value{}, conversionErrorf(v, "must be a procedure")
+		}
+		rv.Set(procedureFunc(p, t))
+	default:
+		return reflect.Value{}, conversionErrorf(v, "cannot be converted to %v", t)
+	}
+	return rv, nil
+}
+
+// sequenceElements returns the elements of a list or vector.
+func sequenceElements(v Value) ([]Value, bool) {
+	switch v := v.(type) {
+	case nil:
+		return nil, true
+	case Vector:
+		return v, true
+	case *Pair:
+		var elements []Value
+		for ; v != nil; v, _ = v.cdr.(*Pair) {
+			elements = append(elements, v.car)
+			if _, ok := v.cdr.(*Pair); !ok && v.cdr != nil {
+				return nil, false
+			}
+		}
+		return elements, true
+	default:
+		return nil, false
+	}
+}
+
+// associationList returns the entries of an association list.
+func associationList(v Value) ([]*Pair, bool) {
+	elements, ok := sequenceElements(v)
+	if !ok {
+		return nil, false
+	}
+	entries := make([]*Pair, len(elements))
+	for i, element := range elements {
+		if entries[i], ok = element.(*Pair); !ok {
+			return nil, false
+		}
+	}
+	return entries, true
+}
+
+// toValue converts the Go value rv to a Scheme value. It is an error if rv
+// refers to itself.
+func toValue(rv reflect.Value) (Value, *conversionError) {
+	return marshalValue(rv, map[marshalRef]bool{})
+}
+
+// A marshalRef identifies a pointer, map, or slice that is being marshaled.
+type marshalRef struct {
+	ptr uintptr
+	t   reflect.Type
+	len int
+}
+
+// marshalValue converts the Go value rv to a Scheme value. visiting holds the
+// pointers, maps, and slices that enclose rv; reaching one of them again means
+// that the value is cyclic.
+func marshalValue(rv reflect.Value, visiting map[marshalRef]bool) (Value, *conversionError) {
+	if !rv.IsValid() {
+		return nil, nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if !rv.IsNil() {
+			ref := marshalRef{ptr: rv.Pointer(), t: rv.Type()}
+			if rv.Kind() == reflect.Slice {
+				ref.len = rv.Len()
+			}
+			if visiting[ref] {
+				return nil, &conversionError{problem: "refers to itself and cannot be converted to a Scheme value"}
+			}
+			visiting[ref] = true
+			defer delete(visiting, ref)
+		}
+	}
+
+	if rv.Type().Implements(valueType) {
+		if (rv.Kind() == reflect.Interface || rv.Kind() == reflect.Ptr) && rv.IsNil() {
+			return nil, nil
+		}
+		return rv.Interface().(Value), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return Boolean(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewInt(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewUint(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return NewFloat(rv.Float()), nil
+	case reflect.String:
+		return String(rv.String()), nil
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return Vector{}, nil
+		}
+		elements := make(Vector, rv.Len())
+		for i := range elements {
+			v, err := marshalValue(rv.Index(i), visiting)
+			if err != nil {
+				return nil, err.in("element %d", i)
+			}
+			elements[i] = v
+		}
+		return elements, nil
+	case reflect.Map:
+		entries := make(Vector, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			var key Value
+			if k := iter.Key(); k.Kind() == reflect.String && !k.Type().Implements(valueType) {
+				key = Symbol(k.String())
+			} else {
+				v, err := marshalValue(k, visiting)
+				if err != nil {
+					return nil, err.in("a key")
+				}
+				key = v
+			}
+			value, err := marshalValue(iter.Value(), visiting)
+			if err != nil {
+				return nil, err.in("the value of key %v", EncodeToString(key))
+			}
+			entries = append(entries, Cons(key, value))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return EncodeToString(entries[i].(*Pair).car) < EncodeToString(entries[j].(*Pair).car)
+		})
+		return entries.ToList(), nil
+	case reflect.Struct:
+		var entries Vector
+		for _, field := range structFields(rv.Type()) {
+			fv := rv.Field(field.index)
+			if field.omitEmpty && fv.IsZero() {
+				continue
+			}
+			value, err := marshalValue(fv, visiting)
+			if err != nil {
+				return nil, err.in("field %v", field.name)
+			}
+			entries = append(entries, Cons(field.name, value))
+		}
+		return entries.ToList(), nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return marshalValue(rv.Elem(), visiting)
+	case reflect.Func:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return newGoFunc("", rv), nil
+	default:
+		return nil, &conversionError{problem: fmt.Sprintf("of type %v cannot be converted to a Scheme value", rv.Type())}
+	}
+}
@@ -0,0 +1,167 @@
+package loom
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// duration is a time.Duration that is represented as a string, e.g. "1m30s".
+type duration time.Duration
+
+var errDuration = errors.New("invalid duration")
+
+func (d duration) MarshalSExp() SExpression {
+	return String(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalSExp(v Value) error {
+	s, ok := v.(String)
+	if !ok {
+		return errDuration
+	}
+	x, err := time.ParseDuration(string(s))
+	if err != nil {
+		return errDuration
+	}
+	*d = duration(x)
+	return nil
+}
+
+type listener struct {
+	Address string   `loom:"address"`
+	Port    uint16   `loom:"port"`
+	TLS     bool     `loom:"tls,omitempty"`
+	Timeout duration `loom:"timeout"`
+}
+
+type config struct {
+	Name      string            `loom:"name"`
+	Listeners []listener        `loom:"listeners"`
+	Limits    map[string]int    `loom:"limits"`
+	Ratio     float64           `loom:"ratio"`
+	Parent    *config           `loom:"parent,omitempty"`
+	Labels    map[string]string `loom:",omitempty"`
+	Secret    string            `loom:"-"`
+	Extra     Value             `loom:"extra"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	x, err := ParseString(`(
+		(name . "server")
+		(listeners
+			((address . "localhost") (port . 8080) (timeout . "30s"))
+			((address . "0.0.0.0") (port . 443) (tls . #t) (timeout . "1m")))
+		(limits (connections . 100) ("requests" . 5))
+		(ratio . 1/2)
+		(parent (name . base))
+		(extra 1 2 3))`)
+	require.NoError(t, err)
+
+	var c config
+	require.NoError(t, Unmarshal(x, &c))
+
+	assert.Equal(t, "server", c.Name)
+	assert.Equal(t, []listener{
+		{Address: "localhost", Port: 8080, Timeout: duration(30 * time.Second)},
+		{Address: "0.0.0.0", Port: 443, TLS: true, Timeout: duration(time.Minute)},
+	}, c.Listeners)
+	assert.Equal(t, map[string]int{"connections": 100, "requests": 5}, c.Limits)
+	assert.Equal(t, 0.5, c.Ratio)
+	require.NotNil(t, c.Parent)
+	assert.Equal(t, "base", c.Parent.Name)
+	assert.Equal(t, "(1 2 3)", EncodeToString(c.Extra))
+
+	var n int
+	require.NoError(t, Unmarshal(NewInt(42), &n))
+	assert.Equal(t, 42, n)
+
+	var any interface{}
+	require.NoError(t, Unmarshal(Symbol("sym"), &any))
+	assert.Equal(t, Symbol("sym"), any)
+
+	errs := []struct{ value, message string }{
+		{`((name . 42))`, "field name of the value must be a string: 42"},
+		{`((listeners ((port . 70000))))`, "field port of element 0 of field listeners of the value must be an exact integer in the range of uint16: 70000"},
+		{`((listeners ((timeout . 30))))`, "field timeout of element 0 of field listeners of the value is invalid: invalid duration"},
+		{`((Secret . "x"))`, "the value has no field named: Secret"},
+		{`((limits (a . b)))`, "the value of key a of field limits of the value must be an exact integer: b"},
+		{`(name "server")`, `the value must be an association list: (name "server")`},
+	}
+	for _, e := range errs {
+		x, err := ParseString(e.value)
+		require.NoError(t, err)
+		assert.EqualError(t, Unmarshal(x, &config{}), e.message)
+	}
+
+	x, err = ParseString(`((listeners ((timeout . 30))))`)
+	require.NoError(t, err)
+	assert.True(t, errors.Is(Unmarshal(x, &config{}), errDuration))
+
+	assert.Error(t, Unmarshal(NewInt(1), n))
+	assert.Error(t, Unmarshal(NewInt(1), (*int)(nil)))
+}
+
+func TestMarshal(t *testing.T) {
+	c := config{
+		Name: "server",
+		Listeners: []listener{
+			{Address: "localhost", Port: 8080, Timeout: duration(30 * time.Second)},
+		},
+		Limits: map[string]int{"requests": 5, "connections": 100},
+		Ratio:  0.5,
+		Secret: "hunter2",
+		Extra:  Symbol("x"),
+	}
+
+	v, err := Marshal(c)
+	require.NoError(t, err)
+	assert.Equal(t, `((name . "server") (listeners . #(((address . "localhost") (port . 8080) (timeout . "30s")))) `+
+		`(limits (connections . 100) (requests . 5)) (ratio . 0.5) (extra . x))`, EncodeToString(v))
+
+	var round config
+	require.NoError(t, Unmarshal(v, &round))
+	c.Secret = ""
+	assert.Equal(t, c, round)
+
+	v, err = Marshal([]interface{}{true, 1.5, "s", nil, map[int]bool{2: false, 1: true}})
+	require.NoError(t, err)
+	assert.Equal(t, `#(#t 1.5 "s" () ((1 . #t) (2 . #f)))`, EncodeToString(v))
+
+	_, err = Marshal(map[string]chan int{"c": nil})
+	assert.EqualError(t, err, "the value of key c of the value of type chan int cannot be converted to a Scheme value")
+
+	// cyclic values fail rather than recursing forever
+	type node struct {
+		Next *node
+	}
+	n := &node{}
+	n.Next = n
+	_, err = Marshal(n)
+	assert.EqualError(t, err, "field Next of the value refers to itself and cannot be converted to a Scheme value")
+
+	m := map[string]interface{}{}
+	m["self"] = m
+	_, err = Marshal(m)
+	assert.EqualError(t, err, "the value of key self of the value refers to itself and cannot be converted to a Scheme value")
+
+	s := []interface{}{nil}
+	s[0] = s
+	_, err = Marshal(s)
+	assert.EqualError(t, err, "element 0 of the value refers to itself and cannot be converted to a Scheme value")
+
+	shared := &node{}
+	dag, err := Marshal([]*node{shared, shared})
+	require.NoError(t, err)
+	assert.Equal(t, "#(((Next)) ((Next)))", EncodeToString(dag))
+
+	// marshaled values are usable from Scheme
+	env := NewEnv()
+	env.Set("config", v)
+	x, err := ParseString(`(vector-ref config 2)`)
+	require.NoError(t, err)
+	assert.Equal(t, `"s"`, EncodeToString(env.Eval(x)))
+}
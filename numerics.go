@@ -1,6 +1,265 @@
 package loom
 
-import "math/big"
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// domain returns the representation in which an operation on a and b is
+// performed. Exact operands are promoted to the representation of the other
+// operand; any inexact operand makes the result inexact.
+func domain(a, b Number) numberKind {
+	if a.kind > b.kind {
+		return a.kind
+	}
+	return b.kind
+}
+
+func (n Number) toFloat() float64 {
+	f, _ := n.Float64()
+	return f
+}
+
+func (n Number) toBigInt() *big.Int {
+	b, _ := n.BigInt()
+	return b
+}
+
+func (n Number) toRat() *big.Rat {
+	r, _ := n.Rat()
+	return r
+}
+
+func (n Number) sign() int {
+	switch n.kind {
+	case fixnum:
+		switch {
+		case n.i < 0:
+			return -1
+		case n.i > 0:
+			return 1
+		default:
+			return 0
+		}
+	case bignum:
+		return n.b.Sign()
+	case ratnum:
+		return n.r.Sign()
+	default:
+		switch {
+		case n.f < 0:
+			return -1
+		case n.f > 0:
+			return 1
+		default:
+			return 0
+		}
+	}
+}
+
+func add(a, b Number) Number {
+	switch domain(a, b) {
+	case fixnum:
+		s := a.i + b.i
+		if (b.i > 0 && s < a.i) || (b.i < 0 && s > a.i) {
+			return normalizeInt(new(big.Int).Add(a.toBigInt(), b.toBigInt()))
+		}
+		return NewInt(s)
+	case bignum:
+		return normalizeInt(new(big.Int).Add(a.toBigInt(), b.toBigInt()))
+	case ratnum:
+		return normalizeRat(new(big.Rat).Add(a.toRat(), b.toRat()))
+	default:
+		return NewFloat(a.toFloat() + b.toFloat())
+	}
+}
+
+func sub(a, b Number) Number {
+	switch domain(a, b) {
+	case fixnum:
+		d := a.i - b.i
+		if (b.i < 0 && d < a.i) || (b.i > 0 && d > a.i) {
+			return normalizeInt(new(big.Int).Sub(a.toBigInt(), b.toBigInt()))
+		}
+		return NewInt(d)
+	case bignum:
+		return normalizeInt(new(big.Int).Sub(a.toBigInt(), b.toBigInt()))
+	case ratnum:
+		return normalizeRat(new(big.Rat).Sub(a.toRat(), b.toRat()))
+	default:
+		return NewFloat(a.toFloat() - b.toFloat())
+	}
+}
+
+// maxExactBits is the maximum size in bits of the exact results of
+// multiplication and exponentiation. Larger results fail with an error rather
+// than exhausting the available memory in a single step.
+const maxExactBits = 1 << 24
+
+// checkExactProduct panics if the product of the exact numbers a and b may be
+// larger than maxExactBits. The operands are not included in the error's
+// irritants, as writing them may take nearly as long as computing their
+// product.
+func checkExactProduct(name string, a, b Number) {
+	if bitLen(a)+bitLen(b) > maxExactBits {
+		panic(newNamedError(fmt.Sprintf("%v: result is too large", name)))
+	}
+}
+
+// bitLen returns the size in bits of the numerator or denominator of an exact
+// number, whichever is larger.
+func bitLen(n Number) int {
+	switch n.kind {
+	case fixnum:
+		return 64
+	case bignum:
+		return n.b.BitLen()
+	default:
+		num, den := n.r.Num().BitLen(), n.r.Denom().BitLen()
+		if den > num {
+			return den
+		}
+		return num
+	}
+}
+
+func mul(a, b Number) Number {
+	switch domain(a, b) {
+	case fixnum:
+		if a.i == 0 || b.i == 0 {
+			return NewInt(0)
+		}
+		p := a.i * b.i
+		if p/b.i != a.i || (a.i == -1 && b.i == math.MinInt64) || (b.i == -1 && a.i == math.MinInt64) {
+			return normalizeInt(new(big.Int).Mul(a.toBigInt(), b.toBigInt()))
+		}
+		return NewInt(p)
+	case bignum:
+		checkExactProduct("*", a, b)
+		return normalizeInt(new(big.Int).Mul(a.toBigInt(), b.toBigInt()))
+	case ratnum:
+		checkExactProduct("*", a, b)
+		return normalizeRat(new(big.Rat).Mul(a.toRat(), b.toRat()))
+	default:
+		return NewFloat(a.toFloat() * b.toFloat())
+	}
+}
+
+func div(a, b Number) Number {
+	if domain(a, b) == flonum {
+		return NewFloat(a.toFloat() / b.toFloat())
+	}
+	if b.sign() == 0 {
+		panic(NewError("division by zero", a))
+	}
+	return normalizeRat(new(big.Rat).Quo(a.toRat(), b.toRat()))
+}
+
+// truncateDiv returns the quotient and remainder of the integer division of a
+// by b, with the quotient rounded towards zero.
+func truncateDiv(name string, a, b Number) (Number, Number) {
+	if b.sign() == 0 {
+		panic(newNamedError(fmt.Sprintf("%v: division by zero", name), a))
+	}
+	switch domain(a, b) {
+	case fixnum:
+		if a.i != math.MinInt64 || b.i != -1 {
+			return NewInt(a.i / b.i), NewInt(a.i % b.i)
+		}
+	case flonum:
+		x, y := a.toFloat(), b.toFloat()
+		return NewFloat(math.Trunc(x / y)), NewFloat(math.Mod(x, y))
+	}
+	q, r := new(big.Int).QuoRem(a.toBigInt(), b.toBigInt(), new(big.Int))
+	return normalizeInt(q), normalizeInt(r)
+}
+
+// floorDiv returns the quotient and remainder of the integer division of a by
+// b, with the quotient rounded towards negative infinity.
+func floorDiv(name string, a, b Number) (Number, Number) {
+	q, r := truncateDiv(name, a, b)
+	if r.sign() != 0 && r.sign() != b.sign() {
+		q, r = sub(q, NewInt(1)), add(r, b)
+	}
+	return q, r
+}
+
+// compare compares a and b. The second result is false if the numbers are not
+// comparable (i.e. either number is a NaN).
+func compare(a, b Number) (int, bool) {
+	switch {
+	case a.kind == fixnum && b.kind == fixnum:
+		switch {
+		case a.i < b.i:
+			return -1, true
+		case a.i > b.i:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case a.kind == flonum || b.kind == flonum:
+		x, y := a.toFloat(), b.toFloat()
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return 0, false
+		}
+
+		// Compare infinities and floats directly. Otherwise, compare exactly
+		// in order to preserve transitivity.
+		if a.kind == b.kind || math.IsInf(x, 0) || math.IsInf(y, 0) {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+		return a.toRat().Cmp(b.toRat()), true
+	case a.kind == ratnum || b.kind == ratnum:
+		return a.toRat().Cmp(b.toRat()), true
+	default:
+		return a.toBigInt().Cmp(b.toBigInt()), true
+	}
+}
+
+// exact returns the exact number that is numerically closest to n.
+func (n Number) exact() Number {
+	if n.kind != flonum {
+		return n
+	}
+	if math.IsInf(n.f, 0) || math.IsNaN(n.f) {
+		panic(NewError("no exact representation", n))
+	}
+	return normalizeRat(new(big.Rat).SetFloat64(n.f))
+}
+
+// inexact returns the inexact number that is numerically closest to n.
+func (n Number) inexact() Number {
+	if n.kind == flonum {
+		return n
+	}
+	return NewFloat(n.toFloat())
+}
+
+// numberArg returns the i'th argument to the named procedure as a number.
+func numberArg(name string, args Vector, i int) Number {
+	n, ok := args[i].(Number)
+	if !ok {
+		panic(newNamedError(fmt.Sprintf("the arguments to %v must be numbers", name), args[i]))
+	}
+	return n
+}
+
+// integerArg returns the i'th argument to the named procedure as an integer.
+func integerArg(name string, args Vector, i int) Number {
+	n, ok := args[i].(Number)
+	if !ok || !n.IsInteger() {
+		panic(newNamedError(fmt.Sprintf("the arguments to %v must be integers", name), args[i]))
+	}
+	return n
+}
 
 func NumberPred(args Vector) Value {
 	if len(args) != 1 {
@@ -10,7 +269,9 @@ func NumberPred(args Vector) Value {
 	return Boolean(ok)
 }
 
-func NumberEq(args Vector) Value {
+// numberCompare returns true if each pair of adjacent numbers in args
+// satisfies accept.
+func numberCompare(args Vector, accept func(c int) bool) Value {
 	if len(args) == 0 {
 		return Boolean(true)
 	}
@@ -21,213 +282,636 @@ func NumberEq(args Vector) Value {
 	}
 
 	for _, v := range args[1:] {
-		if !eqv(n, v) {
+		x, ok := v.(Number)
+		if !ok {
 			return Boolean(false)
 		}
+		c, ok := compare(n, x)
+		if !ok || !accept(c) {
+			return Boolean(false)
+		}
+		n = x
 	}
 
 	return Boolean(true)
 }
 
+func NumberEq(args Vector) Value {
+	return numberCompare(args, func(c int) bool { return c == 0 })
+}
+
 func NumberLt(args Vector) Value {
-	if len(args) == 0 {
-		return Boolean(true)
+	return numberCompare(args, func(c int) bool { return c < 0 })
+}
+
+func NumberGt(args Vector) Value {
+	return numberCompare(args, func(c int) bool { return c > 0 })
+}
+
+func NumberLte(args Vector) Value {
+	return numberCompare(args, func(c int) bool { return c <= 0 })
+}
+
+func NumberGte(args Vector) Value {
+	return numberCompare(args, func(c int) bool { return c >= 0 })
+}
+
+func NumberAdd(args Vector) Value {
+	sum := NewInt(0)
+	for i := range args {
+		sum = add(sum, numberArg("+", args, i))
 	}
+	return sum
+}
 
-	n, ok := args[0].(Number)
-	if !ok {
-		return Boolean(false)
+func NumberMul(args Vector) Value {
+	product := NewInt(1)
+	for i := range args {
+		product = mul(product, numberArg("*", args, i))
 	}
+	return product
+}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok || n.f.Cmp(x.f) != -1 {
-			return Boolean(false)
+func NumberSub(args Vector) Value {
+	if len(args) == 0 {
+		panic("- expects at least 1 argument")
+	}
+
+	diff := numberArg("-", args, 0)
+	if len(args) == 1 {
+		// negate flonums directly so that (- 0.0) is -0.0
+		if diff.kind == flonum {
+			return NewFloat(-diff.f)
 		}
-		n = x
+		return sub(NewInt(0), diff)
 	}
 
-	return Boolean(true)
+	for i := range args[1:] {
+		diff = sub(diff, numberArg("-", args, i+1))
+	}
+	return diff
 }
 
-func NumberGt(args Vector) Value {
+func NumberDiv(args Vector) Value {
 	if len(args) == 0 {
-		return Boolean(true)
+		panic("/ expects at least 1 argument")
 	}
 
-	n, ok := args[0].(Number)
-	if !ok {
-		return Boolean(false)
+	quo := numberArg("/", args, 0)
+	if len(args) == 1 {
+		return div(NewInt(1), quo)
 	}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok || n.f.Cmp(x.f) != 1 {
-			return Boolean(false)
-		}
-		n = x
+	for i := range args[1:] {
+		quo = div(quo, numberArg("/", args, i+1))
 	}
+	return quo
+}
 
-	return Boolean(true)
+func NumberExactPred(args Vector) Value {
+	if len(args) != 1 {
+		panic("exact? expects 1 argument")
+	}
+	return Boolean(numberArg("exact?", args, 0).IsExact())
 }
 
-func NumberLte(args Vector) Value {
-	if len(args) == 0 {
-		return Boolean(true)
+func NumberInexactPred(args Vector) Value {
+	if len(args) != 1 {
+		panic("inexact? expects 1 argument")
 	}
+	return Boolean(!numberArg("inexact?", args, 0).IsExact())
+}
 
-	n, ok := args[0].(Number)
+func NumberExact(args Vector) Value {
+	if len(args) != 1 {
+		panic("exact expects 1 argument")
+	}
+	return numberArg("exact", args, 0).exact()
+}
+
+func NumberInexact(args Vector) Value {
+	if len(args) != 1 {
+		panic("inexact expects 1 argument")
+	}
+	return numberArg("inexact", args, 0).inexact()
+}
+
+// rationalArg returns the i'th argument to the named procedure as an exact
+// rational along with the argument's exactness.
+func rationalArg(name string, args Vector, i int) (*big.Rat, bool) {
+	n := numberArg(name, args, i)
+	r, ok := n.Rat()
 	if !ok {
-		return Boolean(false)
+		panic(newNamedError(fmt.Sprintf("the argument to %v must be a rational number", name), n))
 	}
+	return r, n.IsExact()
+}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok || n.f.Cmp(x.f) == 1 {
-			return Boolean(false)
-		}
-		n = x
+func NumberNumerator(args Vector) Value {
+	if len(args) != 1 {
+		panic("numerator expects 1 argument")
+	}
+	r, exact := rationalArg("numerator", args, 0)
+	n := normalizeInt(r.Num())
+	if !exact {
+		return n.inexact()
 	}
+	return n
+}
 
-	return Boolean(true)
+func NumberDenominator(args Vector) Value {
+	if len(args) != 1 {
+		panic("denominator expects 1 argument")
+	}
+	r, exact := rationalArg("denominator", args, 0)
+	n := normalizeInt(r.Denom())
+	if !exact {
+		return n.inexact()
+	}
+	return n
 }
 
-func NumberGte(args Vector) Value {
-	if len(args) == 0 {
-		return Boolean(true)
+// integerDivision returns the quotient and remainder of the integer division of
+// the two arguments to the named procedure.
+func integerDivision(name string, args Vector, div func(name string, a, b Number) (Number, Number)) (Number, Number) {
+	if len(args) != 2 {
+		panic(name + " expects 2 arguments")
 	}
+	return div(name, integerArg(name, args, 0), integerArg(name, args, 1))
+}
+
+// NumberFloorDiv returns the floor quotient and remainder of its arguments as
+// two values.
+func NumberFloorDiv(args Vector) Value {
+	q, r := integerDivision("floor/", args, floorDiv)
+	return Values{q, r}
+}
+
+func NumberFloorQuotient(args Vector) Value {
+	q, _ := integerDivision("floor-quotient", args, floorDiv)
+	return q
+}
+
+func NumberFloorRemainder(args Vector) Value {
+	_, r := integerDivision("floor-remainder", args, floorDiv)
+	return r
+}
+
+// NumberTruncateDiv returns the truncated quotient and remainder of its
+// arguments as two values.
+func NumberTruncateDiv(args Vector) Value {
+	q, r := integerDivision("truncate/", args, truncateDiv)
+	return Values{q, r}
+}
 
+func NumberTruncateQuotient(args Vector) Value {
+	q, _ := integerDivision("truncate-quotient", args, truncateDiv)
+	return q
+}
+
+func NumberTruncateRemainder(args Vector) Value {
+	_, r := integerDivision("truncate-remainder", args, truncateDiv)
+	return r
+}
+
+// numberPredicate returns the result of applying pred to the single number
+// argument to the named procedure.
+func numberPredicate(name string, args Vector, pred func(n Number) bool) Value {
+	if len(args) != 1 {
+		panic(name + " expects 1 argument")
+	}
+	return Boolean(pred(numberArg(name, args, 0)))
+}
+
+func NumberZeroPred(args Vector) Value {
+	return numberPredicate("zero?", args, func(n Number) bool { return n.sign() == 0 && !n.isNaN() })
+}
+
+func NumberPositivePred(args Vector) Value {
+	return numberPredicate("positive?", args, func(n Number) bool { return n.sign() > 0 })
+}
+
+func NumberNegativePred(args Vector) Value {
+	return numberPredicate("negative?", args, func(n Number) bool { return n.sign() < 0 })
+}
+
+func NumberOddPred(args Vector) Value {
+	if len(args) != 1 {
+		panic("odd? expects 1 argument")
+	}
+	_, r := truncateDiv("odd?", integerArg("odd?", args, 0), NewInt(2))
+	return Boolean(r.sign() != 0)
+}
+
+func NumberEvenPred(args Vector) Value {
+	if len(args) != 1 {
+		panic("even? expects 1 argument")
+	}
+	_, r := truncateDiv("even?", integerArg("even?", args, 0), NewInt(2))
+	return Boolean(r.sign() == 0)
+}
+
+func NumberNaNPred(args Vector) Value {
+	return numberPredicate("nan?", args, Number.isNaN)
+}
+
+func NumberInfinitePred(args Vector) Value {
+	return numberPredicate("infinite?", args, func(n Number) bool { return n.kind == flonum && math.IsInf(n.f, 0) })
+}
+
+func NumberFinitePred(args Vector) Value {
+	return numberPredicate("finite?", args, func(n Number) bool {
+		return n.kind != flonum || !math.IsInf(n.f, 0) && !math.IsNaN(n.f)
+	})
+}
+
+// isNaN returns true if the number is a NaN.
+func (n Number) isNaN() bool {
+	return n.kind == flonum && math.IsNaN(n.f)
+}
+
+func NumberIntegerPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
+	n, ok := args[0].(Number)
+	return Boolean(ok && n.IsInteger())
+}
+
+func NumberExactIntegerPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
+	n, ok := args[0].(Number)
+	return Boolean(ok && n.IsExact() && n.IsInteger())
+}
+
+func NumberRationalPred(args Vector) Value {
+	if len(args) != 1 {
+		return Boolean(false)
+	}
 	n, ok := args[0].(Number)
 	if !ok {
 		return Boolean(false)
 	}
+	_, finite := n.Rat()
+	return Boolean(finite)
+}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok || n.f.Cmp(x.f) == -1 {
-			return Boolean(false)
+func NumberAbs(args Vector) Value {
+	if len(args) != 1 {
+		panic("abs expects 1 argument")
+	}
+	n := numberArg("abs", args, 0)
+	if n.sign() < 0 {
+		return sub(NewInt(0), n)
+	}
+	return n
+}
+
+// numberExtremum returns the argument to the named procedure that satisfies
+// accept when compared to each other argument. If any argument is inexact, the
+// result is inexact.
+func numberExtremum(name string, args Vector, accept func(c int) bool) Value {
+	if len(args) == 0 {
+		panic(name + " expects at least 1 argument")
+	}
+
+	result, exact := numberArg(name, args, 0), true
+	for i := range args {
+		n := numberArg(name, args, i)
+		exact = exact && n.IsExact()
+		if n.isNaN() {
+			return n
 		}
-		n = x
+		if c, _ := compare(n, result); accept(c) {
+			result = n
+		}
+	}
+	if !exact {
+		return result.inexact()
 	}
+	return result
+}
 
-	return Boolean(true)
+func NumberMax(args Vector) Value {
+	return numberExtremum("max", args, func(c int) bool { return c > 0 })
 }
 
-func NumberAdd(args Vector) Value {
-	if len(args) == 0 {
-		return nil
+func NumberMin(args Vector) Value {
+	return numberExtremum("min", args, func(c int) bool { return c < 0 })
+}
+
+// gcd returns the greatest common divisor of the integers a and b.
+func gcd(a, b Number) Number {
+	if domain(a, b) == flonum {
+		x, y := math.Abs(a.toFloat()), math.Abs(b.toFloat())
+		for y != 0 {
+			x, y = y, math.Mod(x, y)
+		}
+		return NewFloat(x)
 	}
+	return normalizeInt(new(big.Int).GCD(nil, nil, a.toBigInt(), b.toBigInt()))
+}
 
-	n, ok := args[0].(Number)
-	if !ok {
-		return nil
+func NumberGcd(args Vector) Value {
+	result := NewInt(0)
+	for i := range args {
+		result = gcd(result, integerArg("gcd", args, i))
 	}
+	return result
+}
 
-	var sum big.Float
-	sum.Copy(n.f)
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok {
-			return nil
+func NumberLcm(args Vector) Value {
+	result := NewInt(1)
+	for i := range args {
+		n := integerArg("lcm", args, i)
+		if n.sign() == 0 {
+			return mul(result, n)
+		}
+		if n.sign() < 0 {
+			n = sub(NewInt(0), n)
 		}
-		sum.Add(&sum, x.f)
+		q, _ := truncateDiv("lcm", mul(result, n), gcd(result, n))
+		result = q
 	}
-	return Number{f: &sum}
+	return result
 }
 
-func NumberMul(args Vector) Value {
-	if len(args) == 0 {
-		return nil
+// roundNumber rounds the single number argument to the named procedure to an
+// integer using roundFloat or roundRat.
+func roundNumber(name string, args Vector, roundFloat func(f float64) float64, roundRat func(r *big.Rat) *big.Int) Value {
+	if len(args) != 1 {
+		panic(name + " expects 1 argument")
 	}
+	switch n := numberArg(name, args, 0); n.kind {
+	case flonum:
+		return NewFloat(roundFloat(n.f))
+	case ratnum:
+		return normalizeInt(roundRat(n.r))
+	default:
+		return n
+	}
+}
 
-	n, ok := args[0].(Number)
-	if !ok {
-		return nil
+// floorRat returns the largest integer not larger than r.
+func floorRat(r *big.Rat) *big.Int {
+	// The denominator is always positive, so Euclidean division rounds down.
+	return new(big.Int).Div(r.Num(), r.Denom())
+}
+
+// ceilingRat returns the smallest integer not smaller than r.
+func ceilingRat(r *big.Rat) *big.Int {
+	c := floorRat(r)
+	if !r.IsInt() {
+		c.Add(c, big.NewInt(1))
 	}
+	return c
+}
 
-	var product big.Float
-	product.Copy(n.f)
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok {
-			return nil
-		}
-		product.Mul(&product, x.f)
+// truncateRat returns the integer closest to r whose absolute value is not
+// larger than the absolute value of r.
+func truncateRat(r *big.Rat) *big.Int {
+	return new(big.Int).Quo(r.Num(), r.Denom())
+}
+
+// roundRat returns the integer closest to r, rounding to even when r is halfway
+// between two integers.
+func roundRat(r *big.Rat) *big.Int {
+	floor := floorRat(r)
+	diff := new(big.Rat).Sub(r, new(big.Rat).SetInt(floor))
+	switch c := diff.Cmp(big.NewRat(1, 2)); {
+	case c > 0 || c == 0 && floor.Bit(0) == 1:
+		return floor.Add(floor, big.NewInt(1))
+	default:
+		return floor
 	}
-	return Number{f: &product}
 }
 
-func NumberSub(args Vector) Value {
-	if len(args) == 0 {
-		return nil
+func NumberFloor(args Vector) Value {
+	return roundNumber("floor", args, math.Floor, floorRat)
+}
+
+func NumberCeiling(args Vector) Value {
+	return roundNumber("ceiling", args, math.Ceil, ceilingRat)
+}
+
+func NumberTruncate(args Vector) Value {
+	return roundNumber("truncate", args, math.Trunc, truncateRat)
+}
+
+func NumberRound(args Vector) Value {
+	return roundNumber("round", args, math.RoundToEven, roundRat)
+}
+
+// transcendental applies f to the single number argument to the named
+// procedure. The result is always inexact.
+func transcendental(name string, args Vector, f func(x float64) float64) Value {
+	if len(args) != 1 {
+		panic(name + " expects 1 argument")
 	}
+	return NewFloat(f(numberArg(name, args, 0).toFloat()))
+}
 
-	n, ok := args[0].(Number)
-	if !ok {
-		return nil
+func NumberExp(args Vector) Value {
+	return transcendental("exp", args, math.Exp)
+}
+
+func NumberLog(args Vector) Value {
+	if len(args) == 2 {
+		z1, z2 := numberArg("log", args, 0).toFloat(), numberArg("log", args, 1).toFloat()
+		return NewFloat(math.Log(z1) / math.Log(z2))
 	}
-	var diff big.Float
-	diff.Copy(n.f)
+	return transcendental("log", args, math.Log)
+}
 
-	if len(args) == 1 {
-		diff.Neg(&diff)
-		return Number{&diff}
+func NumberSin(args Vector) Value {
+	return transcendental("sin", args, math.Sin)
+}
+
+func NumberCos(args Vector) Value {
+	return transcendental("cos", args, math.Cos)
+}
+
+func NumberTan(args Vector) Value {
+	return transcendental("tan", args, math.Tan)
+}
+
+func NumberAsin(args Vector) Value {
+	return transcendental("asin", args, math.Asin)
+}
+
+func NumberAcos(args Vector) Value {
+	return transcendental("acos", args, math.Acos)
+}
+
+func NumberAtan(args Vector) Value {
+	if len(args) == 2 {
+		y, x := numberArg("atan", args, 0).toFloat(), numberArg("atan", args, 1).toFloat()
+		return NewFloat(math.Atan2(y, x))
 	}
+	return transcendental("atan", args, math.Atan)
+}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok {
-			return nil
+// exactIntegerSqrt returns s and r such that s*s + r = n and s*s <= n < (s+1)*(s+1).
+func exactIntegerSqrt(n *big.Int) (*big.Int, *big.Int) {
+	s := new(big.Int).Sqrt(n)
+	r := new(big.Int).Sub(n, new(big.Int).Mul(s, s))
+	return s, r
+}
+
+// NumberSqrt returns the principal square root of its argument. The result is
+// exact if the argument is an exact rational whose numerator and denominator
+// are perfect squares.
+func NumberSqrt(args Vector) Value {
+	if len(args) != 1 {
+		panic("sqrt expects 1 argument")
+	}
+	n := numberArg("sqrt", args, 0)
+	if n.IsExact() && n.sign() >= 0 {
+		r := n.toRat()
+		num, numRem := exactIntegerSqrt(r.Num())
+		den, denRem := exactIntegerSqrt(r.Denom())
+		if numRem.Sign() == 0 && denRem.Sign() == 0 {
+			return normalizeRat(new(big.Rat).SetFrac(num, den))
 		}
-		diff.Sub(&diff, x.f)
 	}
-	return Number{&diff}
+	return NewFloat(math.Sqrt(n.toFloat()))
 }
 
-func NumberDiv(args Vector) Value {
-	if len(args) == 0 {
-		return nil
+// NumberExactIntegerSqrt returns s and r such that s*s + r = k and
+// s*s <= k < (s+1)*(s+1) as two values.
+func NumberExactIntegerSqrt(args Vector) Value {
+	if len(args) != 1 {
+		panic("exact-integer-sqrt expects 1 argument")
 	}
-
-	n, ok := args[0].(Number)
-	if !ok {
-		return nil
+	n := integerArg("exact-integer-sqrt", args, 0)
+	if !n.IsExact() || n.sign() < 0 {
+		panic(newNamedError("the argument to exact-integer-sqrt must be a non-negative exact integer", n))
 	}
-	var quo big.Float
-	quo.Copy(n.f)
+	s, r := exactIntegerSqrt(n.toBigInt())
+	return Values{normalizeInt(s), normalizeInt(r)}
+}
 
-	if len(args) == 1 {
-		quo.Quo(big.NewFloat(1), &quo)
-		return Number{&quo}
+// expt returns base raised to the power exponent. If base is exact and
+// exponent is an exact integer, the result is exact.
+func expt(base, exponent Number) Number {
+	if base.IsExact() && exponent.kind == bignum {
+		// only the powers of 0, 1, and -1 are small enough to compute
+		switch {
+		case base.kind == fixnum && base.i == 1:
+			return base
+		case base.kind == fixnum && base.i == -1:
+			if exponent.b.Bit(0) == 0 {
+				return NewInt(1)
+			}
+			return base
+		case base.sign() == 0:
+			if exponent.sign() < 0 {
+				panic(newNamedError("expt: division by zero", base, exponent))
+			}
+			return base
+		default:
+			panic(newNamedError("expt: result is too large", base, exponent))
+		}
 	}
+	if base.IsExact() && exponent.kind == fixnum {
+		e := exponent.i
+		if e < 0 {
+			if base.sign() == 0 {
+				panic(newNamedError("expt: division by zero", base, exponent))
+			}
+			e = -e
+		}
 
-	for _, v := range args[1:] {
-		x, ok := v.(Number)
-		if !ok {
-			return nil
+		r := base.toRat()
+		bits := r.Num().BitLen()
+		if d := r.Denom().BitLen(); d > bits {
+			bits = d
+		}
+		if bits > 1 && uint64(e) > maxExactBits/uint64(bits-1) {
+			panic(newNamedError("expt: result is too large", base, exponent))
+		}
+
+		num := new(big.Int).Exp(r.Num(), big.NewInt(e), nil)
+		den := new(big.Int).Exp(r.Denom(), big.NewInt(e), nil)
+		if exponent.i < 0 {
+			num, den = den, num
+			if den.Sign() < 0 {
+				num.Neg(num)
+				den.Neg(den)
+			}
+		}
+		if den.BitLen() == 1 {
+			return normalizeInt(num)
 		}
-		quo.Quo(&quo, x.f)
+
+		// The powers of a fraction in lowest terms are also in lowest terms,
+		// so the result is assembled directly rather than by SetFrac, whose
+		// GCD is quadratic in the size of the result.
+		q := new(big.Rat).SetFrac64(1, 2)
+		q.Num().Set(num)
+		q.Denom().Set(den)
+		return Number{kind: ratnum, r: q}
 	}
-	return Number{&quo}
+	return NewFloat(math.Pow(base.toFloat(), exponent.toFloat()))
 }
 
-func NumberTruncateQuotient(args Vector) Value {
+func NumberExpt(args Vector) Value {
 	if len(args) != 2 {
-		panic("truncate-quotient expects 2 arguments")
+		panic("expt expects 2 arguments")
 	}
+	return expt(numberArg("expt", args, 0), numberArg("expt", args, 1))
+}
 
-	n1, ok := args[0].(Number)
-	if !ok {
-		panic("the first argument to truncate-quotient must be a number")
+func NumberSquare(args Vector) Value {
+	if len(args) != 1 {
+		panic("square expects 1 argument")
 	}
-	n2, ok := args[1].(Number)
-	if !ok {
-		panic("the second argument to truncate-quotient must be a number")
+	n := numberArg("square", args, 0)
+	return mul(n, n)
+}
+
+// radixArg returns the optional radix argument to the named procedure.
+func radixArg(name string, args Vector, i int) int {
+	if len(args) <= i {
+		return 10
+	}
+	n, ok := args[i].(Number)
+	if ok {
+		if radix, exact := n.Int(); exact {
+			switch radix {
+			case 2, 8, 10, 16:
+				return int(radix)
+			}
+		}
+	}
+	panic(newNamedError(fmt.Sprintf("the radix argument to %v must be one of 2, 8, 10, or 16", name), args[i]))
+}
+
+func NumberToString(args Vector) Value {
+	if len(args) < 1 || len(args) > 2 {
+		panic("number->string expects 1 or 2 arguments")
+	}
+	n, radix := numberArg("number->string", args, 0), radixArg("number->string", args, 1)
+	if !n.IsExact() && radix != 10 {
+		panic(newNamedError("number->string: inexact numbers must be written in radix 10", n))
 	}
+	return String(n.Text(radix))
+}
 
-	var quo big.Float
-	quo.Quo(n1.f, n2.f)
-	quo.SetMode(big.ToZero)
-	i, _ := quo.Int64()
-	return NewInt(i)
+// StringToNumber returns the number expressed by the given string, or #f if
+// the string is not a syntactically valid notation for a number.
+func StringToNumber(args Vector) Value {
+	if len(args) < 1 || len(args) > 2 {
+		panic("string->number expects 1 or 2 arguments")
+	}
+	s, ok := args[0].(String)
+	if !ok {
+		panic(newNamedError("the first argument to string->number must be a string", args[0]))
+	}
+	if n, ok := parsePrefixedNumber(string(s), radixArg("string->number", args, 1)); ok {
+		return n
+	}
+	return Boolean(false)
 }
@@ -0,0 +1,161 @@
+package loom
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// An outputPort is a textual output port that writes to an io.Writer.
+type outputPort struct {
+	w io.Writer
+}
+
+func (*outputPort) MarshalSExp() SExpression {
+	return Symbol("<output port>")
+}
+
+// SetOutput sets the current output port of the environment to a port that
+// writes to w. The output port is shared by the environments derived from e.
+func (e *Env) SetOutput(w io.Writer) {
+	e.globals.dynamic().output = &outputPort{w: w}
+}
+
+// outputProcedures returns the output procedures for the dynamic environment
+// d. The procedures write to d's current output port by default.
+func outputProcedures(d *dynamicEnv) map[Symbol]Value {
+	return map[Symbol]Value{
+		"current-output-port": ProcedureFunc(func(args Vector) Value {
+			if len(args) != 0 {
+				panic("current-output-port expects no arguments")
+			}
+			return d.output
+		}),
+		"write": ProcedureFunc(func(args Vector) Value {
+			return writeValue("write", Write, d, args)
+		}),
+		"write-shared": ProcedureFunc(func(args Vector) Value {
+			return writeValue("write-shared", WriteShared, d, args)
+		}),
+		"write-simple": ProcedureFunc(func(args Vector) Value {
+			return writeValue("write-simple", WriteSimple, d, args)
+		}),
+		"display": ProcedureFunc(func(args Vector) Value {
+			return writeValue("display", Display, d, args)
+		}),
+		"write-string": ProcedureFunc(func(args Vector) Value {
+			return writeString(d, args)
+		}),
+		"write-char": ProcedureFunc(func(args Vector) Value {
+			if len(args) < 1 || len(args) > 2 {
+				panic("write-char expects 1 or 2 arguments")
+			}
+			c, ok := args[0].(Character)
+			if !ok {
+				panic(newNamedError("the first argument to write-char must be a character", args[0]))
+			}
+			return writeOutput(portArg("write-char", d, args, 1), string(rune(c)))
+		}),
+		"newline": ProcedureFunc(func(args Vector) Value {
+			if len(args) > 1 {
+				panic("newline expects at most 1 argument")
+			}
+			return writeOutput(portArg("newline", d, args, 0), "\n")
+		}),
+	}
+}
+
+// portArg returns the optional output port argument at index i of the named
+// procedure's arguments. If the argument is not present, the current output
+// port is returned.
+func portArg(name string, d *dynamicEnv, args Vector, i int) io.Writer {
+	if i >= len(args) {
+		return d.output.w
+	}
+	port, ok := args[i].(*outputPort)
+	if !ok {
+		panic(newNamedError(fmt.Sprintf("%v to %v must be an output port", argumentName(i), name), args[i]))
+	}
+	return port.w
+}
+
+func writeOutput(w io.Writer, s string) Value {
+	if _, err := io.WriteString(w, s); err != nil {
+		panic(err)
+	}
+	return Unspecified
+}
+
+// (write obj)
+// (write obj port)
+// (display obj)
+// (display obj port)
+//
+// (write-shared obj)
+// (write-shared obj port)
+// (write-simple obj)
+// (write-simple obj port)
+//
+// Writes a representation of obj to the given textual output port. The write
+// procedure writes the external representation of obj; display writes a
+// representation that is intended for people rather than machines. Datum
+// labels are used for cycles by write and display, for all shared structure by
+// write-shared, and never by write-simple.
+func writeValue(name string, write func(w io.Writer, v Value) error, d *dynamicEnv, args Vector) Value {
+	if len(args) < 1 || len(args) > 2 {
+		panic(name + " expects 1 or 2 arguments")
+	}
+	if err := write(portArg(name, d, args, 1), args[0]); err != nil {
+		panic(err)
+	}
+	return Unspecified
+}
+
+// (write-string string)
+// (write-string string port)
+// (write-string string port start)
+// (write-string string port start end)
+//
+// Writes the characters of string from start to end in left-to-right order to
+// the textual output port.
+func writeString(d *dynamicEnv, args Vector) Value {
+	if len(args) < 1 || len(args) > 4 {
+		panic("write-string expects between 1 and 4 arguments")
+	}
+	s, ok := args[0].(String)
+	if !ok {
+		panic(newNamedError("the first argument to write-string must be a string", args[0]))
+	}
+	w := portArg("write-string", d, args, 1)
+
+	runes := []rune(string(s))
+	start, end := 0, len(runes)
+	if len(args) > 2 {
+		start = indexArg("write-string", args, 2, len(runes))
+	}
+	if len(args) > 3 {
+		end = indexArg("write-string", args, 3, len(runes))
+	}
+	if start > end {
+		panic(newNamedError("the start index passed to write-string must not exceed the end index", args[2], args[3]))
+	}
+	return writeOutput(w, string(runes[start:end]))
+}
+
+// indexArg returns the index argument at index i of the named procedure's
+// arguments. The index must be an exact integer in the range [0, n].
+func indexArg(name string, args Vector, i, n int) int {
+	x, ok := args[i].(Number)
+	if ok {
+		if index, exact := x.Int(); exact && x.IsExact() && index >= 0 && index <= int64(n) {
+			return int(index)
+		}
+	}
+	panic(newNamedError(fmt.Sprintf("%v to %v must be an exact integer between 0 and %d", argumentName(i), name, n), args[i]))
+}
+
+// newStdoutPort returns an output port that writes to the process's standard
+// output.
+func newStdoutPort() *outputPort {
+	return &outputPort{w: os.Stdout}
+}
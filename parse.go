@@ -1,40 +1,207 @@
 package loom
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"strings"
 )
 
+// Position describes a location in a source file.
+type Position struct {
+	Filename string // the name of the source file, if any
+	Line     int    // the line number, starting at 1
+	Column   int    // the column number, starting at 1 (in runes)
+}
+
+// IsValid returns true if the position is valid.
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns a string of the form file:line:column. If the position has no
+// filename, the result is of the form line:column.
+func (p Position) String() string {
+	if !p.IsValid() {
+		return p.Filename
+	}
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
 func ParseString(s string) (SExpression, error) {
 	return Parse(strings.NewReader(s))
 }
 
+// Parse parses a single expression from r. Any input that follows the
+// expression is ignored; use a Reader to read multiple expressions.
 func Parse(r io.Reader) (SExpression, error) {
-	p := &parser{l: &lexer{r: bufio.NewReader(r)}}
-	return p.parseExpression(0, false)
+	return ParseFile("", r)
+}
+
+// ParseFile parses a single expression from r. The positions of the parsed
+// datums refer to the named file.
+func ParseFile(filename string, r io.Reader) (SExpression, error) {
+	return NewFileReader(filename, r).Read()
+}
+
+// A Reader reads a sequence of datums from an input stream.
+type Reader struct {
+	p parser
+
+	start Position // the position of the last datum read
+}
+
+// NewReader returns a new Reader that reads from r.
+func NewReader(r io.Reader) *Reader {
+	return NewFileReader("", r)
+}
+
+// NewFileReader returns a new Reader that reads from r. The positions of the
+// datums returned by the reader refer to the named file.
+func NewFileReader(filename string, r io.Reader) *Reader {
+	return &Reader{p: parser{l: newLexer(filename, r)}}
+}
+
+// Read reads the next datum from the input. At the end of the input, Read
+// returns io.EOF. If the input ends in the middle of a datum, Read returns an
+// error that wraps io.ErrUnexpectedEOF.
+func (r *Reader) Read() (SExpression, error) {
+	r.p.labels = nil
+	r.p.peek()
+	r.start = r.p.tpos
+	return r.p.parseExpression(0, false)
 }
 
 type parser struct {
 	l *lexer
-	t interface{}
+
+	peeked bool
+	t      interface{} // the peeked token
+	terr   error       // the error that accompanied the peeked token
+	tpos   Position    // the position of the peeked token
+
+	pos Position // the position of the last token returned by next
+
+	labels map[int]*placeholder // the datum labels defined by the current datum
+}
+
+// A placeholder stands in for a labeled datum that is referenced before the
+// datum has been completely read.
+type placeholder struct {
+	label   int
+	value   SExpression // the labeled datum
+	defined bool        // true once the labeled datum has been read
+	used    bool        // true if the placeholder has been referenced
+}
+
+func (ph *placeholder) MarshalSExp() SExpression {
+	return ph
+}
+
+func (ph *placeholder) write(p *printer) error {
+	return p.writeString(fmt.Sprintf("#%d#", ph.label))
+}
+
+// resolve replaces each reference to the placeholder within its value with
+// the value itself.
+func (ph *placeholder) resolve() {
+	visited := map[interface{}]bool{}
+
+	var visit func(v Value)
+	visit = func(v Value) {
+		for {
+			key, ok := identity(v)
+			if !ok || visited[key] {
+				return
+			}
+			visited[key] = true
+
+			switch x := v.(type) {
+			case *Pair:
+				if x.car == ph {
+					x.car = ph.value
+				} else {
+					visit(x.car)
+				}
+				if x.cdr == ph {
+					x.cdr = ph.value
+					return
+				}
+				v = x.cdr
+			case Vector:
+				for i, e := range x {
+					if e == ph {
+						x[i] = ph.value
+					} else {
+						visit(e)
+					}
+				}
+				return
+			}
+		}
+	}
+	visit(ph.value)
 }
 
 func (p *parser) peek() interface{} {
-	if p.t == nil {
-		p.t, _ = p.l.next()
+	if !p.peeked {
+		p.t, p.terr = p.l.next()
+		p.tpos, p.peeked = p.l.start, true
 	}
 	return p.t
 }
 
 func (p *parser) next() (interface{}, error) {
-	if p.t != nil {
-		v := p.t
-		p.t = nil
-		return v, nil
+	var tok interface{}
+	var err error
+	if p.peeked {
+		tok, err, p.pos = p.t, p.terr, p.tpos
+		p.peeked, p.t, p.terr = false, nil, nil
+	} else {
+		tok, err = p.l.next()
+		p.pos = p.l.start
+	}
+	if err != nil && err != io.EOF {
+		return nil, &Error{Position: p.pos, Message: err.Error(), kind: readError, cause: err}
+	}
+	return tok, err
+}
+
+func (p *parser) errorf(pos Position, format string, args ...interface{}) error {
+	return &Error{Position: pos, Message: fmt.Sprintf(format, args...), kind: readError}
+}
+
+// parseDatum parses a datum that is nested inside another datum. Reaching
+// the end of the input is an error.
+func (p *parser) parseDatum(qq int, splice bool) (SExpression, error) {
+	v, err := p.parseExpression(qq, splice)
+	if err == io.EOF {
+		return nil, &Error{Position: p.pos, Message: "unexpected EOF", kind: readError, cause: io.ErrUnexpectedEOF}
 	}
-	return p.l.next()
+	return v, err
+}
+
+// skipDatumComments skips any datum comments (#;) that precede the next token.
+func (p *parser) skipDatumComments(qq int) error {
+	for p.peek() == '#' {
+		p.next()
+		if _, err := p.parseDatum(qq, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns a new list containing the given values. Each pair in the list
+// is annotated with pos.
+func (p *parser) list(pos Position, values ...Value) SExpression {
+	var head SExpression
+	for i := len(values) - 1; i >= 0; i-- {
+		head = &Pair{car: values[i], cdr: head, pos: &pos}
+	}
+	return head
 }
 
 func (p *parser) parseExpression(qq int, splice bool) (SExpression, error) {
@@ -42,19 +209,56 @@ func (p *parser) parseExpression(qq int, splice bool) (SExpression, error) {
 	if err != nil {
 		return nil, err
 	}
+	pos := p.pos
 
 	switch tok := tok.(type) {
 	case SExpression:
 		return tok, nil
+	case labelDefinition:
+		ph := &placeholder{label: int(tok)}
+		if p.labels == nil {
+			p.labels = map[int]*placeholder{}
+		}
+		if _, ok := p.labels[ph.label]; ok {
+			return nil, p.errorf(pos, "datum label #%d= is already defined", ph.label)
+		}
+		p.labels[ph.label] = ph
+
+		v, err := p.parseDatum(qq, splice)
+		if err != nil {
+			return nil, err
+		}
+		if v == ph {
+			return nil, p.errorf(pos, "datum label #%d= refers to itself", ph.label)
+		}
+		ph.value, ph.defined = v, true
+		if ph.used {
+			ph.resolve()
+		}
+		return v, nil
+	case labelReference:
+		ph, ok := p.labels[int(tok)]
+		if !ok {
+			return nil, p.errorf(pos, "undefined datum label #%d#", int(tok))
+		}
+		if ph.defined {
+			return ph.value, nil
+		}
+		ph.used = true
+		return ph, nil
 	case rune:
 		switch tok {
 		case '(':
+			if err := p.skipDatumComments(qq); err != nil {
+				return nil, err
+			}
 			if p.peek() == ')' {
 				p.next()
 				return nil, nil
 			}
 
-			first, err := p.parseExpression(qq, true)
+			firstPos := p.tpos
+			first, err := p.parseDatum(qq, true)
 			if err != nil {
 				return nil, err
 			}
@@ -68,90 +272,99 @@ func (p *parser) parseExpression(qq int, splice bool) (SExpression, error) {
 				}
 			}
 
-			head := &Pair{car: first}
+			head := &Pair{car: first, pos: &pos, carPos: &firstPos}
 			tail := head
 			for {
+				if err := p.skipDatumComments(qq); err != nil {
+					return nil, err
+				}
+
 				switch p.peek() {
 				case ')':
 					p.next()
 					return head, nil
-				case Symbol("."):
+				case '.':
 					p.next()
-					last, err := p.parseExpression(qq, true)
+					last, err := p.parseDatum(qq, true)
 					if err != nil {
 						return nil, err
 					}
+					if err := p.skipDatumComments(qq); err != nil {
+						return nil, err
+					}
 					if tok, _ := p.next(); tok != ')' {
-						return nil, fmt.Errorf("unexpected token %v", tok)
+						return nil, p.errorf(p.pos, "unexpected token %v", tok)
 					}
 					tail.cdr = last
 					return head, nil
 				}
 
-				next, err := p.parseExpression(qq, true)
+				nextPos := p.tpos
+				next, err := p.parseDatum(qq, true)
 				if err != nil {
 					return nil, err
 				}
-				p := &Pair{car: next}
-				tail.cdr, tail = p, p
+				pair := &Pair{car: next, pos: &nextPos}
+				tail.cdr, tail = pair, pair
 			}
 		case '[':
 			var vec Vector
 			for {
+				if err := p.skipDatumComments(qq); err != nil {
+					return nil, err
+				}
 				if p.peek() == ')' {
+					p.next()
 					return vec, nil
 				}
 
-				el, err := p.parseExpression(qq, true)
+				el, err := p.parseDatum(qq, true)
 				if err != nil {
 					return nil, err
 				}
 				vec = append(vec, el)
 			}
 		case '\'':
-			el, err := p.parseExpression(qq, false)
+			el, err := p.parseDatum(qq, false)
 			if err != nil {
 				return nil, err
 			}
-			return Vector{Symbol("quote"), el}.ToList(), nil
+			return p.list(pos, Symbol("quote"), el), nil
 		case '`':
-			el, err := p.parseExpression(qq+1, false)
+			el, err := p.parseDatum(qq+1, false)
 			if err != nil {
 				return nil, err
 			}
-			return Vector{Symbol("quasiquote"), el}.ToList(), nil
+			return p.list(pos, Symbol("quasiquote"), el), nil
 		case ',':
 			if qq == 0 {
-				return nil, fmt.Errorf("unquote must be nested inside quasiquation")
+				return nil, p.errorf(pos, "unquote must be nested inside quasiquation")
 			}
 
-			el, err := p.parseExpression(qq-1, false)
+			el, err := p.parseDatum(qq-1, false)
 			if err != nil {
 				return nil, err
 			}
-			return Vector{Symbol("unquote"), el}.ToList(), nil
+			return p.list(pos, Symbol("unquote"), el), nil
 		case '@':
 			if qq == 0 || !splice {
-				return nil, fmt.Errorf("unquote-splicing must be nested inside quasiquation")
+				return nil, p.errorf(pos, "unquote-splicing must be nested inside quasiquation")
 			}
 
-			el, err := p.parseExpression(qq-1, false)
+			el, err := p.parseDatum(qq-1, false)
 			if err != nil {
 				return nil, err
 			}
-			return Vector{Symbol("unquote-splicing"), el}.ToList(), nil
+			return p.list(pos, Symbol("unquote-splicing"), el), nil
 		case '#':
-			if _, err := p.parseExpression(qq, splice); err != nil {
+			if _, err := p.parseDatum(qq, splice); err != nil {
 				return nil, err
 			}
-			if p.peek() == 0 {
-				return nil, nil
-			}
 			return p.parseExpression(qq, splice)
 		default:
-			return nil, fmt.Errorf("unexpected token %v", tok)
+			return nil, p.errorf(pos, "unexpected token %v", tok)
 		}
 	default:
-		return nil, fmt.Errorf("unexpected token %v", tok)
+		return nil, p.errorf(pos, "unexpected token %v", tok)
 	}
 }
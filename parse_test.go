@@ -0,0 +1,281 @@
+package loom
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(`
+		(define x 42) ; a comment
+		#(1 2 3) #;(ignored datum)
+		(a #;b c . #;d e)
+		#| a block comment |#
+		` + "`(x ,@y)" + `
+		#;last`))
+
+	expected := []string{
+		"(define x 42)",
+		"#(1 2 3)",
+		"(a c . e)",
+		"(quasiquote (x (unquote-splicing y)))",
+	}
+	for _, e := range expected {
+		x, err := r.Read()
+		require.NoError(t, err)
+		assert.Equal(t, e, EncodeToString(x))
+	}
+
+	_, err := r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReaderErrors(t *testing.T) {
+	cases := []struct{ input, message string }{
+		{"(a b", "1:5: unexpected EOF"},
+		{"#(1 2", "1:6: unexpected EOF"},
+		{"(a . b c)", "1:8: unexpected token c"},
+		{"'", "1:2: unexpected EOF"},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader(c.input)).Read()
+			assert.EqualError(t, err, c.message)
+		})
+	}
+}
+
+func TestCharacterLiterals(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected Character
+		written  string
+	}{
+		{`#\a`, 'a', `#\a`},
+		{`#\A`, 'A', `#\A`},
+		{`#\(`, '(', `#\(`},
+		{`#\ `, ' ', `#\space`},
+		{`#\space`, ' ', `#\space`},
+		{`#\newline`, '\n', `#\newline`},
+		{`#\tab`, '\t', `#\tab`},
+		{`#\null`, 0, `#\null`},
+		{`#\alarm`, '\a', `#\alarm`},
+		{`#\backspace`, '\b', `#\backspace`},
+		{`#\delete`, 0x7f, `#\delete`},
+		{`#\escape`, 0x1b, `#\escape`},
+		{`#\return`, '\r', `#\return`},
+		{`#\x`, 'x', `#\x`},
+		{`#\x41`, 'A', `#\A`},
+		{`#\x3bb`, 'λ', `#\λ`},
+		{`#\λ`, 'λ', `#\λ`},
+		{`#\x200B`, 0x200b, `#\x200b`},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			x, err := ParseString(c.input)
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, x)
+			assert.Equal(t, c.written, EncodeToString(x))
+
+			y, err := ParseString(c.written)
+			require.NoError(t, err)
+			assert.Equal(t, x, y)
+		})
+	}
+
+	x, err := ParseString(`(#\a #\b)`)
+	require.NoError(t, err)
+	assert.Equal(t, `(#\a #\b)`, EncodeToString(x))
+
+	_, err = ParseString(`#\nul`)
+	assert.EqualError(t, err, `1:1: invalid character literal #\nul`)
+
+	// surrogate code points are not characters
+	for _, input := range []string{`#\xD800`, `#\xdbff`, `#\xDFFF`, `#\x110000`, `"\xD800;"`} {
+		_, err = ParseString(input)
+		assert.Error(t, err, input)
+	}
+	x, err = ParseString(`#\xD7FF`)
+	require.NoError(t, err)
+	assert.Equal(t, Character(0xd7ff), x)
+}
+
+func TestNumberLiterals(t *testing.T) {
+	cases := []struct{ input, written string }{
+		{"42", "42"},
+		{"-17", "-17"},
+		{"+5", "5"},
+		{"1/2", "1/2"},
+		{"-6/4", "-3/2"},
+		{"4/2", "2"},
+		{"1.5", "1.5"},
+		{".5", "0.5"},
+		{"2.", "2.0"},
+		{"1e3", "1000.0"},
+		{"1e21", "1e+21"},
+		{"+inf.0", "+inf.0"},
+		{"-inf.0", "-inf.0"},
+		{"+nan.0", "+nan.0"},
+		{"#x-ff", "-255"},
+		{"#b101", "5"},
+		{"#o17", "15"},
+		{"#d10", "10"},
+		{"#e1.5", "3/2"},
+		{"#e0.1", "1/10"},
+		{"#i1/2", "0.5"},
+		{"#x#e10", "16"},
+		{"#e#x10", "16"},
+		{"#i#b11", "3.0"},
+		{"123456789012345678901234567890", "123456789012345678901234567890"},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			x, err := ParseString(c.input)
+			require.NoError(t, err)
+			assert.Equal(t, c.written, EncodeToString(x))
+		})
+	}
+
+	errors := []string{"1/0", "#e+inf.0", "#b12", "#x1.5", "#q1", "#e1e5100000", "#e1e100000000", "#e1e-100000000", "#e1e99999999999999999999"}
+	for _, input := range errors {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseString(input)
+			assert.Error(t, err)
+
+			testExpr(t, `(string->number "`+input+`")`, "#f")
+		})
+	}
+}
+
+func TestWriteDisplay(t *testing.T) {
+	cases := []struct{ input, written, displayed string }{
+		{`"a\"b\\c"`, `"a\"b\\c"`, `a"b\c`},
+		{`"tab\there\nnewline"`, `"tab\there\nnewline"`, "tab\there\nnewline"},
+		{`"\x7f;"`, `"\x7f;"`, "\x7f"},
+		{`#\a`, `#\a`, `a`},
+		{`#\space`, `#\space`, ` `},
+		{`|odd symbol|`, `|odd symbol|`, `odd symbol`},
+		{`|a\|b|`, `|a\|b|`, `a|b`},
+		{`||`, `||`, ``},
+		{`|+1|`, `|+1|`, `+1`},
+		{`|.|`, `|.|`, `.`},
+		{`...`, `...`, `...`},
+		{`->x`, `->x`, `->x`},
+		{`(a "b" #\c . d)`, `(a "b" #\c . d)`, `(a b c . d)`},
+		{`#(1 "two" (three))`, `#(1 "two" (three))`, `#(1 two (three))`},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			x, err := ParseString(c.input)
+			require.NoError(t, err)
+
+			written := EncodeToString(x)
+			assert.Equal(t, c.written, written)
+			assert.Equal(t, c.displayed, DisplayString(x))
+
+			// the written representation reads back as an equivalent value
+			y, err := ParseString(written)
+			require.NoError(t, err)
+			assert.Equal(t, written, EncodeToString(y))
+		})
+	}
+}
+
+func TestDatumLabels(t *testing.T) {
+	x, err := ParseString(`#0=(a b . #0#)`)
+	require.NoError(t, err)
+	p := x.(*Pair)
+	assert.True(t, p.cdr.(*Pair).cdr == p)
+
+	x, err = ParseString(`#0=#(1 #1=(2 . #1#) #0#)`)
+	require.NoError(t, err)
+	v := x.(Vector)
+	assert.Equal(t, &v[0], &v[2].(Vector)[0])
+	assert.True(t, v[1].(*Pair).cdr == v[1])
+
+	cases := []struct{ input, written, shared, displayed string }{
+		{`#0=(a b . #0#)`, `#0=(a b . #0#)`, `#0=(a b . #0#)`, `#0=(a b . #0#)`},
+		{`(#0=(1 2) #0#)`, `((1 2) (1 2))`, `(#0=(1 2) #0#)`, `((1 2) (1 2))`},
+		{`((1 . #1=(2)) #1#)`, `((1 2) (2))`, `((1 . #0=(2)) #0#)`, `((1 2) (2))`},
+		{`#0=#("x" #0#)`, `#0=#("x" #0#)`, `#0=#("x" #0#)`, `#0=#(x #0#)`},
+		{`(#0=(a . #0#) #0#)`, `(#0=(a . #0#) #0#)`, `(#0=(a . #0#) #0#)`, `(#0=(a . #0#) #0#)`},
+		{`(x #12=(y . #12#))`, `(x #0=(y . #0#))`, `(x #0=(y . #0#))`, `(x #0=(y . #0#))`},
+		{`(x . #0=(y . #0#))`, `(x . #0=(y . #0#))`, `(x . #0=(y . #0#))`, `(x . #0=(y . #0#))`},
+		{`(#0=() #0#)`, `(() ())`, `(() ())`, `(() ())`},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			x, err := ParseString(c.input)
+			require.NoError(t, err)
+
+			assert.Equal(t, c.written, EncodeToString(x))
+			assert.Equal(t, c.displayed, DisplayString(x))
+
+			var shared strings.Builder
+			require.NoError(t, WriteShared(&shared, x))
+			assert.Equal(t, c.shared, shared.String())
+
+			// written representations read back as equivalent values
+			y, err := ParseString(shared.String())
+			require.NoError(t, err)
+			assert.Equal(t, c.written, EncodeToString(y))
+		})
+	}
+
+	errors := []string{`#0#`, `#0=#0#`, `(#0= a #1#)`, `#1x`, `#0=`, `#0=(a #0=(b))`, `(#0=a #0=b)`}
+	for _, input := range errors {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseString(input)
+			assert.Error(t, err)
+		})
+	}
+
+	// labels are scoped to a single datum
+	r := NewReader(strings.NewReader(`#0=(a) #0#`))
+	_, err = r.Read()
+	require.NoError(t, err)
+	_, err = r.Read()
+	assert.Error(t, err)
+}
+
+func TestIncompleteInput(t *testing.T) {
+	incomplete := []string{`(a`, `(a . `, `#(1 2`, `'`, `"abc`, `|sym`, `#| comment`, `#0=`}
+	for _, input := range incomplete {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseString(input)
+			assert.True(t, errors.Is(err, io.ErrUnexpectedEOF), "%v", err)
+		})
+	}
+
+	malformed := []string{`)`, `(a . b c)`, `"\q"`}
+	for _, input := range malformed {
+		t.Run(input, func(t *testing.T) {
+			_, err := ParseString(input)
+			require.Error(t, err)
+			assert.False(t, errors.Is(err, io.ErrUnexpectedEOF))
+		})
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	cases := []struct{ input, written string }{
+		{"#!/usr/bin/env loom\n(a b)", "(a b)"},
+		{"#! /usr/bin/loom -e\n(a b)", "(a b)"},
+		{"#!fold-case (a b)", "(a b)"},
+		{"(a #!no-fold-case b)", "(a b)"},
+		{"; a comment\n(a b) ; another comment", "(a b)"},
+	}
+	for _, c := range cases {
+		x, err := ParseString(c.input)
+		require.NoError(t, err)
+		assert.Equal(t, c.written, EncodeToString(x))
+	}
+
+	_, err := ParseString("; a comment without a newline")
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,264 @@
+package loom
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// A printer writes the textual representations of values.
+type printer struct {
+	w io.Writer
+
+	// display is true if the printer writes human-readable representations
+	// rather than external representations.
+	display bool
+
+	// labels maps the identities of the pairs and vectors that are written
+	// using datum labels to their labels. A label of -1 indicates that the
+	// object has not been written yet.
+	labels map[interface{}]int
+	next   int // the next datum label
+}
+
+// identity returns a key that identifies the storage of a pair or vector. The
+// second result is false if v has no identity that is relevant to printing or
+// reading datum labels.
+func identity(v Value) (interface{}, bool) {
+	switch v := v.(type) {
+	case *Pair:
+		return v, v != nil
+	case Vector:
+		if len(v) == 0 {
+			return nil, false
+		}
+		return &v[0], true
+	default:
+		return nil, false
+	}
+}
+
+// label assigns datum labels to the pairs and vectors in v that are part of a
+// cycle. If shared is true, labels are also assigned to the pairs and vectors
+// that occur more than once in v.
+func (p *printer) label(v Value, shared bool) {
+	p.labels = map[interface{}]int{}
+
+	// visiting maps the objects that have been visited to true while they are
+	// being visited and to false once they have been visited
+	visiting := map[interface{}]bool{}
+
+	var visit func(v Value)
+	visit = func(v Value) {
+		// the tails of lists are visited iteratively, so every pair in the
+		// list remains active until the end of the list has been reached
+		var active []interface{}
+		defer func() {
+			for _, key := range active {
+				visiting[key] = false
+			}
+		}()
+
+		for {
+			key, ok := identity(v)
+			if !ok {
+				return
+			}
+			if isActive, seen := visiting[key]; seen {
+				if isActive || shared {
+					p.labels[key] = -1
+				}
+				return
+			}
+			visiting[key], active = true, append(active, key)
+
+			switch x := v.(type) {
+			case *Pair:
+				visit(x.car)
+				v = x.cdr
+			case Vector:
+				for _, e := range x {
+					visit(e)
+				}
+				return
+			}
+		}
+	}
+
+	if vs, ok := v.(Values); ok {
+		for _, e := range vs {
+			visit(e)
+		}
+		return
+	}
+	visit(v)
+}
+
+// isLabeled returns true if v is written using a datum label.
+func (p *printer) isLabeled(v Value) bool {
+	key, ok := identity(v)
+	if !ok {
+		return false
+	}
+	_, ok = p.labels[key]
+	return ok
+}
+
+func (p *printer) writeString(s string) error {
+	_, err := io.WriteString(p.w, s)
+	return err
+}
+
+// print writes the representation of v. Values that are not s-expressions are
+// written using the results of their MarshalSExp methods. By convention, a
+// value that marshals to a symbol is an opaque object that is named by the
+// symbol; the name is always written as-is.
+func (p *printer) print(v Value) error {
+	if key, ok := identity(v); ok {
+		if n, ok := p.labels[key]; ok {
+			if n >= 0 {
+				return p.writeString(fmt.Sprintf("#%d#", n))
+			}
+
+			n, p.next = p.next, p.next+1
+			p.labels[key] = n
+			if err := p.writeString(fmt.Sprintf("#%d=", n)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s, ok := v.(SExpression); ok {
+		return s.write(p)
+	}
+	if v == nil {
+		return p.writeString("()")
+	}
+
+	s := v.MarshalSExp()
+	if name, ok := s.(Symbol); ok {
+		return p.writeString(string(name))
+	}
+	return p.print(s)
+}
+
+// Write writes the external representation of v to w. Strings, characters,
+// and symbols are written using the notation of the reader, so the output can
+// be read back by Parse.
+//
+// If v contains cycles, the pairs and vectors that begin each cycle are
+// written using datum labels, e.g. #0=(a b . #0#). Datum labels are not used
+// for data that is shared but not cyclic.
+func Write(w io.Writer, v Value) error {
+	p := printer{w: w}
+	p.label(v, false)
+	return p.print(v)
+}
+
+// WriteShared is like Write, but it also uses datum labels for every pair and
+// vector that occurs more than once in v.
+func WriteShared(w io.Writer, v Value) error {
+	p := printer{w: w}
+	p.label(v, true)
+	return p.print(v)
+}
+
+// WriteSimple is like Write, but it never uses datum labels. WriteSimple does
+// not terminate if v contains cycles.
+func WriteSimple(w io.Writer, v Value) error {
+	p := printer{w: w}
+	return p.print(v)
+}
+
+// Display writes a human-readable representation of v to w. Strings and
+// characters are written as their contents, and symbols are written without
+// escapes. Like Write, Display uses datum labels for cyclic data.
+func Display(w io.Writer, v Value) error {
+	p := printer{w: w, display: true}
+	p.label(v, false)
+	return p.print(v)
+}
+
+// Encode writes the external representation of v to w. It is equivalent to
+// Write.
+func Encode(w io.Writer, v Value) error {
+	return Write(w, v)
+}
+
+// EncodeToString returns the external representation of v.
+func EncodeToString(v Value) string {
+	var b strings.Builder
+	Write(&b, v)
+	return b.String()
+}
+
+// DisplayString returns the human-readable representation of v.
+func DisplayString(v Value) string {
+	var b strings.Builder
+	Display(&b, v)
+	return b.String()
+}
+
+// stringEscapes maps characters that are escaped in the external
+// representations of strings and symbols to their escape sequences.
+var stringEscapes = map[rune]string{
+	'\\': `\\`,
+	'\a': `\a`,
+	'\b': `\b`,
+	'\t': `\t`,
+	'\n': `\n`,
+	'\r': `\r`,
+}
+
+// writeQuoted writes s enclosed in the given delimiter, escaping the delimiter,
+// backslashes, and non-graphic characters.
+func writeQuoted(p *printer, s string, delimiter rune) error {
+	var b strings.Builder
+	b.WriteRune(delimiter)
+	for _, c := range s {
+		switch {
+		case c == delimiter:
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case stringEscapes[c] != "":
+			b.WriteString(stringEscapes[c])
+		case c == ' ' || unicode.IsGraphic(c):
+			b.WriteRune(c)
+		default:
+			fmt.Fprintf(&b, `\x%x;`, c)
+		}
+	}
+	b.WriteRune(delimiter)
+	return p.writeString(b.String())
+}
+
+// isPlainSymbol returns true if the symbol named s can be written without
+// vertical bars.
+func isPlainSymbol(s string) bool {
+	if s == "" || s == "." {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune("()\"';`,|\\", c):
+			return false
+		case i == 0:
+			if c == '#' || c >= '0' && c <= '9' {
+				return false
+			}
+			if !beginsIdentifier(c) && !strings.ContainsRune("!$%&*/:<=>?^_~+-.", c) {
+				return false
+			}
+		case !continuesIdentifier(c):
+			return false
+		}
+	}
+
+	// symbols that begin with a sign or a period must not read as numbers
+	if _, ok := parseNumber(s, 10, 0); ok {
+		return false
+	}
+	return true
+}
@@ -28,6 +28,15 @@ func ProcedureApply(args Vector) Value {
 	return proc.Apply(actuals)
 }
 
+// (values obj ...)
+//
+// Delivers all of its arguments to its continuation. It is an error to deliver
+// any number of values other than one to a continuation that accepts a single
+// value, such as that of an argument or of the test of an if expression.
+func ProcedureValues(args Vector) Value {
+	return makeValues(args)
+}
+
 func ProcedureMap(args Vector) Value {
 	if len(args) < 2 {
 		panic("map expects at least 2 arguments")
@@ -60,3 +69,60 @@ func ProcedureMap(args Vector) Value {
 		}
 	}
 }
+
+// A caseLambda is a procedure created by a case-lambda expression. Each clause
+// is a procedure created by a lambda expression. A call to a caseLambda is
+// dispatched to the first clause that accepts the number of arguments.
+type caseLambda struct {
+	clauses []Procedure
+}
+
+func (p *caseLambda) MarshalSExp() SExpression {
+	return Symbol("<case-lambda>")
+}
+
+func (p *caseLambda) Apply(args Vector) Value {
+	return p.clause(args).Apply(args)
+}
+
+// clause returns the first clause of p that accepts args. It is an error for
+// the arguments not to agree with the formals of any clause.
+func (p *caseLambda) clause(args Vector) Procedure {
+	for _, c := range p.clauses {
+		if required, isVariadic := arity(c); len(args) == required || isVariadic && len(args) > required {
+			return c
+		}
+	}
+	panic(NewError("no case-lambda clause accepts the arguments", args.ToList()))
+}
+
+// arity returns the number of arguments that are required by the procedure p
+// and whether p accepts additional arguments. Procedures whose formals are
+// unknown accept any number of arguments.
+func arity(p Procedure) (int, bool) {
+	var formals []Symbol
+	var isVariadic bool
+	switch p := p.(type) {
+	case *procedure:
+		formals, isVariadic = p.formals, p.isVariadic
+	case *compiledClosure:
+		formals, isVariadic = p.proc.formals, p.proc.isVariadic
+	default:
+		return 0, true
+	}
+	if isVariadic {
+		return len(formals) - 1, true
+	}
+	return len(formals), false
+}
+
+// makeCaseLambda returns a procedure whose clauses are the procedures args. The
+// expansion of a case-lambda expression calls makeCaseLambda with the values
+// of the lambda expressions of its clauses.
+func makeCaseLambda(args Vector) Value {
+	clauses := make([]Procedure, len(args))
+	for i, arg := range args {
+		clauses[i] = arg.(Procedure)
+	}
+	return &caseLambda{clauses: clauses}
+}
@@ -0,0 +1,155 @@
+package loom
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// An ExitError records the exit status requested by a call to exit or
+// emergency-exit. Evaluations that are terminated by these procedures fail with
+// an error that wraps an *ExitError; hosts should terminate the program with
+// the given status.
+type ExitError struct {
+	Code int // the requested exit status
+
+	// Emergency is true if the program was terminated by emergency-exit.
+	Emergency bool
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// exit returns an error that terminates evaluation with the given status.
+func exit(status *ExitError) *Error {
+	return &Error{Message: status.Error(), cause: status, kind: exitError}
+}
+
+// exitCode returns the exit status for the argument to exit or
+// emergency-exit.
+func exitCode(name string, args Vector) int {
+	switch len(args) {
+	case 0:
+		return 0
+	case 1:
+		switch obj := args[0].(type) {
+		case Boolean:
+			if obj {
+				return 0
+			}
+			return 1
+		case Number:
+			if code, ok := obj.Int(); ok && obj.IsExact() && code >= 0 && code <= 255 {
+				return int(code)
+			}
+		}
+		return 1
+	default:
+		panic(name + " expects at most 1 argument")
+	}
+}
+
+// (exit)
+// (exit obj)
+//
+// Runs all outstanding dynamic-wind after procedures, terminates the running
+// program, and communicates an exit value to the operating system. If no
+// argument is supplied, or if obj is #t, the exit procedure should communicate
+// to the operating system that the program exited normally. If obj is #f, the
+// exit procedure should communicate to the operating system that the program
+// exited abnormally. Otherwise, exit should translate obj into an appropriate
+// exit value for the operating system, if possible.
+//
+// Exact integers between 0 and 255 are used as-is. Any other object is
+// translated to 1.
+func Exit(args Vector) Value {
+	panic(exit(&ExitError{Code: exitCode("exit", args)}))
+}
+
+// (emergency-exit)
+// (emergency-exit obj)
+//
+// Terminates the program without running any outstanding dynamic-wind after
+// procedures and communicates an exit value to the operating system in the
+// same manner as exit.
+func EmergencyExit(args Vector) Value {
+	panic(exit(&ExitError{Code: exitCode("emergency-exit", args), Emergency: true}))
+}
+
+// (get-environment-variable name)
+//
+// Many operating systems provide each running process with an environment
+// consisting of environment variables. Both the name and value of an
+// environment variable are strings. The procedure get-environment-variable
+// returns the value of the environment variable name, or #f if the named
+// environment variable is not found.
+func GetEnvironmentVariable(args Vector) Value {
+	if len(args) != 1 {
+		panic("get-environment-variable expects 1 argument")
+	}
+	name, ok := args[0].(String)
+	if !ok {
+		panic(newNamedError("the first argument to get-environment-variable must be a string", args[0]))
+	}
+
+	value, ok := os.LookupEnv(string(name))
+	if !ok {
+		return Boolean(false)
+	}
+	return String(value)
+}
+
+// (get-environment-variables)
+//
+// Returns the names and values of all the environment variables as an alist,
+// where the car of each entry is the name of an environment variable and the
+// cdr is its value, both as strings.
+func GetEnvironmentVariables(args Vector) Value {
+	if len(args) != 0 {
+		panic("get-environment-variables expects no arguments")
+	}
+
+	environ := os.Environ()
+	sort.Strings(environ)
+
+	entries := make(Vector, 0, len(environ))
+	for _, v := range environ {
+		name, value := v, ""
+		if i := strings.IndexByte(v, '='); i != -1 {
+			name, value = v[:i], v[i+1:]
+		}
+		entries = append(entries, Cons(String(name), String(value)))
+	}
+	return entries.ToList()
+}
+
+// SetCommandLine sets the command line that is returned by the command-line
+// procedure. By default, the command line is the command line of the process.
+// The command line is shared by the environments derived from e.
+func (e *Env) SetCommandLine(args []string) {
+	e.globals.dynamic().commandLine = args
+}
+
+// processProcedures returns the procedures that describe the process context of
+// the dynamic environment d.
+func processProcedures(d *dynamicEnv) map[Symbol]Value {
+	return map[Symbol]Value{
+		// (command-line)
+		//
+		// Returns the command line passed to the process as a list of strings.
+		// The first string corresponds to the command name.
+		"command-line": ProcedureFunc(func(args Vector) Value {
+			if len(args) != 0 {
+				panic("command-line expects no arguments")
+			}
+
+			commandLine := make(Vector, len(d.commandLine))
+			for i, arg := range d.commandLine {
+				commandLine[i] = String(arg)
+			}
+			return commandLine.ToList()
+		}),
+	}
+}
@@ -0,0 +1,271 @@
+package loom
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DefineFunc binds name to a procedure that calls the Go function fn. Each
+// argument is converted to the type of the corresponding parameter as if by
+// Unmarshal, and the result is converted to a Scheme value as if by Marshal.
+// If fn is variadic, the procedure accepts any number of trailing arguments,
+// each of which is converted to the type of the variadic parameter.
+//
+// fn may return any number of results, optionally followed by an error. If
+// the error is non-nil, the procedure fails with an error that wraps it. A
+// procedure with no results returns an unspecified value, and a procedure with
+// more than one result returns its results as multiple values.
+//
+// If an argument cannot be converted to the type of its parameter, the
+// procedure fails with an error that names the argument.
+//
+// DefineFunc panics if fn is not a function or has an unsupported signature.
+func (e *Env) DefineFunc(name string, fn interface{}) {
+	e.Set(Symbol(name), newGoProcedure(Symbol(name), fn))
+}
+
+// newGoProcedure returns a procedure that calls the Go function fn.
+func newGoProcedure(name Symbol, fn interface{}) Procedure {
+	switch fn := fn.(type) {
+	case Procedure:
+		return fn
+	case func(Vector) Value:
+		return ProcedureFunc(fn)
+	}
+
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func {
+		panic(fmt.Sprintf("%v: expected a function, not %T", name, fn))
+	}
+	checkSignature(name, rv.Type())
+	return newGoFunc(name, rv)
+}
+
+// checkSignature panics if the parameters or results of the function type t
+// cannot be converted between Scheme and Go.
+func checkSignature(name Symbol, t reflect.Type) {
+	for i := 0; i < t.NumIn(); i++ {
+		if !convertible(t.In(i), map[reflect.Type]bool{}) {
+			panic(fmt.Sprintf("%v: %v has unsupported type %v", name, argumentName(i), t.In(i)))
+		}
+	}
+	for i := 0; i < t.NumOut(); i++ {
+		if !convertible(t.Out(i), map[reflect.Type]bool{}) {
+			panic(fmt.Sprintf("%v: %v has unsupported type %v", name, resultName(i), t.Out(i)))
+		}
+	}
+}
+
+// convertible returns true if values of type t can be converted between
+// Scheme and Go by Marshal and Unmarshal. seen holds the types that are
+// already being checked, so that recursive types terminate.
+func convertible(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] || t.Implements(valueType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return true
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Interface,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice, reflect.Array, reflect.Ptr:
+		return convertible(t.Elem(), seen)
+	case reflect.Map:
+		return convertible(t.Key(), seen) && convertible(t.Elem(), seen)
+	case reflect.Struct:
+		for _, f := range structFields(t) {
+			if !convertible(t.Field(f.index).Type, seen) {
+				return false
+			}
+		}
+		return true
+	case reflect.Func:
+		for i := 0; i < t.NumIn(); i++ {
+			if !convertible(t.In(i), seen) {
+				return false
+			}
+		}
+		for i := 0; i < t.NumOut(); i++ {
+			if !convertible(t.Out(i), seen) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	valueType = reflect.TypeOf((*Value)(nil)).Elem()
+)
+
+// A goFunc is a procedure that calls a Go function.
+type goFunc struct {
+	name     Symbol
+	fn       reflect.Value
+	hasError bool // true if the function's last result is an error
+}
+
+func newGoFunc(name Symbol, fn reflect.Value) *goFunc {
+	t := fn.Type()
+
+	hasError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	return &goFunc{name: name, fn: fn, hasError: hasError}
+}
+
+func (f *goFunc) MarshalSExp() SExpression {
+	return f.name
+}
+
+func (f *goFunc) Apply(args Vector) Value {
+	t := f.fn.Type()
+
+	fixed, atLeast := t.NumIn(), ""
+	if t.IsVariadic() {
+		fixed, atLeast = fixed-1, " at least"
+	}
+	if len(args) < fixed || len(args) > fixed && !t.IsVariadic() {
+		s := ""
+		if fixed != 1 {
+			s = "s"
+		}
+		panic(fmt.Sprintf("%v expects%v %d argument%s", f.name, atLeast, fixed, s))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var pt reflect.Type
+		if i < fixed {
+			pt = t.In(i)
+		} else {
+			pt = t.In(fixed).Elem()
+		}
+
+		v, err := fromValue(arg, pt)
+		if err != nil {
+			panic(err.toNamedError(fmt.Sprintf("%v to %v", argumentName(i), f.name)))
+		}
+		in[i] = v
+	}
+
+	out := f.fn.Call(in)
+	if f.hasError {
+		if err := out[len(out)-1]; !err.IsNil() {
+			panic(toError(err.Interface()))
+		}
+		out = out[:len(out)-1]
+	}
+	switch len(out) {
+	case 0:
+		return Unspecified
+	case 1:
+		v, err := toValue(out[0])
+		if err != nil {
+			panic(err.toNamedError(fmt.Sprintf("the result of %v", f.name)))
+		}
+		return v
+	}
+
+	values := make(Values, len(out))
+	for i, rv := range out {
+		v, err := toValue(rv)
+		if err != nil {
+			panic(err.toNamedError(fmt.Sprintf("%v of %v", resultName(i), f.name)))
+		}
+		values[i] = v
+	}
+	return values
+}
+
+var ordinals = []string{"first", "second", "third", "fourth", "fifth", "sixth", "seventh", "eighth", "ninth", "tenth"}
+
+// argumentName returns a description of the i'th argument to a procedure for
+// use in error messages, e.g. "the first argument".
+func argumentName(i int) string {
+	return ordinalName(i, "argument")
+}
+
+// resultName returns a description of the i'th result of a procedure for use
+// in error messages, e.g. "the second result".
+func resultName(i int) string {
+	return ordinalName(i, "result")
+}
+
+func ordinalName(i int, noun string) string {
+	if i < len(ordinals) {
+		return "the " + ordinals[i] + " " + noun
+	}
+	return fmt.Sprintf("%v %d", noun, i+1)
+}
+
+// procedureFunc returns a Go function of type t that applies p. If t has more
+// than one result other than an error, p must return that many values. If the
+// last result of t is an error, any failure that occurs during the application
+// is returned as an *Error.
+func procedureFunc(p Procedure, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) (out []reflect.Value) {
+		out = make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+
+		results := len(out)
+		if n := len(out); n > 0 && t.Out(n-1) == errorType {
+			results--
+			defer func() {
+				if x := recover(); x != nil {
+					out[n-1] = reflect.ValueOf(error(toError(x)))
+				}
+			}()
+		}
+
+		var args Vector
+		for i, arg := range in {
+			if t.IsVariadic() && i == len(in)-1 {
+				for j := 0; j < arg.Len(); j++ {
+					args = append(args, mustValue(arg.Index(j)))
+				}
+				break
+			}
+			args = append(args, mustValue(arg))
+		}
+
+		result := p.Apply(args)
+		switch results {
+		case 0:
+		case 1:
+			v, err := fromValue(result, t.Out(0))
+			if err != nil {
+				panic(err.toError("the result of " + EncodeToString(p)))
+			}
+			out[0] = v
+		default:
+			values := spreadValues(result)
+			if len(values) != results {
+				panic(NewError(fmt.Sprintf("%v must return %d values", EncodeToString(p), results), values...))
+			}
+			for i, value := range values {
+				v, err := fromValue(value, t.Out(i))
+				if err != nil {
+					panic(err.toError(resultName(i) + " of " + EncodeToString(p)))
+				}
+				out[i] = v
+			}
+		}
+		return out
+	})
+}
+
+// mustValue converts a Go argument to a Scheme value, panicking on failure.
+func mustValue(rv reflect.Value) Value {
+	v, err := toValue(rv)
+	if err != nil {
+		panic(err.toError("an argument"))
+	}
+	return v
+}
@@ -44,7 +44,7 @@ func StringRef(args Vector) Value {
 		panic("the second argument to string-ref must be an integer")
 	}
 	if i > int64(len(v)) {
-		panic(fmt.Sprintf("%v is not a member of a string of length %v", i, len(v)))
+		panic(NewError(fmt.Sprintf("%v is not a member of a string of length %v", i, len(v))))
 	}
 
 	// TODO: this is a byte index, not a rune index.
@@ -1,17 +1,29 @@
 package loom
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
 type syntaxRules struct {
 	scope    *scope
+	lexical  *lexicalScope // the lexical scope of the definition, if compiled
+	env      *syntacticEnv // the syntactic environment of the definition, if expanded
+	ellipsis Symbol        // the ellipsis identifier, ... unless specified
 	literals map[Symbol]*scope
 	rules    []syntaxRule
 }
 
 func (r *syntaxRules) match(form *Pair, scope *scope) (Value, bool) {
-	m := syntaxMatcher{
-		literals:  r.literals,
-		ruleScope: r.scope,
-		formScope: scope,
-	}
+	return r.apply(syntaxMatcher{formScope: scope}, form)
+}
+
+// apply matches form against each rule in turn using m, which describes the
+// environment of the macro use, and returns the expansion of the first rule
+// that matches.
+func (r *syntaxRules) apply(m syntaxMatcher, form *Pair) (Value, bool) {
+	m.syntax, m.ellipsis, m.literals = r, r.ellipsis, r.literals
+	m.ruleScope, m.lexical, m.pos = r.scope, r.lexical, form.pos
 	for i := range r.rules {
 		m.rule = &r.rules[i]
 		if v, ok := m.match(form); ok {
@@ -21,274 +33,637 @@ func (r *syntaxRules) match(form *Pair, scope *scope) (Value, bool) {
 	return nil, false
 }
 
+// expand expands a use of the macro. It is an error if no rule matches the
+// use.
+func (r *syntaxRules) expand(form *Pair, scope *scope) Value {
+	if v, ok := r.match(form, scope); ok {
+		return v
+	}
+	panic(NewError("no syntax rule matches the macro use", form))
+}
+
 type syntaxRule struct {
 	pattern  *Pair
 	template Value
 }
 
 type syntaxMatcher struct {
+	syntax    *syntaxRules
+	ellipsis  Symbol
 	literals  map[Symbol]*scope
 	ruleScope *scope
+	lexical   *lexicalScope
 	formScope *scope
 	rule      *syntaxRule
+
+	// expander is the expander that is expanding the macro use, if any, and
+	// formEnv is the syntactic environment of the use. Literals are matched
+	// by the expander rather than by the runtime scope of the use.
+	expander *expander
+	formEnv  *syntacticEnv
+
+	// renames maps each symbol or identifier in the template to the identifier
+	// that replaces it in the expansion.
+	renames map[Value]*identifier
+
+	// pos is the source position of the form being matched. Pairs emitted by
+	// the template are attributed to this position.
+	pos *Position
 }
 
-func (m *syntaxMatcher) match(form *Pair) (Value, bool) {
-	// ignore the first element of the pattern and the form
-	pattern, _ := m.rule.pattern.cdr.(*Pair)
-	form, _ = form.cdr.(*Pair)
+// patternBindings maps each pattern variable to the form that it matched. A
+// variable that occurs within n ellipses in its pattern is bound to a sequence
+// with n levels of nesting.
+type patternBindings map[Symbol]interface{}
 
-	// create a new scope for the pattern's bindings
-	bindings := &scope{env: map[Symbol]Value{}}
+// A sequence holds the matches of a pattern variable for each form that was
+// matched by a subpattern followed by an ellipsis.
+type sequence []interface{}
 
-	if pattern == nil {
-		if form != nil {
-			return nil, false
-		}
-	} else {
-		if !m.matchPattern(pattern, form, bindings) {
-			return nil, false
-		}
+func (m *syntaxMatcher) match(form *Pair) (Value, bool) {
+	// ignore the first element of the pattern and the form
+	bindings := patternBindings{}
+	if !m.matchPattern(m.rule.pattern.cdr, form.cdr, bindings) {
+		return nil, false
 	}
 
 	// emit the template
+	m.renames = map[Value]*identifier{}
 	return m.emitTemplate(m.rule.template, bindings), true
 }
 
-func (m *syntaxMatcher) emitTemplate(template Value, bindings *scope) Value {
-	if template == nil {
-		return nil
+// aliases is the number of aliases that have been created by expansions.
+var aliases uint64
+
+// rename returns the identifier that replaces the template symbol name in the
+// current expansion. If the symbol was itself inserted by a macro, outer is the
+// identifier that inserted it. Every occurrence of a symbol in a template is
+// replaced by the same identifier.
+func (m *syntaxMatcher) rename(name Symbol, outer *identifier) *identifier {
+	var key Value = name
+	if outer != nil {
+		key = outer
+	}
+	if id, ok := m.renames[key]; ok {
+		return id
 	}
 
-	switch t := template.(type) {
-	case Symbol:
-		if where, ok := m.literals[t]; ok {
-			if where != nil {
-				return &binding{where: where, name: t}
+	id := &identifier{name: name, alias: newAlias(name), outer: outer, scope: m.ruleScope, lexical: m.lexical, env: m.syntax.env}
+	m.renames[key] = id
+	return id
+}
+
+// newAlias returns a new alias for name that is distinct from every other
+// alias.
+func newAlias(name Symbol) Symbol {
+	return Symbol(fmt.Sprintf("%v#%d", name, atomic.AddUint64(&aliases, 1)))
+}
+
+// isEllipsis returns true if v is the ellipsis identifier of the rules. An
+// ellipsis that is listed among the literals is matched as a literal.
+func (m *syntaxMatcher) isEllipsis(v Value) bool {
+	sym, ok := symbolName(v)
+	if !ok || sym != m.ellipsis {
+		return false
+	}
+	_, isLiteral := m.literals[sym]
+	return !isLiteral
+}
+
+// patternVariable returns the name under which the pattern variable v is bound.
+// The second result is false if v is not a pattern variable.
+func (m *syntaxMatcher) patternVariable(v Value) (Symbol, bool) {
+	sym, ok := symbolName(v)
+	if !ok || sym == "_" || m.isEllipsis(v) {
+		return "", false
+	}
+	if _, isLiteral := m.literals[sym]; isLiteral {
+		return "", false
+	}
+	return variableName(v)
+}
+
+// patternVariables appends the names of the pattern variables in pattern to
+// names.
+func (m *syntaxMatcher) patternVariables(pattern Value, names []Symbol) []Symbol {
+	switch p := pattern.(type) {
+	case *Pair:
+		for {
+			names = m.patternVariables(p.car, names)
+			next, ok := p.cdr.(*Pair)
+			if !ok {
+				return m.patternVariables(p.cdr, names)
 			}
-			return t
+			p = next
 		}
-
-		if v, ok := bindings.lookup(t); ok {
-			return v
+	case Vector:
+		for _, e := range p {
+			names = m.patternVariables(e, names)
 		}
-		return t
+		return names
+	default:
+		if name, ok := m.patternVariable(p); ok {
+			names = append(names, name)
+		}
+		return names
+	}
+}
+
+// checkRule panics if the template of a rule uses the ellipses that follow its
+// subtemplates inconsistently with its pattern. A subtemplate followed by n
+// ellipses must contain a pattern variable that is followed by at least n
+// ellipses in the pattern, and a pattern variable may only occur in a
+// subtemplate followed by at least as many ellipses as follow it in the
+// pattern.
+func (m *syntaxMatcher) checkRule(pattern *Pair, template Value) {
+	depths := map[Symbol]int{}
+	m.patternDepths(pattern.cdr, 0, depths)
+	m.checkTemplate(template, 0, depths)
+}
+
+// patternDepths records the number of ellipses that follow each pattern
+// variable in pattern, which is itself followed by depth ellipses.
+func (m *syntaxMatcher) patternDepths(pattern Value, depth int, depths map[Symbol]int) {
+	switch p := pattern.(type) {
 	case *Pair:
-		var head, tail *Pair
 		for {
-			// check for an ellipsis
-			next, more := t.cdr.(*Pair)
-			if more && next.car == Symbol("...") {
-				sym, ok := t.car.(Symbol)
-				if ok {
-					// emit the matches
-					matches, _ := bindings.lookup(sym)
-					for _, m := range matches.(Vector) {
-						p := &Pair{car: m}
-						if head == nil {
-							head, tail = p, p
-						} else {
-							tail.cdr, tail = p, p
-						}
-					}
-				}
-				t = next
-				next, more = next.cdr.(*Pair)
-			} else {
-				p := &Pair{car: m.emitTemplate(t.car, bindings)}
-				if head == nil {
-					head, tail = p, p
-				} else {
-					tail.cdr, tail = p, p
-				}
+			element, d := p.car, depth
+			if next, ok := p.cdr.(*Pair); ok && m.isEllipsis(next.car) {
+				d, p = depth+1, next
 			}
+			m.patternDepths(element, d, depths)
 
-			if more {
-				t = next
-				continue
+			next, ok := p.cdr.(*Pair)
+			if !ok {
+				m.patternDepths(p.cdr, depth, depths)
+				return
 			}
+			p = next
+		}
+	case Vector:
+		m.patternDepths(p.ToList(), depth, depths)
+	default:
+		if name, ok := m.patternVariable(p); ok {
+			depths[name] = depth
+		}
+	}
+}
+
+// checkTemplate checks a subtemplate that is followed by depth ellipses.
+func (m *syntaxMatcher) checkTemplate(template Value, depth int, depths map[Symbol]int) {
+	switch t := template.(type) {
+	case Symbol, *identifier:
+		name, _ := variableName(t)
+		if d, ok := depths[name]; ok && d > depth {
+			sym, _ := symbolName(t)
+			panic(NewError("pattern variable is used without an ellipsis", sym))
+		}
+	case *Pair:
+		if m.isEllipsis(t.car) {
+			if rest, ok := t.cdr.(*Pair); ok && rest.cdr == nil {
+				escaped := *m
+				escaped.ellipsis = ""
+				escaped.checkTemplate(rest.car, depth, depths)
+				return
+			}
+		}
 
-			if t.cdr != nil {
-				tail.cdr = m.emitTemplate(t.cdr, bindings)
+		var template Value = t
+		for {
+			t, ok := template.(*Pair)
+			if !ok {
+				break
 			}
 
-			if sym, ok := head.car.(Symbol); ok {
-				if syntax, ok := m.ruleScope.lookupKeyword(sym); ok {
-					if v, ok := syntax.match(head, m.ruleScope); ok {
-						return v
+			n, next := 0, t.cdr
+			for {
+				p, ok := next.(*Pair)
+				if !ok || !m.isEllipsis(p.car) {
+					break
+				}
+				n, next = n+1, p.cdr
+			}
+			if n != 0 {
+				repeated := false
+				for _, name := range m.patternVariables(t.car, nil) {
+					if depths[name] >= depth+n {
+						repeated = true
 					}
 				}
+				if !repeated {
+					panic("a template followed by an ellipsis must contain a pattern variable that is followed by an ellipsis in the pattern")
+				}
 			}
+			m.checkTemplate(t.car, depth+n, depths)
 
-			return head
+			template = next
 		}
+		m.checkTemplate(template, depth, depths)
 	case Vector:
-		var result Vector
-		for len(t) > 0 {
-			// check for an ellipsis
-			if len(t) > 1 && t[1] == Symbol("...") {
-				ellipsis := t[0]
-				t = t[2:]
-
-				sym, ok := ellipsis.(Symbol)
-				if ok {
-					matches, _ := bindings.lookup(sym)
-					result = append(result, matches.(Vector)...)
-				}
-			} else {
-				result = append(result, m.emitTemplate(t[0], bindings))
-				t = t[1:]
+		m.checkTemplate(t.ToList(), depth, depths)
+	}
+}
+
+func (m *syntaxMatcher) emitTemplate(template Value, bindings patternBindings) Value {
+	switch t := template.(type) {
+	case Symbol, *identifier:
+		name, _ := variableName(t)
+		if v, ok := bindings[name]; ok {
+			if _, ok := v.(sequence); ok {
+				sym, _ := symbolName(t)
+				panic(NewError("pattern variable is used without an ellipsis", sym))
 			}
+			value, _ := v.(Value)
+			return value
 		}
-		return result
+		if id, ok := t.(*identifier); ok {
+			return m.rename(id.name, id)
+		}
+		return m.rename(t.(Symbol), nil)
+	case *Pair:
+		// (⟨ellipsis⟩ ⟨template⟩) is identical to ⟨template⟩, except that
+		// ellipses within the template have no special meaning
+		if m.isEllipsis(t.car) {
+			if rest, ok := t.cdr.(*Pair); ok && rest.cdr == nil {
+				escaped := *m
+				escaped.ellipsis = ""
+				return escaped.emitTemplate(rest.car, bindings)
+			}
+		}
+		return m.emitList(t, bindings)
+	case Vector:
+		elements, _ := m.emitList(t.ToList(), bindings).(*Pair)
+		return append(Vector{}, elements.ToVector()...)
 	default:
 		return t
 	}
 }
 
-func (m *syntaxMatcher) matchPattern(pattern, form Value, bindings *scope) bool {
+// emitList emits a list template. Each element of the template may be followed
+// by one or more ellipses, in which case the element is emitted once for each
+// match of the pattern variables that it contains.
+func (m *syntaxMatcher) emitList(template Value, bindings patternBindings) Value {
+	var head, tail *Pair
+	for {
+		t, ok := template.(*Pair)
+		if !ok {
+			break
+		}
+
+		// count the ellipses that follow the element
+		depth, next := 0, t.cdr
+		for {
+			p, ok := next.(*Pair)
+			if !ok || !m.isEllipsis(p.car) {
+				break
+			}
+			depth, next = depth+1, p.cdr
+		}
+
+		elements := []Value{nil}
+		if depth == 0 {
+			elements[0] = m.emitTemplate(t.car, bindings)
+		} else {
+			elements = m.emitRepeated(t.car, depth, bindings)
+		}
+		for _, e := range elements {
+			p := &Pair{car: e, pos: m.pos}
+			if head == nil {
+				head, tail = p, p
+			} else {
+				tail.cdr, tail = p, p
+			}
+		}
+
+		template = next
+	}
+
+	rest := m.emitTemplate(template, bindings)
+	if head == nil {
+		return rest
+	}
+	tail.cdr = rest
+
+	// quoted data is not renamed
+	if sym, _ := symbolName(head.car); sym == "quote" {
+		unwrapSyntax(head.cdr)
+	}
+
+	// recursive uses of the macro are expanded in place, each as a separate
+	// expansion. The expander expands them when it expands the result.
+	if m.expander != nil {
+		return head
+	}
+	if syntax, ok := lookupSyntax(m.formScope, head.car); ok && syntax == m.syntax {
+		if v, ok := syntax.match(head, m.formScope); ok {
+			return v
+		}
+	}
+
+	return head
+}
+
+// emitRepeated emits a template that is followed by depth ellipses. The
+// template is emitted once for each element of the sequences bound to the
+// pattern variables that it contains, which must all have the same length.
+func (m *syntaxMatcher) emitRepeated(template Value, depth int, bindings patternBindings) []Value {
+	var names []Symbol
+	for _, name := range m.patternVariables(template, nil) {
+		if _, ok := bindings[name].(sequence); ok && !containsSymbol(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		panic("a template followed by an ellipsis must contain a pattern variable that is followed by an ellipsis in the pattern")
+	}
+
+	n := len(bindings[names[0]].(sequence))
+	for _, name := range names[1:] {
+		if len(bindings[name].(sequence)) != n {
+			panic(NewError("pattern variables followed by the same ellipsis matched different numbers of forms", names[0], name))
+		}
+	}
+
+	var result []Value
+	for i := 0; i < n; i++ {
+		iteration := make(patternBindings, len(bindings))
+		for name, v := range bindings {
+			iteration[name] = v
+		}
+		for _, name := range names {
+			iteration[name] = bindings[name].(sequence)[i]
+		}
+
+		if depth == 1 {
+			result = append(result, m.emitTemplate(template, iteration))
+		} else {
+			result = append(result, m.emitRepeated(template, depth-1, iteration)...)
+		}
+	}
+	return result
+}
+
+func (m *syntaxMatcher) matchPattern(pattern, form Value, bindings patternBindings) bool {
 	if pattern == nil {
 		return form == nil
 	}
 
 	switch p := pattern.(type) {
-	case Symbol:
-		if p == "_" {
-			return true
+	case Symbol, *identifier:
+		sym, _ := symbolName(p)
+		if where, ok := m.literals[sym]; ok {
+			return m.matchLiteral(sym, where, form)
 		}
-		if where, ok := m.literals[p]; ok {
-			form, ok := form.(Symbol)
-			return ok && p == form && m.formScope.where(form) == where
+		if name, ok := m.patternVariable(p); ok {
+			bindings[name] = form
 		}
-		bindings.set(p, form)
 		return true
 	case *Pair:
-		form, ok := form.(*Pair)
+		var elements []Value
+		var tail Value = p
+		for {
+			p, ok := tail.(*Pair)
+			if !ok {
+				break
+			}
+			elements, tail = append(elements, p.car), p.cdr
+		}
+		return m.matchList(elements, tail, form, bindings)
+	case Vector:
+		form, ok := form.(Vector)
 		if !ok {
 			return false
 		}
+		return m.matchList(p, nil, form.ToList(), bindings)
+	default:
+		return equal(p, form, map[Value]struct{}{})
+	}
+}
 
-		scope := bindings.push()
-		for {
-			// check for an ellipsis
-			next, more := p.cdr.(*Pair)
-			matchedEllipsis := false
-			if more && next.car == Symbol("...") {
-				ellipsis := p.car
-
-				// determine how many matches we need
-				matches := form.len() - next.len() + 1
-				if matches < 0 {
-					return false
-				}
-
-				var matched Vector
-				if matches > 0 {
-					for {
-						if !m.matchPattern(ellipsis, form.car, scope) {
-							return false
-						}
-						matched = append(matched, form.car)
-
-						matches--
-						if matches == 0 {
-							break
-						}
-						form, _ = form.cdr.(*Pair)
-					}
-				}
-
-				if sym, ok := ellipsis.(Symbol); ok {
-					if _, ok := m.literals[sym]; !ok {
-						scope.set(sym, matched)
-					}
-				}
-
-				p, matchedEllipsis = next, true
-				next, more = next.cdr.(*Pair)
-			} else if form == nil || !m.matchPattern(p.car, form.car, scope) {
+// matchList matches a list pattern of the form
+//
+//	(⟨pattern⟩ ... ⟨pattern⟩ ⟨ellipsis⟩ ⟨pattern⟩ ... . ⟨pattern⟩)
+//
+// whose elements and final cdr are given. At most one element may be followed
+// by an ellipsis. That element matches as many elements of the form as
+// possible, leaving enough elements to match the elements that follow it; the
+// final cdr of the pattern matches the remainder of the form.
+func (m *syntaxMatcher) matchList(elements []Value, tail, form Value, bindings patternBindings) bool {
+	matchElements := func(elements []Value) bool {
+		for _, e := range elements {
+			p, ok := form.(*Pair)
+			if !ok || !m.matchPattern(e, p.car, bindings) {
 				return false
 			}
+			form = p.cdr
+		}
+		return true
+	}
 
-			if more {
-				nextForm, ok := form.cdr.(*Pair)
-				if !ok && nextForm != nil {
-					return false
-				}
-				p, form = next, nextForm
-				continue
-			}
+	ellipsis := -1
+	for i := 1; i < len(elements); i++ {
+		if m.isEllipsis(elements[i]) {
+			ellipsis = i - 1
+			break
+		}
+	}
+	if ellipsis == -1 {
+		return matchElements(elements) && m.matchPattern(tail, form, bindings)
+	}
 
-			if form == nil {
-				if !matchedEllipsis && p.cdr == nil {
-					return false
-				}
-			} else if !m.matchPattern(p.cdr, form.cdr, scope) {
-				return false
-			}
+	before, repeated, after := elements[:ellipsis], elements[ellipsis], elements[ellipsis+2:]
+	if !matchElements(before) {
+		return false
+	}
 
-			// copy out this pattern's bindings.
-			for k, v := range scope.env {
-				bindings.env[k] = v
-			}
-			return true
-		}
-	case Vector:
-		form, ok := form.(Vector)
-		if !ok {
+	length := 0
+	for f, ok := form.(*Pair); ok; f, ok = f.cdr.(*Pair) {
+		length++
+	}
+	if length < len(after) {
+		return false
+	}
+
+	matches := make([]patternBindings, length-len(after))
+	for i := range matches {
+		p := form.(*Pair)
+		matches[i] = patternBindings{}
+		if !m.matchPattern(repeated, p.car, matches[i]) {
 			return false
 		}
+		form = p.cdr
+	}
+	for _, name := range m.patternVariables(repeated, nil) {
+		s := make(sequence, len(matches))
+		for i, match := range matches {
+			s[i] = match[name]
+		}
+		bindings[name] = s
+	}
 
-		scope := bindings.push()
-		for {
-			if len(p) == 0 {
-				if len(form) != 0 {
-					return false
-				}
+	return matchElements(after) && m.matchPattern(tail, form, bindings)
+}
 
-				// copy out this pattern's bindings.
-				for k, v := range scope.env {
-					bindings.env[k] = v
-				}
-				return true
+// matchLiteral returns true if form matches the literal identifier p, which is
+// bound in where: form must be an identifier with the same name that refers to
+// the same binding.
+func (m *syntaxMatcher) matchLiteral(p Symbol, where *scope, form Value) bool {
+	if m.expander != nil {
+		return m.expander.sameBinding(form, m.formEnv, p, m.syntax.env)
+	}
+
+	switch form := form.(type) {
+	case Symbol:
+		return form == p && m.formScope.where(form) == where
+	case *identifier:
+		s, name := form.resolve(m.formScope)
+		return form.name == p && s.where(name) == where
+	default:
+		return false
+	}
+}
+
+// resolve returns the scope in which the identifier is looked up when it is
+// referenced from s and the name under which it is bound in that scope. An
+// identifier that is bound by the expansion that inserted it refers to that
+// binding; otherwise it refers to the binding of its symbol in the scope of
+// the macro definition.
+func (id *identifier) resolve(s *scope) (*scope, Symbol) {
+	for {
+		if s.bound(id.alias) {
+			return s, id.alias
+		}
+		if id.outer == nil {
+			return id.scope, id.name
+		}
+		s, id = id.scope, id.outer
+	}
+}
+
+// lookupSyntax returns the keyword that the symbol or identifier v names in s.
+func lookupSyntax(s *scope, v Value) (*syntaxRules, bool) {
+	switch v := v.(type) {
+	case Symbol:
+		return s.lookupKeyword(v)
+	case *identifier:
+		for id := v; ; id = id.outer {
+			if syntax, ok := s.lookupKeyword(id.alias); ok {
+				return syntax, true
+			}
+			if id.outer == nil {
+				return id.scope.lookupKeyword(id.name)
 			}
+			s = id.scope
+		}
+	default:
+		return nil, false
+	}
+}
 
-			// check for an ellipsis
-			if len(p) > 1 && p[1] == Symbol("...") {
-				ellipsis := p[0]
-				p = p[2:]
+// variableName returns the name under which a binding form binds the symbol
+// or identifier v. The second result is false if v is neither.
+func variableName(v Value) (Symbol, bool) {
+	switch v := v.(type) {
+	case Symbol:
+		return v, true
+	case *identifier:
+		return v.alias, true
+	default:
+		return "", false
+	}
+}
 
-				// determine how many matches we need
-				matches := len(form) - len(p)
-				if matches < 0 {
-					return false
-				}
+// symbolName returns the symbol that was written for the symbol or identifier
+// v. Syntactic keywords and auxiliary syntax such as else and => are
+// recognized by their symbols. The second result is false if v is neither a
+// symbol nor an identifier.
+func symbolName(v Value) (Symbol, bool) {
+	switch v := v.(type) {
+	case Symbol:
+		return v, true
+	case *identifier:
+		return v.name, true
+	default:
+		return "", false
+	}
+}
 
-				matched := form[:matches]
-				for _, form := range matched {
-					if !m.matchPattern(ellipsis, form, scope) {
-						return false
-					}
-				}
+// unwrapIdentifier returns the symbol of v if v is an identifier and v
+// otherwise.
+func unwrapIdentifier(v Value) Value {
+	if id, ok := v.(*identifier); ok {
+		return id.name
+	}
+	return v
+}
 
-				if sym, ok := ellipsis.(Symbol); ok {
-					if _, ok := m.literals[sym]; !ok {
-						scope.set(sym, matched)
-					}
-				}
+// unwrapSyntax replaces each identifier within the datum v with its symbol.
+// Pairs and vectors are updated in place.
+func unwrapSyntax(v Value) Value {
+	unwrapDatum(v, map[interface{}]bool{})
+	return unwrapIdentifier(v)
+}
 
-				form = form[matches:]
-				continue
+func unwrapDatum(v Value, seen map[interface{}]bool) {
+	switch v := v.(type) {
+	case *Pair:
+		for p := v; !seen[p]; {
+			seen[p] = true
+			if id, ok := p.car.(*identifier); ok {
+				p.car = id.name
+			} else {
+				unwrapDatum(p.car, seen)
 			}
 
-			if len(form) == 0 || !m.matchPattern(p[0], form[0], scope) {
-				return false
+			next, ok := p.cdr.(*Pair)
+			if !ok {
+				if id, ok := p.cdr.(*identifier); ok {
+					p.cdr = id.name
+				} else {
+					unwrapDatum(p.cdr, seen)
+				}
+				return
 			}
+			p = next
+		}
+	case Vector:
+		if len(v) == 0 || seen[&v[0]] {
+			return
+		}
+		seen[&v[0]] = true
+		for i, e := range v {
+			if id, ok := e.(*identifier); ok {
+				v[i] = id.name
+			} else {
+				unwrapDatum(e, seen)
+			}
+		}
+	}
+}
 
-			p, form = p[1:], form[1:]
+// MacroExpand repeatedly expands form while it is a macro use: a list whose
+// operator is a keyword defined in the environment and whose shape matches one
+// of the keyword's rules. The subforms of the result are not expanded.
+func (e *Env) MacroExpand(form Value) (v Value, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			v, err = nil, toError(x)
 		}
+	}()
 
-	default:
-		return equal(p, form, map[Value]struct{}{})
+	for {
+		p, ok := form.(*Pair)
+		if !ok {
+			return form, nil
+		}
+		syntax, ok := lookupSyntax(e.globals, p.car)
+		if !ok {
+			return form, nil
+		}
+		expansion, ok := syntax.match(p, e.globals)
+		if !ok {
+			return form, nil
+		}
+		form = expansion
 	}
 }
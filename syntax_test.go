@@ -1,6 +1,8 @@
 package loom
 
 import (
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -104,3 +106,307 @@ func TestSyntaxRules(t *testing.T) {
 		assert.Equal(t, "(if (> 3 2) (begin (quote greater)) (if (< 3 2) (begin (quote less))))", EncodeToString(v))
 	}
 }
+
+func TestMacroExpand(t *testing.T) {
+	env := NewEnv()
+	_, err := env.EvalAll(strings.NewReader(`
+		(define-syntax swap!
+			(syntax-rules ()
+				((_ a b) (my-let tmp a (set! a b) (set! b tmp)))))
+		(define-syntax my-let
+			(syntax-rules ()
+				((_ name value body ...) ((lambda (name) body ...) value))))`))
+	require.NoError(t, err)
+
+	cases := []struct{ form, expansion string }{
+		{`(swap! x y)`, `((lambda (tmp) (set! x y) (set! y tmp)) x)`},
+		{`(my-let a 1 (swap! a b))`, `((lambda (a) (swap! a b)) 1)`},
+		{`(swap! x)`, `(swap! x)`},
+		{`(f x)`, `(f x)`},
+		{`42`, `42`},
+	}
+	for _, c := range cases {
+		form, err := ParseString(c.form)
+		require.NoError(t, err)
+		v, err := env.MacroExpand(form)
+		require.NoError(t, err)
+		assert.Equal(t, c.expansion, EncodeToString(v))
+	}
+}
+
+func TestExpand(t *testing.T) {
+	env := NewEnv()
+	_, err := env.EvalAll(strings.NewReader(`
+		(define-syntax swap!
+			(syntax-rules ()
+				((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))`))
+	require.NoError(t, err)
+
+	cases := []struct{ form, expansion string }{
+		{`(let ((x 1) (y 2)) (+ x y))`, `((lambda (x y) (+ x y)) 1 2)`},
+		{`(and a b c)`, `(if a (if b c #f) #f)`},
+		{`(and)`, `#t`},
+		{`(or a b)`, `(if a a b)`},
+		{`(cond ((f x) 1) (else 2))`, `(if (f x) 1 2)`},
+		{`(let* ((x 1) (y x)) y)`, `((lambda (x) ((lambda (y) y) x)) 1)`},
+		{`(when a b c)`, `(if a (begin b c))`},
+		{`(receive (q . r) (f x) r)`, `(call-with-values (lambda () (f x)) (lambda (q . r) r))`},
+		{`(when-not-a-macro (and x y))`, `(when-not-a-macro (if x y #f))`},
+		{`(swap! x y)`, `((lambda (tmp#) (set! x y) (set! y tmp#)) x)`},
+		{`(let ((tmp 1) (y 2)) (swap! tmp y))`, `((lambda (tmp y) ((lambda (tmp#) (set! tmp y) (set! y tmp#)) tmp)) 1 2)`},
+		{`(define (f x) (and x 'y))`, `(define (f x) (if x (quote y) #f))`},
+		{`(let-syntax ((m (syntax-rules () ((_) 42)))) (m))`, `((lambda () 42))`},
+		{`'(and a b)`, `(quote (and a b))`},
+	}
+	for _, c := range cases {
+		form, err := ParseString(c.form)
+		require.NoError(t, err)
+		v, err := Expand(env, form)
+		require.NoError(t, err)
+		assert.Equal(t, c.expansion, aliasPattern.ReplaceAllString(EncodeToString(v), "#"))
+	}
+
+	t.Run("define-syntax", func(t *testing.T) {
+		env := NewEnv()
+		form, err := ParseString(`(define-syntax ten (syntax-rules () ((_) 10)))`)
+		require.NoError(t, err)
+		_, err = Expand(env, form)
+		require.NoError(t, err)
+
+		form, err = ParseString(`(ten)`)
+		require.NoError(t, err)
+		v, err := Expand(env, form)
+		require.NoError(t, err)
+		assert.Equal(t, "10", EncodeToString(v))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		form, err := ParseString(`(swap! x)`)
+		require.NoError(t, err)
+		_, err = Expand(env, form)
+		assert.Error(t, err)
+	})
+
+	exprs := []struct{ name, expr, expected string }{
+		{"macroexpand", `(macroexpand '(let ((x 1)) (or x 2)))`, "'((lambda (x) (if x x 2)) 1)"},
+		{"macroexpand-1", `(begin
+			(define-syntax my-if (syntax-rules () ((_ c a b) (cond (c a) (else b)))))
+			(macroexpand-1 '(my-if x 1 2)))`, "'(cond (x 1) (else 2))"},
+		{"macroexpand-1 not a macro use", `(macroexpand-1 '(f x))`, "'(f x)"},
+		{"macroexpand-1 let*", `(macroexpand-1 '(let* ((a 1) (b a)) b))`, "'(let ((a 1)) (let* ((b a)) b))"},
+		{"macroexpand-1 when", `(macroexpand-1 '(when a b))`, "'(if a b)"},
+		{"macroexpand-1 named let", `(macroexpand-1 '(let loop ((i 0)) (loop i)))`, "'((letrec ((loop (lambda (i) (loop i)))) loop) 0)"},
+		{"macroexpand case", `(macroexpand '(case x ((1 2) 'a) (else 'b)))`, "'(if (memv x (quote (1 2))) (quote a) (quote b))"},
+		{"macroexpand quasiquote", "(macroexpand '`(a ,b ,@c))", "'(cons (quote a) (cons b (append c (quote ()))))"},
+		{"macroexpand let-values", `(macroexpand '(let-values (((a b) (f))) (+ a b)))`, "'(call-with-values (lambda () (f)) (lambda (a b) (+ a b)))"},
+		{"macroexpand case-lambda", `(macroexpand '(case-lambda ((x) x) ((x y) y)))`, "'(make-case-lambda (lambda (x) x) (lambda (x y) y))"},
+		{"macroexpand guard", `(macroexpand '(guard (e (#t e)) (f)))`, "'(call-with-guard (lambda () (f)) (lambda (e) (if #t e guard-no-match)))"},
+	}
+	for _, c := range exprs {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+}
+
+// aliasPattern matches the unique suffix of an alias.
+var aliasPattern = regexp.MustCompile(`#[0-9]+`)
+
+func TestHygiene(t *testing.T) {
+	const swap = `(define-syntax swap!
+		(syntax-rules ()
+			((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))`
+	const myOr = `(define-syntax my-or
+		(syntax-rules ()
+			((_) #f)
+			((_ e) e)
+			((_ e r ...) (let ((t e)) (if t t (my-or r ...))))))`
+
+	cases := []struct{ name, expr, expected string }{
+		{"swap! tmp", `((lambda () ` + swap + ` (define tmp 1) (define other 2) (swap! tmp other) (list tmp other)))`, "'(2 1)"},
+		{"swap! global tmp", `(begin ` + swap + ` (define tmp 1) (define other 2) (swap! other tmp) (list tmp other))`, "'(2 1)"},
+		{"my-or t", `((lambda () ` + myOr + ` (define t 5) (my-or #f t)))`, "5"},
+		{"my-or temp", `((lambda () ` + myOr + ` (define t #f) (define u 7) (my-or t u)))`, "7"},
+		{"free identifier", `(begin
+			(define-syntax first (syntax-rules () ((_ l) (car l))))
+			(let ((car cdr)) (first '(1 2))))`, "1"},
+		{"definition scope", `(let ((x 1))
+			(define-syntax get-x (syntax-rules () ((_) x)))
+			(let ((x 2)) (get-x)))`, "1"},
+		{"set! free identifier", `(begin
+			(define counter 0)
+			(define-syntax inc! (syntax-rules () ((_) (set! counter (+ counter 1)))))
+			(list (let ((counter 10)) (inc!) counter) counter))`, "'(10 1)"},
+		{"shadowed memv", `(let ((memv (lambda args #f))) (case 1 ((1) 'one) (else 'other)))`, "'one"},
+		{"shadowed cons", "(let ((cons list) (append list)) `(1 ,@(list 2) 3))", "'(1 2 3)"},
+		{"shadowed call-with-values", `(let ((call-with-values #f)) (let-values (((a b) (values 1 2))) (+ a b)))`, "3"},
+		{"shadowed make-case-lambda", `(let ((make-case-lambda #f)) ((case-lambda ((x) x) ((x y) y)) 1 2))`, "2"},
+		{"quoted symbols", "(begin (define-syntax q (syntax-rules () ((_ x) (list 'tmp `(tmp ,x) (case 'a ((a) 'is-a)))))) (q 1))", "'(tmp (tmp 1) is-a)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	for _, b := range backends {
+		t.Run("nested/"+b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			v, err := env.EvalAll(strings.NewReader(`
+				(define-syntax def-getter
+					(syntax-rules ()
+						((_ name) (begin
+							(define tmp 42)
+							(define-syntax name (syntax-rules () ((_) tmp)))))))
+				(def-getter get)
+				(define tmp 0)
+				(list (get) tmp)`))
+			require.NoError(t, err)
+			assert.Equal(t, "(42 0)", EncodeToString(v))
+		})
+	}
+}
+
+func TestEllipsis(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"nested pattern", `(begin
+			(define-syntax my-let
+				(syntax-rules ()
+					((_ ((name val) ...) body1 body2 ...) ((lambda (name ...) body1 body2 ...) val ...))))
+			(my-let ((a 1) (b 2)) (+ a b)))`, "3"},
+		{"depth 2", `(begin
+			(define-syntax rotate
+				(syntax-rules ()
+					((_ (x y ...) ...) '((y ... x) ...))))
+			(rotate (1 2 3) (4 5) (6)))`, "'((2 3 1) (5 4) (6))"},
+		{"flatten", `(begin
+			(define-syntax flatten (syntax-rules () ((_ (a ...) ...) '(a ... ...))))
+			(flatten (1 2) (3) ()))`, "'(1 2 3)"},
+		{"constant in ellipsis", `(begin
+			(define-syntax tag (syntax-rules () ((_ t x ...) '((t x) ...))))
+			(tag k 1 2))`, "'((k 1) (k 2))"},
+		{"tail pattern", `(begin
+			(define-syntax last (syntax-rules () ((_ a ... b) 'b)))
+			(list (last 1) (last 1 2 3)))`, "'(1 3)"},
+		{"dotted tail pattern", `(begin
+			(define-syntax rest (syntax-rules () ((_ a b ... . r) '(r b ...))))
+			(rest 1 2 3 . 4))`, "'(4 2 3)"},
+		{"vector pattern", `(begin
+			(define-syntax v (syntax-rules () ((_ #(a ... b)) '#(b a ...))))
+			(let ((x (v #(1 2 3)))) (list (vector-ref x 0) (vector-ref x 2))))`, "'(3 2)"},
+		{"escaped ellipsis", `(begin
+			(define-syntax e (syntax-rules () ((_ x) '(x (... ...)))))
+			(e 1))`, "'(1 ...)"},
+		{"custom ellipsis", `(begin
+			(define-syntax my-list (syntax-rules ::: () ((_ x :::) (list x :::))))
+			(my-list 1 2 3))`, "'(1 2 3)"},
+		{"custom ellipsis variable", `(begin
+			(define-syntax m (syntax-rules ::: () ((_ a ...) '(... a))))
+			(m 1 2))`, "'(2 1)"},
+		{"ellipsis literal", `(begin
+			(define-syntax m (syntax-rules (...) ((_ a ...) 'a)))
+			(m 1 ...))`, "1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			v, err := env.EvalAll(strings.NewReader(`
+				(define-syntax be-like-begin
+					(syntax-rules ()
+						((be-like-begin name)
+							(define-syntax name
+								(syntax-rules ()
+									((name expr (... ...))
+										(begin expr (... ...))))))))
+				(be-like-begin sequence)
+				(sequence 1 2 3 4)`))
+			require.NoError(t, err)
+			assert.Equal(t, "4", EncodeToString(v))
+
+			_, err = env.EvalAll(strings.NewReader(`
+				(define-syntax zip (syntax-rules () ((_ (a ...) (b ...)) '((a b) ...))))
+				(zip (1 2) (3))`))
+			assert.Error(t, err)
+
+			// templates that misuse ellipses are rejected when the macro is
+			// defined rather than when it is used
+			definitions := []string{
+				`(define-syntax m (syntax-rules () ((_ a ...) '(1 ...))))`,
+				`(define-syntax m (syntax-rules () ((_ a b ...) '((a b) ... ...))))`,
+				`(define-syntax m (syntax-rules () ((_ a ...) 'a)))`,
+				`(let-syntax ((m (syntax-rules () ((_ a) '(a ...))))) 1)`,
+			}
+			for _, d := range definitions {
+				_, err = env.EvalAll(strings.NewReader(d))
+				assert.Error(t, err, d)
+			}
+		})
+	}
+}
+
+func TestLetSyntax(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"let-syntax", `(let-syntax ((double (syntax-rules () ((_ x) (* x 2))))) (double 21))`, "42"},
+		{"let-syntax scope", `(let ((x 'outer))
+			(let-syntax ((m (syntax-rules () ((m) x))))
+				(let ((x 'inner))
+					(m))))`, "'outer"},
+		{"let-syntax variable named if", `(let-syntax
+				((given-that (syntax-rules ()
+					((_ test stmt1 stmt2 ...) (if test (begin stmt1 stmt2 ...))))))
+			(let ((if #t))
+				(given-that if (set! if 'now))
+				if))`, "'now"},
+		{"let-syntax shadows", `(begin
+			(define-syntax m (syntax-rules () ((_) 'outer)))
+			(list (let-syntax ((m (syntax-rules () ((_) 'inner)))) (m)) (m)))`, "'(inner outer)"},
+		{"let-syntax not recursive", `(begin
+			(define-syntax m (syntax-rules () ((_) 'outer)))
+			(let-syntax ((m (syntax-rules () ((_) 'inner) ((_ x) (m))))) (m 1)))`, "'outer"},
+		{"letrec-syntax", `(letrec-syntax
+				((my-or (syntax-rules ()
+					((my-or) #f)
+					((my-or e) e)
+					((my-or e1 e2 ...)
+						(let ((temp e1))
+							(if temp temp (my-or e2 ...)))))))
+			(let ((x #f) (y 7) (temp 8))
+				(my-or x temp y)))`, "8"},
+		{"letrec-syntax mutual", `(letrec-syntax
+				((ev? (syntax-rules () ((_) #t) ((_ x . r) (od? . r))))
+				 (od? (syntax-rules () ((_) #f) ((_ x . r) (ev? . r)))))
+			(list (ev? 1 2) (od? 1 2 3)))`, "'(#t #t)"},
+		{"let-syntax body definitions", `(let-syntax ((m (syntax-rules () ((_ v) (* v 2)))))
+			(define x (m 2))
+			(+ x 1))`, "5"},
+		{"internal define-syntax", `(begin
+			(define-syntax m (syntax-rules () ((_) 'outer)))
+			(list (let () (define-syntax m (syntax-rules () ((_) 'inner))) (m)) (m)))`, "'(inner outer)"},
+		{"internal define-syntax in lambda", `(begin
+			(define-syntax m (syntax-rules () ((_) 'outer)))
+			(define (f) (define-syntax m (syntax-rules () ((_) 'inner))) (m))
+			(list (f) (m)))`, "'(inner outer)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testExpr(t, c.expr, c.expected)
+		})
+	}
+
+	for _, b := range backends {
+		t.Run("no matching rule/"+b.name, func(t *testing.T) {
+			env := NewEnv().WithBackend(b.backend)
+			_, err := env.EvalAll(strings.NewReader(`
+				(define-syntax two (syntax-rules () ((_ a b) (list a b))))
+				(two 1)`))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "no syntax rule matches the macro use")
+		})
+	}
+}
@@ -2,10 +2,11 @@ package loom
 
 import (
 	"fmt"
-	"io"
+	"math"
 	"math/big"
+	"strconv"
 	"strings"
-	"unicode/utf8"
+	"unicode"
 )
 
 // Value
@@ -17,77 +18,223 @@ type Value interface {
 type SExpression interface {
 	Value
 
-	write(w io.Writer) error
-}
-
-// Encode writes a textual representation of v to w.
-func Encode(w io.Writer, v Value) error {
-	if p, ok := v.(SExpression); ok {
-		return p.write(w)
-	}
-	if v == nil {
-		_, err := w.Write([]byte("()"))
-		return err
-	}
-	return v.MarshalSExp().write(w)
-}
-
-// Encode returns the textual representation of v.
-func EncodeToString(v Value) string {
-	var b strings.Builder
-	Encode(&b, v)
-	return b.String()
+	write(p *printer) error
 }
 
 // Number
+//
+// A Number is an exact integer, an exact rational, or an inexact real. Exact
+// integers that fit in an int64 are represented directly; larger exact integers
+// and exact rationals are represented using math/big. Inexact reals are
+// represented as float64 values. Numbers are immutable.
 type Number struct {
-	f *big.Float
+	kind numberKind
+	i    int64    // fixnum
+	b    *big.Int // bignum
+	r    *big.Rat // ratnum
+	f    float64  // flonum
 }
 
-func (n Number) write(w io.Writer) error {
-	text, err := n.f.MarshalText()
-	if err != nil {
-		return err
-	}
-	_, err = w.Write(text)
-	return err
+type numberKind byte
+
+const (
+	fixnum numberKind = iota // an exact integer that fits in an int64
+	bignum                   // an exact integer that does not fit in an int64
+	ratnum                   // an exact rational that is not an integer
+	flonum                   // an inexact real
+)
+
+func (n Number) write(p *printer) error {
+	return p.writeString(n.String())
 }
 
 func (n Number) MarshalSExp() SExpression {
 	return n
 }
 
+// String returns the external representation of the number in radix 10.
+func (n Number) String() string {
+	return n.Text(10)
+}
+
+// Text returns the external representation of the number in the given radix.
+// Inexact numbers are always represented in radix 10.
+func (n Number) Text(radix int) string {
+	switch n.kind {
+	case bignum:
+		return n.b.Text(radix)
+	case ratnum:
+		return n.r.Num().Text(radix) + "/" + n.r.Denom().Text(radix)
+	case flonum:
+		switch {
+		case math.IsNaN(n.f):
+			return "+nan.0"
+		case math.IsInf(n.f, 1):
+			return "+inf.0"
+		case math.IsInf(n.f, -1):
+			return "-inf.0"
+		}
+		text := strconv.FormatFloat(n.f, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		return text
+	default:
+		return strconv.FormatInt(n.i, radix)
+	}
+}
+
 func NewInt(x int64) Number {
-	var f big.Float
-	f.SetInt64(x)
-	return Number{&f}
+	return Number{kind: fixnum, i: x}
 }
 
 func NewUint(x uint64) Number {
-	var f big.Float
-	f.SetUint64(x)
-	return Number{&f}
+	if x > math.MaxInt64 {
+		var b big.Int
+		return Number{kind: bignum, b: b.SetUint64(x)}
+	}
+	return NewInt(int64(x))
 }
 
 func NewFloat(x float64) Number {
-	var f big.Float
-	f.SetFloat64(x)
-	return Number{&f}
+	return Number{kind: flonum, f: x}
 }
 
+// NewBigInt returns an exact integer with the value of x.
+func NewBigInt(x *big.Int) Number {
+	var b big.Int
+	return normalizeInt(b.Set(x))
+}
+
+// NewRat returns an exact rational with the value of x.
+func NewRat(x *big.Rat) Number {
+	var r big.Rat
+	return normalizeRat(r.Set(x))
+}
+
+// normalizeInt returns the canonical representation of the exact integer x.
+// The number takes ownership of x.
+func normalizeInt(x *big.Int) Number {
+	if x.IsInt64() {
+		return NewInt(x.Int64())
+	}
+	return Number{kind: bignum, b: x}
+}
+
+// normalizeRat returns the canonical representation of the exact rational x.
+// The number takes ownership of x.
+func normalizeRat(x *big.Rat) Number {
+	if x.IsInt() {
+		return normalizeInt(x.Num())
+	}
+	return Number{kind: ratnum, r: x}
+}
+
+// IsExact returns true if the number is exact.
+func (n Number) IsExact() bool {
+	return n.kind != flonum
+}
+
+// IsInteger returns true if the number is an integer.
+func (n Number) IsInteger() bool {
+	switch n.kind {
+	case fixnum, bignum:
+		return true
+	case flonum:
+		return n.f == math.Trunc(n.f) && !math.IsInf(n.f, 0)
+	default:
+		return false
+	}
+}
+
+// Int returns the value of the number as an int64. The second result is true if
+// the number is an integer that can be represented exactly as an int64.
 func (n Number) Int() (int64, bool) {
-	x, acc := n.f.Int64()
-	return x, acc == big.Exact
+	switch n.kind {
+	case fixnum:
+		return n.i, true
+	case flonum:
+		if n.IsInteger() && n.f >= math.MinInt64 && n.f < math.MaxInt64 {
+			return int64(n.f), true
+		}
+		return int64(n.f), false
+	default:
+		f, _ := n.Float64()
+		return int64(f), false
+	}
 }
 
+// Uint returns the value of the number as a uint64. The second result is true if
+// the number is an integer that can be represented exactly as a uint64.
 func (n Number) Uint() (uint64, bool) {
-	x, acc := n.f.Uint64()
-	return x, acc == big.Exact
+	switch n.kind {
+	case fixnum:
+		return uint64(n.i), n.i >= 0
+	case bignum:
+		return n.b.Uint64(), n.b.IsUint64()
+	case flonum:
+		if n.IsInteger() && n.f >= 0 && n.f < math.MaxUint64 {
+			return uint64(n.f), true
+		}
+		return uint64(n.f), false
+	default:
+		f, _ := n.Float64()
+		return uint64(f), false
+	}
 }
 
+// Float64 returns the value of the number as a float64. The second result is
+// true if the value can be represented exactly as a float64.
 func (n Number) Float64() (float64, bool) {
-	x, acc := n.f.Float64()
-	return x, acc == big.Exact
+	switch n.kind {
+	case fixnum:
+		f := float64(n.i)
+		return f, f < math.MaxInt64 && int64(f) == n.i
+	case bignum:
+		f, acc := new(big.Float).SetInt(n.b).Float64()
+		return f, acc == big.Exact
+	case ratnum:
+		return n.r.Float64()
+	default:
+		return n.f, true
+	}
+}
+
+// BigInt returns the value of the number as a *big.Int. The second result is
+// true if the number is an integer.
+func (n Number) BigInt() (*big.Int, bool) {
+	switch n.kind {
+	case fixnum:
+		return big.NewInt(n.i), true
+	case bignum:
+		return new(big.Int).Set(n.b), true
+	case ratnum:
+		return new(big.Int).Quo(n.r.Num(), n.r.Denom()), false
+	default:
+		if math.IsInf(n.f, 0) || math.IsNaN(n.f) {
+			return new(big.Int), false
+		}
+		b, acc := big.NewFloat(n.f).Int(nil)
+		return b, acc == big.Exact
+	}
+}
+
+// Rat returns the value of the number as a *big.Rat. The second result is
+// true if the number is finite.
+func (n Number) Rat() (*big.Rat, bool) {
+	switch n.kind {
+	case fixnum:
+		return new(big.Rat).SetInt64(n.i), true
+	case bignum:
+		return new(big.Rat).SetInt(n.b), true
+	case ratnum:
+		return new(big.Rat).Set(n.r), true
+	default:
+		if math.IsInf(n.f, 0) || math.IsNaN(n.f) {
+			return new(big.Rat), false
+		}
+		return new(big.Rat).SetFloat64(n.f), true
+	}
 }
 
 // Boolean
@@ -97,13 +244,11 @@ func (b Boolean) MarshalSExp() SExpression {
 	return b
 }
 
-func (b Boolean) write(w io.Writer) error {
-	text := "#t"
+func (b Boolean) write(p *printer) error {
 	if !b {
-		text = "#f"
+		return p.writeString("#f")
 	}
-	_, err := w.Write([]byte(text))
-	return err
+	return p.writeString("#t")
 }
 
 // Truthy returns the truth value of v. Any value besides false is considered true.
@@ -112,10 +257,31 @@ func Truthy(v Value) bool {
 	return !ok || bool(b)
 }
 
+// Unspecified is the value of expressions whose value is unspecified, e.g.
+// assignments, definitions, and calls to output procedures. It is distinct from
+// every other value, including the empty list.
+var Unspecified Value = unspecifiedValue{}
+
+type unspecifiedValue struct{}
+
+func (unspecifiedValue) MarshalSExp() SExpression {
+	return Symbol("<unspecified>")
+}
+
 // Pair
 type Pair struct {
 	car Value
 	cdr Value
+
+	// pos records the source position at which the pair's textual
+	// representation begins, if the pair was produced by the parser. For the
+	// first pair in a list this is the position of the opening parenthesis;
+	// for subsequent pairs it is the position of the pair's car.
+	pos *Position
+
+	// carPos records the source position of the car of the first pair in a
+	// list, if known.
+	carPos *Position
 }
 
 func Cons(car, cdr Value) *Pair {
@@ -126,39 +292,55 @@ func (p *Pair) MarshalSExp() SExpression {
 	return p
 }
 
-func (p *Pair) write(w io.Writer) error {
-	if _, err := w.Write([]byte("(")); err != nil {
+func (p *Pair) write(pr *printer) error {
+	if err := pr.writeString("("); err != nil {
 		return err
 	}
-	first := true
-	for p != nil {
+	for first := true; p != nil; first = false {
 		if !first {
-			if _, err := w.Write([]byte(" ")); err != nil {
+			if err := pr.writeString(" "); err != nil {
 				return err
 			}
 		}
-		first = false
 
-		if err := Encode(w, p.car); err != nil {
+		if err := pr.print(p.car); err != nil {
 			return err
 		}
 		if p.cdr == nil {
 			break
 		}
 		tail, ok := p.cdr.(*Pair)
-		if !ok {
-			if _, err := w.Write([]byte(" . ")); err != nil {
+		if !ok || pr.isLabeled(tail) {
+			if err := pr.writeString(" . "); err != nil {
 				return err
 			}
-			if err := Encode(w, p.cdr); err != nil {
+			if err := pr.print(p.cdr); err != nil {
 				return err
 			}
 			break
 		}
 		p = tail
 	}
-	_, err := w.Write([]byte(")"))
-	return err
+	return pr.writeString(")")
+}
+
+// Position returns the source position of the pair, if known. The result is
+// not valid if the pair was not produced by the parser.
+func (p *Pair) Position() Position {
+	if p.pos == nil {
+		return Position{}
+	}
+	return *p.pos
+}
+
+// carPosition returns the source position of the pair's car, if known. If the
+// position of the car of the first pair in a list is not known, the position of
+// the list is returned instead.
+func (p *Pair) carPosition() *Position {
+	if p.carPos != nil {
+		return p.carPos
+	}
+	return p.pos
 }
 
 // Car returns the car field of the pair.
@@ -227,19 +409,35 @@ func (s Symbol) MarshalSExp() SExpression {
 	return s
 }
 
-func (s Symbol) write(w io.Writer) error {
-	_, err := w.Write([]byte(s))
-	return err
+func (s Symbol) write(p *printer) error {
+	if p.display || isPlainSymbol(string(s)) {
+		return p.writeString(string(s))
+	}
+	return writeQuoted(p, string(s), '|')
 }
 
-// Binding
-type binding struct {
-	where *scope
-	name  Symbol
+// Identifier
+//
+// An identifier is a symbol that was inserted into a form by the template of a
+// macro. Identifiers that are bound by the expanded form are bound under their
+// alias, which is unique to the expansion, so they cannot capture the
+// variables of the macro use. All other identifiers refer to the binding of
+// their symbol in the environment in which the macro was defined.
+type identifier struct {
+	name  Symbol // the symbol written in the template
+	alias Symbol // the name under which the identifier is bound
+
+	// outer is the identifier that was renamed to produce this identifier, if
+	// the template that inserted it was itself inserted by a macro.
+	outer *identifier
+
+	scope   *scope        // the scope in which the macro was defined
+	lexical *lexicalScope // the lexical scope of the definition, if compiled
+	env     *syntacticEnv // the syntactic environment of the definition, if expanded
 }
 
-func (b *binding) MarshalSExp() SExpression {
-	return b.name
+func (id *identifier) MarshalSExp() SExpression {
+	return id.name
 }
 
 // Character
@@ -249,13 +447,33 @@ func (c Character) MarshalSExp() SExpression {
 	return c
 }
 
-func (c Character) write(w io.Writer) error {
-	var buf [8]byte
-	len := utf8.EncodeRune(buf[:], rune(c))
-	_, err := w.Write(buf[:len])
-	return err
+func (c Character) write(p *printer) error {
+	if p.display {
+		return p.writeString(string(rune(c)))
+	}
+
+	var text string
+	switch {
+	case characterWriteNames[c] != "":
+		text = characterWriteNames[c]
+	case unicode.IsGraphic(rune(c)):
+		text = string(rune(c))
+	default:
+		text = fmt.Sprintf("x%x", rune(c))
+	}
+	return p.writeString(`#\` + text)
 }
 
+// characterWriteNames maps characters that are written using their names to
+// those names.
+var characterWriteNames = func() map[Character]string {
+	names := map[Character]string{}
+	for name, c := range characterNames {
+		names[c] = name
+	}
+	return names
+}()
+
 // String
 type String string
 
@@ -263,9 +481,11 @@ func (s String) MarshalSExp() SExpression {
 	return s
 }
 
-func (s String) write(w io.Writer) error {
-	_, err := w.Write([]byte(s))
-	return err
+func (s String) write(p *printer) error {
+	if p.display {
+		return p.writeString(string(s))
+	}
+	return writeQuoted(p, string(s), '"')
 }
 
 // Vector
@@ -275,20 +495,21 @@ func (v Vector) MarshalSExp() SExpression {
 	return v
 }
 
-func (v Vector) write(w io.Writer) error {
-	if _, err := w.Write([]byte("(vector")); err != nil {
+func (v Vector) write(p *printer) error {
+	if err := p.writeString("#("); err != nil {
 		return err
 	}
-	for _, e := range v {
-		if _, err := w.Write([]byte(" ")); err != nil {
-			return err
+	for i, e := range v {
+		if i != 0 {
+			if err := p.writeString(" "); err != nil {
+				return err
+			}
 		}
-		if err := Encode(w, e); err != nil {
+		if err := p.print(e); err != nil {
 			return err
 		}
 	}
-	_, err := w.Write([]byte(")"))
-	return err
+	return p.writeString(")")
 }
 
 // ToList converts the vector to a list.
@@ -300,6 +521,74 @@ func (v Vector) ToList() SExpression {
 	return head
 }
 
+// Values holds the results of an expression that delivers any number of values
+// other than one, e.g. (values 1 2). A single value is always represented by
+// the value itself. Procedures may return Values to deliver multiple values to
+// their continuations.
+type Values []Value
+
+func (v Values) MarshalSExp() SExpression {
+	return v
+}
+
+// write writes each value separated by a space.
+func (v Values) write(p *printer) error {
+	for i, e := range v {
+		if i != 0 {
+			if err := p.writeString(" "); err != nil {
+				return err
+			}
+		}
+		if err := p.print(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeValues returns the values that deliver args to a continuation.
+func makeValues(args Vector) Value {
+	if len(args) == 1 {
+		return args[0]
+	}
+	return append(Values{}, args...)
+}
+
+// checkValues panics if the values vs are not accepted by the formals of a
+// receive form.
+func checkValues(formals []Symbol, isVariadic bool, vs Vector) {
+	n, atLeast := len(formals), ""
+	if isVariadic {
+		n, atLeast = n-1, " at least"
+	}
+	if len(vs) < n || len(vs) > n && !isVariadic {
+		s := ""
+		if n != 1 {
+			s = "s"
+		}
+		panic(NewError(fmt.Sprintf("expected%v %d value%v", atLeast, n, s), vs...))
+	}
+}
+
+// singleValue returns v if it is a single value, and panics if v delivers any
+// other number of values. Only the consumers of call-with-values accept
+// multiple values; arguments, tests, and the values of definitions and
+// assignments must be single values.
+func singleValue(v Value) Value {
+	if vs, ok := v.(Values); ok {
+		panic(NewError("expected 1 value", vs...))
+	}
+	return v
+}
+
+// spreadValues returns the values delivered by v.
+func spreadValues(v Value) Vector {
+	if vs, ok := v.(Values); ok {
+		return Vector(vs)
+	}
+	return Vector{v}
+}
+
 // Procedure
 type Procedure interface {
 	Value
@@ -318,8 +607,22 @@ func (f ProcedureFunc) Apply(args Vector) Value {
 }
 
 type tailCall struct {
-	p    Procedure
-	args Vector
+	name   Symbol
+	pos    *Position
+	p      Procedure
+	args   Vector
+	budget *budget
+}
+
+// isScheme returns true if the call's procedure is implemented by the
+// tree-walking evaluator.
+func (t *tailCall) isScheme() bool {
+	switch t.p.(type) {
+	case *procedure, *caseLambda:
+		return true
+	default:
+		return false
+	}
 }
 
 func (t *tailCall) MarshalSExp() SExpression {
@@ -332,12 +635,29 @@ type procedure struct {
 	formals    []Symbol
 	isVariadic bool
 	body       []Value
+
+	// definitions holds the variables that are defined at the top level of
+	// the body other than the formals. They are bound to unassigned when the
+	// procedure is called.
+	definitions []Symbol
+}
+
+// bodyDefinitions returns the variables that are defined at the top level of
+// body other than the given formals.
+func bodyDefinitions(formals []Symbol, body []Value) []Symbol {
+	var definitions []Symbol
+	for _, sym := range scanDefinitions(body, nil) {
+		if !containsSymbol(formals, sym) {
+			definitions = append(definitions, sym)
+		}
+	}
+	return definitions
 }
 
 func makeFormals(declaration Value) (formals []Symbol, isVariadic bool) {
 	const invalidFormals = "⟨formals⟩ must be of the form (⟨variable1⟩ ...), ⟨variable⟩, or (⟨variable1 ⟩ . . . ⟨variablen ⟩ . ⟨variablen+1 ⟩)"
 
-	if sym, ok := declaration.(Symbol); ok {
+	if sym, ok := variableName(declaration); ok {
 		return []Symbol{sym}, true
 	}
 
@@ -352,7 +672,7 @@ func makeFormals(declaration Value) (formals []Symbol, isVariadic bool) {
 
 	declared := map[Symbol]struct{}{}
 	for {
-		sym, ok := pair.car.(Symbol)
+		sym, ok := variableName(pair.car)
 		if !ok {
 			panic(invalidFormals)
 		}
@@ -363,8 +683,9 @@ func makeFormals(declaration Value) (formals []Symbol, isVariadic bool) {
 		formals = append(formals, sym)
 
 		switch cdr := pair.cdr.(type) {
-		case Symbol:
-			formals, isVariadic = append(formals, cdr), true
+		case Symbol, *identifier:
+			rest, _ := variableName(cdr)
+			formals, isVariadic = append(formals, rest), true
 			return
 		case *Pair:
 			pair = cdr
@@ -382,7 +703,11 @@ func (p *procedure) MarshalSExp() SExpression {
 }
 
 func (p *procedure) Apply(args Vector) Value {
-	return forceTail(p.apply(args))
+	d := p.closure.dynamic()
+	d.currentBudget().step()
+
+	w := walker{dynamic: d}
+	return w.run(func() Value { return forceTail(p.apply(args)) })
 }
 
 func (p *procedure) apply(args Vector) Value {
@@ -405,9 +730,9 @@ func (p *procedure) apply(args Vector) Value {
 		scope.set(p.formals[len(p.formals)-1], args[len(formals):].ToList())
 	}
 
-	for _, x := range p.body[:len(p.body)-1] {
-		eval(x, scope, false)
+	for _, sym := range p.definitions {
+		scope.set(sym, unassigned)
 	}
 
-	return eval(p.body[len(p.body)-1], scope, true)
+	return evalBody(p.body, scope)
 }
@@ -31,7 +31,7 @@ func VectorRef(args Vector) Value {
 		panic("the second argument to vector-ref must be an integer")
 	}
 	if i > int64(len(v)) {
-		panic(fmt.Sprintf("%v is not a member of a vector of length %v", i, len(v)))
+		panic(NewError(fmt.Sprintf("%v is not a member of a vector of length %v", i, len(v))))
 	}
 	return v[i]
 }
@@ -8,17 +8,34 @@ type opcode byte
 
 const (
 	opQuote opcode = iota
-	opGet
-	opBinding
+	opGlobal
+	opLocal
+	opSetLocal
+	opIdentifier
 	opVector
 	opList
 	opLambda
-	opIf
+	opJump
+	opJumpIfFalse
+	opJumpIfTrue
+	opDup
+	opSwap
+	opMemv
 	opSet
+	opSetIdentifier
 	opDefine
 	opCall
 	opTail
+	opCallValues
+	opTailValues
 	opReturn
+	opPop
+	opDefineSyntax
+	opExpand
+	opContinuation
+	opEscape
+	opWind
+	opUnwind
 )
 
 type instruction struct {
@@ -36,24 +53,64 @@ type compiledProcedure struct {
 	name       Symbol
 	formals    []Symbol
 	isVariadic bool
+	slots      int // the number of slots in the procedure's scope
 	body       []instruction
+	positions  []*Position    // the source position of each instruction, if known
+	names      map[int]Symbol // the operator names of call instructions and the variables of local references, by pc
+
+	// internal is true if the procedure was introduced by the compiler. Frames
+	// for internal procedures take the name of their caller.
+	internal bool
+
+	// scoped is true if the procedure's body defines keywords. Such procedures
+	// always have their own scope so that the keywords are local to the body.
+	scoped bool
+}
+
+// newScope returns the scope for a call to the procedure. Internal procedures
+// that have no slots and define no keywords share the scope of their closure.
+// The slots of the variables defined by the procedure's body are unassigned.
+func (p *compiledProcedure) newScope(closure *scope) *scope {
+	if p.internal && p.slots == 0 && !p.scoped {
+		return closure
+	}
+	slots := make([]Value, p.slots)
+	for i := len(p.formals); i < len(slots); i++ {
+		slots[i] = unassigned
+	}
+	return &scope{slots: slots, outer: closure}
+}
+
+// position returns the source position of the instruction at pc, if known.
+func (p *compiledProcedure) position(pc int) *Position {
+	if pc < 0 || pc >= len(p.positions) {
+		return nil
+	}
+	return p.positions[pc]
 }
 
 func (*compiledProcedure) MarshalSExp() SExpression {
 	return Symbol("<compiled procedure>")
 }
 
-var callCC = &compiledClosure{
+// (call-with-values producer consumer)
+//
+// Calls its producer argument with no arguments and a continuation that, when
+// passed some values, calls the consumer procedure with those values as
+// arguments. The continuation for the call to consumer is the continuation of
+// the call to call-with-values.
+var callWithValues = &compiledClosure{
 	proc: &compiledProcedure{
-		name:    "call-with-current-continuation",
-		formals: []Symbol{"procedure", "continuation"},
+		name:    "call-with-values",
+		formals: []Symbol{"producer", "consumer"},
+		slots:   2,
 		body: []instruction{
-			{opGet, Symbol("procedure")},
-			{opGet, Symbol("continuation")},
-			{opTail, integer(1)},
+			{opLocal, local{0, 1}},
+			{opLocal, local{0, 0}},
+			{opCall, integer(0)},
+			{opTailValues, nil},
 		},
 	},
-	scope: globalScope,
 }
 
 type compiledClosure struct {
@@ -61,41 +118,29 @@ type compiledClosure struct {
 	scope *scope
 }
 
-func (*compiledClosure) MarshalSExp() SExpression {
-	return Symbol("<compiled closure>")
+func (c *compiledClosure) MarshalSExp() SExpression {
+	return c.proc.name
 }
 
 func (c *compiledClosure) Apply(args Vector) Value {
-	scope := c.scope.push()
+	scope := c.proc.newScope(c.scope)
 
 	var vm vm
-	vm.assignFormals(c.proc, scope, args)
+	vm.assignFormals(c.proc.name, c.proc, scope, args)
 	vm.init(c, scope)
-	return vm.run()
+	return vm.run(nil)
 }
 
-type continuation struct {
-	stack *frame
-	arity int
-}
+// evalCompiled compiles expression and executes it in the given scope.
+func evalCompiled(expression Value, scope *scope) Value {
+	exprs := []Value{expression}
+	c := compiler{ctx: newCompileContext(scope, exprs)}
+	c.compileSequence(exprs, true)
+	proc := c.finish("", nil, false)
 
-func (c *continuation) MarshalSExp() SExpression {
-	return Symbol("<continuation>")
-}
-
-func (c *continuation) Apply(args Vector) Value {
-	if len(args) != c.arity {
-		s := ""
-		if c.arity > 1 {
-			s = "s"
-		}
-		panic(fmt.Errorf("continuation expects %v argument%s", c.arity, s))
-	}
-
-	// copy the stack, push the argument, and resume
-	m := vm{stack: c.stack.copyStack()}
-	m.stack.stack = append(m.stack.stack, args[0])
-	return m.run()
+	vm := vm{toplevel: true}
+	vm.init(&compiledClosure{proc: proc, scope: scope}, scope)
+	return vm.run(nil)
 }
 
 type frame struct {
@@ -104,6 +149,14 @@ type frame struct {
 	scope   *scope
 	stack   Vector
 	pc      int
+
+	// name is the name by which the frame's procedure was called. Failures
+	// that occur in the frame are attributed to this name.
+	name Symbol
+	// pos is the source position of the call that pushed the frame, if known.
+	// The position is retained if the frame replaces its caller by way of a
+	// tail call.
+	pos *Position
 }
 
 func (f *frame) copy() *frame {
@@ -115,6 +168,8 @@ func (f *frame) copy() *frame {
 		scope:   f.scope,
 		stack:   s,
 		pc:      f.pc,
+		name:    f.name,
+		pos:     f.pos,
 	}
 }
 
@@ -129,55 +184,214 @@ func (f *frame) copyStack() *frame {
 
 type vm struct {
 	stack *frame
+
+	// dynamic is the dynamic environment of the VM, if any. The active
+	// dynamic-wind calls and exception handlers of the environment at the
+	// start of the current run are saved in winders and handlers.
+	dynamic  *dynamicEnv
+	winders  *windStack
+	handlers *handlerStack
+
+	running  bool // true while the VM is running
+	toplevel bool // true if the VM evaluates a top-level form
 }
 
-func (*vm) assignFormals(p *compiledProcedure, scope *scope, args Vector) {
+func (*vm) assignFormals(name Symbol, p *compiledProcedure, scope *scope, args Vector) {
 	formals, atLeast := p.formals, ""
 	if p.isVariadic {
 		formals, atLeast = formals[:len(formals)-1], " at least"
 	}
 
-	if len(args) < len(formals) {
-		panic(fmt.Errorf("%v expects%v %d arguments", p.name, atLeast, len(formals)))
+	if p.internal && len(args) != len(p.formals) {
+		// the arguments of an internal procedure always agree with its
+		// formals unless they are the values received by a receive form
+		checkValues(p.formals, p.isVariadic, args)
 	}
-
-	for i, sym := range formals {
-		scope.set(sym, args[i])
+	if len(args) < len(formals) {
+		panic(&Error{Procedure: name, Message: fmt.Sprintf("%v expects%v %d arguments", name, atLeast, len(formals)), named: true})
 	}
 
+	copy(scope.slots, args[:len(formals)])
 	if p.isVariadic {
-		scope.set(p.formals[len(p.formals)-1], args[len(formals):].ToList())
+		scope.slots[len(formals)] = args[len(formals):].ToList()
 	}
 }
 
 func (m *vm) init(closure *compiledClosure, scope *scope) {
-	m.stack = &frame{closure: closure, scope: scope}
+	m.stack = &frame{closure: closure, scope: scope, name: closure.proc.name}
+	m.dynamic = scope.dynamic()
+}
+
+// active returns true if f is one of the VM's active frames.
+func (m *vm) active(f *frame) bool {
+	for s := m.stack; s != nil; s = s.caller {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
+
+// procedureName returns the name by which the procedure p is called by the
+// instruction at pc in the current frame.
+func (m *vm) procedureName(pc int, p Procedure) Symbol {
+	if name, ok := m.stack.closure.proc.names[pc]; ok {
+		return name
+	}
+	return procedureName(nil, p)
 }
 
-func (m *vm) run() Value {
+// applyBuiltin applies a procedure that is not implemented by the VM. Any
+// failure that occurs during the application is attributed to name unless
+// more specific information has already been identified.
+func applyBuiltin(name Symbol, p Procedure, args Vector) Value {
+	defer func() {
+		if x := recover(); x != nil {
+			err := toError(x)
+			if err.Procedure == "" {
+				err.Procedure = name
+			}
+			panic(err)
+		}
+	}()
+	return p.Apply(args)
+}
+
+// stackTrace returns the calls that are active in the VM, innermost first. The
+// position of each call is the position of the calling instruction. Frames for
+// internal procedures, which take the names of their callers, are omitted
+// unless they have replaced their callers by way of a tail call.
+func (m *vm) stackTrace() []StackFrame {
+	var frames []StackFrame
+	for f := m.stack; f != nil; f = f.caller {
+		if f.name == "" || f.closure.proc.internal && f.caller != nil && f.caller.name == f.name {
+			continue
+		}
+
+		frame := StackFrame{Procedure: f.name}
+		if f.pos != nil {
+			frame.Position = *f.pos
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// run runs the VM until its outermost frame returns. If j is not nil, the
+// continuation of j is resumed first. The dynamic-wind calls and exception
+// handlers that are active when run is called are reinstated before it returns.
+func (m *vm) run(j *jump) (v Value) {
+	if d := m.dynamic; d != nil {
+		m.winders, m.handlers = d.winders, d.handlers
+	}
+	m.running = true
+	defer func() { m.running = false }()
+
+	for {
+		if j != nil && !m.resume(j) {
+			v = j.v
+			break
+		}
+		if v, j = m.exec(); j == nil {
+			break
+		}
+	}
+
+	if d := m.dynamic; d != nil && (d.winders != m.winders || d.handlers != m.handlers) {
+		d.rewind(m.winders)
+		d.handlers = m.handlers
+	}
+	return v
+}
+
+// unwind reinstates the dynamic-wind calls and exception handlers that were
+// active at the start of the current run as err propagates out of the VM.
+func (m *vm) unwind(err *Error) {
+	d := m.dynamic
+	if d == nil {
+		return
+	}
+	if err.unwinds() {
+		d.rewind(m.winders)
+	}
+	d.handlers = m.handlers
+}
+
+// exec executes instructions until the outermost frame returns or a jump to a
+// continuation that was captured by the VM unwinds the Go stack to the VM, in
+// which case the jump is returned.
+func (m *vm) exec() (result Value, j *jump) {
 	body := m.stack.closure.proc.body
 	scope := m.stack.scope
-	stack := ([]Value)(nil)
-	pc := 0
+	stack := ([]Value)(m.stack.stack)
+	pc := m.stack.pc
+	budget := scope.dynamic().currentBudget()
+
+	defer func() {
+		if x := recover(); x != nil {
+			err := toError(x)
+			if target, ok := err.cause.(*jump); ok && target.k.vm == m {
+				result, j = nil, target
+				return
+			}
+
+			if err.kind != jumpError {
+				if err.Procedure == "" {
+					err.Procedure = m.stack.name
+				}
+				if !err.Position.IsValid() {
+					// builtin procedures that are implemented by bytecode have
+					// no positions; use the position of the call instead
+					pos := m.stack.closure.proc.position(pc)
+					for f := m.stack; pos == nil && f.caller != nil; f = f.caller {
+						pos = f.caller.closure.proc.position(f.caller.pc)
+					}
+					if pos != nil {
+						err.Position = *pos
+					}
+				}
+				err.Stack = append(err.Stack, m.stackTrace()...)
+				scope.dynamic().signal(err)
+			}
+			m.unwind(err)
+			panic(err)
+		}
+	}()
 
 	for {
+		if budget != nil {
+			budget.step()
+		}
+
 		inst := &body[pc]
 		switch inst.code {
 		case opQuote:
 			// push immediate
 			stack = append(stack, inst.immediate)
-		case opGet:
+		case opGlobal:
 			// push value
 			sym := inst.immediate.(Symbol)
 			value, ok := scope.lookup(sym)
 			if !ok {
-				panic(fmt.Errorf("%v is not bound", string(sym)))
+				panic(NewError("unbound variable", sym))
 			}
 			stack = append(stack, value)
-		case opBinding:
-			b := inst.immediate.(*binding)
-			value, _ := b.where.lookup(b.name)
-			stack = append(stack, value)
+		case opLocal:
+			// push slot
+			l := inst.immediate.(local)
+			v := scope.outerN(l.depth).slots[l.index]
+			if _, ok := v.(unassignedValue); ok {
+				checkAssigned(m.stack.closure.proc.names[pc], v)
+			}
+			stack = append(stack, v)
+		case opSetLocal:
+			// pop value, set slot
+			l := inst.immediate.(local)
+			scope.outerN(l.depth).slots[l.index] = singleValue(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		case opIdentifier:
+			// push value
+			stack = append(stack, evalIdentifier(inst.immediate.(*identifier), scope))
 		case opVector:
 			// pop n values, push vector
 			n := int(inst.immediate.(integer))
@@ -195,151 +409,223 @@ func (m *vm) run() Value {
 
 			head := tail
 			for i := len(values) - 1; i >= 0; i-- {
-				head = Cons(values[i], tail)
+				head = Cons(values[i], head)
 			}
 			stack = append(stack, head)
 		case opLambda:
 			// push a new closure
 			proc := inst.immediate.(*compiledProcedure)
 			stack = append(stack, &compiledClosure{proc: proc, scope: scope})
-		case opIf:
-			// pop condition, pop then, pop else, push choice
-			else_, if_, cond := stack[len(stack)-1], stack[len(stack)-2], stack[len(stack)-3]
-			stack = stack[:len(stack)-2]
+		case opJump:
+			// jump
+			pc = int(inst.immediate.(integer))
+			continue
+		case opJumpIfFalse:
+			// pop condition, jump if false
+			cond := singleValue(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			if !Truthy(cond) {
+				pc = int(inst.immediate.(integer))
+				continue
+			}
+		case opJumpIfTrue:
+			// pop condition, jump if true
+			cond := singleValue(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
 			if Truthy(cond) {
-				stack[len(stack)-1] = if_
-			} else {
-				stack[len(stack)-1] = else_
+				pc = int(inst.immediate.(integer))
+				continue
 			}
+		case opDup:
+			// push top
+			stack = append(stack, stack[len(stack)-1])
+		case opSwap:
+			// swap the top two values
+			n := len(stack)
+			stack[n-2], stack[n-1] = stack[n-1], stack[n-2]
+		case opMemv:
+			// push whether the top is eqv? to a member of the immediate list
+			key, member := stack[len(stack)-1], false
+			for data, _ := inst.immediate.(*Pair); data != nil; data, _ = data.cdr.(*Pair) {
+				if eqv(key, data.car) {
+					member = true
+					break
+				}
+			}
+			stack = append(stack, Boolean(member))
 		case opSet:
 			// pop value, set symbol
 			sym := inst.immediate.(Symbol)
-			value := stack[len(stack)-1]
+			value := singleValue(stack[len(stack)-1])
 			stack = stack[:len(stack)-1]
 			if !scope.setIfBound(sym, value) {
-				panic(fmt.Errorf("set!: %v is not bound", sym))
+				panic(NewError(fmt.Sprintf("set!: %v is not bound", sym)))
+			}
+		case opSetIdentifier:
+			// pop value, set identifier
+			id := inst.immediate.(*identifier)
+			value := singleValue(stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+			if s, name := id.resolve(scope); !s.setIfBound(name, value) {
+				panic(NewError(fmt.Sprintf("set!: %v is not bound", id.name)))
 			}
 		case opDefine:
 			// pop value, define symbol
 			sym := inst.immediate.(Symbol)
-			value := stack[len(stack)-1]
+			value := singleValue(stack[len(stack)-1])
 			stack = stack[:len(stack)-1]
 			scope.set(sym, value)
-		case opCall:
-			// pop args, closure, push frame, assign formals, jump
-			nargs := int(inst.immediate.(integer))
-			args := Vector(stack[len(stack)-nargs:])
-			stack = stack[:len(stack)-nargs]
-
-			proc := stack[len(stack)-1].(Procedure)
+		case opDefineSyntax:
+			// define keyword
+			d := inst.immediate.(*syntaxDefinition)
+			env := scope
+			if d.outer {
+				env = scope.outer
+			}
+			scope.setKeyword(d.keyword, newSyntaxRules(d.spec, env, d.lexical))
+		case opPop:
+			// pop value
 			stack = stack[:len(stack)-1]
+		case opExpand:
+			// expand the macro use, push frame, jump
+			use := inst.immediate.(*macroUse)
+			proc := use.expand(scope)
 
-			switch proc := proc.(type) {
-			case *compiledClosure:
-				m.stack.stack, m.stack.pc = stack, pc
-
-				if proc == callCC {
-					// push new continuation
-					args = append(args, &continuation{
-						stack: m.stack.copyStack(),
-						arity: int(inst.immediate.(integer)),
-					})
-				}
+			m.stack.stack, m.stack.pc = stack, pc
 
-				scope = proc.scope.push()
-				m.assignFormals(proc.proc, scope, args)
-
-				m.stack = &frame{
-					caller:  m.stack,
-					closure: proc,
-				}
-				body, stack, pc = proc.proc.body, nil, -1
-			case *continuation:
-				// replace the current stack with the continuation
-
-				if len(args) != proc.arity {
-					s := ""
-					if proc.arity > 1 {
-						s = "s"
-					}
-					panic(fmt.Errorf("continuation expects %v argument%s", proc.arity, s))
-				}
-
-				m.stack = proc.stack.copyStack()
-				body, scope, stack, pc = m.stack.closure.proc.body, m.stack.scope, m.stack.stack, m.stack.pc
+			caller := m.stack
+			if use.tail {
+				caller = caller.caller
+			}
 
-				stack = append(stack, args...)
+			m.stack = &frame{
+				caller:  caller,
+				closure: &compiledClosure{proc: proc, scope: scope},
+				scope:   scope,
+				name:    m.stack.name,
+				pos:     m.stack.pos,
+			}
+			body, stack, pc = proc.body, nil, -1
+		case opCall, opTail, opCallValues, opTailValues:
+			// pop args, pop procedure; then either push a frame (opCall) or
+			// replace the current frame (opTail) and jump. opCallValues and
+			// opTailValues pop a single value and pass the values it delivers
+			// as the args. The args of opCall and opTail must be single values.
+			//
+			// args aliases the popped portion of the stack. It must be consumed
+			// before anything else is pushed.
+			code := inst.code
+			var nargs int
+			switch code {
+			case opCallValues, opTailValues:
+				vs := spreadValues(stack[len(stack)-1])
+				stack = append(stack[:len(stack)-1], vs...)
+				nargs, code = len(vs), code-opCallValues+opCall
 			default:
-				stack = append(stack, proc.Apply(args))
+				nargs = int(inst.immediate.(integer))
+				for _, arg := range stack[len(stack)-nargs:] {
+					singleValue(arg)
+				}
 			}
-		case opTail:
-			// pop args, closure, pop frame, push frame, jump
-			nargs := int(inst.immediate.(integer))
 			args := Vector(stack[len(stack)-nargs:])
-			stack = stack[:len(stack)-nargs]
+			operator := stack[len(stack)-nargs-1]
+			stack = stack[:len(stack)-nargs-1]
 
-			proc := stack[len(stack)-1].(Procedure)
-			stack = stack[:len(stack)-1]
+			proc, ok := operator.(Procedure)
+			if !ok {
+				panic(NewError("value is not a procedure", operator))
+			}
+			name := m.procedureName(pc, proc)
+			switch p := proc.(type) {
+			case *dynamicProcedure:
+				proc = p.bind(scope.dynamic())
+			case *caseLambda:
+				proc = p.clause(args)
+			}
 
 			switch proc := proc.(type) {
 			case *compiledClosure:
 				m.stack.stack, m.stack.pc = stack, pc
 
-				if proc == callCC {
-					// push new continuation
-					args = append(args, &continuation{
-						stack: m.stack.copyStack(),
-						arity: int(inst.immediate.(integer)),
-					})
+				if proc.proc.internal {
+					name = m.stack.name
 				}
 
-				scope = proc.scope.push()
+				scope = proc.proc.newScope(proc.scope)
+				m.assignFormals(name, proc.proc, scope, args)
 
-				m.assignFormals(proc.proc, scope, args)
+				caller := m.stack
+				if code == opTail {
+					caller = caller.caller
+				}
 
 				m.stack = &frame{
-					caller:  m.stack.caller,
+					caller:  caller,
 					closure: proc,
+					scope:   scope,
+					name:    name,
+					pos:     m.stack.closure.proc.position(pc),
 				}
 				body, stack, pc = proc.proc.body, nil, -1
 			case *continuation:
-				// replace the current stack with the continuation
-
-				if len(args) != proc.arity {
-					s := ""
-					if proc.arity > 1 {
-						s = "s"
-					}
-					panic(fmt.Errorf("continuation expects %v argument%s", proc.arity, s))
+				// resume the continuation in place unless it must be resumed
+				// by another VM
+				j := &jump{k: proc, v: makeValues(args)}
+				proc.jump(m, j.v)
+				if !m.resume(j) {
+					return j.v, nil
 				}
-
-				m.stack = proc.stack.copyStack()
 				body, scope, stack, pc = m.stack.closure.proc.body, m.stack.scope, m.stack.stack, m.stack.pc
-
-				stack = append(stack, args...)
+				continue
 			default:
-				v := proc.Apply(args)
-				caller := m.stack.caller
+				v := applyBuiltin(name, proc, append(Vector(nil), args...))
+				if code == opCall {
+					stack = append(stack, v)
+					break
+				}
 
+				caller := m.stack.caller
 				if caller == nil {
-					return v
+					return v, nil
 				}
 
 				m.stack = caller
-				scope, body, stack, pc = caller.closure.scope, caller.closure.proc.body, caller.stack, caller.pc
+				scope, body, stack, pc = caller.scope, caller.closure.proc.body, caller.stack, caller.pc
 				stack = append(stack, v)
 			}
+		case opContinuation:
+			// push a continuation that resumes the caller of the current frame
+			stack = append(stack, m.capture(false))
+		case opEscape:
+			// push an escape continuation that returns from the current frame
+			stack = append(stack, m.capture(true))
+		case opWind:
+			// pop after, pop before, install the thunks of a dynamic-wind call
+			before, ok := stack[len(stack)-2].(Procedure)
+			if !ok {
+				panic(newNamedError("the first argument to dynamic-wind must be a procedure", stack[len(stack)-2]))
+			}
+			after, ok := stack[len(stack)-1].(Procedure)
+			if !ok {
+				panic(newNamedError("the third argument to dynamic-wind must be a procedure", stack[len(stack)-1]))
+			}
+			stack = stack[:len(stack)-2]
+			scope.dynamic().wind(before, after)
+		case opUnwind:
+			// remove the thunks of the innermost dynamic-wind call
+			d := scope.dynamic()
+			d.winders = d.winders.outer
 		case opReturn:
 			// pop value, pop frame, continue
 			v := stack[len(stack)-1]
 			caller := m.stack.caller
 
 			if caller == nil {
-				return v
+				return v, nil
 			}
 
 			m.stack = caller
-			scope, body, stack, pc = caller.closure.scope, caller.closure.proc.body, caller.stack, caller.pc
+			scope, body, stack, pc = caller.scope, caller.closure.proc.body, caller.stack, caller.pc
 			stack = append(stack, v)
 		default:
 			panic(fmt.Errorf("unexpected opcode %v", inst.code))
@@ -1,6 +1,7 @@
 package loom
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,7 +10,7 @@ import (
 
 func TestVM(t *testing.T) {
 	root := &compiledClosure{
-		scope: globalScope,
+		scope: newGlobalScope(),
 		proc: &compiledProcedure{
 			name: "test",
 			body: []instruction{
@@ -20,9 +21,9 @@ func TestVM(t *testing.T) {
 				{opLambda, &compiledProcedure{
 					name: "<lambda>",
 					body: []instruction{
-						{opGet, Symbol("+")},
-						{opGet, Symbol("a")},
-						{opGet, Symbol("b")},
+						{opGlobal, Symbol("+")},
+						{opGlobal, Symbol("a")},
+						{opGlobal, Symbol("b")},
 						{opTail, integer(2)},
 					},
 				}},
@@ -34,7 +35,7 @@ func TestVM(t *testing.T) {
 	v := root.Apply(nil)
 	assert.True(t, eq(NewInt(66), v))
 
-	scope := globalScope.push()
+	scope := newGlobalScope()
 	scope.set("call/cc", callCC)
 
 	root = &compiledClosure{
@@ -42,14 +43,15 @@ func TestVM(t *testing.T) {
 		proc: &compiledProcedure{
 			name: "test2",
 			body: []instruction{
-				{opGet, Symbol("*")},
+				{opGlobal, Symbol("*")},
 				{opQuote, NewInt(2)},
-				{opGet, Symbol("call/cc")},
+				{opGlobal, Symbol("call/cc")},
 				{opLambda, &compiledProcedure{
 					name:    "<lambda>",
 					formals: []Symbol{"c"},
+					slots:   1,
 					body: []instruction{
-						{opGet, Symbol("c")},
+						{opLocal, local{0, 0}},
 						{opQuote, NewInt(33)},
 						{opCall, integer(1)},
 						{opQuote, NewInt(21)},
@@ -70,7 +72,7 @@ func TestCompile(t *testing.T) {
 	expr, err := ParseString(`((lambda (a b) ((lambda () (+ a b))) ) 42 24)`)
 	require.NoError(t, err)
 
-	scope := globalScope.push()
+	scope := newGlobalScope()
 	scope.set("call/cc", callCC)
 
 	root := &compiledClosure{
@@ -92,6 +94,22 @@ func TestCompile(t *testing.T) {
 	v = root.Apply(nil)
 	assert.True(t, eq(NewInt(66), v))
 
+	expr, err = ParseString(`(call-with-values (lambda () (call/cc (lambda (c) (c 1 2)))) list)`)
+	require.NoError(t, err)
+
+	root.proc.body = compileBody([]Value{expr})
+
+	v = root.Apply(nil)
+	assert.Equal(t, "(1 2)", EncodeToString(v))
+
+	expr, err = ParseString(`(call-with-values (lambda () (call/cc (lambda (c) (c)))) list)`)
+	require.NoError(t, err)
+
+	root.proc.body = compileBody([]Value{expr})
+
+	v = root.Apply(nil)
+	assert.Nil(t, v)
+
 	expr, err = ParseString(`((lambda (x)
 		(define (fac n acc)
 			(if
@@ -105,3 +123,148 @@ func TestCompile(t *testing.T) {
 	v = root.Apply(nil)
 	assert.True(t, eq(NewInt(24), v))
 }
+
+func TestVMExceptions(t *testing.T) {
+	cases := []struct{ name, expr, expected string }{
+		{"guard", `(guard (e (#t (cons 'caught e))) (raise 'boom))`, "(caught . boom)"},
+		{"guard =>", `(guard (e ((assq 'a e) => cdr) ((assq 'b e))) (raise (list (cons 'a 42))))`, "42"},
+		{"guard test", `(guard (e ((assq 'a e) => cdr) ((assq 'b e))) (raise (list (cons 'b 23))))`, "(b . 23)"},
+		{"guard else", `(guard (e ((symbol? e) 'symbol) (else 'other)) (raise 42))`, "other"},
+		{"guard no exception", `(guard (e (#t 'caught)) (+ 1 2))`, "3"},
+		{"guard re-raise", `(guard (outer (#t (cons 'outer outer))) (guard (inner ((string? inner) 'inner)) (raise 'boom)))`, "(outer . boom)"},
+		{"builtin error", `(guard (e ((error-object? e) (error-object-message e))) (car 42))`, `"car expects a list"`},
+		{"raise-continuable", `(with-exception-handler (lambda (c) 42) (lambda () (+ (raise-continuable 'oops) 2)))`, "44"},
+		{"handler escape", `(guard (e (#t (cons 'escaped e))) (with-exception-handler (lambda (c) (raise 'handled)) (lambda () (raise 'boom))))`, "(escaped . handled)"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expr, err := ParseString(c.expr)
+			require.NoError(t, err)
+
+			root := &compiledClosure{
+				scope: newGlobalScope(),
+				proc: &compiledProcedure{
+					name: "<stdin>",
+					body: compileBody([]Value{expr}),
+				},
+			}
+			assert.Equal(t, c.expected, EncodeToString(root.Apply(nil)))
+		})
+	}
+}
+
+func TestLexicalAddressing(t *testing.T) {
+	expr, err := ParseString(`(lambda (x) (define y 2) (lambda (z) (set! y z) (+ x y)))`)
+	require.NoError(t, err)
+
+	outer := compileBody([]Value{expr})[0].immediate.(*compiledProcedure)
+	assert.Equal(t, 2, outer.slots)
+
+	var inner *compiledProcedure
+	for _, inst := range outer.body {
+		if inst.code == opLambda {
+			inner = inst.immediate.(*compiledProcedure)
+		}
+	}
+	require.NotNil(t, inner)
+	assert.Equal(t, []instruction{
+		{opLocal, local{0, 0}},
+		{opSetLocal, local{1, 1}},
+		{opQuote, Unspecified},
+		{opPop, nil},
+		{opGlobal, Symbol("+")},
+		{opLocal, local{1, 0}},
+		{opLocal, local{1, 1}},
+		{opTail, integer(2)},
+		{opReturn, nil},
+	}, inner.body)
+}
+
+func TestConditionalJumps(t *testing.T) {
+	expr, err := ParseString(`(lambda (x) (if x (f 1) (or x 2)))`)
+	require.NoError(t, err)
+
+	proc := compileBody([]Value{expr})[0].immediate.(*compiledProcedure)
+	assert.Equal(t, []instruction{
+		{opLocal, local{0, 0}},
+		{opJumpIfFalse, integer(6)},
+		{opGlobal, Symbol("f")},
+		{opQuote, NewInt(1)},
+		{opTail, integer(1)},
+		{opJump, integer(11)},
+		{opLocal, local{0, 0}},
+		{opDup, nil},
+		{opJumpIfTrue, integer(11)},
+		{opPop, nil},
+		{opQuote, NewInt(2)},
+		{opReturn, nil},
+	}, proc.body)
+}
+
+// benchmarkProgram evaluates the given program once per iteration with each
+// backend.
+func benchmarkProgram(b *testing.B, program string) {
+	x, err := ParseString(program)
+	require.NoError(b, err)
+
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			env := NewEnv().With(nil).WithBackend(backend.backend)
+			for i := 0; i < b.N; i++ {
+				env.Eval(x)
+			}
+		})
+	}
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkProgram(b, `((lambda ()
+		(define (fib n)
+			(if (< n 2)
+				n
+				(+ (fib (- n 1)) (fib (- n 2)))))
+		(fib 20)))`)
+}
+
+func BenchmarkTak(b *testing.B) {
+	benchmarkProgram(b, `((lambda ()
+		(define (tak x y z)
+			(if (not (< y x))
+				z
+				(tak (tak (- x 1) y z)
+				     (tak (- y 1) z x)
+				     (tak (- z 1) x y))))
+		(tak 18 12 6)))`)
+}
+
+func BenchmarkLoop(b *testing.B) {
+	benchmarkProgram(b, `(let loop ((i 0) (acc 0))
+		(if (= i 10000)
+			acc
+			(loop (+ i 1) (+ acc i))))`)
+}
+
+func TestDisassemble(t *testing.T) {
+	env := NewEnv()
+	_, err := env.EvalAll(strings.NewReader("(define (f x . rest)\n  (if x (g 1) (lambda () \"s\")))"))
+	require.NoError(t, err)
+
+	var b strings.Builder
+	require.NoError(t, Disassemble(&b, env.Eval(Symbol("f"))))
+	assert.Equal(t, `f (x . rest)
+    0  local          0 0                ; 2:7
+    1  jump-if-false  6                  ; 2:3
+    2  global         g                  ; 2:10
+    3  quote          1                  ; 2:9
+    4  tail           1                  ; g 2:9
+    5  jump           7                  ; 2:3
+    6  lambda         <lambda>           ; 2:15
+    7  return
+
+<lambda> ()
+    0  quote          "s"
+    1  return
+`, b.String())
+
+	assert.Error(t, Disassemble(&b, ProcedureFunc(PairCons)))
+}